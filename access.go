@@ -0,0 +1,96 @@
+package cmux
+
+import (
+	"context"
+	"net"
+)
+
+// AccessOption configures the handler returned by AccessControl.
+type AccessOption func(a *accessHandler)
+
+// WithAccessReset resets the refused TCP connections instead of closing them gracefully.
+func WithAccessReset() AccessOption {
+	return func(a *accessHandler) {
+		a.rst = true
+	}
+}
+
+// WithAccessAudit sets the function called with every connection checked and whether it was allowed.
+func WithAccessAudit(fn func(conn net.Conn, allowed bool)) AccessOption {
+	return func(a *accessHandler) {
+		a.audit = fn
+	}
+}
+
+// AccessControl returns a handler that serves h only with the connections whose source address
+// is in one of the allow CIDRs and none of the deny CIDRs, the others are closed before h sees them.
+// The deny list takes precedence and an empty allow list allows every source.
+// An IPv4-mapped IPv6 address is checked as the IPv4 address, a source that is not an IP address
+// such as a unix socket matches no CIDR, so it is only allowed with an empty allow list.
+func AccessControl(h Handler, allow, deny []string, opts ...AccessOption) (Handler, error) {
+	a := &accessHandler{
+		handler: h,
+	}
+	for _, cidr := range allow {
+		n, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, n)
+	}
+	for _, cidr := range deny {
+		n, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.deny = append(a.deny, n)
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+type accessHandler struct {
+	handler Handler
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	rst     bool
+	audit   func(conn net.Conn, allowed bool)
+}
+
+func (a *accessHandler) ServeConn(conn net.Conn) {
+	a.ServeConnContext(context.Background(), conn)
+}
+
+func (a *accessHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	allowed := a.allowed(addrIP(conn.RemoteAddr()))
+	if a.audit != nil {
+		a.audit(conn, allowed)
+	}
+	if !allowed {
+		RejectHandler(a.rst).ServeConn(conn)
+		return
+	}
+	serveHandler(ctx, a.handler, conn)
+}
+
+func (a *accessHandler) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(a.allow) == 0
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// accessOf returns whether AccessControl with the lists serves a connection from remote,
+// and whether the audit function saw the same decision.
+func accessOf(t testing.TB, allow, deny []string, remote net.Addr) bool {
+	t.Helper()
+	served := false
+	audited := make(chan bool, 1)
+	h, err := AccessControl(HandlerFunc(func(conn net.Conn) {
+		served = true
+		conn.Close()
+	}), allow, deny, WithAccessAudit(func(conn net.Conn, allowed bool) {
+		audited <- allowed
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newMemConn(nil)
+	conn.remote = remote
+	h.ServeConn(conn)
+	if allowed := <-audited; allowed != served {
+		t.Fatalf("the audit saw allowed=%v for %v, and the handler was served=%v", allowed, remote, served)
+	}
+	return served
+}
+
+func TestAccessControl(t *testing.T) {
+	allow := []string{"10.0.0.0/8", "fd00::/8", "192.168.1.7"}
+	deny := []string{"10.9.0.0/16", "fd00:bad::/32"}
+	for _, tc := range []struct {
+		remote string
+		want   bool
+	}{
+		{"10.1.2.3", true},
+		{"10.9.1.1", false},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:10.9.1.1", false},
+		{"fd00::1", true},
+		{"fd00:bad::1", false},
+		{"2001:db8::1", false},
+	} {
+		if got := accessOf(t, allow, deny, tcpAddr(tc.remote)); got != tc.want {
+			t.Errorf("%s allowed=%v, want %v", tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestAccessControlEmptyAllow(t *testing.T) {
+	deny := []string{"10.0.0.0/8"}
+	for _, tc := range []struct {
+		remote net.Addr
+		want   bool
+	}{
+		{tcpAddr("192.0.2.1"), true},
+		{tcpAddr("2001:db8::1"), true},
+		{tcpAddr("::ffff:10.0.0.1"), false},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, true},
+	} {
+		if got := accessOf(t, nil, deny, tc.remote); got != tc.want {
+			t.Errorf("%v allowed=%v with no allow list, want %v", tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestAccessControlNonIP(t *testing.T) {
+	for _, remote := range []net.Addr{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, &net.UnixAddr{Name: "@abstract", Net: "unix"}} {
+		if accessOf(t, []string{"0.0.0.0/0", "::/0"}, nil, remote) {
+			t.Errorf("%v was allowed by an allow list", remote)
+		}
+	}
+}
+
+func TestAccessControlInvalidCIDR(t *testing.T) {
+	for _, lists := range [][2][]string{
+		{{"10.0.0.0/33"}, nil},
+		{nil, {"not an address"}},
+	} {
+		if _, err := AccessControl(handlerID("h"), lists[0], lists[1]); err == nil {
+			t.Errorf("AccessControl(%q, %q) returned nil", lists[0], lists[1])
+		}
+	}
+}
+
+func TestAccessControlReset(t *testing.T) {
+	h, err := AccessControl(handlerID("h"), []string{"10.0.0.0/8"}, nil, WithAccessReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewCMux()
+	mux.HandlePrefix(h, "SCAN")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("SCAN"))
+	if err := readErr(t, conn); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("the refused connection read %v, want a reset", err)
+	}
+}
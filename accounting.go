@@ -0,0 +1,83 @@
+package cmux
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SetAccounting sets whether the bytes of the dispatched connections are counted,
+// the totals are added to the Stats of the pattern and reported to the OnConnClosed callback
+// when the handler closes the connection. The sniffed bytes are counted once, as the handler reads them.
+// The connections keep their CloseWrite, WriteTo and ReadFrom, the bytes read or written through
+// the connection under the wrapper, such as by NetConn, are not counted.
+func (m *CMux) SetAccounting(enabled bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.accounting = enabled
+	m.rebuild()
+}
+
+// OnConnClosed sets the callback invoked once a counted connection is closed, with its totals
+// and the time since it was dispatched. pattern is empty for the NotFound handler.
+func (m *CMux) OnConnClosed(fn func(pattern string, bytesIn, bytesOut int64, dur time.Duration)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onConnClosed = fn
+	m.rebuild()
+}
+
+// account starts counting the bytes of conn, conn must have been recorded by withMatch.
+func (t *table) account(conn net.Conn, pattern string, counter *routeCounter) {
+	if !t.accounting {
+		return
+	}
+	us, _ := asUnreadConn(conn)
+	us.acct = &connAccount{
+		pattern:  pattern,
+		counter:  counter,
+		start:    time.Now(),
+		onClosed: t.onConnClosed,
+	}
+}
+
+// connAccount is the byte counters of a connection.
+type connAccount struct {
+	in       int64
+	out      int64
+	closed   uint32
+	pattern  string
+	counter  *routeCounter
+	start    time.Time
+	onClosed func(pattern string, bytesIn, bytesOut int64, dur time.Duration)
+}
+
+func (a *connAccount) read(n int64) {
+	if a != nil {
+		atomic.AddInt64(&a.in, n)
+	}
+}
+
+func (a *connAccount) written(n int64) {
+	if a != nil {
+		atomic.AddInt64(&a.out, n)
+	}
+}
+
+// close reports the totals the first time it is called.
+func (a *connAccount) close() {
+	if a == nil || !atomic.CompareAndSwapUint32(&a.closed, 0, 1) {
+		return
+	}
+	in, out := atomic.LoadInt64(&a.in), atomic.LoadInt64(&a.out)
+	if c := a.counter; c != nil {
+		atomic.AddInt64(&c.bytesIn, in)
+		atomic.AddInt64(&c.bytesOut, out)
+	}
+	if a.onClosed != nil {
+		defer func() {
+			recover()
+		}()
+		a.onClosed(a.pattern, in, out, time.Since(a.start))
+	}
+}
@@ -0,0 +1,187 @@
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connTotals is what OnConnClosed reported for a connection.
+type connTotals struct {
+	pattern  string
+	in, out  int64
+	duration time.Duration
+}
+
+func closedChan(mux *CMux) <-chan connTotals {
+	ch := make(chan connTotals, 16)
+	mux.OnConnClosed(func(pattern string, bytesIn, bytesOut int64, dur time.Duration) {
+		ch <- connTotals{pattern, bytesIn, bytesOut, dur}
+	})
+	return ch
+}
+
+// echoHandler copies the client back to it until the end of the stream, then closes the write side if it can.
+var echoHandler = HandlerFunc(func(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+})
+
+func recvTotals(t *testing.T, ch <-chan connTotals) connTotals {
+	t.Helper()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnClosed was not called")
+	}
+	return connTotals{}
+}
+
+func TestAccountingEcho(t *testing.T) {
+	mux := NewCMux()
+	mux.SetAccounting(true)
+	closed := closedChan(mux)
+	mux.HandlePrefix(echoHandler, "ECHO ")
+	var sent int64
+	for _, size := range []int{0, 1, 1000, 100 << 10} {
+		conn := serveTCP(t, mux)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		b := append([]byte("ECHO "), bytes.Repeat([]byte("x"), size)...)
+		go func() {
+			// the prefix comes alone so that the sniffed bytes and the rest are read apart
+			conn.Write(b[:5])
+			time.Sleep(10 * time.Millisecond)
+			conn.Write(b[5:])
+			conn.CloseWrite()
+		}()
+		back, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(back, b) {
+			t.Fatalf("the echo of %d bytes returned %d bytes", len(b), len(back))
+		}
+		got := recvTotals(t, closed)
+		if got.pattern != "ECHO " || got.in != int64(len(b)) || got.out != int64(len(b)) {
+			t.Fatalf("the echo of %d bytes was reported as %+v", len(b), got)
+		}
+		if got.duration <= 0 {
+			t.Fatalf("the echo was reported to last %v", got.duration)
+		}
+		sent += int64(len(b))
+	}
+	s := mux.Stats().Patterns["ECHO "]
+	if s.BytesIn != sent || s.BytesOut != sent {
+		t.Fatalf("the pattern has the totals %d in and %d out, want %d", s.BytesIn, s.BytesOut, sent)
+	}
+}
+
+func TestAccountingNotFound(t *testing.T) {
+	mux := NewCMux()
+	mux.SetAccounting(true)
+	closed := closedChan(mux)
+	mux.HandlePrefix(echoHandler, "ECHO ")
+	mux.NotFound(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write([]byte("no"))
+	}))
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("QUIT"))
+	if got := readN(t, client, 2); got != "no" {
+		t.Fatalf("read %q", got)
+	}
+	if got := recvTotals(t, closed); got.pattern != "" || got.in != 4 || got.out != 2 {
+		t.Fatalf("the NotFound connection was reported as %+v", got)
+	}
+}
+
+func TestAccountingDisabled(t *testing.T) {
+	mux := NewCMux()
+	closed := closedChan(mux)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "ECHO ")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("ECHO "))
+	conn := recvConn(t, ch)
+	readN(t, conn, 5)
+	conn.Close()
+	select {
+	case got := <-closed:
+		t.Fatalf("a connection was reported as %+v without SetAccounting", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := conn.(interface{ CloseWrite() error }); ok {
+		t.Fatal("the conn of a pipe has CloseWrite")
+	}
+}
+
+func TestAccountingKeepsCloseWrite(t *testing.T) {
+	mux := NewCMux()
+	mux.SetAccounting(true)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "ECHO ")
+	client := serveTCP(t, mux)
+	defer client.Close()
+	client.Write([]byte("ECHO "))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	for _, iface := range []struct {
+		name string
+		ok   bool
+	}{
+		{"CloseWrite", func() bool { _, ok := conn.(interface{ CloseWrite() error }); return ok }()},
+		{"WriterTo", func() bool { _, ok := conn.(io.WriterTo); return ok }()},
+		{"ReaderFrom", func() bool { _, ok := conn.(io.ReaderFrom); return ok }()},
+	} {
+		if !iface.ok {
+			t.Errorf("the counted %T hides %s", conn, iface.name)
+		}
+	}
+}
+
+func TestAccountingToggledWhileDispatching(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(echoHandler, "ECHO ")
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mux.SetAccounting(i%2 == 0)
+			mux.OnConnClosed(func(pattern string, bytesIn, bytesOut int64, dur time.Duration) {})
+		}
+	}()
+	for i := 0; i != 50; i++ {
+		client := servePipe(mux)
+		go func() {
+			client.Write([]byte("ECHO hi"))
+		}()
+		if got := readN(t, client, 7); got != "ECHO hi" {
+			t.Fatalf("read %q", got)
+		}
+		client.Close()
+	}
+	close(stop)
+	wg.Wait()
+	if s := mux.Stats().Patterns["ECHO "]; s.BytesIn%7 != 0 || s.BytesOut != s.BytesIn {
+		t.Fatalf("the pattern has %d bytes in, want whole connections", s.BytesIn)
+	}
+}
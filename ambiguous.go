@@ -0,0 +1,102 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The decisions of the decide func of HandleAmbiguous, any other value is undecided.
+const (
+	AmbiguousPrimary   = 0
+	AmbiguousSecondary = 1
+	AmbiguousUndecided = -1
+)
+
+// defaultAmbiguousBytes is the number of the bytes buffered by HandleAmbiguous without SetMaxSniffBytes.
+const defaultAmbiguousBytes = 4 << 10
+
+// HandleAmbiguous handle the primary or the secondary handler for the prefix, for the protocols that
+// cannot be told apart by the prefix alone. The bytes are buffered up to SetMaxSniffBytes, 4 KiB without
+// a bound, for at most maxWait and decide is called with the bytes buffered so far each time more arrive,
+// starting with the sniffed ones, until it returns AmbiguousPrimary or AmbiguousSecondary.
+// The connection goes to the primary handler once maxWait is over, the bound is reached,
+// the connection ends or decide panics undecided, which is counted in the AmbiguousFallbacks of the Stats.
+// The buffered bytes are replayed to the handler.
+func (m *CMux) HandleAmbiguous(primary, secondary Handler, decide func(prefix []byte) int, maxWait time.Duration, prefixes ...string) error {
+	if err := noBudget("HandleAmbiguous", primary, secondary); err != nil {
+		return err
+	}
+	return m.HandlePrefix(&ambiguousHandler{
+		mux:       m,
+		primary:   primary,
+		secondary: secondary,
+		decide:    decide,
+		maxWait:   maxWait,
+	}, prefixes...)
+}
+
+type ambiguousHandler struct {
+	mux       *CMux
+	primary   Handler
+	secondary Handler
+	decide    func(prefix []byte) int
+	maxWait   time.Duration
+}
+
+func (h *ambiguousHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *ambiguousHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	size := h.mux.load().maxSniffBytes
+	if size <= 0 {
+		size = defaultAmbiguousBytes
+	}
+	buf := make([]byte, 0, size)
+	decision := AmbiguousUndecided
+	conn.SetReadDeadline(time.Now().Add(h.maxWait))
+	for len(buf) < size {
+		n, err := conn.Read(buf[len(buf):size])
+		buf = buf[:len(buf)+n]
+		if n != 0 {
+			decision = h.call(buf)
+			if decision == AmbiguousPrimary || decision == AmbiguousSecondary {
+				break
+			}
+		}
+		// the handler sees the error of an ended connection once the bytes are replayed
+		if err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = NewUnreadConn(conn, buf)
+
+	switch decision {
+	case AmbiguousSecondary:
+		serveHandler(ctx, h.secondary, conn)
+	case AmbiguousPrimary:
+		serveHandler(ctx, h.primary, conn)
+	default:
+		atomic.AddUint64(&h.mux.fallbacks, 1)
+		serveHandler(ctx, h.primary, conn)
+	}
+}
+
+func (h *ambiguousHandler) bind(m *CMux) Handler {
+	c := *h
+	c.mux = m
+	return &c
+}
+
+// call returns the decision of decide, undecided if it panics.
+func (h *ambiguousHandler) call(prefix []byte) (decision int) {
+	defer func() {
+		if recover() != nil {
+			decision = AmbiguousUndecided
+		}
+	}()
+	return h.decide(prefix[:len(prefix):len(prefix)])
+}
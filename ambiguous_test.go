@@ -0,0 +1,189 @@
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsLike decides for the secondary handler once the bytes after the two length bytes look like a DNS header,
+// the primary one for anything else, and waits for the header.
+func dnsLike(prefix []byte) int {
+	if len(prefix) < 6 {
+		return AmbiguousUndecided
+	}
+	// a query with one question
+	if prefix[4] == 0 && prefix[5] == 0x01 {
+		return AmbiguousSecondary
+	}
+	return AmbiguousPrimary
+}
+
+// ambiguousMux routes the prefix 0x00 to either handler by dnsLike.
+func ambiguousMux(decide func(prefix []byte) int, maxWait time.Duration) (mux *CMux, primary, secondary chan net.Conn) {
+	mux = NewCMux()
+	p, primary := connChan()
+	s, secondary := connChan()
+	mux.HandleAmbiguous(p, s, decide, maxWait, "\x00")
+	return mux, primary, secondary
+}
+
+func TestHandleAmbiguousDecidedEarly(t *testing.T) {
+	mux, primary, secondary := ambiguousMux(dnsLike, time.Minute)
+	conn := servePipe(mux)
+	defer conn.Close()
+	msg := "\x00\x1d\xab\xcd\x00\x01rest"
+	go conn.Write([]byte(msg))
+	got := recvConn(t, secondary)
+	defer got.Close()
+	if b := readN(t, got, len(msg)); b != msg {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, primary)
+	if n := mux.Stats().AmbiguousFallbacks; n != 0 {
+		t.Fatalf("%d fallbacks, want none", n)
+	}
+}
+
+func TestHandleAmbiguousDecidedLate(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	var mut sync.Mutex
+	var calls []string
+	mux, primary, secondary := ambiguousMux(func(prefix []byte) int {
+		mut.Lock()
+		calls = append(calls, string(prefix))
+		mut.Unlock()
+		return dnsLike(prefix)
+	}, time.Minute)
+	conn := servePipe(mux)
+	defer conn.Close()
+	start := time.Now()
+	go func() {
+		// a slow writer sends the header in pieces
+		for _, chunk := range []string{"\x00\x1d", "\xab\xcd", "\x00\x02"} {
+			time.Sleep(delay)
+			if _, err := conn.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+	}()
+	got := recvConn(t, primary)
+	defer got.Close()
+	if d := time.Since(start); d < 3*delay {
+		t.Fatalf("decided after %v, before the header arrived", d)
+	}
+	if b := readN(t, got, 6); b != "\x00\x1d\xab\xcd\x00\x02" {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, secondary)
+	mut.Lock()
+	defer mut.Unlock()
+	// decide is given every byte buffered so far, starting with the sniffed ones
+	if len(calls) < 2 || calls[0] != "\x00" || calls[len(calls)-1] != "\x00\x1d\xab\xcd\x00\x02" {
+		t.Fatalf("decide was called with %q", calls)
+	}
+	for i := 1; i < len(calls); i++ {
+		if len(calls[i]) <= len(calls[i-1]) || calls[i][:len(calls[i-1])] != calls[i-1] {
+			t.Fatalf("decide was called with %q, want the buffered bytes growing", calls)
+		}
+	}
+	if n := mux.Stats().AmbiguousFallbacks; n != 0 {
+		t.Fatalf("%d fallbacks, want none", n)
+	}
+}
+
+func TestHandleAmbiguousTimeoutFallback(t *testing.T) {
+	const maxWait = 50 * time.Millisecond
+	mux, primary, secondary := ambiguousMux(dnsLike, maxWait)
+	conn := servePipe(mux)
+	defer conn.Close()
+	start := time.Now()
+	go conn.Write([]byte("\x00\x1d\xab"))
+	got := recvConn(t, primary)
+	defer got.Close()
+	if d := time.Since(start); d < maxWait {
+		t.Fatalf("fell back after %v, before the wait was over", d)
+	}
+	// the bytes buffered are replayed before the ones sent after the fallback
+	go conn.Write([]byte("\xcd\x00\x01"))
+	if b := readN(t, got, 6); b != "\x00\x1d\xab\xcd\x00\x01" {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, secondary)
+	if n := mux.Stats().AmbiguousFallbacks; n != 1 {
+		t.Fatalf("%d fallbacks, want 1", n)
+	}
+}
+
+func TestHandleAmbiguousFallbacks(t *testing.T) {
+	tests := []struct {
+		name   string
+		decide func(prefix []byte) int
+		max    int
+		send   string
+		close  bool
+	}{
+		{"undecided at the bound", func(prefix []byte) int { return AmbiguousUndecided }, 8, "\x00\x1d\xab\xcd\x00\x01\x02\x03\x04", false},
+		{"any other value", func(prefix []byte) int { return 7 }, 8, "\x00\x1d\xab\xcd\x00\x01\x02\x03\x04", false},
+		{"panic", func(prefix []byte) int { panic("decide") }, 6, "\x00\x1d\xab\xcd\x00\x01", false},
+		{"end of the connection", dnsLike, 0, "\x00\x1d", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			mux, primary, secondary := ambiguousMux(tt.decide, time.Minute)
+			if tt.max != 0 {
+				mux.SetMaxSniffBytes(tt.max)
+			}
+			conn := servePipe(mux)
+			defer conn.Close()
+			go func() {
+				conn.Write([]byte(tt.send))
+				if tt.close {
+					conn.Close()
+				}
+			}()
+			got := recvConn(t, primary)
+			defer got.Close()
+			got.SetReadDeadline(time.Now().Add(5 * time.Second))
+			want := tt.send
+			if tt.close {
+				b, err := io.ReadAll(got)
+				if err != nil || !bytes.Equal(b, []byte(want)) {
+					t.Fatalf("replayed %q, %v, want %q and the end", b, err, want)
+				}
+			} else if b := readN(t, got, len(want)); b != want {
+				t.Fatalf("replayed %q, want %q", b, want)
+			}
+			noConn(t, secondary)
+			if n := mux.Stats().AmbiguousFallbacks; n != 1 {
+				t.Fatalf("%d fallbacks, want 1", n)
+			}
+		})
+	}
+}
+
+func TestHandleAmbiguousClone(t *testing.T) {
+	mux, primary, secondary := ambiguousMux(func(prefix []byte) int { return AmbiguousUndecided }, time.Minute)
+	c := mux.Clone()
+	// the clone buffers up to its own bound
+	c.SetMaxSniffBytes(4)
+	conn := servePipe(c)
+	defer conn.Close()
+	go conn.Write([]byte("\x00\x1d\xab\xcd"))
+	got := recvConn(t, primary)
+	defer got.Close()
+	if b := readN(t, got, 4); b != "\x00\x1d\xab\xcd" {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, secondary)
+	if n := c.Stats().AmbiguousFallbacks; n != 1 {
+		t.Fatalf("the clone counted %d fallbacks, want 1", n)
+	}
+	if n := mux.Stats().AmbiguousFallbacks; n != 0 {
+		t.Fatalf("the original counted %d fallbacks of the clone", n)
+	}
+}
@@ -0,0 +1,43 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// bannerWriteTimeout bounds the write of the banner.
+const bannerWriteTimeout = 10 * time.Second
+
+// SetBanner sets the greeting written to the connections whose client sends nothing within the delay,
+// such as the banner of SMTP or FTP, the sniffing then goes on with the answer of the client.
+// The clients that speak first never see it. The wait of HandleServerFirst starts once the banner is written.
+// An empty banner disables it.
+func (m *CMux) SetBanner(banner []byte, delay time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.banner = append([]byte(nil), banner...)
+	m.bannerDelay = delay
+	m.rebuild()
+}
+
+// greet writes the banner to conn unless the client speaks within the delay.
+func (t *table) greet(conn net.Conn) (net.Conn, error) {
+	if t.bannerDelay > 0 {
+		c, timedOut, err := t.waitClient(conn, t.bannerDelay)
+		if !timedOut {
+			return c, err
+		}
+		conn = c
+	}
+	conn.SetWriteDeadline(time.Now().Add(bannerWriteTimeout))
+	_, err := conn.Write(t.banner)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return conn, fmt.Errorf("write banner: %w", err)
+	}
+	if t.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
+	return conn, nil
+}
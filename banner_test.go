@@ -0,0 +1,106 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// bannerMux answers SMTP with a banner after 50ms and routes EHLO and TLS.
+func bannerMux() (*CMux, chan net.Conn, chan net.Conn) {
+	mux := NewCMux()
+	smtp, smtpCh := connChan()
+	tls, tlsCh := connChan()
+	mux.HandlePrefix(smtp, "EHLO ")
+	mux.HandlePrefix(tls, "\x16\x03")
+	mux.SetBanner([]byte("220 mx ready\r\n"), 50*time.Millisecond)
+	return mux, smtpCh, tlsCh
+}
+
+func TestBannerSilentClient(t *testing.T) {
+	mux, smtpCh, _ := bannerMux()
+	client := servePipe(mux)
+	defer client.Close()
+	if got := readN(t, client, 14); got != "220 mx ready\r\n" {
+		t.Fatalf("the silent client read %q, want the banner", got)
+	}
+	go client.Write([]byte("EHLO client\r\n"))
+	conn := recvConn(t, smtpCh)
+	defer conn.Close()
+	if got := readN(t, conn, 13); got != "EHLO client\r\n" {
+		t.Fatalf("the handler read %q", got)
+	}
+}
+
+func TestBannerClientSpeaksFirst(t *testing.T) {
+	mux, _, tlsCh := bannerMux()
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("\x16\x03\x01"))
+	conn := recvConn(t, tlsCh)
+	defer conn.Close()
+	if got := readN(t, conn, 3); got != "\x16\x03\x01" {
+		t.Fatalf("the handler read %q", got)
+	}
+	// wait past the delay, what the client reads first is the answer of the handler
+	time.Sleep(100 * time.Millisecond)
+	go conn.Write([]byte("ok"))
+	if got := readN(t, client, 2); got != "ok" {
+		t.Fatalf("the client speaking first read %q, want no banner", got)
+	}
+}
+
+func TestBannerClientNeverSpeaks(t *testing.T) {
+	mux, smtpCh, _ := bannerMux()
+	mux.SetReadTimeout(100 * time.Millisecond)
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	client := servePipe(mux)
+	defer client.Close()
+	if got := readN(t, client, 14); got != "220 mx ready\r\n" {
+		t.Fatalf("read %q, want the banner", got)
+	}
+	select {
+	case err := <-errc:
+		var se *SniffError
+		if !errors.As(err, &se) || !se.Timeout() {
+			t.Fatalf("OnError got %v, want the read timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the silent client was not timed out")
+	}
+	noConn(t, smtpCh)
+}
+
+// writeFailingConn is a conn whose writes fail with err.
+type writeFailingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *writeFailingConn) Write(p []byte) (int, error) {
+	return 0, c.err
+}
+
+func TestBannerWriteError(t *testing.T) {
+	mux, _, _ := bannerMux()
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	errWrite := errors.New("broken pipe")
+	client, server := net.Pipe()
+	defer client.Close()
+	go mux.ServeConn(&writeFailingConn{Conn: server, err: errWrite})
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errWrite) {
+			t.Fatalf("OnError got %v, want the write error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write error was not reported")
+	}
+}
@@ -0,0 +1,51 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TimedConn is implemented by the connections the mux dispatches, including those given to the NotFound handler
+// and to the OnError callback once sniffed, it tells the handler how much of its time the mux spent.
+type TimedConn interface {
+	net.Conn
+	// DispatchTime returns when the mux started to dispatch the connection.
+	DispatchTime() time.Time
+	// SniffDuration returns how long the sniffing took, the sniffings of a redispatched connection are added up.
+	SniffDuration() time.Duration
+}
+
+// SetConnBudget sets the time a connection is given from when it is dispatched, zero means no budget, the default.
+// The handler that implements ContextHandler is served with a context whose deadline is the DispatchTime
+// plus the budget, what is left once the sniffing is over. The deadlines of the connection are not changed.
+func (m *CMux) SetConnBudget(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.connBudget = d
+	m.rebuild()
+}
+
+// withTiming records the dispatching that started at start on conn, conn is wrapped if it does not replay anything.
+// A connection that is dispatched again keeps its first DispatchTime.
+func withTiming(conn net.Conn, start time.Time, sniffed time.Duration) net.Conn {
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	if us.dispatched.IsZero() {
+		us.dispatched = start
+	}
+	us.sniffDuration += sniffed
+	return conn
+}
+
+// withBudget returns the context of the handler of conn, conn must have been recorded by withTiming.
+func (t *table) withBudget(ctx context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	us, _ := asUnreadConn(conn)
+	if t.connBudget <= 0 || us == nil {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, us.dispatched.Add(t.connBudget))
+}
@@ -0,0 +1,214 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dispatched is what a handler was served with.
+type dispatched struct {
+	ctx     context.Context
+	conn    net.Conn
+	entered time.Time
+}
+
+// dispatchedHandler is a ContextHandler sending what it was served with to ch.
+func dispatchedHandler() (Handler, chan dispatched) {
+	ch := make(chan dispatched, 4)
+	return redispatchFunc(func(ctx context.Context, conn net.Conn) {
+		ch <- dispatched{ctx: ctx, conn: conn, entered: time.Now()}
+	}), ch
+}
+
+func recvDispatched(t testing.TB, ch chan dispatched) dispatched {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection was dispatched")
+		return dispatched{}
+	}
+}
+
+// slowPrefix serves a pipe with mux, the client sends the first byte of the prefix and the rest after delay.
+func slowPrefix(mux *CMux, prefix string, delay time.Duration) (net.Conn, time.Time) {
+	conn := servePipe(mux)
+	start := time.Now()
+	go func() {
+		if _, err := conn.Write([]byte(prefix[:1])); err != nil {
+			return
+		}
+		time.Sleep(delay)
+		conn.Write([]byte(prefix[1:]))
+	}()
+	return conn, start
+}
+
+func TestSniffDurationSlowWriter(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	h, ch := dispatchedHandler()
+	mux.HandlePrefix(h, "GET ")
+	conn, start := slowPrefix(mux, "GET ", delay)
+	defer conn.Close()
+	d := recvDispatched(t, ch)
+	tc, ok := d.conn.(TimedConn)
+	if !ok {
+		t.Fatalf("the conn %T is not a TimedConn", d.conn)
+	}
+	if sniffed := tc.SniffDuration(); sniffed < delay || sniffed > d.entered.Sub(start) {
+		t.Fatalf("the sniffing took %v, want between %v and %v", sniffed, delay, d.entered.Sub(start))
+	}
+	if at := tc.DispatchTime(); at.Before(start.Add(-time.Second)) || at.After(start.Add(delay)) {
+		t.Fatalf("dispatched at %v, the client connected at %v", at, start)
+	}
+	if _, ok := d.ctx.Deadline(); ok {
+		t.Fatal("the ctx has a deadline without a budget")
+	}
+}
+
+func TestConnBudgetShortensDeadline(t *testing.T) {
+	const (
+		delay  = 100 * time.Millisecond
+		budget = 2 * time.Second
+	)
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	mux.SetConnBudget(budget)
+	h, ch := dispatchedHandler()
+	mux.HandlePrefix(h, "GET ")
+
+	slow, _ := slowPrefix(mux, "GET ", delay)
+	defer slow.Close()
+	d := recvDispatched(t, ch)
+	tc := d.conn.(TimedConn)
+	deadline, ok := d.ctx.Deadline()
+	if !ok {
+		t.Fatal("the ctx has no deadline")
+	}
+	if want := tc.DispatchTime().Add(budget); !deadline.Equal(want) {
+		t.Fatalf("the deadline is %v, want the dispatch time plus the budget %v", deadline, want)
+	}
+	// the time spent sniffing is taken from the budget
+	if left := deadline.Sub(d.entered); left > budget-tc.SniffDuration() || left > budget-delay {
+		t.Fatalf("%v of the budget is left after sniffing for %v", left, tc.SniffDuration())
+	}
+
+	// a fast client is left more of the budget than the slow one
+	fast, _ := slowPrefix(mux, "GET ", 0)
+	defer fast.Close()
+	f := recvDispatched(t, ch)
+	fastDeadline, _ := f.ctx.Deadline()
+	if fastLeft, slowLeft := fastDeadline.Sub(f.entered), deadline.Sub(d.entered); fastLeft <= slowLeft {
+		t.Fatalf("the fast client is left %v, the slow one %v", fastLeft, slowLeft)
+	}
+
+	// the budget only applies to the connections dispatched while it is set
+	mux.SetConnBudget(0)
+	c, _ := slowPrefix(mux, "GET ", 0)
+	defer c.Close()
+	if _, ok := recvDispatched(t, ch).ctx.Deadline(); ok {
+		t.Fatal("the ctx has a deadline after the budget was removed")
+	}
+}
+
+func TestSniffTimingNotFoundAndError(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	mux.SetConnBudget(time.Minute)
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	h, ch := dispatchedHandler()
+	mux.NotFound(h)
+	conn, _ := slowPrefix(mux, "SXYZ", delay)
+	defer conn.Close()
+	d := recvDispatched(t, ch)
+	if tc, ok := d.conn.(TimedConn); !ok || tc.SniffDuration() < delay {
+		t.Fatalf("the NotFound handler was given %T without the sniffing of the slow client", d.conn)
+	}
+	if _, ok := d.ctx.Deadline(); !ok {
+		t.Fatal("the NotFound handler has no deadline")
+	}
+
+	mux.NotFound(nil)
+	errs := make(chan net.Conn, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- conn
+	})
+	conn, _ = slowPrefix(mux, "SXYZ", delay)
+	defer conn.Close()
+	select {
+	case c := <-errs:
+		if tc, ok := c.(TimedConn); !ok || tc.SniffDuration() < delay {
+			t.Fatalf("the error hook was given %T without the sniffing of the slow client", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the error hook was not called")
+	}
+}
+
+func TestSniffTimingRedispatch(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	first := make(chan TimedConn, 1)
+	mux.HandlePrefix(redispatchFunc(func(ctx context.Context, conn net.Conn) {
+		conn.Read(make([]byte, 4))
+		first <- conn.(TimedConn)
+		mux.RedispatchContext(ctx, conn)
+	}), "AUTH")
+	h, ch := dispatchedHandler()
+	mux.HandlePrefix(h, "GET ")
+	conn, _ := slowPrefix(mux, "AUTH", delay)
+	defer conn.Close()
+	before := <-first
+	sniffed, at := before.SniffDuration(), before.DispatchTime()
+	go func() {
+		time.Sleep(delay)
+		conn.Write([]byte("GET "))
+	}()
+	d := recvDispatched(t, ch)
+	tc := d.conn.(TimedConn)
+	// the sniffings are added up and the first dispatch time is kept
+	if tc.SniffDuration() < sniffed+delay {
+		t.Fatalf("the sniffing of the redispatch took %v, the first one %v", tc.SniffDuration(), sniffed)
+	}
+	if !tc.DispatchTime().Equal(at) {
+		t.Fatalf("dispatched again at %v, first at %v", tc.DispatchTime(), at)
+	}
+}
+
+func TestSetConnBudgetWhileDispatching(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(redispatchFunc(func(ctx context.Context, conn net.Conn) {
+		ctx.Deadline()
+		conn.Close()
+	}), "X")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mux.SetConnBudget(time.Duration(i%2) * time.Hour)
+		}
+	}()
+	for i := 0; i != 100; i++ {
+		client, server := net.Pipe()
+		go client.Write([]byte("X"))
+		mux.ServeConn(server)
+		client.Close()
+	}
+	close(done)
+	wg.Wait()
+}
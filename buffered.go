@@ -0,0 +1,40 @@
+package cmux
+
+import (
+	"bufio"
+	"io"
+)
+
+// HandlerBuffered returns most matching handler for the given reader without consuming it,
+// the bytes are examined with Peek so the reader still returns the full stream afterwards.
+// When the buffer of the reader is smaller than the bytes needed, the match is decided
+// with the bytes that fit in the buffer.
+func (m *CMux) HandlerBuffered(br *bufio.Reader) (Handler, error) {
+	handler, _, _, err := m.load().resolve(&peekReader{br: br})
+	return handler, err
+}
+
+// peekReader reads the bytes ahead of the position of br without advancing it.
+type peekReader struct {
+	br  *bufio.Reader
+	off int
+}
+
+func (r *peekReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.br.Buffered() <= r.off {
+		_, err := r.br.Peek(r.off + 1)
+		if err == bufio.ErrBufferFull {
+			return 0, io.EOF
+		}
+		if err != nil && r.br.Buffered() <= r.off {
+			return 0, err
+		}
+	}
+	buf, _ := r.br.Peek(r.br.Buffered())
+	n := copy(p, buf[r.off:])
+	r.off += n
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHandlerBufferedKeepsStream(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	stream := "SSH-2.0-OpenSSH_9.0\r\nrest of the stream"
+	br := bufio.NewReader(&chunkedReader{s: stream, n: 3})
+	h, err := mux.HandlerBuffered(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != handlerID("ssh2") {
+		t.Fatalf("matched %v, want ssh2", h)
+	}
+	b, err := io.ReadAll(br)
+	if err != nil || string(b) != stream {
+		t.Fatalf("the reader returned %q, %v, want the full stream", b, err)
+	}
+}
+
+func TestHandlerBufferedShortStream(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	// Peek returns fewer bytes than asked
+	br := bufio.NewReader(strings.NewReader("SSH-2"))
+	h, err := mux.HandlerBuffered(br)
+	if err != nil || h != handlerID("ssh") {
+		t.Fatalf("HandlerBuffered = %v, %v", h, err)
+	}
+	if b, _ := io.ReadAll(br); string(b) != "SSH-2" {
+		t.Fatalf("the reader returned %q", b)
+	}
+
+	br = bufio.NewReader(strings.NewReader("XY"))
+	if _, err := mux.HandlerBuffered(br); err == nil {
+		t.Fatal("HandlerBuffered matched an unknown stream")
+	}
+	if b, _ := io.ReadAll(br); string(b) != "XY" {
+		t.Fatalf("the reader returned %q", b)
+	}
+}
+
+func TestHandlerBufferedBufferFull(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("short"), "0123")
+	mux.HandlePrefix(handlerID("long"), "0123"+strings.Repeat("x", 40))
+	stream := "0123" + strings.Repeat("x", 60)
+	// the buffer of the reader is smaller than the longest prefix, the bytes that fit decide
+	br := bufio.NewReaderSize(strings.NewReader(stream), 16)
+	h, err := mux.HandlerBuffered(br)
+	if err != nil || h != handlerID("short") {
+		t.Fatalf("HandlerBuffered = %v, %v", h, err)
+	}
+	if b, _ := io.ReadAll(br); string(b) != stream {
+		t.Fatalf("the reader returned %q", b)
+	}
+}
+
+// chunkedReader returns s n bytes at a time.
+type chunkedReader struct {
+	s string
+	n int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.s) == 0 {
+		return 0, io.EOF
+	}
+	n := r.n
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.s) {
+		n = len(r.s)
+	}
+	copy(p, r.s[:n])
+	r.s = r.s[n:]
+	return n, nil
+}
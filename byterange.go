@@ -0,0 +1,37 @@
+package cmux
+
+import (
+	"fmt"
+)
+
+// HandleByteRange handle the handler that matches the byte at the offset falling in [lo, hi],
+// such as the first byte 0x14-0x17 of the TLS records. The rule is consulted like a matcher,
+// in registration order after the prefixes, so an exact registration still wins.
+func (m *CMux) HandleByteRange(handler Handler, offset int, lo, hi byte) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid offset %d", offset)
+	}
+	if lo > hi {
+		return fmt.Errorf("invalid byte range %#02x-%#02x", lo, hi)
+	}
+	br := &byteRangeMatcher{
+		offset: offset,
+		lo:     lo,
+		hi:     hi,
+	}
+	return m.handleMatcher(handler, br, offset+1, fmt.Sprintf("range:%d:%#02x-%#02x", offset, lo, hi))
+}
+
+type byteRangeMatcher struct {
+	offset int
+	lo, hi byte
+}
+
+// Match asks for more bytes until the byte at the offset is read.
+func (r *byteRangeMatcher) Match(b []byte) (matched bool, needMore bool) {
+	if len(b) <= r.offset {
+		return false, true
+	}
+	c := b[r.offset]
+	return c >= r.lo && c <= r.hi, false
+}
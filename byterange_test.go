@@ -0,0 +1,68 @@
+package cmux
+
+import (
+	"testing"
+)
+
+func TestHandleByteRange(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleByteRange(handlerID("tls"), 0, 20, 23)
+	mux.HandleByteRange(handlerID("socks"), 0, 4, 5)
+	mux.HandleByteRange(handlerID("rpc"), 0, 0x80, 0x9f)
+	// overlapping ranges are decided by the registration order
+	mux.HandleByteRange(handlerID("high"), 0, 0x90, 0xff)
+	mux.HandlePrefix(handlerID("exact"), "\x16\x03")
+
+	for b, want := range map[string]string{
+		"\x14\x03\x03": "tls",
+		"\x17\x03\x03": "tls",
+		"\x16\x02\x01": "tls",
+		// the exact registration wins over the range
+		"\x16\x03\x01": "exact",
+		"\x04\x01\x00": "socks",
+		"\x05\x01\x00": "socks",
+		"\x06\x01\x00": "",
+		"\x80\x00":     "rpc",
+		"\x9f\x00":     "rpc",
+		"\xa0\x00":     "high",
+		"\xff\x00":     "high",
+		"\x13\x00":     "",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleByteRangeOffset(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleByteRange(handlerID("v2"), 3, 0x20, 0x2f)
+	mux.HandlePrefix(handlerID("ab"), "AB")
+
+	// the sniffing reads the 4 bytes before deciding
+	_, _, consumed, err := mux.MatchBytes([]byte("XYZ\x25rest"))
+	if err != nil || consumed != 4 {
+		t.Fatalf("decided after %d bytes with %v, want 4", consumed, err)
+	}
+	for b, want := range map[string]string{
+		"XYZ\x25":    "v2",
+		"XYZ\x30":    "",
+		"XYZ":        "",
+		"AB\x00\x2a": "ab",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+	for _, tc := range []struct {
+		offset int
+		lo, hi byte
+	}{
+		{-1, 0, 1},
+		{0, 2, 1},
+	} {
+		if err := mux.HandleByteRange(handlerID("bad"), tc.offset, tc.lo, tc.hi); err == nil {
+			t.Errorf("HandleByteRange(%d, %d, %d) was accepted", tc.offset, tc.lo, tc.hi)
+		}
+	}
+}
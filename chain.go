@@ -0,0 +1,132 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDeclineReplay is the number of the bytes a DeclinableHandler may read and still decline.
+const maxDeclineReplay = 64 << 10
+
+// DeclinableHandler is a Handler that may give the connection back, such as a proxy whose backend is down.
+type DeclinableHandler interface {
+	// ServeConnDeclinable serves conn or reports declined once it is done with conn.
+	// The bytes read from conn are replayed to the next handler, a handler that wrote to conn, closed it
+	// or read more than 64 KiB from it can no longer decline and conn is closed.
+	// conn must not be used once the method has returned.
+	ServeConnDeclinable(conn net.Conn) (declined bool)
+}
+
+// ChainHandler is a Handler that tries its handlers in order, a DeclinableHandler that declines
+// passes the connection to the next one. The connection is closed when every handler declines.
+type ChainHandler struct {
+	handlers []Handler
+}
+
+// NewChainHandler create a new ChainHandler.
+func NewChainHandler(handlers ...Handler) *ChainHandler {
+	return &ChainHandler{
+		handlers: handlers,
+	}
+}
+
+func (h *ChainHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *ChainHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	for _, handler := range h.handlers {
+		d, ok := handler.(DeclinableHandler)
+		if !ok {
+			serveHandler(ctx, handler, conn)
+			return
+		}
+		dc := &declineConn{Conn: conn}
+		if !d.ServeConnDeclinable(dc) {
+			return
+		}
+		read, ok := dc.decline()
+		if !ok {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		conn = UnreadConn(conn, read)
+	}
+	conn.Close()
+}
+
+// HandleChain handle the handlers that match the prefix, tried in order as a ChainHandler.
+func (m *CMux) HandleChain(prefixes []string, handlers ...Handler) error {
+	if err := noBudget("HandleChain", handlers...); err != nil {
+		return err
+	}
+	return m.HandlePrefix(NewChainHandler(handlers...), prefixes...)
+}
+
+// declineConn records the bytes read by a DeclinableHandler and whether it may still decline,
+// it fails every use once the handler has declined.
+type declineConn struct {
+	net.Conn
+	mut      sync.Mutex
+	read     []byte
+	served   bool
+	detached bool
+}
+
+func (c *declineConn) Read(p []byte) (int, error) {
+	c.mut.Lock()
+	detached := c.detached
+	c.mut.Unlock()
+	if detached {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Read(p)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.served {
+		if len(c.read)+n > maxDeclineReplay {
+			c.served = true
+			c.read = nil
+		} else {
+			c.read = append(c.read, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+func (c *declineConn) Write(p []byte) (int, error) {
+	if !c.serve() {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *declineConn) Close() error {
+	if !c.serve() {
+		return net.ErrClosed
+	}
+	return c.Conn.Close()
+}
+
+// serve gives up the declining, it reports false once the handler has declined.
+func (c *declineConn) serve() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.detached {
+		return false
+	}
+	c.served = true
+	c.read = nil
+	return true
+}
+
+// decline detaches the handler and returns the bytes it read, ok is false if it can no longer decline.
+func (c *declineConn) decline() (read []byte, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.detached = true
+	return c.read, !c.served
+}
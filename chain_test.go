@@ -0,0 +1,127 @@
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// declineFunc is a DeclinableHandler running fn.
+type declineFunc func(conn net.Conn) bool
+
+func (f declineFunc) ServeConn(conn net.Conn) {
+	f(conn)
+}
+
+func (f declineFunc) ServeConnDeclinable(conn net.Conn) bool {
+	return f(conn)
+}
+
+func TestHandleChainDeclined(t *testing.T) {
+	mux := NewCMux()
+	peeked := make(chan string, 1)
+	first := declineFunc(func(conn net.Conn) bool {
+		// it reads past the prefix before it gives up
+		b := make([]byte, 6)
+		io.ReadFull(conn, b)
+		peeked <- string(b)
+		return true
+	})
+	h, ch := connChan()
+	mux.HandleChain([]string{"TLS"}, first, h)
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("TLS hello"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := <-peeked; got != "TLS he" {
+		t.Fatalf("the declining handler read %q", got)
+	}
+	if got := readN(t, conn, 9); got != "TLS hello" {
+		t.Fatalf("the next handler read %q, want the bytes read by the declining one replayed", got)
+	}
+}
+
+func TestHandleChainDeclinedConnDetached(t *testing.T) {
+	mux := NewCMux()
+	leaked := make(chan net.Conn, 1)
+	first := declineFunc(func(conn net.Conn) bool {
+		leaked <- conn
+		return true
+	})
+	h, ch := connChan()
+	mux.HandleChain([]string{"X"}, first, h)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("X"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+
+	old := <-leaked
+	if _, err := old.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("a write after declining returned %v, want net.ErrClosed", err)
+	}
+	if _, err := old.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("a read after declining returned %v, want net.ErrClosed", err)
+	}
+	if err := old.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("a close after declining returned %v, want net.ErrClosed", err)
+	}
+	if got := readN(t, conn, 1); got != "X" {
+		t.Fatalf("the next handler read %q", got)
+	}
+}
+
+func TestHandleChainDeclineAfterWrite(t *testing.T) {
+	mux := NewCMux()
+	first := declineFunc(func(conn net.Conn) bool {
+		conn.Write([]byte("oops"))
+		return true
+	})
+	h, ch := connChan()
+	mux.HandleChain([]string{"X"}, first, h)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("X"))
+	if got := readN(t, client, 4); got != "oops" {
+		t.Fatalf("read %q", got)
+	}
+	if err := readErr(t, client); err != io.EOF {
+		t.Fatalf("the conn of a handler that wrote and declined read %v, want it closed", err)
+	}
+	noConn(t, ch)
+}
+
+func TestHandleChainAllDecline(t *testing.T) {
+	mux := NewCMux()
+	decline := declineFunc(func(conn net.Conn) bool {
+		return true
+	})
+	mux.HandleChain([]string{"X"}, decline, decline)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("X"))
+	if err := readErr(t, client); err != io.EOF {
+		t.Fatalf("the conn every handler declined read %v, want it closed", err)
+	}
+}
+
+func TestHandleChainServed(t *testing.T) {
+	mux := NewCMux()
+	served := declineFunc(func(conn net.Conn) bool {
+		defer conn.Close()
+		conn.Write([]byte("first"))
+		return false
+	})
+	h, ch := connChan()
+	mux.HandleChain([]string{"X"}, served, h)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("X"))
+	if got := readN(t, client, 5); got != "first" {
+		t.Fatalf("read %q, want the first handler", got)
+	}
+	noConn(t, ch)
+}
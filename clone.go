@@ -0,0 +1,127 @@
+package cmux
+
+// Clone returns a copy of the mux with the registrations, the NotFound handler and the settings,
+// the handlers are shared but the ones that the mux made for a registration, such as by HandlePrefixTLS, use the copy.
+// The copy has its own counters and unmatched samples and does not serve the listeners of the mux,
+// the changes to either one are not seen by the other.
+func (m *CMux) Clone() *CMux {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	c := &CMux{
+		prefixes:        make(map[string]*route, len(m.prefixes)),
+		folds:           make(map[string]*route, len(m.folds)),
+		notFound:        m.notFound,
+		readTimeout:     m.readTimeout,
+		proxyProtocol:   m.proxyProtocol,
+		maxSniffBytes:   m.maxSniffBytes,
+		onError:         m.onError,
+		onMatch:         m.onMatch,
+		onEmpty:         m.onEmpty,
+		onAccept:        m.onAccept,
+		onPanic:         m.onPanic,
+		onSniffStart:    m.onSniffStart,
+		onSniffDone:     m.onSniffDone,
+		accounting:      m.accounting,
+		idleTimeout:     m.idleTimeout,
+		onConnClosed:    m.onConnClosed,
+		slotWait:        m.slotWait,
+		notFoundPolicy:  m.notFoundPolicy,
+		logger:          m.logger,
+		maxClientHello:  m.maxClientHello,
+		allowNonIP:      m.allowNonIP,
+		strategy:        m.strategy,
+		serverFirstWait: m.serverFirstWait,
+		banner:          m.banner,
+		bannerDelay:     m.bannerDelay,
+		skipCutset:      m.skipCutset,
+		skipMax:         m.skipMax,
+		skipReplay:      m.skipReplay,
+		connBudget:      m.connBudget,
+		responderNext:   m.responderNext,
+		middlewares:     m.middlewares[:len(m.middlewares):len(m.middlewares)],
+	}
+	if m.sniffStats != nil {
+		c.sniffStats = &sniffStats{}
+	}
+	if m.slots != nil {
+		c.slots = make(chan struct{}, cap(m.slots))
+	}
+	c.sourcePrefix6 = m.sourcePrefix6
+	if l := m.loadSources(); l != nil {
+		c.sources.Store(newSourceLimiter(l.getLimit(), l.prefix6))
+	}
+	if r, _ := m.unmatched.Load().(*unmatchedRing); r != nil {
+		c.unmatched.Store(r.clone())
+	}
+	if mc := m.loadMatchCache(); mc != nil {
+		c.matchCache.Store(newMatchCache(mc.ttl, mc.size))
+	}
+
+	// the routes are copied so that the copy counts its own connections
+	counters := make(map[*routeCounter]*routeCounter, len(m.counters))
+	for pattern, counter := range m.counters {
+		counters[counter] = c.counterOf(pattern)
+	}
+	copyRoute := func(r *route) *route {
+		if r == nil {
+			return nil
+		}
+		cr := *r
+		cr.counter = counters[r.counter]
+		if h, ok := r.handler.(muxHandler); ok {
+			cr.handler = h.bind(c)
+		}
+		return &cr
+	}
+	for prefix, r := range m.prefixes {
+		c.prefixes[prefix] = copyRoute(r)
+	}
+	if m.restricted != nil {
+		c.restricted = make(map[string][]*route, len(m.restricted))
+		for prefix, rs := range m.restricted {
+			crs := make([]*route, 0, len(rs))
+			for _, r := range rs {
+				crs = append(crs, copyRoute(r))
+			}
+			c.restricted[prefix] = crs
+		}
+	}
+	for prefix, r := range m.folds {
+		c.folds[prefix] = copyRoute(r)
+	}
+	for _, mr := range m.masks {
+		cmr := *mr
+		cmr.route = *copyRoute(&mr.route)
+		c.masks = append(c.masks, &cmr)
+	}
+	for _, mr := range m.matchers {
+		cmr := *mr
+		cmr.route = *copyRoute(&mr.route)
+		c.matchers = append(c.matchers, &cmr)
+	}
+	if m.alpn != nil {
+		c.alpn = make(map[string]*route, len(m.alpn))
+		for proto, r := range m.alpn {
+			c.alpn[proto] = copyRoute(r)
+		}
+	}
+	c.tlsDefault = copyRoute(m.tlsDefault)
+	c.serverFirst = copyRoute(m.serverFirst)
+	c.defaultRoute = copyRoute(m.defaultRoute)
+	if m.origDst != nil {
+		c.origDst = make(map[int]*route, len(m.origDst))
+		for port, r := range m.origDst {
+			c.origDst[port] = copyRoute(r)
+		}
+	}
+	c.origDstSniff = m.origDstSniff
+	c.rebuild()
+	return c
+}
+
+// muxHandler is a handler made by a mux for a registration, it uses the mux it is registered on.
+type muxHandler interface {
+	Handler
+	// bind returns the handler using m instead.
+	bind(m *CMux) Handler
+}
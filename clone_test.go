@@ -0,0 +1,101 @@
+package cmux
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// resolvedBy returns the id of the handler mux resolves b to, or "" for none.
+func resolvedBy(t testing.TB, mux *CMux, b string) string {
+	t.Helper()
+	h, _, err := mux.Handler(bytes.NewReader([]byte(b)))
+	if errors.Is(err, ErrNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := h.(handlerID)
+	return string(id)
+}
+
+func TestCloneIsolatesRegistrations(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ")
+
+	c := mux.Clone()
+	c.HandlePrefix(handlerID("post"), "POST ")
+	c.RemovePrefix("SSH-")
+	if got, want := mux.Prefixes(), []string{"GET ", "SSH-"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the original has %q after changing the clone, want %q", got, want)
+	}
+	if got := resolvedBy(t, mux, "SSH-2.0"); got != "ssh" {
+		t.Fatalf("the original resolved SSH- to %q", got)
+	}
+	if got := resolvedBy(t, mux, "POST /"); got != "" {
+		t.Fatalf("the original resolved the prefix of the clone to %q", got)
+	}
+
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.NotFound(handlerID("notfound"))
+	if got, want := c.Prefixes(), []string{"GET ", "POST "}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the clone has %q after changing the original, want %q", got, want)
+	}
+	if got := resolvedBy(t, c, "POST /"); got != "post" {
+		t.Fatalf("the clone resolved POST to %q", got)
+	}
+	if got := resolvedBy(t, c, "SSH-2.0-x"); got != "" {
+		t.Fatalf("the clone resolved the prefix of the original to %q", got)
+	}
+}
+
+func TestCloneIsolatesCounters(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.DispatchConn(newMemConn([]byte("GET ")))
+	c := mux.Clone()
+	c.DispatchConn(newMemConn([]byte("GET ")))
+	c.DispatchConn(newMemConn([]byte("GET ")))
+	if got := mux.Stats().NotFound; got != 1 {
+		t.Fatalf("the original counted %d unmatched connections, want 1", got)
+	}
+	if got := c.Stats().NotFound; got != 2 {
+		t.Fatalf("the clone counted %d unmatched connections, want 2", got)
+	}
+}
+
+func TestCloneCopiesUnmatchedSamples(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.CaptureUnmatched(4)
+	mux.DispatchConn(newMemConn([]byte("one")))
+
+	c := mux.Clone()
+	if got := c.UnmatchedSamples(); len(got) != 1 || string(got[0].Prefix) != "one" {
+		t.Fatalf("the clone has the samples %v, want the sample of the original", got)
+	}
+	// the clone keeps capturing in its own ring
+	c.DispatchConn(newMemConn([]byte("two")))
+	mux.DispatchConn(newMemConn([]byte("six")))
+	prefixes := func(samples []UnmatchedSample) []string {
+		var s []string
+		for _, sample := range samples {
+			s = append(s, string(sample.Prefix))
+		}
+		return s
+	}
+	if got, want := prefixes(mux.UnmatchedSamples()), []string{"one", "six"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the original has the samples %q, want %q", got, want)
+	}
+	if got, want := prefixes(c.UnmatchedSamples()), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the clone has the samples %q, want %q", got, want)
+	}
+
+	c.CaptureUnmatched(0)
+	if got := mux.UnmatchedSamples(); len(got) != 2 {
+		t.Fatalf("stopping the capture of the clone left %d samples in the original", len(got))
+	}
+}
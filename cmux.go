@@ -1,19 +1,59 @@
 package cmux
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
-
-	"github.com/wzshiming/trie"
+	"time"
 )
 
 var (
 	ErrNotFound = fmt.Errorf("error not found")
+	// ErrEmptyConn is returned for a connection closed by the peer before sending any byte,
+	// such as the probes of the load balancers and the port scanners.
+	ErrEmptyConn = fmt.Errorf("connection closed before any data")
+	// ErrPrefixExists is returned by HandlePrefix for a prefix that is already registered.
+	ErrPrefixExists = fmt.Errorf("prefix already registered")
 )
 
+// SniffError is the error that occurred while reading the prefix of a connection.
+type SniffError struct {
+	Err error
+}
+
+func (e *SniffError) Error() string {
+	return "sniff: " + e.Err.Error()
+}
+
+func (e *SniffError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the read deadline was exceeded.
+func (e *SniffError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// NotFoundError is the error of a connection that matches nothing, it is ErrNotFound for errors.Is.
+type NotFoundError struct {
+	// Prefix is the bytes read before the matching failed, it is not shared with the mux.
+	Prefix []byte
+}
+
+func (e *NotFoundError) Error() string {
+	return ErrNotFound.Error()
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
 type Handler interface {
 	ServeConn(conn net.Conn)
 }
@@ -24,116 +64,1154 @@ func (h HandlerFunc) ServeConn(conn net.Conn) {
 	h(conn)
 }
 
+// ContextHandler is a Handler that is served with the context of the dispatching.
+type ContextHandler interface {
+	ServeConnContext(ctx context.Context, conn net.Conn)
+}
+
+// NotFoundHandler is a Handler for the unmatched connections that also wants the bytes sniffed from them.
+type NotFoundHandler interface {
+	ServeNotFound(conn net.Conn, prefix []byte)
+}
+
+type NotFoundHandlerFunc func(conn net.Conn, prefix []byte)
+
+func (h NotFoundHandlerFunc) ServeNotFound(conn net.Conn, prefix []byte) {
+	h(conn, prefix)
+}
+
+func (h NotFoundHandlerFunc) ServeConn(conn net.Conn) {
+	_, prefix := UnwrapUnreadConn(conn)
+	h(conn, prefix)
+}
+
 // CMux is an Applicative protocol multiplexer
 // It matches the prefix of each incoming reader against a list of registered patterns
 // and calls the handler for the pattern that most closely matches the Handler.
 type CMux struct {
-	trie         *trie.Trie
-	prefixLength int
-	size         uint32
-	handlers     map[uint32]Handler
-	notFound     Handler
+	inFlight        int64 // first for the 64-bit alignment of atomic operations
+	rejected        uint64
+	notFounds       uint64
+	errors          uint64
+	redispatched    uint64
+	idleClosed      uint64
+	sourceRejected  uint64
+	speculated      uint64
+	misSpeculated   uint64
+	fallbacks       uint64
+	mut             sync.Mutex
+	prefixes        map[string]*route
+	restricted      map[string][]*route
+	folds           map[string]*route
+	masks           []*maskRoute
+	matchers        []*matcherRoute
+	alpn            map[string]*route
+	notFound        Handler
+	table           atomic.Value
+	addr            atomic.Value
+	readTimeout     time.Duration
+	proxyProtocol   bool
+	maxSniffBytes   int
+	onError         func(conn net.Conn, err error)
+	onMatch         func(conn net.Conn, prefix []byte, pattern string, handler Handler)
+	conns           connTracker
+	slots           chan struct{}
+	slotWait        time.Duration
+	notFoundPolicy  NotFoundPolicy
+	logger          Logger
+	counters        map[string]*routeCounter
+	maxClientHello  int
+	tlsDefault      *route
+	allowNonIP      bool
+	strategy        MatchStrategy
+	serverFirst     *route
+	serverFirstWait time.Duration
+	defaultRoute    *route
+	origDst         map[int]*route
+	origDstSniff    bool
+	banner          []byte
+	bannerDelay     time.Duration
+	middlewares     []Middleware
+	onEmpty         func(conn net.Conn)
+	unmatched       atomic.Value
+	skipCutset      string
+	skipMax         int
+	skipReplay      bool
+	onAccept        []func(conn net.Conn) (net.Conn, error)
+	onPanic         func(conn net.Conn, recovered interface{}, stack []byte)
+	onSniffStart    func(conn net.Conn)
+	onSniffDone     func(conn net.Conn, pattern string, timing SniffTiming, err error)
+	sniffStats      *sniffStats
+	accounting      bool
+	idleTimeout     time.Duration
+	onConnClosed    func(pattern string, bytesIn, bytesOut int64, dur time.Duration)
+	connBudget      time.Duration
+	responderNext   Handler
+	sources         atomic.Value
+	sourcePrefix6   int
+	matchCache      atomic.Value
+}
+
+// route is a registration, pattern is what the handler was registered with.
+type route struct {
+	pattern string
+	name    string
+	handler Handler
+	counter *routeCounter
+	// sources restricts the route to the source networks, see HandlePrefixFrom.
+	sources []*net.IPNet
+	// locals restricts the route to the local addresses, see HandlePrefixLocal.
+	locals []localAddr
+	// excluded routes the matching connections to the not found path.
+	excluded bool
+	// terminal dispatches as soon as the prefix is read, see HandlePrefixTerminal.
+	terminal bool
+	// maxWait drops the route once the sniffing took longer, see WithBudget.
+	maxWait time.Duration
+}
+
+// table is an immutable snapshot of the routes, it is replaced as a whole on every registration
+// so that the dispatching never has to take a lock.
+type table struct {
+	prefixes        map[string]*route
+	restricted      map[string][]*route
+	sorted          []string
+	exactLength     int
+	firstLength     [256]int
+	byFirst         [256]*route
+	folds           map[string]*route
+	foldSorted      []string
+	foldLength      int
+	masks           []*maskRoute
+	prefixLength    int
+	sniffLength     int
+	maxSniffBytes   int
+	readTimeout     time.Duration
+	idleTimeout     time.Duration
+	connBudget      time.Duration
+	waits           []time.Duration
+	growLength      int
+	matchers        []*matcherRoute
+	alpn            map[string]*route
+	tlsDefault      *route
+	responderNext   Handler
+	first           bool
+	serverFirst     *route
+	serverFirstWait time.Duration
+	defaultRoute    *route
+	origDst         map[int]*route
+	origDstSniff    bool
+	banner          []byte
+	bannerDelay     time.Duration
+	middlewares     []Middleware
+	allowNonIP      bool
+	skipCutset      string
+	skipMax         int
+	skipReplay      bool
+	strip           bool
+	http2Preface    bool
+	notFound        Handler
+	notFoundPolicy  NotFoundPolicy
+	proxyProtocol   bool
+	onError         func(conn net.Conn, err error)
+	onMatch         func(conn net.Conn, prefix []byte, pattern string, handler Handler)
+	onAccept        []func(conn net.Conn) (net.Conn, error)
+	onEmpty         func(conn net.Conn)
+	onPanic         func(conn net.Conn, recovered interface{}, stack []byte)
+	logger          Logger
+	slots           chan struct{}
+	slotWait        time.Duration
+	onSniffStart    func(conn net.Conn)
+	onSniffDone     func(conn net.Conn, pattern string, timing SniffTiming, err error)
+	sniffStats      *sniffStats
+	accounting      bool
+	onConnClosed    func(pattern string, bytesIn, bytesOut int64, dur time.Duration)
+	pool            sync.Pool
 }
 
 // NewCMux create a new CMux.
 func NewCMux() *CMux {
 	p := &CMux{
-		trie:     trie.NewTrie(),
-		handlers: map[uint32]Handler{},
+		prefixes: map[string]*route{},
+		folds:    map[string]*route{},
 	}
-
+	p.rebuild()
 	return p
 }
 
-// NotFound handle the handler that unmatched
+// NotFound handle the handler that unmatched,
+// a handler that implements NotFoundHandler also receives the sniffed bytes.
 func (m *CMux) NotFound(handler Handler) error {
+	if err := noBudget("NotFound", handler); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
 	m.notFound = handler
+	m.rebuild()
 	return nil
 }
 
-// HandlePrefix handle the handler that matches the prefix
+// SetReadTimeout sets the maximum duration for sniffing the prefix of a connection, zero means no timeout.
+func (m *CMux) SetReadTimeout(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.readTimeout = d
+	m.rebuild()
+}
+
+// SetMaxSniffBytes sets the upper bound of the bytes buffered while matching, zero means no bound.
+// Reaching the bound decides with the best match so far.
+func (m *CMux) SetMaxSniffBytes(n int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.maxSniffBytes = n
+	m.rebuild()
+}
+
+// OnError sets the callback invoked before a connection is closed because it could not be dispatched,
+// err is a *NotFoundError, a *SniffError, an ErrInvalidProxyHeader, the error of writing the banner, ErrMuxClosed, ErrTooManyConns, ErrTooManySourceConns, ErrMisSpeculated, the error of an OnAccept hook or the error of the done context.
+func (m *CMux) OnError(fn func(conn net.Conn, err error)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onError = fn
+	m.rebuild()
+}
+
+// OnMatch sets the callback invoked once per dispatched connection before the handler runs,
+// pattern is the registration that won and is empty for the NotFound handler.
+// A panic in the callback is recovered and ignored.
+func (m *CMux) OnMatch(fn func(conn net.Conn, prefix []byte, pattern string, handler Handler)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onMatch = fn
+	m.rebuild()
+}
+
+// OnAccept appends a hook called with every connection before it is sniffed, the hooks run in the order
+// they were added and each one is given the conn returned by the previous one.
+// The returned conn is sniffed and served instead, an error closes the connection without dispatching it.
+func (m *CMux) OnAccept(fn func(conn net.Conn) (net.Conn, error)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onAccept = append(m.onAccept[:len(m.onAccept):len(m.onAccept)], fn)
+	m.rebuild()
+}
+
+// OnEmptyConn sets the callback invoked for a connection closed by the peer before sending any byte,
+// instead of the OnError callback. The connection is closed once the callback returns.
+func (m *CMux) OnEmptyConn(fn func(conn net.Conn)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onEmpty = fn
+	m.rebuild()
+}
+
+// HandlePrefix handle the handler that matches the prefix,
+// a prefix that is empty or already registered is rejected and nothing is registered.
+// A handler of WithBudget is dropped once its WithMaxWait is over.
 func (m *CMux) HandlePrefix(handler Handler, prefixes ...string) error {
 	if len(prefixes) == 0 {
 		return nil
 	}
-	buf := m.setHandler(handler)
+	handler, maxWait, _, err := prefixBudget(handler)
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	err = m.checkPrefixes(prefixes)
+	if err != nil {
+		return err
+	}
+	name := m.nameOf(handler)
+	for _, prefix := range prefixes {
+		m.prefixes[prefix] = &route{
+			pattern: prefix,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf(prefix),
+			maxWait: maxWait,
+		}
+	}
+	m.rebuild()
+	return nil
+}
+
+// HandlePrefixTerminal handle the handler that matches the prefix, the connection is dispatched
+// as soon as the prefix is read, the longer prefixes and the matchers are not waited for.
+func (m *CMux) HandlePrefixTerminal(handler Handler, prefixes ...string) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	handler, maxWait, _, err := prefixBudget(handler)
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	err = m.checkPrefixes(prefixes)
+	if err != nil {
+		return err
+	}
+	name := m.nameOf(handler)
+	for _, prefix := range prefixes {
+		m.prefixes[prefix] = &route{
+			pattern:  prefix,
+			name:     name,
+			handler:  handler,
+			counter:  m.counterOf(prefix),
+			terminal: true,
+			maxWait:  maxWait,
+		}
+	}
+	m.rebuild()
+	return nil
+}
+
+// HandlePrefixReplace handle the handler that matches the prefix in place of the registered one,
+// the previous handler is returned, nil if the prefix was not registered. The replacement keeps
+// the settings of the registration such as HandlePrefixTerminal, and its budget unless handler is of WithBudget.
+func (m *CMux) HandlePrefixReplace(handler Handler, prefix string) (Handler, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("empty prefix")
+	}
+	handler, maxWait, budgeted, err := prefixBudget(handler)
+	if err != nil {
+		return nil, err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var previous Handler
+	r := &route{
+		pattern: prefix,
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf(prefix),
+		maxWait: maxWait,
+	}
+	if old, ok := m.prefixes[prefix]; ok {
+		previous = old.handler
+		r.terminal = old.terminal
+		if !budgeted {
+			r.maxWait = old.maxWait
+		}
+	}
+	m.prefixes[prefix] = r
+	m.rebuild()
+	return previous, nil
+}
+
+// checkPrefixes returns the error for the first prefix that is empty, registered or repeated,
+// the caller must hold the lock.
+func (m *CMux) checkPrefixes(prefixes []string) error {
+	return checkNewPrefixes(prefixes, nil, func(prefix string) (string, bool) {
+		r, ok := m.prefixes[prefix]
+		if !ok {
+			return "", false
+		}
+		return r.name, true
+	})
+}
+
+// checkNewPrefixes returns the error for the first prefix that is empty, or whose key is registered or repeated.
+// key returns the key a prefix is registered with, the prefix itself if key is nil,
+// and registered the name of the handler of a registered key.
+func checkNewPrefixes(prefixes []string, key func(prefix string) string, registered func(key string) (name string, ok bool)) error {
+	if key == nil {
+		key = func(prefix string) string {
+			return prefix
+		}
+	}
+	for i, prefix := range prefixes {
+		if prefix == "" {
+			return fmt.Errorf("empty prefix")
+		}
+		k := key(prefix)
+		if name, ok := registered(k); ok {
+			return fmt.Errorf("prefix %q registered by %s: %w", prefix, name, ErrPrefixExists)
+		}
+		for _, p := range prefixes[:i] {
+			if key(p) == k {
+				return fmt.Errorf("prefix %q repeated: %w", prefix, ErrPrefixExists)
+			}
+		}
+	}
+	return nil
+}
+
+// RemovePrefix removes the handler that matches the prefix
+func (m *CMux) RemovePrefix(prefixes ...string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
 	for _, prefix := range prefixes {
-		m.handle(prefix, buf)
+		if _, ok := m.prefixes[prefix]; !ok {
+			return fmt.Errorf("prefix %q: %w", prefix, ErrNotFound)
+		}
 	}
+	for _, prefix := range prefixes {
+		delete(m.prefixes, prefix)
+	}
+	m.rebuild()
+	return nil
+}
+
+// Reset removes all the registered handlers
+func (m *CMux) Reset() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.prefixes = map[string]*route{}
+	m.restricted = nil
+	m.folds = map[string]*route{}
+	m.masks = nil
+	m.matchers = nil
+	m.alpn = nil
+	m.tlsDefault = nil
+	m.serverFirst = nil
+	m.defaultRoute = nil
+	m.origDst = nil
+	m.notFound = nil
+	m.rebuild()
+}
+
+// SetRoutes replaces the registered prefixes and the NotFound handler as a whole,
+// every connection is matched against either the old routes or the new ones.
+// The other registrations such as the matchers are kept. An empty prefix or a nil handler
+// rejects the update and leaves the routes untouched.
+func (m *CMux) SetRoutes(routes map[string]Handler, notFound Handler) error {
+	sorted := make([]string, 0, len(routes))
+	for prefix, handler := range routes {
+		if prefix == "" {
+			return fmt.Errorf("empty prefix")
+		}
+		if handler == nil {
+			return fmt.Errorf("prefix %q: nil handler", prefix)
+		}
+		if err := noBudget("SetRoutes", handler); err != nil {
+			return err
+		}
+		sorted = append(sorted, prefix)
+	}
+	if err := noBudget("SetRoutes", notFound); err != nil {
+		return err
+	}
+	sort.Strings(sorted)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	prefixes := make(map[string]*route, len(routes))
+	for _, prefix := range sorted {
+		handler := routes[prefix]
+		prefixes[prefix] = &route{
+			pattern: prefix,
+			name:    m.nameOf(handler),
+			handler: handler,
+			counter: m.counterOf(prefix),
+		}
+	}
+	m.prefixes = prefixes
+	m.notFound = notFound
+	m.rebuild()
 	return nil
 }
 
 // Handler returns most matching handler and prefix bytes data to use for the given reader.
 func (m *CMux) Handler(r io.Reader) (handler Handler, prefix []byte, err error) {
-	if m.prefixLength == 0 {
-		if m.notFound == nil {
-			return nil, nil, ErrNotFound
+	handler, _, prefix, err = m.load().resolve(r)
+	return handler, prefix, err
+}
+
+// MatchBytes returns the handler that b would be dispatched to without a connection, as Handler does,
+// with the registration that won and the number of the bytes of b needed to decide.
+// The pattern is empty for the NotFound handler.
+func (m *CMux) MatchBytes(b []byte) (handler Handler, pattern string, consumed int, err error) {
+	handler, pattern, prefix, err := m.load().resolve(&bytewiseReader{b: b})
+	return handler, pattern, len(prefix), err
+}
+
+// resolve sniffs r and returns the handler to serve it with, the NotFound handler when nothing matches.
+func (t *table) resolve(r io.Reader) (handler Handler, pattern string, prefix []byte, err error) {
+	matched, prefix, err := t.sniff(r, nil, nil, nil)
+	if err == ErrNotFound {
+		if t.notFound != nil {
+			return t.notFound, "", prefix, nil
 		}
-		return m.notFound, nil, nil
+		return nil, "", prefix, &NotFoundError{Prefix: prefix}
 	}
-	parent := m.trie.Mapping()
-	off := 0
-	prefix = make([]byte, m.prefixLength)
+	if err != nil {
+		return nil, "", prefix, err
+	}
+	return matched.handler, matched.pattern, prefix, nil
+}
+
+// bytewiseReader returns b one byte per read, so that the sniffing stops at the first byte that decides.
+type bytewiseReader struct {
+	b []byte
+}
+
+func (r *bytewiseReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.b[0]
+	r.b = r.b[1:]
+	return 1, nil
+}
+
+// maxEmptyReads is the number of consecutive reads returning no bytes and no error before the sniffing fails.
+const maxEmptyReads = 100
+
+// sniff reads the prefix of r and returns the most matching route, addr and local are the source
+// and the local address of r if known and the restricted prefixes are only considered with them.
+// It returns ErrNotFound with the bytes read when nothing matches.
+func (t *table) sniff(r io.Reader, addr, local net.Addr, clock *sniffClock) (matched *route, prefix []byte, err error) {
+	if t.sniffLength == 0 && t.growLength == 0 {
+		return nil, nil, ErrNotFound
+	}
+	var skip *skipReader
+	if t.skipMax > 0 {
+		skip = &skipReader{r: r, cutset: t.skipCutset, left: t.skipMax}
+		r = skip
+	}
+	pooled := t.pool.Get().(*[]byte)
+	defer t.pool.Put(pooled)
+	var s sniffState
+	s.init(t, addr, local, *pooled)
+	if clock != nil {
+		s.start = clock.start
+		defer clock.disarm()
+	}
+	empty := 0
 	for {
-		i, err := r.Read(prefix[off:])
+		clock.arm(s.elapsed())
+		i, err := r.Read(s.buf[s.off:])
+		if err != nil && clock.woke(err) {
+			// a budget passed, the registrations out of time are dropped
+			if (i != 0 && s.add(i)) || s.expire() {
+				break
+			}
+			continue
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			// a TLS connection that stalls before its ClientHello is complete still goes to the TLS default
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || t.tlsDefault == nil || !looksLikeTLS(s.buf[:s.off+i]) {
+				return nil, nil, err
+			}
+			s.off += i
+			break
+		}
+		if i != 0 && s.add(i) {
+			break
+		}
+
+		// EOF ends the sniffing, the bytes read so far still decide the handler
 		if err != nil {
-			return nil, nil, err
+			if s.off == 0 {
+				return nil, nil, err
+			}
+			break
 		}
-		if i == 0 {
+		if s.step() {
 			break
 		}
+		if i == 0 {
+			// a reader may transiently return no bytes and no error, only give up when it keeps doing so
+			empty++
+			if empty == maxEmptyReads {
+				return nil, nil, io.ErrNoProgress
+			}
+		} else {
+			empty = 0
+		}
+	}
+	matched = s.result()
+
+	// the pooled buffer is reused by the next connection, hand out a copy
+	prefix = make([]byte, s.off)
+	copy(prefix, s.buf)
+	if skip != nil && t.skipReplay && len(skip.skipped) != 0 {
+		prefix = append(skip.skipped, prefix...)
+	}
+	if matched == nil || matched.excluded {
+		return nil, prefix, ErrNotFound
+	}
+	return matched, prefix, nil
+}
+
+func (m *CMux) load() *table {
+	return m.table.Load().(*table)
+}
 
-		data, next, _ := parent.Get(prefix[off : off+i])
-		if len(data) != 0 {
-			conn, ok := m.getHandler(data)
-			if ok {
-				handler = conn
+// rebuild recreates the table from the registered prefixes and publishes it,
+// the caller must hold the lock.
+func (m *CMux) rebuild() {
+	t := &table{
+		prefixes:        make(map[string]*route, len(m.prefixes)),
+		alpn:            m.alpn,
+		tlsDefault:      m.tlsDefault,
+		responderNext:   m.responderNext,
+		first:           m.strategy == MatchFirst,
+		serverFirst:     m.serverFirst,
+		serverFirstWait: m.serverFirstWait,
+		defaultRoute:    m.defaultRoute,
+		origDst:         m.origDst,
+		origDstSniff:    m.origDstSniff,
+		banner:          m.banner,
+		bannerDelay:     m.bannerDelay,
+		middlewares:     m.middlewares,
+		allowNonIP:      m.allowNonIP,
+		skipCutset:      m.skipCutset,
+		skipMax:         m.skipMax,
+		maxSniffBytes:   m.maxSniffBytes,
+		readTimeout:     m.readTimeout,
+		idleTimeout:     m.idleTimeout,
+		connBudget:      m.connBudget,
+		skipReplay:      m.skipReplay,
+		notFound:        m.notFound,
+		notFoundPolicy:  m.notFoundPolicy,
+		proxyProtocol:   m.proxyProtocol,
+		onError:         m.onError,
+		onMatch:         m.onMatch,
+		onAccept:        m.onAccept,
+		onEmpty:         m.onEmpty,
+		onPanic:         m.onPanic,
+		logger:          m.logger,
+		slots:           m.slots,
+		slotWait:        m.slotWait,
+		onSniffStart:    m.onSniffStart,
+		onSniffDone:     m.onSniffDone,
+		sniffStats:      m.sniffStats,
+		accounting:      m.accounting,
+		onConnClosed:    m.onConnClosed,
+	}
+	for prefix, r := range m.prefixes {
+		t.prefixes[prefix] = r
+		if t.exactLength < len(prefix) {
+			t.exactLength = len(prefix)
+		}
+		if _, ok := r.handler.(*stripHandler); ok {
+			t.strip = true
+		}
+	}
+	t.restricted = m.restricted
+	for prefix := range m.restricted {
+		if t.exactLength < len(prefix) {
+			t.exactLength = len(prefix)
+		}
+	}
+	t.prefixLength = t.exactLength
+	t.sorted = make([]string, 0, len(t.prefixes)+len(t.restricted))
+	for prefix := range t.prefixes {
+		t.sorted = append(t.sorted, prefix)
+	}
+	for prefix := range t.restricted {
+		if _, ok := t.prefixes[prefix]; !ok {
+			t.sorted = append(t.sorted, prefix)
+		}
+	}
+	sort.Strings(t.sorted)
+	t.folds = make(map[string]*route, len(m.folds))
+	t.foldSorted = make([]string, 0, len(m.folds))
+	for prefix, r := range m.folds {
+		t.folds[prefix] = r
+		t.foldSorted = append(t.foldSorted, prefix)
+		if t.foldLength < len(prefix) {
+			t.foldLength = len(prefix)
+		}
+	}
+	sort.Strings(t.foldSorted)
+	if t.prefixLength < t.foldLength {
+		t.prefixLength = t.foldLength
+	}
+	t.masks = make([]*maskRoute, len(m.masks))
+	copy(t.masks, m.masks)
+	for _, mr := range t.masks {
+		if t.prefixLength < len(mr.value) {
+			t.prefixLength = len(mr.value)
+		}
+	}
+	t.buildFirst()
+	t.sniffLength = t.prefixLength
+	t.matchers = make([]*matcherRoute, len(m.matchers))
+	copy(t.matchers, m.matchers)
+	// the higher priorities first, the registrations of a priority keep their order
+	sort.SliceStable(t.matchers, func(i, j int) bool {
+		return t.matchers[i].priority > t.matchers[j].priority
+	})
+	t.buildWaits()
+	for _, mr := range t.matchers {
+		if _, ok := mr.more.(grpcMatcher); ok {
+			t.http2Preface = true
+		}
+		if mr.more != nil {
+			if t.growLength < mr.maxBytes {
+				t.growLength = mr.maxBytes
 			}
+		} else if t.sniffLength < mr.maxBytes {
+			t.sniffLength = mr.maxBytes
 		}
+	}
+	if m.maxSniffBytes > 0 && t.sniffLength > m.maxSniffBytes {
+		t.sniffLength = m.maxSniffBytes
+	}
+	if m.maxSniffBytes > 0 && t.growLength > m.maxSniffBytes {
+		t.growLength = m.maxSniffBytes
+	}
+	// the buffer starts small for the MoreMatchers and is grown up to growLength as they ask
+	if t.growLength <= t.sniffLength {
+		t.growLength = 0
+	} else if t.sniffLength < initialGrowLength {
+		t.sniffLength = initialGrowLength
+		if t.sniffLength > t.growLength {
+			t.sniffLength = t.growLength
+		}
+	}
+	// the default route needs a byte to tell the connection from an empty one
+	if t.sniffLength == 0 && t.defaultRoute != nil {
+		t.sniffLength = 1
+	}
+	// and the TLS default the header of a record
+	if t.sniffLength < 3 && t.tlsDefault != nil {
+		t.sniffLength = 3
+	}
+	sniffLength := t.sniffLength
+	t.pool.New = func() interface{} {
+		buf := make([]byte, sniffLength)
+		return &buf
+	}
+	m.table.Store(t)
+}
 
-		off += i
-		if next == nil {
-			break
+// canExtend reports whether a prefix of sorted longer than b starts with b,
+// that is whether reading more bytes may still change the prefix match.
+func canExtend(sorted []string, b []byte) bool {
+	i := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i] >= string(b)
+	})
+	for ; i < len(sorted); i++ {
+		p := sorted[i]
+		if len(p) < len(b) || p[:len(b)] != string(b) {
+			return false
+		}
+		if len(p) > len(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// canExtendFor is like canExtend, but it leaves out the restricted prefixes that addr and local
+// can never match and the prefixes out of time elapsed since the sniffing started,
+// the connection stops being sniffed as soon as only those are left.
+func (t *table) canExtendFor(b []byte, addr, local net.Addr, elapsed time.Duration) bool {
+	if len(t.restricted) == 0 && len(t.waits) == 0 {
+		return canExtend(t.sorted, b)
+	}
+	i := sort.Search(len(t.sorted), func(i int) bool {
+		return t.sorted[i] >= string(b)
+	})
+	for ; i < len(t.sorted); i++ {
+		p := t.sorted[i]
+		if len(p) < len(b) || p[:len(b)] != string(b) {
+			return false
+		}
+		if len(p) > len(b) && t.reachable(p, addr, local, elapsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable reports whether the prefix p may still match a connection of addr and local elapsed since it started.
+func (t *table) reachable(p string, addr, local net.Addr, elapsed time.Duration) bool {
+	if r, ok := t.prefixes[p]; ok && r.live(elapsed) {
+		return true
+	}
+	if addr == nil && local == nil {
+		return false
+	}
+	for _, r := range t.restricted[p] {
+		if t.allow(r, addr, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPrefix returns the route of the longest prefix of b in prefixes that is longer than from bytes
+// and still live elapsed since the sniffing started, or best if there is none, maxLength bounds the lengths that are looked up.
+// With first the shortest such prefix is returned instead, a terminal prefix is returned as soon as it is found.
+func lookupPrefix(prefixes map[string]*route, b []byte, from, maxLength int, best *route, first bool, elapsed time.Duration) *route {
+	if len(b) < maxLength {
+		maxLength = len(b)
+	}
+	for n := from + 1; n <= maxLength; n++ {
+		if r, ok := prefixes[string(b[:n])]; ok && r.live(elapsed) {
+			best = r
+			if first || r.terminal {
+				break
+			}
 		}
-		parent = next
 	}
+	return best
+}
 
-	if handler == nil {
-		if m.notFound == nil {
-			return nil, prefix[:off], ErrNotFound
+// longestRoute returns the route of the longest prefix, the earlier one on a tie.
+func longestRoute(routes ...*route) *route {
+	var longest *route
+	for _, r := range routes {
+		if r != nil && (longest == nil || len(r.pattern) > len(longest.pattern)) {
+			longest = r
 		}
-		handler = m.notFound
 	}
-	return handler, prefix[:off], nil
+	return longest
 }
 
-func (m *CMux) handle(prefix string, buf []byte) {
-	m.trie.Put([]byte(prefix), buf)
-	if m.prefixLength < len(prefix) {
-		m.prefixLength = len(prefix)
+// Match returns a net.Listener that accepts the connections matching the prefixes.
+// If the prefixes cannot be registered, such as when one is already registered, the listener is closed
+// and Accept returns the error of the registration.
+func (m *CMux) Match(prefixes ...string) net.Listener {
+	l := newMatchListener(m)
+	if err := m.HandlePrefix(l, prefixes...); err != nil {
+		l.closeWithError(err)
 	}
+	return l
+}
+
+func (m *CMux) serveNotFound(conn net.Conn) {
+	_, prefix := UnwrapUnreadConn(conn)
+	m.load().serveNotFound(conn, prefix)
 }
 
-func (m *CMux) setHandler(hand Handler) []byte {
-	k := atomic.AddUint32(&m.size, 1)
-	m.handlers[k] = hand
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, k)
-	return buf
+func (t *table) serveNotFound(conn net.Conn, prefix []byte) {
+	t.serveNotFoundContext(context.Background(), conn, prefix)
 }
 
-func (m *CMux) getHandler(index []byte) (Handler, bool) {
-	c, ok := m.handlers[binary.BigEndian.Uint32(index)]
-	return c, ok
+func (t *table) serveNotFoundContext(ctx context.Context, conn net.Conn, prefix []byte) {
+	switch h := t.notFound.(type) {
+	case nil:
+		conn.Close()
+	case NotFoundHandler:
+		h.ServeNotFound(conn, prefix)
+	default:
+		serveHandler(ctx, h, conn)
+	}
+}
+
+func serveHandler(ctx context.Context, h Handler, conn net.Conn) {
+	if ch, ok := h.(ContextHandler); ok {
+		ch.ServeConnContext(ctx, conn)
+		return
+	}
+	h.ServeConn(conn)
 }
 
 // ServeConn dispatches the reader to the handler whose pattern most closely matches the reader.
 func (m *CMux) ServeConn(conn net.Conn) {
-	connector, buf, err := m.Handler(conn)
-	if err != nil {
+	m.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext is like ServeConn, cancelling the ctx aborts the sniffing,
+// the handler that implements ContextHandler is served with the ctx.
+func (m *CMux) ServeConnContext(ctx context.Context, conn net.Conn) {
+	t := m.load()
+	conn, err := m.dispatch(ctx, t, conn)
+	if err == ErrEmptyConn {
+		if t.onEmpty != nil {
+			t.onEmpty(conn)
+		}
 		conn.Close()
 		return
 	}
-	conn = UnreadConn(conn, buf)
-	connector.ServeConn(conn)
+	if errors.Is(err, ErrNotFound) && t.notFoundPolicy.handler != nil {
+		if t.onError != nil {
+			t.onError(conn, err)
+		}
+		t.notFoundPolicy.handler.ServeConn(conn)
+		return
+	}
+	if err != nil {
+		t.closeWithError(conn, err)
+	}
+}
+
+// DispatchConn is like ServeConn, but it returns the error that kept conn from being dispatched
+// instead of closing conn, the bytes sniffed from a conn that is not found are consumed.
+func (m *CMux) DispatchConn(conn net.Conn) error {
+	return m.DispatchConnContext(context.Background(), conn)
+}
+
+// DispatchConnContext is like DispatchConn, cancelling the ctx aborts the sniffing.
+func (m *CMux) DispatchConnContext(ctx context.Context, conn net.Conn) error {
+	_, err := m.dispatch(ctx, m.load(), conn)
+	return err
+}
+
+// dispatch serves conn with the matching handler and returns once the handler is done,
+// on error conn is returned as wrapped during the sniffing and the read deadline is cleared.
+// The whole dispatching of conn uses the settings and the routes of t.
+func (m *CMux) dispatch(ctx context.Context, t *table, conn net.Conn) (net.Conn, error) {
+	for _, fn := range t.onAccept {
+		c, err := fn(conn)
+		if err != nil {
+			atomic.AddUint64(&m.errors, 1)
+			t.log(EventError, conn, "", 0, 0, err)
+			return conn, err
+		}
+		conn = c
+	}
+	conn = withMeta(ctx, conn)
+	conn = withDepth(ctx, conn)
+	t.log(EventAccepted, conn, "", 0, 0, nil)
+	conn, err := m.dispatchConn(ctx, t, conn)
+	if err != nil && !errors.Is(err, ErrNotFound) && err != ErrEmptyConn {
+		atomic.AddUint64(&m.errors, 1)
+		t.log(EventError, conn, "", 0, 0, err)
+	}
+	return conn, err
+}
+
+func (m *CMux) dispatchConn(ctx context.Context, t *table, conn net.Conn) (net.Conn, error) {
+	if !m.conns.add(conn) {
+		return conn, ErrMuxClosed
+	}
+	defer m.conns.remove(conn)
+	// a redispatched connection already holds its slot
+	redispatch := isRedispatch(ctx)
+	if l := m.loadSources(); l != nil && !redispatch {
+		key, ok := l.acquire(conn.RemoteAddr())
+		if !ok {
+			atomic.AddUint64(&m.sourceRejected, 1)
+			return conn, ErrTooManySourceConns
+		}
+		defer l.release(key)
+	}
+	if slots := t.slots; slots != nil && !redispatch {
+		if !t.acquire() {
+			atomic.AddUint64(&m.rejected, 1)
+			return conn, ErrTooManyConns
+		}
+		defer func() {
+			<-slots
+		}()
+	}
+	if !redispatch {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+	}
+	start := time.Now()
+	cache := m.loadMatchCache()
+	if cache != nil && !redispatch {
+		if t.canSpeculate() {
+			c, matched := m.speculate(cache, t, conn)
+			if matched != nil {
+				atomic.AddUint64(&m.speculated, 1)
+				conn = withMeta(ctx, c)
+				return m.serveMatched(ctx, t, conn, matched, nil, start, 0)
+			}
+		}
+	}
+	if t.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
+	fb := t.sniffTimer(conn)
+	stop := watchContext(ctx, conn)
+	conn, matched, buf, err := m.sniffConn(ctx, t, conn, fb)
+	if fb != nil {
+		t.sniffDone(conn, start, fb, matched, buf, err)
+	}
+	// the conn may be wrapped again by the PROXY protocol
+	conn = withMeta(ctx, conn)
+	sniffed := time.Since(start)
+	if stop() {
+		conn.SetReadDeadline(time.Time{})
+		return withTiming(conn, start, sniffed), ctx.Err()
+	}
+	if t.readTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil && err != ErrNotFound {
+		return withTiming(conn, start, sniffed), err
+	}
+	if err == ErrNotFound {
+		conn = withTiming(NewUnreadConn(conn, buf), start, sniffed)
+		atomic.AddUint64(&m.notFounds, 1)
+		m.captureUnmatched(conn, buf)
+		t.log(EventNotFound, conn, "", len(buf), time.Since(start), nil)
+		if t.notFound == nil {
+			return conn, &NotFoundError{Prefix: buf}
+		}
+		conn = withMatch(conn, "", buf)
+		t.account(conn, "", nil)
+		conn = t.watchIdle(conn, &m.idleClosed)
+		t.matched(conn, buf, "", t.notFound)
+		start = time.Now()
+		ctx, cancel := t.withBudget(ctx, conn)
+		defer cancel()
+		t.serve(ctx, t.chain(&notFoundServer{t: t, prefix: buf}), conn)
+		t.log(EventDone, conn, "", len(buf), time.Since(start), nil)
+		return conn, nil
+	}
+	// the responders are answered from the sniffed bytes, they are not cached
+	if rh, ok := matched.handler.(*responderHandler); ok {
+		return m.respond(ctx, t, conn, matched, rh, buf, start, sniffed)
+	}
+	if cache != nil && !redispatch && len(buf) != 0 && t.canSpeculate() {
+		if key := cacheKey(conn.RemoteAddr()); key != "" {
+			cache.put(key, t, matched)
+		}
+	}
+	return m.serveMatched(ctx, t, conn, matched, buf, start, sniffed)
+}
+
+// serveMatched serves conn with the handler of matched, buf is the sniffed bytes replayed to it.
+func (m *CMux) serveMatched(ctx context.Context, t *table, conn net.Conn, matched *route, buf []byte, start time.Time, sniffed time.Duration) (net.Conn, error) {
+	conn = withTiming(NewUnreadConn(conn, buf), start, sniffed)
+	t.log(EventMatched, conn, matched.pattern, len(buf), time.Since(start), nil)
+	if c := matched.counter; c != nil {
+		atomic.AddUint64(&c.matched, 1)
+	}
+	return m.serveRoute(ctx, t, conn, matched, buf, true)
+}
+
+// serveRoute serves conn recorded by withTiming with the handler of matched, the match hook is called if hook.
+func (m *CMux) serveRoute(ctx context.Context, t *table, conn net.Conn, matched *route, buf []byte, hook bool) (net.Conn, error) {
+	if c := matched.counter; c != nil {
+		atomic.AddInt64(&c.active, 1)
+		defer atomic.AddInt64(&c.active, -1)
+	}
+	conn = withMatch(conn, matched.pattern, buf)
+	t.account(conn, matched.pattern, matched.counter)
+	conn = t.watchIdle(conn, &m.idleClosed)
+	if hook {
+		t.matched(conn, buf, matched.pattern, matched.handler)
+	}
+	start := time.Now()
+	ctx, cancel := t.withBudget(ctx, conn)
+	defer cancel()
+	t.serve(ctx, t.chain(matched.handler), conn)
+	t.log(EventDone, conn, matched.pattern, len(buf), time.Since(start), nil)
+	return conn, nil
+}
+
+// matched calls the match hook, a panic in the hook is recovered so that it cannot break the dispatching.
+func (t *table) matched(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+	if t.onMatch == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	t.onMatch(conn, prefix, pattern, handler)
+}
+
+// sniffConn routes a TLS connection by its negotiated ALPN protocol if there are such routes,
+// otherwise it consumes the PROXY protocol header if enabled and sniffs the prefix of conn.
+func (m *CMux) sniffConn(ctx context.Context, t *table, conn net.Conn, fb *firstByte) (net.Conn, *route, []byte, error) {
+	var dst *route
+	if len(t.origDst) != 0 && !t.proxyProtocol {
+		conn, dst = m.originalDst(t, conn)
+		if dst != nil && !t.origDstSniff {
+			return conn, dst, nil, nil
+		}
+	}
+	if len(t.banner) != 0 && !t.proxyProtocol {
+		c, err := t.greet(conn)
+		if err != nil {
+			return c, nil, nil, err
+		}
+		conn = c
+	}
+	if t.serverFirst != nil && !t.proxyProtocol {
+		c, matched, err := t.awaitClient(conn)
+		if err != nil || matched != nil {
+			return c, matched, nil, err
+		}
+		conn = c
+	}
+	if len(t.alpn) != 0 {
+		matched, err := t.matchALPN(conn)
+		if err != nil {
+			return conn, nil, nil, err
+		}
+		if matched != nil {
+			return conn, matched, nil, nil
+		}
+	}
+	if t.proxyProtocol {
+		c, err := readProxyProtocol(conn)
+		if err == io.EOF {
+			return conn, nil, nil, ErrEmptyConn
+		}
+		if err != nil {
+			return conn, nil, nil, err
+		}
+		conn = c
+		// the client speaks after the header of the proxy
+		if len(t.banner) != 0 {
+			c, err := t.greet(conn)
+			if err != nil {
+				return c, nil, nil, err
+			}
+			conn = c
+		}
+		if t.serverFirst != nil {
+			c, matched, err := t.awaitClient(conn)
+			if err != nil || matched != nil {
+				return c, matched, nil, err
+			}
+			conn = c
+		}
+	}
+	if t.http2Preface {
+		conn = &http2PrefaceConn{Conn: conn}
+	}
+	matched, buf, err := t.sniff(fb.reader(conn), conn.RemoteAddr(), conn.LocalAddr(), t.sniffClock(ctx, conn))
+	if err == io.EOF {
+		return conn, nil, nil, ErrEmptyConn
+	}
+	if err != nil && err != ErrNotFound {
+		return conn, nil, nil, &SniffError{Err: err}
+	}
+	if err == ErrNotFound && dst != nil {
+		return conn, dst, buf, nil
+	}
+	return conn, matched, buf, err
+}
+
+// aLongTimeAgo is a deadline in the past that makes the blocked Read return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext aborts the reads on conn when ctx is done, stop ends the watching
+// and reports whether ctx was done.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool {
+			return false
+		}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-exited
+		return ctx.Err() != nil
+	}
+}
+
+func (t *table) closeWithError(conn net.Conn, err error) {
+	if t.onError != nil {
+		t.onError(conn, err)
+	}
+	conn.Close()
 }
@@ -0,0 +1,1534 @@
+package cmux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// servePipe serves the server end of a pipe with mux and returns the client end.
+func servePipe(mux *CMux) net.Conn {
+	client, server := net.Pipe()
+	go mux.ServeConn(server)
+	return client
+}
+
+// connChan returns a handler sending the connections it is served to ch, the connections are left open.
+func connChan() (Handler, chan net.Conn) {
+	ch := make(chan net.Conn, 16)
+	return HandlerFunc(func(conn net.Conn) {
+		ch <- conn
+	}), ch
+}
+
+// recvConn returns the next connection of ch.
+func recvConn(t testing.TB, ch chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-ch:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection was dispatched")
+		return nil
+	}
+}
+
+// noConn fails if ch receives a connection within a while.
+func noConn(t testing.TB, ch chan net.Conn) {
+	t.Helper()
+	select {
+	case conn := <-ch:
+		t.Fatalf("unexpected connection from %v", conn.RemoteAddr())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// readN reads n bytes from conn, failing after a while.
+func readN(t testing.TB, conn net.Conn, n int) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, n)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf)
+}
+
+func TestReadTimeoutSilentClient(t *testing.T) {
+	mux := NewCMux()
+	mux.SetReadTimeout(50 * time.Millisecond)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "ping")
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+
+	client := servePipe(mux)
+	defer client.Close()
+	select {
+	case err := <-errc:
+		var se *SniffError
+		if !errors.As(err, &se) || !se.Timeout() {
+			t.Fatalf("OnError got %v, want a timed out *SniffError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the silent client was not timed out")
+	}
+	// the connection is closed
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the timed out connection: %v, want io.EOF", err)
+	}
+	noConn(t, ch)
+}
+
+func TestReadTimeoutSlowClient(t *testing.T) {
+	mux := NewCMux()
+	mux.SetReadTimeout(time.Second)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "ping")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go func() {
+		for _, b := range []byte("ping") {
+			time.Sleep(20 * time.Millisecond)
+			client.Write([]byte{b})
+		}
+	}()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 4); got != "ping" {
+		t.Fatalf("handler read %q", got)
+	}
+}
+
+func TestReadTimeoutClearedBeforeHandler(t *testing.T) {
+	mux := NewCMux()
+	mux.SetReadTimeout(30 * time.Millisecond)
+	got := make(chan error, 1)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		// well past the read timeout of the sniffing
+		time.Sleep(100 * time.Millisecond)
+		buf := make([]byte, 8)
+		_, err := io.ReadFull(conn, buf)
+		got <- err
+	}), "ping")
+
+	client := servePipe(mux)
+	defer client.Close()
+	client.Write([]byte("ping"))
+	time.Sleep(60 * time.Millisecond)
+	client.Write([]byte("pong"))
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatalf("handler read: %v, want the deadline of the sniffing cleared", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler did not complete its read")
+	}
+}
+
+func TestSetReadTimeoutWhileServing(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), "ping")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mux.SetReadTimeout(time.Duration(i%3) * time.Second)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		client := servePipe(mux)
+		client.Write([]byte("ping"))
+		client.Close()
+	}
+	<-done
+}
+
+// serveTCP serves one accepted TCP connection with mux and returns the client end of it.
+func serveTCP(t testing.TB, mux *CMux) *net.TCPConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mux.ServeConn(server)
+	return client.(*net.TCPConn)
+}
+
+// listenMux serves mux on a TCP listener closed once the test is over, it returns the address to dial.
+func listenMux(t testing.TB, mux *CMux) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go mux.Serve(l)
+	return l.Addr().String()
+}
+
+func TestEOFAfterMatch(t *testing.T) {
+	mux := NewCMux()
+	served := make(chan string, 1)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		conn.Write([]byte("ok"))
+		served <- string(b)
+	}), "GET ")
+	// a longer prefix keeps the sniffing waiting for more bytes
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), "GET / HTTP/1.0\r\n\r\nmore")
+
+	client := serveTCP(t, mux)
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	client.CloseWrite()
+	select {
+	case got := <-served:
+		if got != "GET / HTTP/1.0\r\n\r\n" {
+			t.Fatalf("handler read %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection half closed after the match was dropped")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, _ := io.ReadAll(client); string(b) != "ok" {
+		t.Fatalf("client read %q, want the response of the handler", b)
+	}
+}
+
+func TestEOFAfterMatchPipe(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "GET ")
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), "GET /long")
+
+	client := servePipe(mux)
+	client.Write([]byte("GET /"))
+	client.Close()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	_, prefix := UnwrapUnreadConn(conn)
+	if string(prefix) != "GET /" {
+		t.Fatalf("UnreadConn holds %q, want the buffered bytes", prefix)
+	}
+	if b, _ := io.ReadAll(conn); string(b) != "GET /" {
+		t.Fatalf("handler read %q", b)
+	}
+}
+
+func TestEOFWithoutBytes(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "GET ")
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	empty := make(chan struct{}, 1)
+	mux.OnEmptyConn(func(conn net.Conn) {
+		empty <- struct{}{}
+	})
+
+	client := servePipe(mux)
+	client.Close()
+	select {
+	case <-empty:
+	case err := <-errc:
+		t.Fatalf("OnError got %v for a connection without bytes", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the empty connection was not reported")
+	}
+	noConn(t, ch)
+}
+
+func TestEOFAfterOneByte(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	empty := make(chan struct{}, 1)
+	mux.OnEmptyConn(func(conn net.Conn) {
+		empty <- struct{}{}
+	})
+
+	client := servePipe(mux)
+	go func() {
+		client.Write([]byte("X"))
+		client.Close()
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("OnError got %v, want ErrNotFound", err)
+		}
+	case <-empty:
+		t.Fatal("a connection with one byte was reported as empty")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not reported")
+	}
+}
+
+func TestEmptyConnRemoteAddr(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	remote := make(chan net.Addr, 1)
+	mux.OnEmptyConn(func(conn net.Conn) {
+		remote <- conn.RemoteAddr()
+	})
+	client := serveTCP(t, mux)
+	local := client.LocalAddr().String()
+	client.Close()
+	select {
+	case addr := <-remote:
+		if addr == nil || addr.String() != local {
+			t.Fatalf("OnEmptyConn saw the remote address %v, want %s", addr, local)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the empty connection was not reported")
+	}
+}
+
+// handlerID is a handler telling which registration served a connection.
+type handlerID string
+
+func (h handlerID) ServeConn(conn net.Conn) {
+	conn.Close()
+}
+
+// matchOf returns the id of the handler that b is dispatched to, "" if nothing matches.
+func matchOf(t testing.TB, mux *CMux, b string) string {
+	t.Helper()
+	h, _, err := mux.Handler(&bytewiseReader{b: []byte(b)})
+	if errors.Is(err, ErrNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("Handler(%q): %v", b, err)
+	}
+	id, ok := h.(handlerID)
+	if !ok {
+		t.Fatalf("Handler(%q) returned %T", b, h)
+	}
+	return string(id)
+}
+
+func TestHandlePrefixTerminal(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixTerminal(handlerID("ping"), "PING\n")
+	mux.HandlePrefix(handlerID("longer"), "PING\nPONG")
+	mux.HandleMatcher(handlerID("matcher"), MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) < 12 {
+			return false, true
+		}
+		return strings.HasPrefix(string(b), "PING"), false
+	}), 12)
+
+	h, pattern, consumed, err := mux.MatchBytes([]byte("PING\nPONG and more"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != handlerID("ping") || pattern != "PING\n" || consumed != 5 {
+		t.Fatalf("matched %v %q after %d bytes, want the terminal prefix after 5", h, pattern, consumed)
+	}
+	// the others still match what the terminal prefix does not
+	if got := matchOf(t, mux, "PING PONG!!!"); got != "matcher" {
+		t.Fatalf("matched %q, want the matcher", got)
+	}
+}
+
+func TestHandlePrefixTerminalDoesNotWait(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefixTerminal(h, "PING\n")
+	mux.HandlePrefix(handlerID("longer"), "PING\nPONG")
+	client := servePipe(mux)
+	defer client.Close()
+	// the client waits for the answer before sending anything else
+	go client.Write([]byte("PING\n"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 5); got != "PING\n" {
+		t.Fatalf("the terminal handler read %q", got)
+	}
+}
+
+// recordingConn records the bytes read through it.
+type recordingConn struct {
+	net.Conn
+	mut  sync.Mutex
+	read []byte
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mut.Lock()
+	c.read = append(c.read, p[:n]...)
+	c.mut.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) bytes() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return string(c.read)
+}
+
+func TestOnAcceptWrapsConn(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	wrapped := make(chan *recordingConn, 1)
+	mux.OnAccept(func(conn net.Conn) (net.Conn, error) {
+		rc := &recordingConn{Conn: conn}
+		wrapped <- rc
+		return rc, nil
+	})
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Fatalf("the handler read %q", got)
+	}
+	if got := (<-wrapped).bytes(); got != "SSH-2.0-x" {
+		t.Fatalf("the wrapping conn saw %q, want the sniffed and the handler reads", got)
+	}
+}
+
+func TestOnAcceptOrder(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	var order []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		mux.OnAccept(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, name)
+			return conn, nil
+		})
+	}
+	mux.DispatchConn(newMemConn([]byte("SSH-")))
+	if got := strings.Join(order, ""); got != "abc" {
+		t.Fatalf("the hooks ran in the order %q, want abc", got)
+	}
+}
+
+func TestOnAcceptError(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	later := false
+	mux.OnAccept(func(conn net.Conn) (net.Conn, error) {
+		return nil, errors.New("refused")
+	})
+	mux.OnAccept(func(conn net.Conn) (net.Conn, error) {
+		later = true
+		return conn, nil
+	})
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-"))
+	if err := readErr(t, client); err != io.EOF && !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("the refused conn read %v, want it closed", err)
+	}
+	noConn(t, ch)
+	if later {
+		t.Fatal("the hook after the failing one was called")
+	}
+}
+
+func TestMatchBytes(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ")
+	for _, tc := range []struct {
+		b        string
+		want     string
+		pattern  string
+		consumed int
+	}{
+		{"SSH-2.0-OpenSSH", "ssh2", "SSH-2.0-", 8},
+		{"SSH-1.99-x", "ssh", "SSH-", 5},
+		{"SSH-", "ssh", "SSH-", 4},
+		{"POST /x", "http", "POST ", 5},
+		{"GET", "", "", 3},
+		{"PUT /", "", "", 2},
+	} {
+		h, pattern, consumed, err := mux.MatchBytes([]byte(tc.b))
+		if tc.want == "" {
+			if !errors.Is(err, ErrNotFound) || h != nil || consumed != tc.consumed {
+				t.Errorf("MatchBytes(%q) = %v, %q, %d, %v, want ErrNotFound after %d bytes", tc.b, h, pattern, consumed, err, tc.consumed)
+			}
+			continue
+		}
+		if err != nil || h != handlerID(tc.want) || pattern != tc.pattern || consumed != tc.consumed {
+			t.Errorf("MatchBytes(%q) = %v, %q, %d, %v, want %s, %q, %d", tc.b, h, pattern, consumed, err, tc.want, tc.pattern, tc.consumed)
+		}
+		// Handler agrees on the same bytes
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("Handler(%q) matched %q, MatchBytes %q", tc.b, got, tc.want)
+		}
+	}
+
+	mux.NotFound(handlerID("nf"))
+	h, pattern, _, err := mux.MatchBytes([]byte("PUT /"))
+	if err != nil || h != handlerID("nf") || pattern != "" {
+		t.Fatalf("MatchBytes with a NotFound handler = %v, %q, %v", h, pattern, err)
+	}
+}
+
+func TestHandlePrefixDuplicate(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandlePrefix(handlerID("a"), "GET "); err != nil {
+		t.Fatal(err)
+	}
+	err := mux.HandlePrefix(handlerID("b"), "POST ", "GET ")
+	if !errors.Is(err, ErrPrefixExists) || !strings.Contains(err.Error(), `"GET "`) {
+		t.Fatalf("the duplicate registration returned %v, want ErrPrefixExists naming the prefix", err)
+	}
+	// nothing of the failing call is registered
+	if got := mux.Prefixes(); len(got) != 1 || got[0] != "GET " {
+		t.Fatalf("Prefixes after the duplicate = %q", got)
+	}
+	if got := matchOf(t, mux, "GET /"); got != "a" {
+		t.Fatalf("matched %q, want the first registration", got)
+	}
+	if err := mux.HandlePrefix(handlerID("c"), "PUT ", "PUT "); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("a prefix repeated in a call returned %v, want ErrPrefixExists", err)
+	}
+	if err := mux.HandlePrefix(handlerID("d"), ""); err == nil || errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("the empty prefix returned %v", err)
+	}
+}
+
+func TestHandlePrefixDistinctLengths(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandlePrefix(handlerID("get"), "GET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.HandlePrefix(handlerID("get-space"), "GET "); err != nil {
+		t.Fatalf("GET  is taken for GET: %v", err)
+	}
+	for b, want := range map[string]string{
+		"GET /": "get-space",
+		"GETX":  "get",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandlePrefixReplace(t *testing.T) {
+	mux := NewCMux()
+	previous, err := mux.HandlePrefixReplace(handlerID("a"), "GET ")
+	if err != nil || previous != nil {
+		t.Fatalf("the first replace returned %v, %v", previous, err)
+	}
+	previous, err = mux.HandlePrefixReplace(handlerID("b"), "GET ")
+	if err != nil || previous != handlerID("a") {
+		t.Fatalf("the replace returned %v, %v, want the previous handler", previous, err)
+	}
+	if got := matchOf(t, mux, "GET /"); got != "b" {
+		t.Fatalf("matched %q after the replace", got)
+	}
+	if _, err := mux.HandlePrefixReplace(handlerID("c"), ""); err == nil {
+		t.Fatal("HandlePrefixReplace accepted an empty prefix")
+	}
+
+	// the replacement of a terminal prefix is still terminal
+	mux.HandlePrefixTerminal(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	if _, err := mux.HandlePrefixReplace(handlerID("ssh-new"), "SSH-"); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchOf(t, mux, "SSH-2.0-x"); got != "ssh-new" {
+		t.Fatalf("matched %q, want the terminal replacement", got)
+	}
+}
+
+func TestRemovePrefixOverlapping(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	if got := matchOf(t, mux, "SSH-2.0-OpenSSH"); got != "ssh2" {
+		t.Fatalf("before removal matched %q", got)
+	}
+
+	if err := mux.RemovePrefix("SSH-2.0-"); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchOf(t, mux, "SSH-2.0-OpenSSH"); got != "ssh" {
+		t.Fatalf("after removing the longer prefix matched %q, want ssh", got)
+	}
+	if got := matchOf(t, mux, "SSH-1.99-"); got != "ssh" {
+		t.Fatalf("matched %q, want ssh", got)
+	}
+
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	if err := mux.RemovePrefix("SSH-"); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchOf(t, mux, "SSH-2.0-OpenSSH"); got != "ssh2" {
+		t.Fatalf("after removing the shorter prefix matched %q, want ssh2", got)
+	}
+	if got := matchOf(t, mux, "SSH-1.99-"); got != "" {
+		t.Fatalf("matched %q, want nothing", got)
+	}
+	if got := matchOf(t, mux, "GET /"); got != "http" {
+		t.Fatalf("matched %q, want http", got)
+	}
+}
+
+func TestRemovePrefixNotRegistered(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	err := mux.RemovePrefix("SSH-", "GET ")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RemovePrefix returned %v, want ErrNotFound", err)
+	}
+	// nothing is removed
+	if got := matchOf(t, mux, "SSH-2.0-"); got != "ssh" {
+		t.Fatalf("matched %q, want ssh", got)
+	}
+}
+
+func TestRemovePrefixKeepsDispatched(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+
+	mux.RemovePrefix("SSH-")
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Fatalf("dispatched conn read %q", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	mux.NotFound(handlerID("nf"))
+	mux.Reset()
+	for _, b := range []string{"SSH-2.0-", "GET /"} {
+		if _, _, err := mux.Handler(&bytewiseReader{b: []byte(b)}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Handler(%q) after Reset returned %v, want ErrNotFound", b, err)
+		}
+	}
+	if len(mux.Prefixes()) != 0 {
+		t.Fatalf("Prefixes after Reset: %q", mux.Prefixes())
+	}
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	if got := matchOf(t, mux, "SSH-2.0-"); got != "ssh" {
+		t.Fatalf("matched %q after registering again", got)
+	}
+}
+
+func TestSetRoutesRejectsWholeUpdate(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.NotFound(handlerID("nf"))
+	for name, routes := range map[string]map[string]Handler{
+		"empty prefix": {"GET ": handlerID("http"), "": handlerID("empty")},
+		"nil handler":  {"GET ": handlerID("http"), "POST ": nil},
+	} {
+		if err := mux.SetRoutes(routes, nil); err == nil {
+			t.Errorf("SetRoutes with an %s returned nil", name)
+		}
+	}
+	if got := mux.Prefixes(); len(got) != 1 || got[0] != "SSH-" {
+		t.Fatalf("Prefixes after the rejected updates: %q", got)
+	}
+	if got := matchOf(t, mux, "GET /"); got != "nf" {
+		t.Fatalf("matched %q after the rejected updates, want the NotFound handler", got)
+	}
+}
+
+func TestSetRoutesReplacesNotFound(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.NotFound(handlerID("nf"))
+	if err := mux.SetRoutes(map[string]Handler{"GET ": handlerID("http")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchOf(t, mux, "GET /"); got != "http" {
+		t.Fatalf("matched %q, want the new route", got)
+	}
+	if _, _, err := mux.Handler(&bytewiseReader{b: []byte("SSH-2.0-")}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("the replaced route and NotFound handler still resolved: %v", err)
+	}
+}
+
+func TestSetRoutesKeepsDispatched(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+
+	if err := mux.SetRoutes(map[string]Handler{"GET ": handlerID("http")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Fatalf("dispatched conn read %q", got)
+	}
+}
+
+func TestSetRoutesNeverMixed(t *testing.T) {
+	// the longest match of the input is a route of its own table in both,
+	// a mix of them matches a shorter route or nothing
+	old := map[string]Handler{"AB": handlerID("old"), "ABC": handlerID("old-ABC")}
+	next := map[string]Handler{"A": handlerID("new"), "ABCD": handlerID("new-ABCD")}
+	mux := NewCMux()
+	if err := mux.SetRoutes(old, handlerID("old-nf")); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				mux.SetRoutes(next, handlerID("new-nf"))
+			} else {
+				mux.SetRoutes(old, handlerID("old-nf"))
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				switch got := matchOf(t, mux, "ABCDE"); got {
+				case "old-ABC", "new-ABCD":
+				default:
+					t.Errorf("matched %q while swapping the routes", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-swapped
+}
+
+func TestRegisterWhileServing(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	stop := make(chan struct{})
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			prefix := fmt.Sprintf("P%d-", i%8)
+			mux.HandlePrefix(handlerID(prefix), prefix)
+			mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {})
+			mux.OnError(func(conn net.Conn, err error) {})
+			mux.OnEmptyConn(func(conn net.Conn) {})
+			mux.SetNotFoundPolicy(PolicyClose)
+			mux.SetLogger(LoggerFunc(func(e Event) {}))
+			mux.RecoverPanics(func(conn net.Conn, recovered interface{}, stack []byte) {})
+			mux.RemovePrefix(prefix)
+		}
+	}()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				client, server := net.Pipe()
+				go func() {
+					client.Write([]byte(fmt.Sprintf("P%d-x SSH-", (g+i)%8)))
+					client.Close()
+				}()
+				mux.ServeConn(server)
+				if got := matchOf(t, mux, "SSH-2.0-"); got != "ssh" {
+					t.Errorf("matched %q while registering, want ssh", got)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	<-registered
+}
+
+func TestNotFoundHandlerPrefix(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	got := make(chan string, 1)
+	mux.NotFound(NotFoundHandlerFunc(func(conn net.Conn, prefix []byte) {
+		defer conn.Close()
+		// the conn still replays the prefix
+		b := make([]byte, len(prefix))
+		io.ReadFull(conn, b)
+		if string(b) != string(prefix) {
+			t.Errorf("conn replayed %q, want %q", b, prefix)
+		}
+		got <- string(prefix)
+	}))
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSX"))
+	select {
+	case prefix := <-got:
+		if prefix != "SSX" {
+			t.Fatalf("NotFound got %q, want the bytes of the probe", prefix)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the NotFound handler was not called")
+	}
+}
+
+func TestNotFoundPlainHandler(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	h, ch := connChan()
+	mux.NotFound(h)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("HELLO"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if _, prefix := UnwrapUnreadConn(conn); len(prefix) == 0 || !strings.HasPrefix("HELLO", string(prefix)) {
+		t.Fatalf("UnreadConn holds %q, want the sniffed bytes", prefix)
+	}
+	if got := readN(t, conn, 5); got != "HELLO" {
+		t.Fatalf("NotFound read %q", got)
+	}
+}
+
+// failingConn is a conn whose reads fail with err.
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingConn) Read(p []byte) (int, error) {
+	return 0, c.err
+}
+
+func TestOnErrorClasses(t *testing.T) {
+	errIO := errors.New("connection reset")
+	for _, tc := range []struct {
+		name  string
+		conn  func() (net.Conn, net.Conn)
+		check func(err error) bool
+	}{
+		{
+			name: "not found",
+			conn: func() (net.Conn, net.Conn) {
+				client, server := net.Pipe()
+				go client.Write([]byte("HELLO"))
+				return client, server
+			},
+			check: func(err error) bool {
+				var nf *NotFoundError
+				return errors.Is(err, ErrNotFound) && errors.As(err, &nf) && len(nf.Prefix) != 0
+			},
+		},
+		{
+			name: "timeout",
+			conn: func() (net.Conn, net.Conn) {
+				return net.Pipe()
+			},
+			check: func(err error) bool {
+				var se *SniffError
+				return errors.As(err, &se) && se.Timeout()
+			},
+		},
+		{
+			name: "io",
+			conn: func() (net.Conn, net.Conn) {
+				client, server := net.Pipe()
+				return client, &failingConn{Conn: server, err: errIO}
+			},
+			check: func(err error) bool {
+				var se *SniffError
+				return errors.As(err, &se) && !se.Timeout() && errors.Is(err, errIO)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := NewCMux()
+			mux.SetReadTimeout(50 * time.Millisecond)
+			mux.HandlePrefix(handlerID("ssh"), "SSH-")
+			errc := make(chan error, 1)
+			mux.OnError(func(conn net.Conn, err error) {
+				errc <- err
+			})
+			client, server := tc.conn()
+			defer client.Close()
+			go mux.ServeConn(server)
+			select {
+			case err := <-errc:
+				if !tc.check(err) {
+					t.Fatalf("OnError got %#v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnError was not called")
+			}
+		})
+	}
+}
+
+func TestNoOnErrorClosesConn(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("HELLO"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the unmatched connection: %v, want io.EOF", err)
+	}
+}
+
+type ctxKey struct{}
+
+// ctxHandler is a ContextHandler sending the contexts it is served with to ch.
+type ctxHandler chan context.Context
+
+func (h ctxHandler) ServeConn(conn net.Conn) {
+	panic("ServeConn is called instead of ServeConnContext")
+}
+
+func (h ctxHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	conn.Close()
+	h <- ctx
+}
+
+func TestServeConnContextHandler(t *testing.T) {
+	mux := NewCMux()
+	h := make(ctxHandler, 1)
+	mux.HandlePrefix(h, "SSH-")
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace")
+	go mux.ServeConnContext(ctx, server)
+	select {
+	case got := <-h:
+		if got.Value(ctxKey{}) != "trace" {
+			t.Fatalf("the handler got a ctx without the value")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler was not served")
+	}
+
+	// ServeConn serves with the background context
+	client = servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	if got := <-h; got.Value(ctxKey{}) != nil || got.Done() != nil {
+		t.Fatalf("ServeConn served with %v", got)
+	}
+}
+
+func TestServeConnContextCancel(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		mux.ServeConnContext(ctx, server)
+		close(done)
+	}()
+	client.Write([]byte("SS"))
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the ctx did not abort the sniffing")
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("OnError got %v, want context.Canceled", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the cancelled connection: %v, want io.EOF", err)
+	}
+	noConn(t, ch)
+}
+
+func BenchmarkHandlerDispatch(b *testing.B) {
+	mux := NewCMux()
+	mux.HandleHTTP2(handlerID("h2"))
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	data := []byte(HTTP2Preface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		h, _, err := mux.Handler(r)
+		if err != nil || h != handlerID("h2") {
+			b.Fatal(h, err)
+		}
+	}
+}
+
+func TestPooledBuffersNotShared(t *testing.T) {
+	mux := NewCMux()
+	var wg sync.WaitGroup
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer wg.Done()
+		defer conn.Close()
+		_, prefix := UnwrapUnreadConn(conn)
+		want := string(prefix)
+		// let the other connections take the buffers from the pool
+		time.Sleep(time.Millisecond)
+		b, _ := io.ReadAll(conn)
+		if !strings.HasPrefix(string(b), want) {
+			t.Errorf("the conn replayed %q, want it to start with its sniffed bytes %q", b, want)
+		}
+		if string(prefix) != want {
+			t.Errorf("the sniffed bytes changed from %q to %q", want, prefix)
+		}
+	}), "ID-")
+	// a longer prefix makes the sniffing read more than the pattern
+	mux.HandlePrefix(handlerID("long"), "ID-"+strings.Repeat("x", 60))
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		client, server := net.Pipe()
+		go mux.ServeConn(server)
+		go func(i int) {
+			defer client.Close()
+			fmt.Fprintf(client, "ID-%d-%s", i, strings.Repeat(string(rune('a'+i%26)), 80))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMaxSniffBytesShorterThanPrefix(t *testing.T) {
+	mux := NewCMux()
+	long := "GET /" + strings.Repeat("a", 195)
+	mux.HandlePrefix(handlerID("long"), long)
+	mux.HandlePrefix(handlerID("get"), "GET ")
+	mux.SetMaxSniffBytes(8)
+	if got := matchOf(t, mux, long); got != "get" {
+		t.Fatalf("matched %q, want the best match within the bound", got)
+	}
+	h, _, err := mux.Handler(strings.NewReader(long))
+	if err != nil || h != handlerID("get") {
+		t.Fatalf("Handler = %v, %v", h, err)
+	}
+	_, _, consumed, _ := mux.MatchBytes([]byte(long))
+	if consumed > 8 {
+		t.Fatalf("sniffed %d bytes, want at most 8", consumed)
+	}
+
+	mux.SetMaxSniffBytes(0)
+	if got := matchOf(t, mux, long); got != "long" {
+		t.Fatalf("matched %q without a bound", got)
+	}
+}
+
+func TestMaxSniffBytesStopsOnDecision(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("long"), "SSH-"+strings.Repeat("a", 196))
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	// the client sends 5 bytes and waits, the long prefix can no longer match
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2"))
+	conn := recvConn(t, ch)
+	conn.Close()
+}
+
+func TestMaxSniffBytesMatcherWantsMore(t *testing.T) {
+	mux := NewCMux()
+	var longest int
+	mux.HandleMatcher(handlerID("greedy"), MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) > longest {
+			longest = len(b)
+		}
+		return len(b) >= 100, len(b) < 100
+	}), 200)
+	mux.SetMaxSniffBytes(10)
+	if got := matchOf(t, mux, strings.Repeat("x", 150)); got != "" {
+		t.Fatalf("matched %q, want nothing once the bound is reached", got)
+	}
+	if longest > 10 {
+		t.Fatalf("the matcher saw %d bytes, want at most the bound", longest)
+	}
+}
+
+// matchEvent is a call of the OnMatch callback.
+type matchEvent struct {
+	prefix  string
+	pattern string
+	handler Handler
+}
+
+// onMatchChan sets an OnMatch callback sending its calls to the returned channel.
+func onMatchChan(mux *CMux) chan matchEvent {
+	ch := make(chan matchEvent, 16)
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		ch <- matchEvent{prefix: string(prefix), pattern: pattern, handler: handler}
+	})
+	return ch
+}
+
+func TestOnMatchPattern(t *testing.T) {
+	mux := NewCMux()
+	ssh, sshConns := connChan()
+	mux.HandlePrefix(ssh, "SSH-")
+	ssh2, ssh2Conns := connChan()
+	mux.HandlePrefix(ssh2, "SSH-2.0-")
+	nf, nfConns := connChan()
+	mux.NotFound(nf)
+	events := onMatchChan(mux)
+
+	for _, tc := range []struct {
+		data    string
+		pattern string
+		conns   chan net.Conn
+	}{
+		{"SSH-2.0-x", "SSH-2.0-", ssh2Conns},
+		{"SSH-1.99", "SSH-", sshConns},
+		{"HELLO", "", nfConns},
+	} {
+		client := servePipe(mux)
+		go client.Write([]byte(tc.data))
+		conn := recvConn(t, tc.conns)
+		e := <-events
+		if e.pattern != tc.pattern {
+			t.Errorf("%q: OnMatch got the pattern %q, want %q", tc.data, e.pattern, tc.pattern)
+		}
+		if !strings.HasPrefix(tc.data, e.prefix) || len(e.prefix) < len(tc.pattern) {
+			t.Errorf("%q: OnMatch got the prefix %q", tc.data, e.prefix)
+		}
+		conn.Close()
+		client.Close()
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("OnMatch was called again for %q", e.pattern)
+	default:
+	}
+}
+
+func TestOnMatchBeforeHandler(t *testing.T) {
+	mux := NewCMux()
+	order := make(chan string, 2)
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		order <- "match"
+	})
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		order <- "handler"
+		conn.Close()
+	}), "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	client.Write([]byte("SSH-"))
+	if first, second := <-order, <-order; first != "match" || second != "handler" {
+		t.Fatalf("called %s then %s", first, second)
+	}
+}
+
+func TestOnMatchPanicRecovered(t *testing.T) {
+	mux := NewCMux()
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		panic("hook")
+	})
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Fatalf("handler read %q after the panic of the hook", got)
+	}
+}
+
+// chunkReader returns the bytes in the chunks of the sizes, the last size repeats.
+type chunkReader struct {
+	b     []byte
+	sizes []int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := r.sizes[0]
+	if len(r.sizes) > 1 {
+		r.sizes = r.sizes[1:]
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.b) {
+		n = len(r.b)
+	}
+	copy(p, r.b[:n])
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func segmentationMux() *CMux {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.HandlePrefix(handlerID("ge"), "GE")
+	mux.HandlePrefix(handlerID("get"), "GET ")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	mux.HandlePrefixFold(handlerID("helo"), "helo ")
+	mux.HandlePattern(handlerID("frame"), []byte("MX?v"), []byte{0xff, 0xff, 0x00, 0xff})
+	mux.HandleMatcher(handlerID("line"), MatcherFunc(func(b []byte) (bool, bool) {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return false, true
+		}
+		return bytes.HasPrefix(b, []byte("LINE")), false
+	}), 32)
+	return mux
+}
+
+// resolveID returns the id and the prefix of the handler r is dispatched to.
+func resolveID(t testing.TB, mux *CMux, r io.Reader) (string, string) {
+	t.Helper()
+	h, prefix, err := mux.Handler(r)
+	if errors.Is(err, ErrNotFound) {
+		return "", string(prefix)
+	}
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+	return string(h.(handlerID)), string(prefix)
+}
+
+var segmentationInputs = []string{
+	"SSH-2.0-x",
+	"SSH-1.99",
+	"SSH",
+	"GET /",
+	"GEX",
+	"\x16\x03\x01\x00",
+	"HeLo x",
+	"MX7v..",
+	"LINE 1\n",
+	"LINX 1\n",
+	"nothing here",
+}
+
+func TestMatchIndependentOfSegmentation(t *testing.T) {
+	mux := segmentationMux()
+	for _, in := range segmentationInputs {
+		want, _ := resolveID(t, mux, bytes.NewReader([]byte(in)))
+		// every way to cut the input into chunks
+		for cuts := 0; cuts != 1<<(len(in)-1); cuts++ {
+			var sizes []int
+			n := 1
+			for i := 0; i != len(in)-1; i++ {
+				if cuts&(1<<i) != 0 {
+					sizes = append(sizes, n)
+					n = 0
+				}
+				n++
+			}
+			sizes = append(sizes, n)
+			got, _ := resolveID(t, mux, &chunkReader{b: []byte(in), sizes: sizes})
+			if got != want {
+				t.Fatalf("%q in chunks %v matched %q, in one read %q", in, sizes, got, want)
+			}
+		}
+		got, prefix := resolveID(t, mux, iotest.OneByteReader(bytes.NewReader([]byte(in))))
+		if got != want {
+			t.Fatalf("%q one byte at a time matched %q, in one read %q", in, got, want)
+		}
+		if !strings.HasPrefix(in, prefix) {
+			t.Fatalf("%q one byte at a time sniffed %q", in, prefix)
+		}
+	}
+}
+
+func TestMatchRandomChunks(t *testing.T) {
+	mux := segmentationMux()
+	rng := rand.New(rand.NewSource(1))
+	for _, in := range segmentationInputs {
+		in += strings.Repeat("-", 40)
+		want, _ := resolveID(t, mux, bytes.NewReader([]byte(in)))
+		for i := 0; i != 200; i++ {
+			sizes := make([]int, 1+rng.Intn(len(in)))
+			for j := range sizes {
+				sizes[j] = 1 + rng.Intn(5)
+			}
+			got, _ := resolveID(t, mux, &chunkReader{b: []byte(in), sizes: sizes})
+			if got != want {
+				t.Fatalf("%q in chunks %v matched %q, in one read %q", in, sizes, got, want)
+			}
+		}
+	}
+}
+
+// emptyReadsReader returns (0, nil) n times before each byte of b.
+type emptyReadsReader struct {
+	b     []byte
+	n     int
+	empty int
+}
+
+func (r *emptyReadsReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	if r.empty < r.n {
+		r.empty++
+		return 0, nil
+	}
+	r.empty = 0
+	p[0] = r.b[0]
+	r.b = r.b[1:]
+	return 1, nil
+}
+
+func TestSniffRetriesEmptyReads(t *testing.T) {
+	mux := segmentationMux()
+	for _, in := range segmentationInputs {
+		want, _ := resolveID(t, mux, bytes.NewReader([]byte(in)))
+		for _, n := range []int{1, 3, maxEmptyReads - 1} {
+			got, prefix := resolveID(t, mux, &emptyReadsReader{b: []byte(in), n: n})
+			if got != want {
+				t.Fatalf("%q with %d empty reads between the bytes matched %q, want %q", in, n, got, want)
+			}
+			if !strings.HasPrefix(in, prefix) {
+				t.Fatalf("%q with %d empty reads sniffed %q", in, n, prefix)
+			}
+		}
+	}
+}
+
+func TestSniffGivesUpOnEmptyReads(t *testing.T) {
+	mux := segmentationMux()
+	_, _, err := mux.Handler(&emptyReadsReader{b: []byte("SSH-2.0-x"), n: maxEmptyReads})
+	if err != io.ErrNoProgress {
+		t.Fatalf("a reader never returning bytes got %v, want io.ErrNoProgress", err)
+	}
+	// the bytes read before the empty reads still count
+	_, _, err = mux.Handler(io.MultiReader(strings.NewReader("SSH"), &emptyReadsReader{b: []byte("x"), n: maxEmptyReads}))
+	if err != io.ErrNoProgress {
+		t.Fatalf("a reader stalling after some bytes got %v, want io.ErrNoProgress", err)
+	}
+}
+
+func TestNotFoundErrorPrefixStable(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	_, _, err := mux.Handler(strings.NewReader("GET /"))
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Handler returned %v, want a *NotFoundError", err)
+	}
+	if string(nf.Prefix) != "GET " {
+		t.Fatalf("the error carries %q, want the sniffed bytes", nf.Prefix)
+	}
+	// the pooled buffers are used again by the next resolutions
+	for i := 0; i != 8; i++ {
+		mux.Handler(strings.NewReader("POST"))
+		mux.DispatchConn(newMemConn([]byte("PUT ")))
+	}
+	if string(nf.Prefix) != "GET " {
+		t.Fatalf("the prefix of the error changed to %q", nf.Prefix)
+	}
+}
+
+func TestNotFoundErrorOnError(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	errc := make(chan error, 2)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+	for _, b := range []string{"GET ", "PUT "} {
+		b, client := b, servePipe(mux)
+		go func() {
+			client.Write([]byte(b))
+			client.Close()
+		}()
+	}
+	var prefixes []string
+	var errs []*NotFoundError
+	for i := 0; i != 2; i++ {
+		select {
+		case err := <-errc:
+			var nf *NotFoundError
+			if !errors.As(err, &nf) {
+				t.Fatalf("OnError got %v, want a *NotFoundError", err)
+			}
+			errs = append(errs, nf)
+			prefixes = append(prefixes, string(nf.Prefix))
+		case <-time.After(5 * time.Second):
+			t.Fatal("the unmatched connection was not reported")
+		}
+	}
+	for i, nf := range errs {
+		if string(nf.Prefix) != prefixes[i] || (prefixes[i] != "GET " && prefixes[i] != "PUT ") {
+			t.Fatalf("the error %d carries %q, it was %q", i, nf.Prefix, prefixes[i])
+		}
+	}
+	if prefixes[0] == prefixes[1] {
+		t.Fatalf("both errors carry %q", prefixes[0])
+	}
+}
+
+func TestDispatchConnNotFoundKeepsConnOpen(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("GET "))
+
+	err := mux.DispatchConn(server)
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DispatchConn returned %v, want a *NotFoundError", err)
+	}
+	if string(nf.Prefix) != "GET " {
+		t.Fatalf("the error carries %q, want the sniffed bytes", nf.Prefix)
+	}
+	// the conn is left open, the caller can still talk on it
+	go client.Write([]byte("/ HTTP/1.1"))
+	if got := readN(t, server, 10); got != "/ HTTP/1.1" {
+		t.Fatalf("read %q after DispatchConn", got)
+	}
+	go server.Write([]byte("bye"))
+	if got := readN(t, client, 3); got != "bye" {
+		t.Fatalf("the client read %q", got)
+	}
+}
+
+func TestDispatchConnErrors(t *testing.T) {
+	errIO := errors.New("connection reset")
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	err := mux.DispatchConn(&failingConn{Conn: server, err: errIO})
+	var se *SniffError
+	if !errors.As(err, &se) || se.Timeout() || !errors.Is(err, errIO) {
+		t.Fatalf("a failing read returned %v, want a *SniffError of the read error", err)
+	}
+
+	mux.SetReadTimeout(20 * time.Millisecond)
+	client, server = net.Pipe()
+	defer client.Close()
+	err = mux.DispatchConn(server)
+	if !errors.As(err, &se) || !se.Timeout() {
+		t.Fatalf("a silent client returned %v, want a timed out *SniffError", err)
+	}
+	// the conn is not closed
+	go client.Write([]byte("late"))
+	if got := readN(t, server, 4); got != "late" {
+		t.Fatalf("read %q after the timeout", got)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	if err := mux.DispatchConn(server); err != nil {
+		t.Fatalf("a matched conn returned %v", err)
+	}
+}
+
+// memConn is a conn reading from a buffer, its writes, closes and deadlines do nothing.
+type memConn struct {
+	net.Conn
+	r      bytes.Reader
+	remote net.Addr
+}
+
+func newMemConn(b []byte) *memConn {
+	c := &memConn{}
+	c.r.Reset(b)
+	return c
+}
+
+var memAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *memConn) Close() error                { return nil }
+func (c *memConn) LocalAddr() net.Addr         { return memAddr }
+func (c *memConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return memAddr
+}
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,20 @@
+package cmux
+
+// HandleDefault handle the handler that takes the connections nothing else matches,
+// as if it was registered with an empty prefix. Every registration wins over it and it wins over NotFound,
+// the connections closed before sending any byte and the excluded prefixes still take the not found path.
+func (m *CMux) HandleDefault(handler Handler) error {
+	if err := noBudget("HandleDefault", handler); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.defaultRoute = &route{
+		pattern: "default",
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf("default"),
+	}
+	m.rebuild()
+	return nil
+}
@@ -0,0 +1,68 @@
+package cmux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleDefaultPrecedence(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandleMatcher(handlerID("matcher"), MatcherFunc(func(b []byte) (bool, bool) {
+		return len(b) != 0 && b[0] == 'M', len(b) == 0
+	}), 1)
+	mux.ExcludePrefix("SSH-1")
+	mux.NotFound(handlerID("notfound"))
+	if got := matchOf(t, mux, "GET /"); got != "notfound" {
+		t.Fatalf("matched %q before HandleDefault", got)
+	}
+	mux.HandleDefault(handlerID("default"))
+	for b, want := range map[string]string{
+		"SSH-2.0-": "ssh",
+		"MAIL":     "matcher",
+		"GET /":    "default",
+		"S":        "default",
+		"SSH-1.99": "notfound",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleDefaultCounted(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandleDefault(handlerID("default"))
+	for i := 0; i != 3; i++ {
+		if err := mux.DispatchConn(newMemConn([]byte("GET /"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := mux.Stats()
+	if stats.NotFound != 0 {
+		t.Fatalf("the default connections counted %d not found", stats.NotFound)
+	}
+	if got := stats.Patterns["default"].Matched; got != 3 {
+		t.Fatalf("the default pattern matched %d, want 3", got)
+	}
+}
+
+func TestHandleDefaultEmptyConn(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleDefault(h)
+	empty := make(chan struct{}, 1)
+	mux.OnEmptyConn(func(conn net.Conn) {
+		empty <- struct{}{}
+	})
+	client := servePipe(mux)
+	client.Close()
+	select {
+	case <-empty:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the empty connection was not reported")
+	}
+	noConn(t, ch)
+}
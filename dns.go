@@ -0,0 +1,61 @@
+package cmux
+
+// dnsHeaderLength is the length of the 2-byte length and the header of a DNS message over TCP.
+const dnsHeaderLength = 2 + 12
+
+// HandleDNS handle the handler that matches a DNS query over TCP, see MatchDNS.
+// The sniffed bytes are replayed so the handler reads the whole message.
+func (m *CMux) HandleDNS(handler Handler) error {
+	return m.handleMatcher(handler, MatcherFunc(MatchDNS), dnsHeaderLength, "dns")
+}
+
+// MatchDNS matches the 2-byte length and the header of a DNS query over TCP.
+// The length must fit a header and a question, the header must be a query with a known opcode,
+// no response code, the reserved bit clear and exactly one question.
+// A TLS record "\x16\x03" is rejected by its handshake type 0x01 landing in the response code,
+// a HTTP request is rejected because two ASCII bytes cannot form the question count of one.
+func MatchDNS(b []byte) (matched bool, needMore bool) {
+	n := len(b)
+	if n > dnsHeaderLength {
+		n = dnsHeaderLength
+	}
+	b = b[:n]
+	if len(b) >= 2 {
+		// a header and the shortest question, the root name with its type and class
+		if length := int(b[0])<<8 | int(b[1]); length < 12+5 {
+			return false, false
+		}
+	}
+	if len(b) >= 5 {
+		// QR is clear for a query
+		if b[4]&0x80 != 0 {
+			return false, false
+		}
+		switch opcode := b[4] >> 3 & 0x0f; opcode {
+		case 0, 2, 4, 5: // QUERY, STATUS, NOTIFY, UPDATE
+		default:
+			return false, false
+		}
+	}
+	if len(b) >= 6 {
+		// Z is reserved and RCODE is only set in responses
+		if b[5]&0x40 != 0 || b[5]&0x0f != 0 {
+			return false, false
+		}
+	}
+	if len(b) >= 8 {
+		if b[6] != 0 || b[7] != 1 {
+			return false, false
+		}
+	}
+	if len(b) >= 10 {
+		// only a NOTIFY carries answers in a request
+		if b[4]>>3&0x0f != 4 && (b[8] != 0 || b[9] != 0) {
+			return false, false
+		}
+	}
+	if len(b) < dnsHeaderLength {
+		return false, true
+	}
+	return true, false
+}
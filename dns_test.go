@@ -0,0 +1,101 @@
+package cmux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsQuery returns a DNS over TCP query of the A record of name, with its 2-byte length.
+func dnsQuery(id uint16, name string) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1)
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestMatchDNS(t *testing.T) {
+	query := dnsQuery(0x1234, "example.com")
+	for i := 0; i < dnsHeaderLength; i++ {
+		if matched, needMore := MatchDNS(query[:i]); matched || !needMore {
+			t.Fatalf("%d bytes of a query reported %v %v, want more", i, matched, needMore)
+		}
+	}
+	if matched, _ := MatchDNS(query); !matched {
+		t.Fatal("the query did not match")
+	}
+
+	response := append([]byte(nil), query...)
+	response[4] |= 0x80
+	twoQuestions := append([]byte(nil), query...)
+	twoQuestions[9] = 2
+	short := append([]byte(nil), query...)
+	short[0], short[1] = 0, 12
+	for name, b := range map[string][]byte{
+		"response":      response,
+		"two questions": twoQuestions,
+		"short length":  short,
+		"tls 1.0":       []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03abcd"),
+		"tls 1.2":       []byte("\x16\x03\x03\x00\xf4\x01\x00\x00\xf0\x03\x03abcd"),
+	} {
+		if matched, _ := MatchDNS(b); matched {
+			t.Errorf("%s matched as DNS", name)
+		}
+	}
+	for _, method := range []string{"GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE", "PRI"} {
+		b := []byte(method + " /index.html HTTP/1.1\r\n")
+		if matched, _ := MatchDNS(b); matched {
+			t.Errorf("%s request matched as DNS", method)
+		}
+	}
+}
+
+func TestHandleDNSReplaysMessage(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTP1(handlerID("http"))
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	got := make(chan string, 1)
+	mux.HandleDNS(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			got <- err.Error()
+			return
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			got <- err.Error()
+			return
+		}
+		var labels []string
+		for b := msg[12:]; b[0] != 0; b = b[1+b[0]:] {
+			labels = append(labels, string(b[1:1+b[0]]))
+		}
+		got <- strings.Join(labels, ".")
+	}))
+
+	query := dnsQuery(7, "example.com")
+	client := servePipe(mux)
+	defer client.Close()
+	go writeChunks(client, string(query[:1]), string(query[1:9]), string(query[9:]))
+	select {
+	case name := <-got:
+		if name != "example.com" {
+			t.Fatalf("the DNS handler parsed %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the query was not dispatched to the DNS handler")
+	}
+	if got := matchOf(t, mux, "GET / HTTP/1.1\r\n"); got != "http" {
+		t.Errorf("HTTP matched %q", got)
+	}
+	if got := matchOf(t, mux, "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03abcd"); got != "tls" {
+		t.Errorf("TLS matched %q", got)
+	}
+}
@@ -0,0 +1,26 @@
+package cmux
+
+// ExcludePrefix sends the connections that match the prefixes to the not found path,
+// even if a shorter registered prefix matches them as well.
+// The exclusion competes with the other prefixes by its length, a longer registration still wins over it.
+// RemovePrefix removes the exclusion like a registration, an already registered prefix is an ErrPrefixExists.
+func (m *CMux) ExcludePrefix(prefixes ...string) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	err := m.checkPrefixes(prefixes)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		m.prefixes[prefix] = &route{
+			pattern:  prefix,
+			name:     "excluded",
+			excluded: true,
+		}
+	}
+	m.rebuild()
+	return nil
+}
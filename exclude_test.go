@@ -0,0 +1,85 @@
+package cmux
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExcludePrefixPrecedence(t *testing.T) {
+	const (
+		depth4  = "GET "
+		depth12 = "GET /interna"
+		depth13 = "GET /internal"
+	)
+	if len(depth4) != 4 || len(depth12) != 12 || len(depth13) != 13 {
+		t.Fatal("the prefixes are not of the depths of the test")
+	}
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), depth4)
+	mux.ExcludePrefix(depth12)
+	mux.HandlePrefix(handlerID("internal"), depth13)
+	nf := handlerID("notfound")
+	mux.NotFound(nf)
+
+	for b, want := range map[string]string{
+		"GET / HTTP/1.1":        "http",
+		"GET /intern HTTP/1.1":  "http",
+		"GET /internab":         "notfound",
+		"GET /internals":        "internal",
+		"GET /internal/x":       "internal",
+		"GET /interna":          "notfound",
+		"POST /internal/x":      "notfound",
+		"GET /internaX HTTP/1.": "notfound",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestExcludePrefixWithoutNotFoundHandler(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	mux.ExcludePrefix("GET /internal")
+	if got := matchOf(t, mux, "GET /internal/x"); got != "" {
+		t.Fatalf("the excluded prefix matched %q, want ErrNotFound", got)
+	}
+	if _, ok := mux.HandlerForPrefix("GET /internal"); ok {
+		t.Fatal("HandlerForPrefix found a handler for the exclusion")
+	}
+	mux.RemovePrefix("GET /internal")
+	if got := matchOf(t, mux, "GET /internal/x"); got != "http" {
+		t.Fatalf("after RemovePrefix matched %q, want the broad registration", got)
+	}
+}
+
+func TestExcludePrefixConflicts(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	if err := mux.ExcludePrefix("GET /internal", "GET "); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("excluding a registered prefix returned %v, want ErrPrefixExists", err)
+	}
+	if h, ok := mux.HandlerForPrefix("GET "); !ok || h != handlerID("http") {
+		t.Fatalf("the registered handler was replaced by the exclusion: %v, %v", h, ok)
+	}
+	// the failing call excludes nothing
+	if got := matchOf(t, mux, "GET /internal/x"); got != "http" {
+		t.Fatalf("matched %q after the failing exclusion", got)
+	}
+	if err := mux.ExcludePrefix(""); err == nil {
+		t.Fatal("ExcludePrefix accepted an empty prefix")
+	}
+	if err := mux.ExcludePrefix("GET /a", "GET /a"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("excluding a prefix twice in a call returned %v, want ErrPrefixExists", err)
+	}
+
+	if err := mux.ExcludePrefix("GET /internal"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.HandlePrefix(handlerID("internal"), "GET /internal"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("registering an excluded prefix returned %v, want ErrPrefixExists", err)
+	}
+	if err := mux.ExcludePrefix("GET /internal"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("excluding a prefix again returned %v, want ErrPrefixExists", err)
+	}
+}
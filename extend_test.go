@@ -0,0 +1,140 @@
+package cmux
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// countingReader returns its bytes one at a time and counts the reads.
+type countingReader struct {
+	b     []byte
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.b[0]
+	r.b = r.b[1:]
+	return 1, nil
+}
+
+// oldSniff is the sniffing before the restricted prefixes were left out of canExtend: it decides from
+// every byte up to the longest prefix, and reports how many bytes the loop read before no prefix could extend.
+func oldSniff(t *table, b []byte, addr, local net.Addr) (matched *route, read int) {
+	n := len(b)
+	if n > t.exactLength {
+		n = t.exactLength
+	}
+	matched = lookupPrefix(t.prefixes, b[:n], 0, t.exactLength, nil, false, 0)
+	limited := t.lookupRestricted(b[:n], 0, addr, local, nil, false)
+	matched = longestRoute(limited, matched)
+	for read = 1; read < n && canExtend(t.sorted, b[:read]); read++ {
+	}
+	return matched, read
+}
+
+func TestCanExtendForMatchesOldSniff(t *testing.T) {
+	const alphabet = "abc"
+	rnd := rand.New(rand.NewSource(1))
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000},
+		&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 5000},
+	}
+	locals := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+	}
+	var earlier int
+	for i := 0; i != 300; i++ {
+		mux := NewCMux()
+		for j := rnd.Intn(4); j != 0; j-- {
+			p := string(randomBytes(rnd, "ab", 6))
+			if p != "" {
+				mux.HandlePrefix(handlerID(p), p)
+			}
+		}
+		for j := 1 + rnd.Intn(4); j != 0; j-- {
+			p := string(randomBytes(rnd, "ab", 8))
+			if p == "" {
+				continue
+			}
+			if rnd.Intn(2) == 0 {
+				mux.HandlePrefixFrom(handlerID("from:"+p), []string{"10.0.0.0/8"}, p)
+			} else {
+				mux.HandlePrefixLocal(handlerID("local:"+p), []string{":22"}, p)
+			}
+		}
+		tbl := mux.load()
+		if tbl.sniffLength == 0 {
+			continue
+		}
+		for j := 0; j != 20; j++ {
+			b := randomBytes(rnd, alphabet, 10)
+			if len(b) == 0 {
+				continue
+			}
+			addr, local := addrs[rnd.Intn(len(addrs))], locals[rnd.Intn(len(locals))]
+			want, oldReads := oldSniff(tbl, b, addr, local)
+			r := &countingReader{b: b}
+			got, _, err := tbl.sniff(r, addr, local, nil)
+			if err != nil && err != ErrNotFound {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("%q from %v to %v with %s decided %v, want %v", b, addr, local, mux, got, want)
+			}
+			// the reads of the new loop, not counting the read of the end of the stream
+			reads := r.reads
+			if len(r.b) == 0 && reads > len(b) {
+				reads = len(b)
+			}
+			if reads > oldReads {
+				t.Fatalf("%q from %v to %v with %s took %d reads, %d before", b, addr, local, mux, reads, oldReads)
+			}
+			if reads < oldReads {
+				earlier++
+			}
+		}
+	}
+	if earlier == 0 {
+		t.Fatal("the sniffing never stopped earlier")
+	}
+}
+
+func benchmarkSniffReads(b *testing.B, mux *CMux, input string, addr net.Addr) {
+	tbl := mux.load()
+	reads := 0
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := &countingReader{b: []byte(input)}
+		tbl.sniff(r, addr, nil, nil)
+		reads += r.reads
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+}
+
+// earlyExitMux has a long prefix restricted to a network and a short plain prefix.
+func earlyExitMux() *CMux {
+	mux := NewCMux()
+	mux.HandlePrefixFrom(handlerID("h2-internal"), []string{"10.0.0.0/8"}, HTTP2Preface)
+	mux.HandlePrefix(handlerID("pri"), "PRI ")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	return mux
+}
+
+func BenchmarkSniffReadsRestrictedReachable(b *testing.B) {
+	benchmarkSniffReads(b, earlyExitMux(), HTTP2Preface, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+}
+
+func BenchmarkSniffReadsRestrictedUnreachable(b *testing.B) {
+	benchmarkSniffReads(b, earlyExitMux(), HTTP2Preface, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+}
+
+func BenchmarkSniffReadsDeadBranch(b *testing.B) {
+	benchmarkSniffReads(b, earlyExitMux(), "GET / HTTP/1.1\r\n\r\n", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+}
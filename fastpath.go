@@ -0,0 +1,51 @@
+package cmux
+
+// buildFirst indexes the prefixes by their first byte, so that most connections are decided
+// without looking up every length of the prefixes. The caller must have filled the prefixes, the folds and the masks.
+func (t *table) buildFirst() {
+	for _, prefix := range t.sorted {
+		if prefix == "" {
+			continue
+		}
+		if c := prefix[0]; t.firstLength[c] < len(prefix) {
+			t.firstLength[c] = len(prefix)
+		}
+	}
+	for c := range t.firstLength {
+		// a single byte prefix decides the first read on its own when no longer prefix starts with it,
+		// the bytes after it can then change neither the route nor the pattern
+		if t.firstLength[c] != 1 {
+			continue
+		}
+		key := string([]byte{byte(c)})
+		if r, ok := t.prefixes[key]; ok && t.firstEligible(key, r) && !t.foldsFirst(byte(c)) && !t.masksFirst(byte(c)) {
+			t.byFirst[c] = r
+		}
+	}
+}
+
+// firstEligible reports whether the route of the prefix is decided by the bytes alone.
+func (t *table) firstEligible(prefix string, r *route) bool {
+	return r != nil && !r.excluded && r.maxWait == 0 && len(t.restricted[prefix]) == 0
+}
+
+// foldsFirst reports whether a folded prefix may match the bytes starting with c.
+func (t *table) foldsFirst(c byte) bool {
+	c = toLower(c)
+	for _, prefix := range t.foldSorted {
+		if prefix == "" || prefix[0] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// masksFirst reports whether a masked pattern may match the bytes starting with c.
+func (t *table) masksFirst(c byte) bool {
+	for _, mr := range t.masks {
+		if c&mr.mask[0] == mr.value[0] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// slowTable returns the table of a copy of mux without the first byte index.
+func slowTable(mux *CMux) *table {
+	t := mux.Clone().load()
+	t.byFirst = [256]*route{}
+	return t
+}
+
+// randomBytes returns up to max bytes from the alphabet.
+func randomBytes(rnd *rand.Rand, alphabet string, max int) []byte {
+	b := make([]byte, rnd.Intn(max+1))
+	for i := range b {
+		b[i] = alphabet[rnd.Intn(len(alphabet))]
+	}
+	return b
+}
+
+func TestFastPathMatchesSlowPath(t *testing.T) {
+	const alphabet = "\x16\x03SH-"
+	rnd := rand.New(rand.NewSource(1))
+	hits := 0
+	for round := 0; round != 300; round++ {
+		mux := NewCMux()
+		if rnd.Intn(4) == 0 {
+			mux.SetMatchStrategy(MatchFirst)
+		}
+		for i := rnd.Intn(8); i != 0; i-- {
+			prefix := string(randomBytes(rnd, alphabet, 4))
+			switch rnd.Intn(8) {
+			case 0:
+				mux.ExcludePrefix(prefix)
+			case 1:
+				mux.HandlePrefixTerminal(handlerID("terminal"), prefix)
+			case 2:
+				mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {}), prefix)
+			default:
+				// few handlers so that the prefixes under a byte often share one
+				mux.HandlePrefix(handlerID([]string{"a", "b"}[rnd.Intn(2)]), prefix)
+			}
+		}
+		fast, slow := mux.load(), slowTable(mux)
+		for c := range fast.byFirst {
+			if fast.byFirst[c] != nil {
+				hits++
+			}
+		}
+		for i := 0; i != 50; i++ {
+			b := randomBytes(rnd, alphabet, 8)
+			// the same reads decide the same route and read the same bytes
+			for _, reader := range []func() io.Reader{
+				func() io.Reader { return bytes.NewReader(b) },
+				func() io.Reader { return &bytewiseReader{b: b} },
+			} {
+				fh, fp, fb, ferr := fast.resolve(reader())
+				sh, sp, sb, serr := slow.resolve(reader())
+				if !sameDecision(fh, sh) || fp != sp || !bytes.Equal(fb, sb) || (ferr == nil) != (serr == nil) {
+					t.Fatalf("%q with %q: the fast path decided %v %q %q %v, the slow path %v %q %q %v", b, mux.Prefixes(), fh, fp, fb, ferr, sh, sp, sb, serr)
+				}
+			}
+			// the writes of the client do not change the decision of the fast path
+			wh, wp, _, werr := fast.resolve(bytes.NewReader(b))
+			sizes := randomSizes(rnd, len(b))
+			ch, cp, _, cerr := fast.resolve(&chunkReader{b: b, sizes: sizes})
+			if !sameDecision(wh, ch) || wp != cp || (werr == nil) != (cerr == nil) {
+				t.Fatalf("%q with %q: decided %v %q %v in one read, %v %q %v in reads of %v", b, mux.Prefixes(), wh, wp, werr, ch, cp, cerr, sizes)
+			}
+		}
+	}
+	if hits == 0 {
+		t.Fatal("the fast path was never taken")
+	}
+}
+
+// sameDecision reports whether the handlers are the same registration.
+func sameDecision(a, b Handler) bool {
+	if _, ok := a.(HandlerFunc); ok {
+		_, ok = b.(HandlerFunc)
+		return ok
+	}
+	return a == b
+}
+
+// randomSizes returns the sizes of random reads of n bytes.
+func randomSizes(rnd *rand.Rand, n int) []int {
+	sizes := []int{}
+	for n > 0 {
+		size := 1 + rnd.Intn(n)
+		sizes = append(sizes, size)
+		n -= size
+	}
+	return append(sizes, 1)
+}
+
+func TestFastPathLongerPrefixes(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("tls"), "\x16")
+	mux.HandlePrefix(handlerID("ssh"), "S", "SSH-")
+	tbl := mux.load()
+	if tbl.byFirst[0x16] == nil {
+		t.Fatal("the single byte prefix is not indexed by its first byte")
+	}
+	if tbl.byFirst['S'] != nil {
+		t.Fatal("the single byte prefix under longer ones is indexed by its first byte")
+	}
+	// the first byte decides, whatever comes next
+	for _, b := range []string{"\x16", "\x16\x03\x01\x02", "\x16\xff"} {
+		h, _, consumed, err := mux.MatchBytes([]byte(b))
+		if err != nil || h != handlerID("tls") || consumed != 1 {
+			t.Errorf("%q matched %v after %d bytes, %v, want tls after the first byte", b, h, consumed, err)
+		}
+	}
+	// the pattern and the bytes left to the handler do not depend on the writes of the client
+	for _, sizes := range [][]int{{7}, {1, 6}, {2, 1, 4}} {
+		h, pattern, _, err := tbl.resolve(&chunkReader{b: []byte("SSH-2.0"), sizes: sizes})
+		if err != nil || h != handlerID("ssh") || pattern != "SSH-" {
+			t.Fatalf("reads of %v matched %v %q, %v, want ssh with SSH-", sizes, h, pattern, err)
+		}
+	}
+}
+
+func benchmarkFirstByte(b *testing.B, tbl *table) {
+	data := []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03")
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		h, _, _, err := tbl.resolve(r)
+		if err != nil || h != handlerID("tls") {
+			b.Fatal(h, err)
+		}
+	}
+}
+
+// firstByteMux routes TLS by its first byte and SSH by its prefix.
+func firstByteMux() *CMux {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("tls"), "\x16")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ", "PUT ", "DELETE ")
+	return mux
+}
+
+func BenchmarkFirstByteFastPath(b *testing.B) {
+	benchmarkFirstByte(b, firstByteMux().load())
+}
+
+func BenchmarkFirstByteSlowPath(b *testing.B) {
+	benchmarkFirstByte(b, slowTable(firstByteMux()))
+}
@@ -0,0 +1,51 @@
+package cmux
+
+// HandlePrefixFold handle the handler that matches the prefix ignoring the ASCII case,
+// a case-sensitive prefix of the same length wins over it. A prefix that is empty or already registered
+// in any case is rejected and nothing is registered.
+func (m *CMux) HandlePrefixFold(handler Handler, prefixes ...string) error {
+	if err := noBudget("HandlePrefixFold", handler); err != nil {
+		return err
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	err := checkNewPrefixes(prefixes, foldString, func(key string) (string, bool) {
+		r, ok := m.folds[key]
+		if !ok {
+			return "", false
+		}
+		return r.name, true
+	})
+	if err != nil {
+		return err
+	}
+	name := m.nameOf(handler)
+	for _, prefix := range prefixes {
+		m.folds[foldString(prefix)] = &route{
+			pattern: prefix,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf("fold:" + prefix),
+		}
+	}
+	m.rebuild()
+	return nil
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func foldString(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		b[i] = toLower(c)
+	}
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package cmux
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHandlePrefixFold(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixFold(handlerID("smtp"), "HELO ", "EHLO ")
+	mux.HandlePrefixFold(handlerID("fold-get"), "get ")
+	mux.HandlePrefix(handlerID("exact-get"), "GET ")
+	mux.HandlePrefixFold(handlerID("fold-api"), "GET /API")
+	mux.HandlePrefix(handlerID("exact-ge"), "GE")
+
+	for b, want := range map[string]string{
+		"HELO example.com\r\n": "smtp",
+		"helo example.com\r\n": "smtp",
+		"eHlO example.com\r\n": "smtp",
+		// the exact prefix wins the tie of the same length
+		"GET / HTTP/1.1\r\n": "exact-get",
+		"get / HTTP/1.1\r\n": "fold-get",
+		"Get / HTTP/1.1\r\n": "fold-get",
+		// a longer folded prefix wins over a shorter exact one on the same byte path
+		"GET /api/v1 HTTP/1.1\r\n": "fold-api",
+		"get /Api/v1 HTTP/1.1\r\n": "fold-api",
+		"GEX":                      "exact-ge",
+		"gex":                      "",
+		"HELO":                     "",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandlePrefixFoldNonLetters(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixFold(handlerID("bin"), "\x16\x03A")
+	if got := matchOf(t, mux, "\x16\x03a"); got != "bin" {
+		t.Fatalf("matched %q, want the letter folded", got)
+	}
+	// only the ASCII letters are folded
+	if got := matchOf(t, mux, "\x36\x03A"); got != "" {
+		t.Fatalf("matched %q, want the other bytes exact", got)
+	}
+}
+
+func TestHandlePrefixFoldDuplicate(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandlePrefixFold(handlerID("old"), "quit"); err != nil {
+		t.Fatal(err)
+	}
+	err := mux.HandlePrefixFold(handlerID("new"), "HELO", "QUIT")
+	if !errors.Is(err, ErrPrefixExists) || !strings.Contains(err.Error(), `"QUIT"`) {
+		t.Fatalf("the duplicate in another case returned %v, want ErrPrefixExists naming the prefix", err)
+	}
+	if got := matchOf(t, mux, "Quit\r\n"); got != "old" {
+		t.Fatalf("matched %q, want the first folded registration", got)
+	}
+	if got := matchOf(t, mux, "helo x"); got != "" {
+		t.Fatalf("matched %q, want nothing of the failing call registered", got)
+	}
+	if err := mux.HandlePrefixFold(handlerID("c"), "Mail", "MAIL"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("a prefix repeated in another case returned %v, want ErrPrefixExists", err)
+	}
+	if err := mux.HandlePrefixFold(handlerID("d"), ""); err == nil || errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("the empty prefix returned %v", err)
+	}
+	// a case-sensitive prefix is registered apart from the folded one
+	if err := mux.HandlePrefix(handlerID("exact"), "QUIT"); err != nil {
+		t.Fatal(err)
+	}
+}
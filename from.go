@@ -0,0 +1,145 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HandlePrefixFrom handle the handler that matches the prefix of the connections whose source address
+// is in one of the CIDRs, such as "10.0.0.0/8" or a single address. The connections from elsewhere are matched
+// as if the registration did not exist. It wins over a plain registration of the same prefix.
+func (m *CMux) HandlePrefixFrom(handler Handler, cidrs []string, prefixes ...string) error {
+	if err := noBudget("HandlePrefixFrom", handler); err != nil {
+		return err
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		n, err := parseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	name := m.nameOf(handler)
+	restricted := make(map[string][]*route, len(m.restricted)+len(prefixes))
+	for prefix, rs := range m.restricted {
+		restricted[prefix] = rs
+	}
+	for _, prefix := range prefixes {
+		pattern := "from:" + strings.Join(cidrs, ",") + ":" + prefix
+		r := &route{
+			pattern: prefix,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf(pattern),
+			sources: nets,
+		}
+		rs := make([]*route, 0, len(restricted[prefix])+1)
+		rs = append(rs, restricted[prefix]...)
+		restricted[prefix] = append(rs, r)
+	}
+	m.restricted = restricted
+	m.rebuild()
+	return nil
+}
+
+// SetAllowNonIPSources sets whether the connections whose source address is not an IP address,
+// such as the ones of a unix socket, pass the restrictions of HandlePrefixFrom, the default is false.
+func (m *CMux) SetAllowNonIPSources(allow bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.allowNonIP = allow
+	m.rebuild()
+}
+
+func (t *table) allowSource(nets []*net.IPNet, addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return t.allowNonIP
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow reports whether the restrictions of r allow the source addr and the local address.
+func (t *table) allow(r *route, addr, local net.Addr) bool {
+	if r.locals != nil && !allowLocal(r.locals, local) {
+		return false
+	}
+	return r.sources == nil || t.allowSource(r.sources, addr)
+}
+
+// lookupRestricted is like lookupPrefix for the restricted prefixes that allow addr and local,
+// the earlier registration of a prefix wins.
+func (t *table) lookupRestricted(b []byte, from int, addr, local net.Addr, best *route, first bool) *route {
+	maxLength := t.exactLength
+	if len(b) < maxLength {
+		maxLength = len(b)
+	}
+	for n := from + 1; n <= maxLength; n++ {
+		for _, r := range t.restricted[string(b[:n])] {
+			if t.allow(r, addr, local) {
+				best = r
+				break
+			}
+		}
+		if first && best != nil {
+			break
+		}
+	}
+	return best
+}
+
+// parseCIDR parses a CIDR or a single IP address, IPv4 addresses are kept in their 4-byte form.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// addrIP returns the IP address of addr, an IPv4-mapped IPv6 address is returned in its 4-byte form.
+func addrIP(addr net.Addr) net.IP {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,101 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// dispatchFrom returns the id of the handler that b from the remote address is dispatched to, "" if nothing matches.
+func dispatchFrom(t testing.TB, mux *CMux, remote net.Addr, b string) string {
+	t.Helper()
+	var id string
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		id = string(handler.(handlerID))
+	})
+	conn := newMemConn([]byte(b))
+	conn.remote = remote
+	err := mux.DispatchConn(conn)
+	if errors.Is(err, ErrNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("DispatchConn(%q from %v): %v", b, remote, err)
+	}
+	return id
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestHandlePrefixFrom(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixFrom(handlerID("admin-ssh"), []string{"10.0.0.0/8", "192.168.1.7", "fd00::/8"}, "SSH-")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+
+	for _, tc := range []struct {
+		from string
+		want string
+	}{
+		{"10.1.2.3", "admin-ssh"},
+		{"192.168.1.7", "admin-ssh"},
+		{"192.168.1.8", ""},
+		{"8.8.8.8", ""},
+		// the IPv4-mapped IPv6 addresses are the IPv4 addresses
+		{"::ffff:10.1.2.3", "admin-ssh"},
+		{"::ffff:8.8.8.8", ""},
+		{"fd12::1", "admin-ssh"},
+		{"2001:db8::1", ""},
+	} {
+		if got := dispatchFrom(t, mux, tcpAddr(tc.from), "SSH-2.0-x"); got != tc.want {
+			t.Errorf("SSH from %s matched %q, want %q", tc.from, got, tc.want)
+		}
+	}
+	// the open registrations do not care about the source
+	if got := dispatchFrom(t, mux, tcpAddr("8.8.8.8"), "\x16\x03\x01"); got != "tls" {
+		t.Errorf("TLS from outside matched %q", got)
+	}
+}
+
+func TestHandlePrefixFromWithOpenPrefix(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixFrom(handlerID("internal"), []string{"10.0.0.0/8"}, "GET ")
+	mux.HandlePrefix(handlerID("public"), "GET ")
+	mux.HandlePrefix(handlerID("broad"), "GE")
+	mux.HandlePrefixFrom(handlerID("internal-api"), []string{"10.0.0.0/8"}, "GET /api")
+
+	for _, tc := range []struct {
+		from, b, want string
+	}{
+		{"10.0.0.1", "GET / HTTP/1.1", "internal"},
+		{"8.8.8.8", "GET / HTTP/1.1", "public"},
+		{"10.0.0.1", "GET /api HTTP/1.1", "internal-api"},
+		// the longer restricted prefix does not exist for the outside, the open one of the same path wins
+		{"8.8.8.8", "GET /api HTTP/1.1", "public"},
+		{"8.8.8.8", "GEX", "broad"},
+	} {
+		if got := dispatchFrom(t, mux, tcpAddr(tc.from), tc.b); got != tc.want {
+			t.Errorf("%q from %s matched %q, want %q", tc.b, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestHandlePrefixFromNonIP(t *testing.T) {
+	unix := &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}
+	mux := NewCMux()
+	mux.HandlePrefixFrom(handlerID("admin"), []string{"10.0.0.0/8"}, "SSH-")
+	if got := dispatchFrom(t, mux, unix, "SSH-2.0-x"); got != "" {
+		t.Fatalf("a unix socket matched %q, want it denied by default", got)
+	}
+	mux.SetAllowNonIPSources(true)
+	if got := dispatchFrom(t, mux, unix, "SSH-2.0-x"); got != "admin" {
+		t.Fatalf("a unix socket matched %q once allowed", got)
+	}
+	if got := dispatchFrom(t, mux, tcpAddr("8.8.8.8"), "SSH-2.0-x"); got != "" {
+		t.Fatalf("allowing the non IP sources let %q through", got)
+	}
+	if err := mux.HandlePrefixFrom(handlerID("bad"), []string{"10.0.0.0/33"}, "X"); err == nil {
+		t.Fatal("an invalid CIDR was accepted")
+	}
+}
@@ -1,5 +1,11 @@
 module github.com/wzshiming/cmux
 
-go 1.15
+go 1.16
 
-require github.com/wzshiming/trie v0.0.1
+require (
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/jackc/pgproto3/v2 v2.1.1
+	github.com/jackc/pgx/v4 v4.13.0
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
+	google.golang.org/grpc v1.41.0
+)
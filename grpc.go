@@ -0,0 +1,204 @@
+package cmux
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	http2FrameHeaderLength = 9
+	// http2MaxFrameLength is the initial SETTINGS_MAX_FRAME_SIZE, a client cannot exceed it before the server settings.
+	http2MaxFrameLength = 1 << 14
+	http2FrameHeaders   = 0x1
+	http2FrameCont      = 0x9
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+	// maxGRPCFrames and maxGRPCSniffLength bound the frames inspected for the first header block.
+	maxGRPCFrames      = 8
+	maxGRPCSniffLength = 16 << 10
+	// http2Settings is an empty SETTINGS frame and http2SettingsAck its acknowledgement.
+	http2Settings    = "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+	http2SettingsAck = "\x00\x00\x00\x04\x01\x00\x00\x00\x00"
+)
+
+// HandleGRPC handle the handlers that match the HTTP/2 connections with prior knowledge, the connection whose
+// first request has a content-type starting with "application/grpc" goes to grpc and the others go to other,
+// see MatchGRPC. A nil other leaves the others unmatched. It takes the place of HandleHTTP2,
+// whose prefix would win over the inspection of the frames. All the bytes buffered are replayed to the handler.
+// As the clients such as grpc-go wait for the server preface before their first request, the mux answers
+// the connection preface with an empty SETTINGS frame and takes the acknowledgement of it out of the bytes
+// the handler reads, the server of the handler sends its own settings as usual.
+func (m *CMux) HandleGRPC(grpc Handler, other Handler) error {
+	err := m.addMatcher(grpc, &matcherRoute{more: grpcMatcher{}, maxBytes: maxGRPCSniffLength}, "grpc")
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return nil
+	}
+	// consulted once MatchGRPC has given up, as the matchers are in registration order
+	return m.handleMatcher(other, MatcherFunc(matchHTTP2Preface), len(HTTP2Preface), "h2")
+}
+
+func matchHTTP2Preface(b []byte) (matched bool, needMore bool) {
+	n := len(b)
+	if n > len(HTTP2Preface) {
+		n = len(HTTP2Preface)
+	}
+	if string(b[:n]) != HTTP2Preface[:n] {
+		return false, false
+	}
+	return n == len(HTTP2Preface), n < len(HTTP2Preface)
+}
+
+// MatchGRPC matches the HTTP/2 connection preface followed by the frames up to the end of the first header block,
+// the HEADERS frame and its CONTINUATION frames, whose content-type starts with "application/grpc".
+// It reads at most 8 frames after the preface.
+func MatchGRPC(b []byte) (matched bool, more int) {
+	if ok, needMore := matchHTTP2Preface(b); !ok {
+		if needMore {
+			return false, len(HTTP2Preface) - len(b)
+		}
+		return false, 0
+	}
+	off := len(HTTP2Preface)
+	var block []byte
+	for frames := 0; ; frames++ {
+		if frames == maxGRPCFrames {
+			return false, 0
+		}
+		if len(b) < off+http2FrameHeaderLength {
+			return false, off + http2FrameHeaderLength - len(b)
+		}
+		length := int(b[off])<<16 | int(b[off+1])<<8 | int(b[off+2])
+		typ, flags := b[off+3], b[off+4]
+		if length > http2MaxFrameLength {
+			return false, 0
+		}
+		off += http2FrameHeaderLength
+		if len(b) < off+length {
+			return false, off + length - len(b)
+		}
+		payload := b[off : off+length]
+		off += length
+
+		switch {
+		case typ == http2FrameHeaders && block == nil:
+			if flags&http2FlagPadded != 0 {
+				if len(payload) < 1 || int(payload[0]) >= len(payload) {
+					return false, 0
+				}
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+			if flags&http2FlagPriority != 0 {
+				if len(payload) < 5 {
+					return false, 0
+				}
+				payload = payload[5:]
+			}
+			block = append([]byte{}, payload...)
+		case typ == http2FrameCont && block != nil:
+			block = append(block, payload...)
+		case block != nil:
+			// nothing but CONTINUATION may follow a HEADERS frame without END_HEADERS
+			return false, 0
+		default:
+			// SETTINGS, WINDOW_UPDATE and the others before the first request
+			continue
+		}
+		if flags&http2FlagEndHeaders != 0 {
+			contentType, ok := hpackContentType(block)
+			return ok && strings.HasPrefix(contentType, "application/grpc"), 0
+		}
+	}
+}
+
+// grpcMatcher is MatchGRPC, the table answers the preface of the HTTP/2 clients when it is registered.
+type grpcMatcher struct{}
+
+func (grpcMatcher) MatchMore(b []byte) (matched bool, more int) {
+	return MatchGRPC(b)
+}
+
+// http2PrefaceConn answers the connection preface of an HTTP/2 client with an empty SETTINGS frame
+// and takes the first SETTINGS acknowledgement of the client, the one of that frame, out of what is read.
+type http2PrefaceConn struct {
+	net.Conn
+	// off is the offset in the preface, then in the header of the frame being read.
+	off      int
+	answered bool
+	done     bool
+	// header is held back until it is known not to be the acknowledgement.
+	header [http2FrameHeaderLength]byte
+	// payload is the length left to read of the payload of the frame.
+	payload int
+	pending []byte
+}
+
+func (c *http2PrefaceConn) Read(b []byte) (int, error) {
+	for {
+		if len(c.pending) != 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		if c.done || len(b) == 0 {
+			return c.Conn.Read(b)
+		}
+		n, err := c.Conn.Read(b)
+		c.filter(b[:n])
+		if len(c.pending) == 0 && err != nil {
+			return 0, err
+		}
+	}
+}
+
+// filter appends in to the pending bytes but the acknowledgement, it answers the preface once it was read.
+func (c *http2PrefaceConn) filter(in []byte) {
+	for len(in) != 0 && !c.done {
+		switch {
+		case !c.answered:
+			n := len(HTTP2Preface) - c.off
+			if n > len(in) {
+				n = len(in)
+			}
+			if string(in[:n]) != HTTP2Preface[c.off:c.off+n] {
+				// not HTTP/2, nothing is answered
+				c.done = true
+				continue
+			}
+			c.pending = append(c.pending, in[:n]...)
+			in = in[n:]
+			c.off += n
+			if c.off == len(HTTP2Preface) {
+				c.answered = true
+				c.off = 0
+				c.Conn.Write([]byte(http2Settings))
+			}
+		case c.payload != 0:
+			n := c.payload
+			if n > len(in) {
+				n = len(in)
+			}
+			c.pending = append(c.pending, in[:n]...)
+			in = in[n:]
+			c.payload -= n
+		default:
+			n := copy(c.header[c.off:], in)
+			in = in[n:]
+			c.off += n
+			if c.off != len(c.header) {
+				continue
+			}
+			c.off = 0
+			if string(c.header[:]) == http2SettingsAck {
+				c.done = true
+				continue
+			}
+			c.pending = append(c.pending, c.header[:]...)
+			c.payload = int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+		}
+	}
+	c.pending = append(c.pending, in...)
+}
@@ -0,0 +1,250 @@
+package cmux
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// hpackInt encodes v with a prefix of n bits under the flags of the first byte.
+func hpackInt(flags byte, n uint, v int) []byte {
+	max := 1<<n - 1
+	if v < max {
+		return []byte{flags | byte(v)}
+	}
+	b := []byte{flags | byte(max)}
+	for v -= max; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// huffmanEncode encodes s with the Huffman code of HPACK, padded with ones.
+func huffmanEncode(s string) []byte {
+	var out []byte
+	var acc uint64
+	var n uint
+	for i := 0; i != len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += uint(c.bits)
+		for n >= 8 {
+			out = append(out, byte(acc>>(n-8)))
+			n -= 8
+		}
+		acc &= 1<<n - 1
+	}
+	if n != 0 {
+		out = append(out, byte(acc<<(8-n))|byte(1<<(8-n)-1))
+	}
+	return out
+}
+
+// hpackStr encodes a string literal, Huffman encoded like grpc-go and net/http2 do when it is shorter.
+func hpackStr(s string, huffman bool) []byte {
+	if huffman {
+		h := huffmanEncode(s)
+		return append(hpackInt(0x80, 7, len(h)), h...)
+	}
+	return append(hpackInt(0, 7, len(s)), s...)
+}
+
+// requestBlock returns the header block of the first request of a client, with the content-type if it is not empty.
+func requestBlock(contentType string, huffman bool) []byte {
+	// :method POST, :scheme http, :path /, then the literals without indexing
+	block := []byte{0x83, 0x86, 0x84}
+	block = append(block, hpackInt(0x00, 4, 1)...)
+	block = append(block, hpackStr("localhost", huffman)...)
+	if contentType != "" {
+		block = append(block, hpackInt(0x00, 4, hpackStaticContentType)...)
+		block = append(block, hpackStr(contentType, huffman)...)
+	}
+	// te: trailers, with a literal name
+	block = append(block, 0x00)
+	block = append(block, hpackStr("te", huffman)...)
+	block = append(block, hpackStr("trailers", huffman)...)
+	return block
+}
+
+func http2Frame(typ, flags byte, stream uint32, payload []byte) string {
+	n := len(payload)
+	header := []byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	return string(header) + string(payload)
+}
+
+// clientStart returns the preface, the SETTINGS and WINDOW_UPDATE frames a client sends first,
+// then the header block in a HEADERS frame followed by CONTINUATION frames cut at the offsets.
+func clientStart(block []byte, offsets ...int) string {
+	s := HTTP2Preface
+	s += http2Frame(0x4, 0, 0, []byte{0x00, 0x02, 0, 0, 0, 0, 0x00, 0x04, 0, 0x40, 0, 0})
+	s += http2Frame(0x8, 0, 0, []byte{0, 0x3f, 0, 0x01})
+	last := 0
+	for i, off := range append(offsets, len(block)) {
+		typ, flags := byte(http2FrameCont), byte(0)
+		if i == 0 {
+			typ = http2FrameHeaders
+		}
+		if off == len(block) {
+			flags = http2FlagEndHeaders
+		}
+		s += http2Frame(typ, flags, 1, block[last:off])
+		last = off
+	}
+	return s
+}
+
+func TestHandleGRPC(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleGRPC(handlerID("grpc"), handlerID("h2"))
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	grpc := requestBlock("application/grpc", true)
+	padded := append([]byte{3}, requestBlock("application/grpc+proto", false)...)
+	padded = append(padded, 0, 0, 0)
+	priority := append([]byte{0, 0, 0, 0, 15}, grpc...)
+	for _, tc := range []struct {
+		name string
+		b    string
+		want string
+	}{
+		{"gRPC", clientStart(grpc), "grpc"},
+		{"gRPC without Huffman", clientStart(requestBlock("application/grpc", false)), "grpc"},
+		{"gRPC with a subtype", clientStart(requestBlock("application/grpc+proto", true)), "grpc"},
+		{"gRPC in CONTINUATION frames", clientStart(grpc, 2, 9, len(grpc)-3), "grpc"},
+		{"gRPC with a literal name", clientStart(append(append([]byte{0x10}, hpackStr("content-type", true)...), hpackStr("application/grpc", true)...)), "grpc"},
+		{"gRPC padded", HTTP2Preface + http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagPadded, 1, padded), "grpc"},
+		{"gRPC with priority", HTTP2Preface + http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagPriority, 1, priority), "grpc"},
+		{"JSON", clientStart(requestBlock("application/json", true)), "h2"},
+		{"no content-type", clientStart(requestBlock("", true)), "h2"},
+		{"content-type without value", clientStart([]byte{0x83, 0x86, 0x80 | hpackStaticContentType}), "h2"},
+		{"DATA between HEADERS and CONTINUATION", HTTP2Preface + http2Frame(http2FrameHeaders, 0, 1, grpc[:4]) +
+			http2Frame(0x0, 0, 1, []byte("x")) + http2Frame(http2FrameCont, http2FlagEndHeaders, 1, grpc[4:]), "h2"},
+		{"too many frames", HTTP2Preface + strings.Repeat(http2Frame(0x8, 0, 0, []byte{0, 0, 0, 1}), maxGRPCFrames) +
+			http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, grpc), "h2"},
+		{"frame over the length bound", HTTP2Preface + "\x00\x40\x01\x04\x00\x00\x00\x00\x00", "h2"},
+		{"malformed block", clientStart([]byte{0x00, 0x85}), "h2"},
+		{"HTTP/1", "GET / HTTP/1.1\r\n\r\n", "http"},
+	} {
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHandleGRPCWithoutOther(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleGRPC(handlerID("grpc"), nil)
+	if got := matchOf(t, mux, clientStart(requestBlock("application/json", true))); got != "" {
+		t.Fatalf("matched %q, want the other connections unmatched", got)
+	}
+}
+
+func TestMatchGRPCTruncated(t *testing.T) {
+	b := clientStart(requestBlock("application/grpc", true), 5)
+	for n := 0; n < len(b); n++ {
+		matched, more := MatchGRPC([]byte(b[:n]))
+		if matched || more <= 0 || n+more > len(b) {
+			t.Fatalf("MatchGRPC of %d bytes = %v, %d, want at most %d more bytes", n, matched, more, len(b)-n)
+		}
+	}
+	if matched, _ := MatchGRPC([]byte(b)); !matched {
+		t.Fatal("MatchGRPC did not match the whole header block")
+	}
+}
+
+func TestHandleGRPCReplaysFrames(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleGRPC(h, handlerID("h2"))
+	client := servePipe(mux)
+	defer client.Close()
+	b := clientStart(requestBlock("application/grpc", true), 3)
+	// the client acknowledges the settings of the mux before its request, as grpc-go does
+	start := len(HTTP2Preface) + 2*http2FrameHeaderLength + 12 + 4
+	wire := b[:start] + http2SettingsAck + b[start:]
+	// the frames arrive cut inside the frame headers
+	go writeChunks(client, wire[:20], wire[20:30], wire[30:start+4], wire[start+4:start+20], wire[start+20:])
+	if got := readN(t, client, len(http2Settings)); got != http2Settings {
+		t.Fatalf("the preface was answered %q, want an empty SETTINGS frame", got)
+	}
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(b)); got != b {
+		t.Fatalf("the gRPC handler read %q, want the frames replayed without the acknowledgement", got)
+	}
+	// the next acknowledgement is the one of the settings of the server of the handler
+	ping := http2Frame(0x6, 0, 0, []byte("12345678"))
+	go writeChunks(client, http2SettingsAck[:4], http2SettingsAck[4:]+ping[:3], ping[3:])
+	if got, want := readN(t, conn, len(http2SettingsAck)+len(ping)), http2SettingsAck+ping; got != want {
+		t.Fatalf("the gRPC handler read %q, want %q", got, want)
+	}
+}
+
+func TestHandleGRPCClients(t *testing.T) {
+	grpcLn := NewListenerHandler()
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(grpcLn)
+	defer gs.Stop()
+	srv := &http2.Server{}
+	h2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("h2 " + r.Header.Get("Content-Type")))
+	})
+	mux := NewCMux()
+	mux.HandleGRPC(grpcLn, HandlerFunc(func(conn net.Conn) {
+		srv.ServeConn(conn, &http2.ServeConnOpts{Handler: h2})
+	}))
+	addr := listenMux(t, mux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("the gRPC client got the status %v", resp.Status)
+	}
+
+	client := h2cClient()
+	defer client.CloseIdleConnections()
+	r, err := client.Post("http://"+addr+"/api", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "h2 application/json" {
+		t.Fatalf("the h2c client got %q, want the answer of the other HTTP/2 handler", body)
+	}
+}
+
+func TestHuffmanDecodeRoundTrip(t *testing.T) {
+	for _, s := range []string{"", "a", "application/grpc", "www.example.com", "\x00\xff~|"} {
+		got, ok := huffmanDecode(huffmanEncode(s))
+		if !ok || got != s {
+			t.Errorf("huffmanDecode(huffmanEncode(%q)) = %q, %v", s, got, ok)
+		}
+	}
+	// the padding must be the most significant bits of EOS
+	if _, ok := huffmanDecode([]byte{0x00}); ok {
+		t.Error("huffmanDecode accepted a padding of zeros")
+	}
+}
@@ -0,0 +1,161 @@
+package cmux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RejectHandler returns a handler that closes the connections,
+// with rst set a TCP connection is reset instead of being closed gracefully.
+func RejectHandler(rst bool) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		if rst {
+			if lc, ok := baseConn(conn).(interface{ SetLinger(sec int) error }); ok {
+				lc.SetLinger(0)
+			}
+		}
+		conn.Close()
+	})
+}
+
+// StaticOption configures the handler returned by StaticHandler.
+type StaticOption func(s *staticHandler)
+
+// WithStaticWriteTimeout bounds the writing of the response, the default is 5 seconds.
+func WithStaticWriteTimeout(timeout time.Duration) StaticOption {
+	return func(s *staticHandler) {
+		s.writeTimeout = timeout
+	}
+}
+
+// WithStaticDrain sets how long the bytes still sent by the client are discarded after the response,
+// closing with unread bytes makes some stacks reset the connection before the client reads the response.
+// The default is 1 second, zero closes right after the response.
+func WithStaticDrain(grace time.Duration) StaticOption {
+	return func(s *staticHandler) {
+		s.drain = grace
+	}
+}
+
+// StaticHandler returns a handler that writes the response and closes the connections.
+func StaticHandler(response []byte, opts ...StaticOption) Handler {
+	s := &staticHandler{
+		response:     response,
+		writeTimeout: 5 * time.Second,
+		drain:        time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// HTTPErrorHandler returns a handler that answers with a minimal HTTP/1.1 response of the status code and body.
+func HTTPErrorHandler(code int, body string, opts ...StaticOption) Handler {
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+	return StaticHandler([]byte(response), opts...)
+}
+
+type staticHandler struct {
+	response     []byte
+	writeTimeout time.Duration
+	drain        time.Duration
+}
+
+func (s *staticHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	if s.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	_, err := conn.Write(s.response)
+	if err != nil || s.drain <= 0 {
+		return
+	}
+	drain(conn, maxDrainBytes, s.drain, true)
+}
+
+const (
+	// defaultDrainBytes and maxDrainBytes are the default and the upper bound of the bytes discarded by a drain.
+	defaultDrainBytes = 64 << 10
+	maxDrainBytes     = 16 << 20
+	// defaultDrainDuration and maxDrainDuration are the default and the upper bound of the duration of a drain.
+	defaultDrainDuration = time.Second
+	maxDrainDuration     = time.Minute
+)
+
+// DrainHandler returns a handler that discards the bytes still sent by the client before closing the connection,
+// so that the close does not reset the connection while the writes of the client are in flight.
+// It reads until the client closes, up to max bytes and for up to d, zero means 64 KiB and 1 second,
+// and they are bounded to 16 MiB and 1 minute. With closeWrite the write side is closed first
+// so that the client sees the end of the stream and closes its side.
+func DrainHandler(max int64, d time.Duration, closeWrite bool) Handler {
+	if max <= 0 {
+		max = defaultDrainBytes
+	} else if max > maxDrainBytes {
+		max = maxDrainBytes
+	}
+	if d <= 0 {
+		d = defaultDrainDuration
+	} else if d > maxDrainDuration {
+		d = maxDrainDuration
+	}
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		drain(conn, max, d, closeWrite)
+	})
+}
+
+// drain discards the bytes read from conn until EOF, max bytes or d.
+func drain(conn net.Conn, max int64, d time.Duration, closeWrite bool) {
+	if closeWrite {
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+	io.CopyN(io.Discard, conn, max)
+}
+
+// NotFoundPolicy is how the mux disposes of the connections that are not found when there is no NotFound handler.
+type NotFoundPolicy struct {
+	handler Handler
+}
+
+var (
+	// PolicyClose closes the connection.
+	PolicyClose = NotFoundPolicy{}
+	// PolicyReset resets a TCP connection instead of closing it gracefully.
+	PolicyReset = NotFoundPolicy{handler: RejectHandler(true)}
+)
+
+// PolicyDrain discards the bytes still sent by the client for the grace before closing the connection,
+// so that the in-flight writes of the client do not make the close reset the connection.
+func PolicyDrain(grace time.Duration) NotFoundPolicy {
+	return PolicyDrainConn(maxDrainBytes, grace, false)
+}
+
+// PolicyDrainConn drains the connection like DrainHandler before closing it.
+func PolicyDrainConn(max int64, d time.Duration, closeWrite bool) NotFoundPolicy {
+	return NotFoundPolicy{handler: DrainHandler(max, d, closeWrite)}
+}
+
+// PolicyTarpit holds the connection open doing nothing for the duration before closing it, to slow down scanners.
+func PolicyTarpit(d time.Duration) NotFoundPolicy {
+	return NotFoundPolicy{handler: HandlerFunc(func(conn net.Conn) {
+		time.Sleep(d)
+		conn.Close()
+	})}
+}
+
+// SetNotFoundPolicy sets how the connections that are not found are disposed of when there is no NotFound handler,
+// the default is PolicyClose.
+func (m *CMux) SetNotFoundPolicy(p NotFoundPolicy) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.notFoundPolicy = p
+	m.rebuild()
+}
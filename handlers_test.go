@@ -0,0 +1,304 @@
+package cmux
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readErr reads from conn until an error, the error is returned.
+func readErr(t testing.TB, conn net.Conn) error {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+func TestRejectHandlerReset(t *testing.T) {
+	for _, register := range []struct {
+		name string
+		fn   func(mux *CMux, h Handler)
+	}{
+		{"prefix", func(mux *CMux, h Handler) { mux.HandlePrefix(h, "SCAN") }},
+		{"notfound", func(mux *CMux, h Handler) { mux.NotFound(h) }},
+	} {
+		mux := NewCMux()
+		register.fn(mux, RejectHandler(true))
+		conn := serveTCP(t, mux)
+		conn.Write([]byte("SCAN"))
+		err := readErr(t, conn)
+		conn.Close()
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("%s: the client read %v, want ECONNRESET", register.name, err)
+		}
+	}
+}
+
+func TestRejectHandlerClose(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(RejectHandler(false), "SCAN")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("SCAN"))
+	if err := readErr(t, conn); err != io.EOF {
+		t.Fatalf("the client read %v, want a graceful io.EOF", err)
+	}
+
+	// a conn without SetLinger is closed
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SCAN"))
+	if err := readErr(t, client); err != io.EOF {
+		t.Fatalf("the pipe read %v, want io.EOF", err)
+	}
+}
+
+func TestStaticHandlerWhileClientSends(t *testing.T) {
+	response := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	mux := NewCMux()
+	mux.HandlePrefix(StaticHandler(response, WithStaticDrain(200*time.Millisecond)), "GET ")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	// the client keeps sending its request while the response is written
+	go func() {
+		conn.Write([]byte("GET "))
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for i := 0; i != 256; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+		conn.CloseWrite()
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read %d bytes of the response: %v", len(got), err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Fatalf("read %d bytes, want the %d bytes of the response", len(got), len(response))
+	}
+}
+
+func TestHTTPErrorHandler(t *testing.T) {
+	mux := NewCMux()
+	mux.NotFound(HTTPErrorHandler(http.StatusBadRequest, "bad request\n", WithStaticDrain(0)))
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("GARBAGE"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || string(body) != "bad request\n" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	if !resp.Close || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("Connection close is %v and Content-Length is %d", resp.Close, resp.ContentLength)
+	}
+}
+
+func TestStaticHandlerWriteTimeout(t *testing.T) {
+	h := StaticHandler([]byte("never read"), WithStaticWriteTimeout(20*time.Millisecond))
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		h.ServeConn(server)
+		close(done)
+	}()
+	// nobody reads the pipe, the write deadline gives up
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write to a stuck client did not time out")
+	}
+}
+
+func TestNotFoundPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy NotFoundPolicy
+		// send writes to the client after the unmatched prefix
+		send  func(conn *net.TCPConn)
+		check func(err error, elapsed time.Duration) bool
+	}{
+		{
+			name:   "close",
+			policy: PolicyClose,
+			check: func(err error, elapsed time.Duration) bool {
+				return err == io.EOF && elapsed < time.Second
+			},
+		},
+		{
+			name:   "drain",
+			policy: PolicyDrain(time.Second),
+			// closing with these bytes unread would reset the connection
+			send: func(conn *net.TCPConn) {
+				conn.Write(bytes.Repeat([]byte("x"), 64<<10))
+				conn.CloseWrite()
+			},
+			check: func(err error, elapsed time.Duration) bool {
+				return err == io.EOF && elapsed < time.Second
+			},
+		},
+		{
+			name:   "drain grace",
+			policy: PolicyDrain(100 * time.Millisecond),
+			check: func(err error, elapsed time.Duration) bool {
+				return err == io.EOF && elapsed >= 100*time.Millisecond
+			},
+		},
+		{
+			name:   "reset",
+			policy: PolicyReset,
+			check: func(err error, elapsed time.Duration) bool {
+				return errors.Is(err, syscall.ECONNRESET)
+			},
+		},
+		{
+			name:   "tarpit",
+			policy: PolicyTarpit(100 * time.Millisecond),
+			check: func(err error, elapsed time.Duration) bool {
+				return err == io.EOF && elapsed >= 100*time.Millisecond
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := NewCMux()
+			mux.HandlePrefix(handlerID("ssh"), "SSH-")
+			mux.SetNotFoundPolicy(tc.policy)
+			conn := serveTCP(t, mux)
+			defer conn.Close()
+			start := time.Now()
+			conn.Write([]byte("GET "))
+			if tc.send != nil {
+				go tc.send(conn)
+			}
+			err := readErr(t, conn)
+			if elapsed := time.Since(start); !tc.check(err, elapsed) {
+				t.Fatalf("the client read %v after %v", err, elapsed)
+			}
+		})
+	}
+}
+
+func TestNotFoundHandlerWinsOverPolicy(t *testing.T) {
+	mux := NewCMux()
+	mux.SetNotFoundPolicy(PolicyTarpit(time.Hour))
+	h, ch := connChan()
+	mux.NotFound(h)
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("GET "))
+	conn := recvConn(t, ch)
+	conn.Close()
+}
+
+func TestDrainAvoidsReset(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy NotFoundPolicy
+		reset  bool
+	}{
+		{"close", PolicyClose, true},
+		{"drain", PolicyDrainConn(1<<20, time.Second, false), false},
+		{"drain closing the write side", PolicyDrainConn(1<<20, time.Second, true), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := NewCMux()
+			mux.HandlePrefix(handlerID("ssh"), "SSH-")
+			mux.SetNotFoundPolicy(tc.policy)
+			conn := serveTCP(t, mux)
+			defer conn.Close()
+			// the request is still in flight when the mux gives up on its first bytes
+			go func() {
+				conn.Write(append([]byte("GET / HTTP/1.1\r\n"), bytes.Repeat([]byte("x"), 256<<10)...))
+				conn.CloseWrite()
+			}()
+			err := readErr(t, conn)
+			if reset := errors.Is(err, syscall.ECONNRESET); reset != tc.reset {
+				t.Fatalf("the client read %v, want a reset %v", err, tc.reset)
+			}
+			if !tc.reset && err != io.EOF {
+				t.Fatalf("the client read %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestDrainHandlerCloseWrite(t *testing.T) {
+	done := make(chan struct{})
+	h := DrainHandler(0, 5*time.Second, true)
+	mux := NewCMux()
+	mux.NotFound(HandlerFunc(func(conn net.Conn) {
+		h.ServeConn(conn)
+		close(done)
+	}))
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("QUIT\r\n"))
+	// the write side is closed at once, the client sees the end of the stream while the mux still reads
+	if err := readErr(t, conn); err != io.EOF {
+		t.Fatalf("the client read %v, want EOF", err)
+	}
+	if _, err := conn.Write([]byte("late bytes")); err != nil {
+		t.Fatalf("the client could not write to the draining side: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("the drain ended before the client closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the drain did not end once the client closed")
+	}
+}
+
+func TestDrainHandlerBounds(t *testing.T) {
+	done := make(chan struct{})
+	h := DrainHandler(16, time.Minute, false)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		h.ServeConn(server)
+		close(done)
+	}()
+	// the client keeps the connection open, the drain ends after its bytes
+	client.Write([]byte(strings.Repeat("x", 16)))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the drain did not end after max bytes")
+	}
+
+	start := time.Now()
+	client, server = net.Pipe()
+	defer client.Close()
+	DrainHandler(0, 50*time.Millisecond, false).ServeConn(server)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("the drain of a silent client took %v, want its duration", elapsed)
+	}
+}
@@ -0,0 +1,78 @@
+package cmux
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HandlePrefixHex handle the handler that matches the prefix written in hex, such as "16 03 01",
+// "0x160301" or "16-03-01". A prefix that does not parse is an error and nothing is registered.
+func (m *CMux) HandlePrefixHex(handler Handler, hexPrefixes ...string) error {
+	prefixes := make([]string, 0, len(hexPrefixes))
+	for _, s := range hexPrefixes {
+		b, err := parseHex(s)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, string(b))
+	}
+	return m.HandlePrefix(handler, prefixes...)
+}
+
+// parseHex parses the hex bytes of s, separated or not by spaces, dashes or colons, with an optional "0x".
+func parseHex(s string) ([]byte, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "0x"), "0X")
+	digits = strings.NewReplacer(" ", "", "-", "", ":", "").Replace(digits)
+	if digits == "" {
+		return nil, fmt.Errorf("hex pattern %q: empty", s)
+	}
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("hex pattern %q: %w", s, err)
+	}
+	return b, nil
+}
+
+// ParsePattern parses the bytes of a pattern written as text with the escapes of Go, such as "GET \x00"
+// or "\x16\x03\x01". A pattern in double quotes is unquoted as a Go string, so the prefixes printed by String
+// can be pasted back.
+func ParsePattern(s string) ([]byte, error) {
+	if strings.HasPrefix(s, `"`) {
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", s, err)
+		}
+		return []byte(u), nil
+	}
+	b := make([]byte, 0, len(s))
+	for rest := s; rest != ""; {
+		// the bytes up to the next escape are taken as they are, even if they are not UTF-8
+		if i := strings.IndexByte(rest, '\\'); i != 0 {
+			if i < 0 {
+				i = len(rest)
+			}
+			b = append(b, rest[:i]...)
+			rest = rest[i:]
+			continue
+		}
+		if len(rest) >= 2 && (rest[1] == '"' || rest[1] == '\'') {
+			// the quotes are escaped in the quoted forms, the pattern may be pasted from them without its quotes
+			b = append(b, rest[1])
+			rest = rest[2:]
+			continue
+		}
+		r, multibyte, tail, err := strconv.UnquoteChar(rest, 0)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", s, err)
+		}
+		if r < 0x100 && !multibyte {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, string(r)...)
+		}
+		rest = tail
+	}
+	return b, nil
+}
@@ -0,0 +1,148 @@
+package cmux
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHandlePrefixHex(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandlePrefixHex(handlerID("tls"), "16 03 01", "0x160302", "16-03-03"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.HandlePrefixHex(handlerID("rdp"), "03:00"); err != nil {
+		t.Fatal(err)
+	}
+	for b, want := range map[string]string{
+		"\x16\x03\x01\x02": "tls",
+		"\x16\x03\x02\x02": "tls",
+		"\x16\x03\x03\x02": "tls",
+		"\x16\x03\x04\x02": "",
+		"\x03\x00\x00\x13": "rdp",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandlePrefixHexInvalid(t *testing.T) {
+	for _, s := range []string{"", "0x", "16 0", "zz", "16 03 0g", "\\x16"} {
+		mux := NewCMux()
+		err := mux.HandlePrefixHex(handlerID("x"), "16 03 01", s)
+		if err == nil {
+			t.Errorf("HandlePrefixHex accepted %q", s)
+			continue
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(s)) {
+			t.Errorf("the error %q does not name the pattern %q", err, s)
+		}
+		// nothing is registered
+		if prefixes := mux.Prefixes(); len(prefixes) != 0 {
+			t.Errorf("HandlePrefixHex registered %q with the invalid %q", prefixes, s)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string
+	}{
+		{`GET \x00`, "GET \x00"},
+		{`\x16\x03\x01`, "\x16\x03\x01"},
+		{`SSH-2.0-\r\n`, "SSH-2.0-\r\n"},
+		{`tab\there`, "tab\there"},
+		{`quote " and \\`, "quote \" and \\"},
+		{`escaped \" and \'`, "escaped \" and '"},
+		{`\377\xff`, "\xff\xff"},
+		{`é`, "é"},
+		{"raw \xff é", "raw \xff é"},
+		{`"GET \x00"`, "GET \x00"},
+		{`""`, ""},
+	} {
+		got, err := ParsePattern(tc.s)
+		if err != nil {
+			t.Errorf("ParsePattern(%q): %v", tc.s, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("ParsePattern(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+	for _, s := range []string{`\x1`, `\xzz`, `trailing \`, `\q`, `"unterminated`, `"a" "b"`} {
+		_, err := ParsePattern(s)
+		if err == nil {
+			t.Errorf("ParsePattern accepted %q", s)
+			continue
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(s)) {
+			t.Errorf("the error %q does not name the pattern %q", err, s)
+		}
+	}
+}
+
+// quotedPrefixes returns the quoted prefixes that start the lines of the dump of String.
+func quotedPrefixes(t *testing.T, dump string) []string {
+	var quoted []string
+	for _, line := range strings.Split(strings.TrimSpace(dump), "\n") {
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+		end := 1
+		for line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		quoted = append(quoted, line[:end+1])
+	}
+	return quoted
+}
+
+func TestParsePatternRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i != 200; i++ {
+		b := make([]byte, 1+rnd.Intn(16))
+		rnd.Read(b)
+		// the quoted form of String and the form without the quotes
+		quoted := strconv.Quote(string(b))
+		for _, s := range []string{quoted, quoted[1 : len(quoted)-1]} {
+			got, err := ParsePattern(s)
+			if err != nil {
+				t.Fatalf("ParsePattern(%s): %v", s, err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatalf("ParsePattern(%s) = %q, want %q", s, got, b)
+			}
+		}
+	}
+
+	// the dump of a mux is pasted back into another
+	mux := NewCMux()
+	patterns := []string{"\x16\x03\x01", "GET \x00", "SSH-2.0-", "\xff\xfe\"\\", "é\r\n"}
+	for i, p := range patterns {
+		mux.HandlePrefix(handlerID(strconv.Itoa(i)), p)
+	}
+	copied := NewCMux()
+	for _, quoted := range quotedPrefixes(t, mux.String()) {
+		b, err := ParsePattern(quoted)
+		if err != nil {
+			t.Fatalf("ParsePattern(%s): %v", quoted, err)
+		}
+		h, ok := mux.HandlerForPrefix(string(b))
+		if !ok {
+			t.Fatalf("%s is not a prefix of the mux", quoted)
+		}
+		if err := copied.HandlePrefix(h, string(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := copied.Prefixes(), mux.Prefixes(); strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+		t.Fatalf("the pasted dump has the prefixes %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,267 @@
+package cmux
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HTTP2Preface is the connection preface sent by HTTP/2 clients with prior knowledge.
+const HTTP2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// maxRequestLineLength is the longest HTTP/1.x request line that is sniffed.
+const maxRequestLineLength = 4096
+
+// maxHeaderLength is the longest HTTP/1.x request head that is sniffed for the Host header.
+const maxHeaderLength = 8 << 10
+
+// HandleHTTP1 handle the handler that matches any HTTP/1.x request line,
+// including extension methods such as the WebDAV ones.
+func (m *CMux) HandleHTTP1(handler Handler) error {
+	return m.handleMatcher(handler, MatcherFunc(matchHTTP1), maxRequestLineLength, "http1")
+}
+
+// HandleHTTP2 handle the handler that matches the HTTP/2 connection preface,
+// such as h2c clients with prior knowledge, the whole preface is replayed to the handler.
+func (m *CMux) HandleHTTP2(handler Handler) error {
+	return m.HandlePrefix(handler, HTTP2Preface)
+}
+
+// HandleHTTPHost handle the handler that matches the Host header of a HTTP/1.x request,
+// a host of the form "*.example.com" matches every subdomain of example.com.
+// The headers are buffered until the Host header is seen and replayed to the handler.
+func (m *CMux) HandleHTTPHost(handler Handler, hosts ...string) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		names = append(names, strings.ToLower(strings.TrimSuffix(host, ".")))
+	}
+	return m.handleMatcher(handler, &hostMatcher{hosts: names}, maxHeaderLength, "host:"+strings.Join(names, ","))
+}
+
+// HandleHTTPHostDefault handle the handler that matches the HTTP/1.x request without a Host header,
+// or whose headers exceed the sniffed bound before the Host header.
+func (m *CMux) HandleHTTPHostDefault(handler Handler) error {
+	return m.handleMatcher(handler, &hostMatcher{}, maxHeaderLength, "host:")
+}
+
+// hostMatcher matches the HTTP/1.x request whose host is one of hosts,
+// with no hosts it matches the request carrying no host.
+type hostMatcher struct {
+	hosts []string
+}
+
+func (h *hostMatcher) Match(b []byte) (matched bool, needMore bool) {
+	host, ok, needMore := parseHTTPHost(b)
+	if !ok {
+		if len(h.hosts) == 0 && needMore && len(b) >= maxHeaderLength {
+			return true, false
+		}
+		return false, needMore
+	}
+	if len(h.hosts) == 0 {
+		return host == "", false
+	}
+	return matchServerName(h.hosts, host), false
+}
+
+// parseHTTPHost returns the host without port of the Host header of the HTTP/1.x request head in b,
+// ok is reported once the header is seen or the head ended without it.
+func parseHTTPHost(b []byte) (host string, ok bool, needMore bool) {
+	value, ok, needMore := parseHTTPHeader(b, "Host")
+	if !ok {
+		return "", false, needMore
+	}
+	return stripHostPort(strings.ToLower(value)), true, false
+}
+
+// parseHTTPHeader returns the value of the first header field of the name in the HTTP/1.x request head in b,
+// with the folded lines joined and the surrounding spaces trimmed.
+// ok is reported once the field is seen or the head ended without it.
+func parseHTTPHeader(b []byte, header string) (value string, ok bool, needMore bool) {
+	_, _, version, ok, needMore := parseRequestLine(b)
+	if !ok {
+		return "", false, needMore
+	}
+	if !matchHTTP1Version(version) {
+		return "", false, false
+	}
+	rest := b[bytes.IndexByte(b, '\n')+1:]
+	for {
+		if len(rest) == 0 || len(rest) == 1 && rest[0] == '\r' {
+			return "", false, true
+		}
+		if rest[0] == '\n' || rest[0] == '\r' && rest[1] == '\n' {
+			return "", true, false
+		}
+
+		// A header field may be folded over several lines starting with a space or tab.
+		var field []byte
+		for {
+			i := bytes.IndexByte(rest, '\n')
+			if i < 0 || i == len(rest)-1 {
+				return "", false, true
+			}
+			field = append(field, bytes.TrimRight(rest[:i], "\r")...)
+			rest = rest[i+1:]
+			if rest[0] != ' ' && rest[0] != '\t' {
+				break
+			}
+		}
+
+		i := bytes.IndexByte(field, ':')
+		if i <= 0 {
+			return "", false, false
+		}
+		name := field[:i]
+		for _, c := range name {
+			if !isTokenChar(c) {
+				return "", false, false
+			}
+		}
+		if !bytes.EqualFold(name, []byte(header)) {
+			continue
+		}
+		return strings.TrimSpace(strings.Join(strings.Fields(string(field[i+1:])), " ")), true, false
+	}
+}
+
+// stripHostPort removes the port and the brackets of an IPv6 literal from host.
+func stripHostPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			return host[1:i]
+		}
+		return host
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// HandleHTTPPath handle the handler that matches the path of the HTTP/1.x request target by any of the prefixes,
+// absolute-form targets sent to proxies are matched by their path and the query is ignored.
+func (m *CMux) HandleHTTPPath(handler Handler, pathPrefixes ...string) error {
+	if len(pathPrefixes) == 0 {
+		return nil
+	}
+	return m.handleMatcher(handler, &pathMatcher{prefixes: pathPrefixes}, maxRequestLineLength, "path:"+strings.Join(pathPrefixes, ","))
+}
+
+type pathMatcher struct {
+	prefixes []string
+}
+
+func (p *pathMatcher) Match(b []byte) (matched bool, needMore bool) {
+	_, target, version, ok, needMore := parseRequestLine(b)
+	if !ok {
+		return false, needMore
+	}
+	if !matchHTTP1Version(version) {
+		return false, false
+	}
+	path := requestPath(target)
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// requestPath returns the path of the request target without the query,
+// the scheme and authority of an absolute-form target are removed.
+func requestPath(target []byte) string {
+	path := string(target)
+	if i := strings.Index(path, "://"); i > 0 && path[0] != '/' {
+		path = path[i+len("://"):]
+		if j := strings.IndexByte(path, '/'); j >= 0 {
+			path = path[j:]
+		} else {
+			path = "/"
+		}
+	}
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// matchHTTP1 matches "method SP request-target SP HTTP/1.x CRLF".
+func matchHTTP1(b []byte) (matched bool, needMore bool) {
+	_, _, version, ok, needMore := parseRequestLine(b)
+	if !ok {
+		return false, needMore
+	}
+	return matchHTTP1Version(version), false
+}
+
+func matchHTTP1Version(version []byte) bool {
+	return len(version) == 8 && bytes.HasPrefix(version, []byte("HTTP/1.")) &&
+		version[7] >= '0' && version[7] <= '9'
+}
+
+// parseRequestLine splits the first line of b into its three parts,
+// it fails as soon as a byte that cannot be part of a request line is seen.
+func parseRequestLine(b []byte) (method, target, version []byte, ok bool, needMore bool) {
+	i := 0
+	for ; i < len(b) && isTokenChar(b[i]); i++ {
+	}
+	if i == len(b) {
+		return nil, nil, nil, false, true
+	}
+	if i == 0 || b[i] != ' ' {
+		return nil, nil, nil, false, false
+	}
+	method = b[:i]
+
+	j := i + 1
+	for ; j < len(b) && b[j] > ' ' && b[j] < 0x7f; j++ {
+	}
+	if j == len(b) {
+		return nil, nil, nil, false, true
+	}
+	if j == i+1 || b[j] != ' ' {
+		return nil, nil, nil, false, false
+	}
+	target = b[i+1 : j]
+
+	k := j + 1
+	for ; k < len(b) && b[k] > ' ' && b[k] < 0x7f; k++ {
+	}
+	if k == len(b) {
+		return nil, nil, nil, false, true
+	}
+	version = b[j+1 : k]
+	switch {
+	case b[k] == '\n':
+	case b[k] == '\r':
+		if k+1 == len(b) {
+			return nil, nil, nil, false, true
+		}
+		if b[k+1] != '\n' {
+			return nil, nil, nil, false, false
+		}
+	default:
+		return nil, nil, nil, false, false
+	}
+	if len(version) == 0 {
+		return nil, nil, nil, false, false
+	}
+	return method, target, version, true, false
+}
+
+// isTokenChar reports whether c is a tchar of RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
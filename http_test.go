@@ -0,0 +1,248 @@
+package cmux
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestHandleHTTP1(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTP1(handlerID("http"))
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS", "CONNECT", "TRACE"} {
+		b := method + " / HTTP/1.1\r\nHost: x\r\n\r\n"
+		if got := matchOf(t, mux, b); got != "http" {
+			t.Errorf("%s matched %q, want http", method, got)
+		}
+	}
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "REPORT"} {
+		b := method + " /dav/ HTTP/1.1\r\n"
+		if got := matchOf(t, mux, b); got != "http" {
+			t.Errorf("%s matched %q, want http", method, got)
+		}
+	}
+	if got := matchOf(t, mux, "GET / HTTP/1.0\r\n"); got != "http" {
+		t.Errorf("HTTP/1.0 matched %q", got)
+	}
+	if got := matchOf(t, mux, "SSH-2.0-OpenSSH_9.0\r\n"); got != "ssh" {
+		t.Errorf("SSH matched %q", got)
+	}
+	if got := matchOf(t, mux, "\x16\x03\x01\x00\x05hello"); got != "tls" {
+		t.Errorf("TLS matched %q", got)
+	}
+}
+
+func TestHandleHTTP1Bogus(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTP1(handlerID("http"))
+	for _, b := range []string{
+		"GET / FTP/1.0\r\n",
+		"GET /\r\n",
+		"G(T / HTTP/1.1\r\n",
+		"GET  HTTP/1.1\r\n",
+		"HELO example.com\r\n",
+		// binary protocols starting with ASCII letters
+		"RFB 003.008\n",
+		"AMQP\x00\x00\x09\x01",
+		"ABCD\x00\x01\xff\xfe not a request line\r\n",
+	} {
+		if got := matchOf(t, mux, b); got != "" {
+			t.Errorf("%q matched %q, want nothing", b, got)
+		}
+	}
+}
+
+func TestHandleHTTP2Preface(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleHTTP2(h)
+	mux.HandleHTTP1(handlerID("http1"))
+
+	client := servePipe(mux)
+	defer client.Close()
+	// the SETTINGS frame without parameters that follows the preface
+	settings := "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+	go func() {
+		b := []byte(HTTP2Preface + settings)
+		for len(b) != 0 {
+			n := 3
+			if n > len(b) {
+				n = len(b)
+			}
+			client.Write(b[:n])
+			b = b[n:]
+		}
+	}()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(HTTP2Preface)); got != HTTP2Preface {
+		t.Fatalf("handler read %q, want the whole preface replayed", got)
+	}
+	if got := readN(t, conn, len(settings)); got != settings {
+		t.Fatalf("handler read the frame %q", got)
+	}
+}
+
+// h2cClient returns a client of HTTP/2 with prior knowledge over plain TCP.
+func h2cClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func TestHandleHTTP2Client(t *testing.T) {
+	srv := &http2.Server{}
+	h2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto + " " + r.URL.Path))
+	})
+	mux := NewCMux()
+	mux.HandleHTTP2(HandlerFunc(func(conn net.Conn) {
+		srv.ServeConn(conn, &http2.ServeConnOpts{Handler: h2})
+	}))
+	mux.HandleHTTP1(handlerID("http1"))
+	addr := listenMux(t, mux)
+
+	client := h2cClient()
+	defer client.CloseIdleConnections()
+	// the second request goes over the connection of the first one
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "HTTP/2.0 " + path; string(body) != want {
+			t.Fatalf("the h2c client got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestHandleHTTPHost(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTPHost(handlerID("api"), "api.example.com")
+	mux.HandleHTTPHost(handlerID("wild"), "*.apps.example.com")
+	mux.HandleHTTPHostDefault(handlerID("default"))
+	mux.HandleHTTP1(handlerID("other"))
+
+	for b, want := range map[string]string{
+		"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n":                                 "api",
+		"GET / HTTP/1.1\r\nhost: API.Example.COM:8080\r\n\r\n":                            "api",
+		"GET / HTTP/1.1\r\nHost:    api.example.com   \r\n\r\n":                           "api",
+		"GET / HTTP/1.1\r\nHost:\r\n  api.example.com\r\n\r\n":                            "api",
+		"GET / HTTP/1.1\r\nAccept: */*\r\nX-A: b\r\n\tc\r\nHost: api.example.com\r\n\r\n": "api",
+		"GET / HTTP/1.1\r\nHost: x.apps.example.com\r\n\r\n":                              "wild",
+		"GET / HTTP/1.1\r\nHost: apps.example.com\r\n\r\n":                                "other",
+		"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n":                                           "default",
+		"GET / HTTP/1.0\n\n":                                                              "default",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleHTTPHostHeadersOverBound(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTPHost(handlerID("api"), "api.example.com")
+	mux.HandleHTTPHostDefault(handlerID("default"))
+	b := "GET / HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", maxHeaderLength) + "\r\nHost: api.example.com\r\n\r\n"
+	if got := matchOf(t, mux, b); got != "default" {
+		t.Fatalf("headers over the bound matched %q, want the default", got)
+	}
+}
+
+func TestHandleHTTPHostReplaysHeaders(t *testing.T) {
+	mux := NewCMux()
+	got := make(chan string, 1)
+	mux.HandleHTTPHost(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- req.Host + " " + req.URL.Path + " " + req.Header.Get("Accept")
+	}), "api.example.com")
+
+	client := servePipe(mux)
+	defer client.Close()
+	req := "GET /path HTTP/1.1\r\nAccept: text/plain\r\nHost: api.example.com\r\n\r\n"
+	chunks := make([]string, 0, len(req))
+	for i := 0; i < len(req); i += 3 {
+		end := i + 3
+		if end > len(req) {
+			end = len(req)
+		}
+		chunks = append(chunks, req[i:end])
+	}
+	go writeChunks(client, chunks...)
+	select {
+	case s := <-got:
+		if s != "api.example.com /path text/plain" {
+			t.Fatalf("net/http parsed %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not dispatched")
+	}
+}
+
+func TestHandleHTTPPath(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleHTTPPath(handlerID("local"), "/metrics", "/debug/")
+	mux.HandleHTTP1(handlerID("proxy"))
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	for b, want := range map[string]string{
+		"GET /metrics HTTP/1.1\r\n":                    "local",
+		"GET /metrics?format=text HTTP/1.1\r\n":        "local",
+		"GET /debug/pprof/ HTTP/1.1\r\n":               "local",
+		"GET http://host:8080/debug/vars HTTP/1.1\r\n": "local",
+		"GET https://host/metrics?x=1 HTTP/1.1\r\n":    "local",
+		"GET /debug HTTP/1.1\r\n":                      "proxy",
+		"GET /api/metrics HTTP/1.1\r\n":                "proxy",
+		"GET http://host/api?u=/metrics HTTP/1.1\r\n":  "proxy",
+		"POST / HTTP/1.1\r\n":                          "proxy",
+		"SSH-2.0-OpenSSH_9.0\r\n":                      "ssh",
+		"SSH-2.0-/metrics\r\n":                         "ssh",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleHTTPPathReplaysRequest(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleHTTPPath(h, "/metrics")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	client := servePipe(mux)
+	defer client.Close()
+	req := "GET http://host/metrics?x=1 HTTP/1.1\r\nHost: host\r\n\r\n"
+	go writeChunks(client, req[:5], req[5:20], req[20:])
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(req)); got != req {
+		t.Fatalf("handler read %q, want the request replayed", got)
+	}
+}
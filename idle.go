@@ -0,0 +1,135 @@
+package cmux
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimeoutHandler returns a handler that serves h with a connection closed once no read or write
+// has succeeded on it for d, such as for the backends that leak the sockets of half-dead peers.
+// The connection keeps its CloseWrite and its deadlines, the copying of its WriteTo and ReadFrom goes
+// through the reads and writes of the process so that its progress is seen.
+// The connections closed this way are counted in the IdleClosed of the Stats of the mux that dispatched them.
+func IdleTimeoutHandler(h Handler, d time.Duration) Handler {
+	return &idleHandler{
+		handler: h,
+		timeout: d,
+	}
+}
+
+type idleHandler struct {
+	handler Handler
+	timeout time.Duration
+}
+
+func (h *idleHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *idleHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	if h.timeout > 0 {
+		conn = watchIdle(conn, h.timeout)
+	}
+	serveHandler(ctx, h.handler, conn)
+}
+
+// SetIdleTimeout sets the idle timeout of IdleTimeoutHandler for every dispatched connection,
+// an IdleTimeoutHandler of a registration replaces it. Zero disables it, the default.
+func (m *CMux) SetIdleTimeout(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.idleTimeout = d
+	m.rebuild()
+}
+
+// watchIdle closes conn once it is idle for d, conn is wrapped if it does not replay anything.
+func watchIdle(conn net.Conn, d time.Duration) net.Conn {
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	if us.idle != nil {
+		us.idle.stop()
+	}
+	w := &idleWatch{
+		start:   time.Now(),
+		timeout: d,
+		conn:    us,
+	}
+	us.idle = w
+	// the timer is armed once it is assigned, fire may rearm it
+	w.timer = time.AfterFunc(math.MaxInt64, w.fire)
+	w.timer.Reset(d)
+	return conn
+}
+
+// idleWatch closes a connection that is idle for the timeout, the timer is only rearmed when it fires.
+type idleWatch struct {
+	// last is the time of the last read or write since start.
+	last    int64
+	done    uint32
+	start   time.Time
+	timeout time.Duration
+	timer   *time.Timer
+	conn    *unreadConn
+}
+
+func (w *idleWatch) touch() {
+	if w != nil {
+		atomic.StoreInt64(&w.last, int64(time.Since(w.start)))
+	}
+}
+
+func (w *idleWatch) fire() {
+	if atomic.LoadUint32(&w.done) != 0 {
+		return
+	}
+	idle := time.Since(w.start) - time.Duration(atomic.LoadInt64(&w.last))
+	if idle < w.timeout {
+		w.timer.Reset(w.timeout - idle)
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&w.done, 0, 1) {
+		return
+	}
+	if c := w.conn.idleClosed; c != nil {
+		atomic.AddUint64(c, 1)
+	}
+	w.conn.close()
+}
+
+func (w *idleWatch) stop() {
+	if w != nil && atomic.CompareAndSwapUint32(&w.done, 0, 1) {
+		w.timer.Stop()
+	}
+}
+
+// idleWriter marks the progress of a copy.
+type idleWriter struct {
+	w    io.Writer
+	idle *idleWatch
+}
+
+func (w idleWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n != 0 {
+		w.idle.touch()
+	}
+	return n, err
+}
+
+// watchIdle records the counter of the mux on conn and watches it with the idle timeout of the table if set,
+// conn must have been recorded by withMatch.
+func (t *table) watchIdle(conn net.Conn, idleClosed *uint64) net.Conn {
+	us, _ := asUnreadConn(conn)
+	us.idleClosed = idleClosed
+	if t.idleTimeout > 0 {
+		conn = watchIdle(conn, t.idleTimeout)
+	}
+	return conn
+}
@@ -0,0 +1,182 @@
+package cmux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalled is a handler reading its prefix and then neither reading nor writing until the connection is closed.
+func stalled(closed chan<- time.Time) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		conn.Read(make([]byte, 16))
+		// the read is only ended by the close of the idle watch
+		_, err := conn.Read(make([]byte, 1))
+		if err != nil {
+			closed <- time.Now()
+		}
+	})
+}
+
+func TestIdleTimeoutHandlerClosesStalled(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	mux := NewCMux()
+	closed := make(chan time.Time, 1)
+	mux.HandlePrefix(IdleTimeoutHandler(stalled(closed), idle), "IDLE")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	start := time.Now()
+	conn.Write([]byte("IDLE"))
+	select {
+	case at := <-closed:
+		if d := at.Sub(start); d < idle || d > 10*idle {
+			t.Fatalf("closed after %v, want about %v", d, idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled connection was not closed")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("the client read %v, want the connection closed", err)
+	}
+	if got := mux.Stats().IdleClosed; got != 1 {
+		t.Fatalf("%d connections idle closed, want 1", got)
+	}
+}
+
+func TestIdleTimeoutHandlerKeepsActiveEcho(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	mux := NewCMux()
+	mux.HandlePrefix(IdleTimeoutHandler(echoHandler, idle), "ECHO ")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("ECHO "))
+	if got := readN(t, conn, 5); got != "ECHO " {
+		t.Fatalf("echoed %q", got)
+	}
+	// the session lasts several timeouts, it is never idle for one
+	for deadline := time.Now().Add(5 * idle); time.Now().Before(deadline); {
+		time.Sleep(idle / 4)
+		_, err := conn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readN(t, conn, 4); got != "ping" {
+			t.Fatalf("echoed %q", got)
+		}
+	}
+	if got := mux.Stats().IdleClosed; got != 0 {
+		t.Fatalf("%d connections idle closed, want none", got)
+	}
+}
+
+func TestIdleTimeoutHandlerPassThrough(t *testing.T) {
+	mux := NewCMux()
+	errs := make(chan error, 2)
+	mux.HandlePrefix(IdleTimeoutHandler(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		conn.Read(make([]byte, 4))
+		// the deadline of the conn times the read out, the watch does not close it
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		errs <- err
+		cw, ok := conn.(interface{ CloseWrite() error })
+		if !ok {
+			errs <- nil
+			return
+		}
+		errs <- cw.CloseWrite()
+		conn.SetReadDeadline(time.Time{})
+		io.Copy(io.Discard, conn)
+	}), time.Second), "PASS")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("PASS"))
+	err := <-errs
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("the read past the deadline returned %v, want a timeout", err)
+	}
+	err = <-errs
+	if err != nil {
+		t.Fatalf("CloseWrite returned %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("the client read %v, want the end of the stream of the CloseWrite", err)
+	}
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	mux := NewCMux()
+	mux.SetIdleTimeout(idle)
+	closed := make(chan time.Time, 2)
+	mux.HandlePrefix(stalled(closed), "IDLE")
+	// the timeout of the registration replaces the one of the mux
+	kept := make(chan time.Time, 1)
+	mux.HandlePrefix(IdleTimeoutHandler(stalled(kept), time.Hour), "KEEP")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("IDLE"))
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled connection was not closed by the idle timeout of the mux")
+	}
+	keep := serveTCP(t, mux)
+	defer keep.Close()
+	keep.Write([]byte("KEEP"))
+	select {
+	case <-kept:
+		t.Fatal("the idle timeout of the mux replaced the one of the registration")
+	case <-time.After(4 * idle):
+	}
+
+	// the connections dispatched after it is disabled are not watched
+	mux.SetIdleTimeout(0)
+	conn = serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("IDLE"))
+	select {
+	case <-closed:
+		t.Fatal("the connection was closed after the idle timeout was disabled")
+	case <-time.After(4 * idle):
+	}
+	if got := mux.Stats().IdleClosed; got != 1 {
+		t.Fatalf("%d connections idle closed, want 1", got)
+	}
+}
+
+func TestSetIdleTimeoutWhileDispatching(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), "X")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mux.SetIdleTimeout(time.Duration(i%2) * time.Hour)
+		}
+	}()
+	for i := 0; i != 100; i++ {
+		client, server := net.Pipe()
+		go client.Write([]byte("X"))
+		mux.ServeConn(server)
+		client.Close()
+	}
+	close(done)
+	wg.Wait()
+}
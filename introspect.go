@@ -0,0 +1,116 @@
+package cmux
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefixes returns the sorted list of the registered prefixes.
+func (m *CMux) Prefixes() []string {
+	return m.load().sortedPrefixes()
+}
+
+func (t *table) sortedPrefixes() []string {
+	prefixes := make([]string, len(t.sorted))
+	copy(prefixes, t.sorted)
+	return prefixes
+}
+
+// HandlerForPrefix returns the handler registered for exactly the prefix.
+func (m *CMux) HandlerForPrefix(prefix string) (Handler, bool) {
+	t := m.load()
+	r, ok := t.prefixes[prefix]
+	if !ok || r.excluded {
+		return nil, false
+	}
+	return r.handler, true
+}
+
+// String returns the routing table in a printable form, one prefix per line,
+// in the order the routes are consulted.
+func (m *CMux) String() string {
+	t := m.load()
+	var buf strings.Builder
+	if !t.origDstSniff {
+		t.writeOrigDst(&buf)
+	}
+	if r := t.serverFirst; r != nil {
+		fmt.Fprintf(&buf, "%s(%v) -> %s\n", r.pattern, t.serverFirstWait, r.label())
+	}
+	protos := make([]string, 0, len(t.alpn))
+	for proto := range t.alpn {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	for _, proto := range protos {
+		r := t.alpn[proto]
+		fmt.Fprintf(&buf, "%s -> %s\n", r.pattern, r.label())
+	}
+	for _, prefix := range t.sortedPrefixes() {
+		for _, r := range t.restricted[prefix] {
+			kind := "from"
+			if r.locals != nil {
+				kind = "local"
+			}
+			fmt.Fprintf(&buf, "%s %s -> %s\n", strconv.Quote(prefix), kind, r.label())
+		}
+		if r, ok := t.prefixes[prefix]; ok && r.excluded {
+			fmt.Fprintf(&buf, "%s -> excluded\n", strconv.Quote(prefix))
+		} else if ok {
+			fmt.Fprintf(&buf, "%s -> %s\n", strconv.Quote(prefix), r.label())
+		}
+	}
+	for _, prefix := range t.foldSorted {
+		r := t.folds[prefix]
+		fmt.Fprintf(&buf, "fold:%s -> %s\n", strconv.Quote(r.pattern), r.label())
+	}
+	for _, mr := range t.masks {
+		fmt.Fprintf(&buf, "mask:%s -> %s\n", strconv.Quote(mr.pattern), mr.label())
+	}
+	for i, mr := range t.matchers {
+		if mr.priority != 0 {
+			fmt.Fprintf(&buf, "#%d %s(%d) priority %d -> %s\n", i, mr.pattern, mr.maxBytes, mr.priority, mr.label())
+		} else {
+			fmt.Fprintf(&buf, "#%d %s(%d) -> %s\n", i, mr.pattern, mr.maxBytes, mr.label())
+		}
+	}
+	if r := t.tlsDefault; r != nil {
+		fmt.Fprintf(&buf, "%s -> %s\n", r.pattern, r.label())
+	}
+	if r := t.defaultRoute; r != nil {
+		fmt.Fprintf(&buf, "%s -> %s\n", r.pattern, r.label())
+	}
+	// with the sniffing the original destination only takes the connections that match nothing
+	if t.origDstSniff {
+		t.writeOrigDst(&buf)
+	}
+	if t.notFound != nil {
+		fmt.Fprintf(&buf, "* -> %s\n", describeHandler(t.notFound))
+	}
+	return buf.String()
+}
+
+func (t *table) writeOrigDst(buf *strings.Builder) {
+	for _, port := range t.sortedOrigDstPorts() {
+		r := t.origDst[port]
+		fmt.Fprintf(buf, "%s -> %s\n", r.pattern, r.label())
+	}
+}
+
+func describeHandler(h Handler) string {
+	if n, ok := h.(*NamedHandler); ok {
+		h = n.Handler
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// label returns the name of the route followed by the type of its handler when the name does not already say it.
+func (r *route) label() string {
+	desc := describeHandler(r.handler)
+	if r.name == desc {
+		return r.name
+	}
+	return r.name + " (" + desc + ")"
+}
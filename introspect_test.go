@@ -0,0 +1,78 @@
+package cmux
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrefixes(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ")
+	want := []string{"GET ", "POST ", "SSH-", "SSH-2.0-"}
+	if got := mux.Prefixes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Prefixes() = %q, want %q", got, want)
+	}
+
+	mux.RemovePrefix("SSH-", "POST ")
+	want = []string{"GET ", "SSH-2.0-"}
+	if got := mux.Prefixes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Prefixes() after removal = %q, want %q", got, want)
+	}
+	// the returned slice is a copy
+	mux.Prefixes()[0] = "x"
+	if got := mux.Prefixes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Prefixes() after modifying a result = %q", got)
+	}
+}
+
+func TestHandlerForPrefix(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	for prefix, want := range map[string]Handler{
+		"SSH-":     handlerID("ssh"),
+		"SSH-2.0-": handlerID("ssh2"),
+	} {
+		h, ok := mux.HandlerForPrefix(prefix)
+		if !ok || h != want {
+			t.Errorf("HandlerForPrefix(%q) = %v, %v, want %v", prefix, h, ok, want)
+		}
+	}
+	// only the exact prefix is looked up
+	if h, ok := mux.HandlerForPrefix("SSH-2"); ok {
+		t.Errorf("HandlerForPrefix(%q) = %v", "SSH-2", h)
+	}
+	mux.RemovePrefix("SSH-")
+	if _, ok := mux.HandlerForPrefix("SSH-"); ok {
+		t.Error("HandlerForPrefix found a removed prefix")
+	}
+}
+
+func TestStringEscapesBinaryPrefixes(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03\x01")
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	s := mux.String()
+	for _, want := range []string{
+		`"\x16\x03\x01" -> `,
+		`"GET " -> `,
+		"-> cmux.handlerID\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		for _, r := range line {
+			if r < ' ' || r > '~' {
+				t.Fatalf("String() line %q is not printable", line)
+			}
+		}
+	}
+	if strings.Index(s, `\x16`) > strings.Index(s, "GET ") {
+		t.Errorf("String() = %q, want the prefixes sorted", s)
+	}
+}
@@ -0,0 +1,84 @@
+package cmux
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// HandleTLSFingerprint handle the handler that matches the TLS ClientHello whose JA3 fingerprint is one of
+// fingerprints, the MD5 hashes in hex such as "e7d705a3286e19ea42f587b344ee6865".
+// The ClientHello that matches none goes on to the other registrations such as HandleTLSDefault,
+// the whole ClientHello is replayed to the handler that wins.
+func (m *CMux) HandleTLSFingerprint(handler Handler, fingerprints ...string) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(fingerprints))
+	for _, fp := range fingerprints {
+		set[strings.ToLower(strings.TrimSpace(fp))] = struct{}{}
+	}
+	return m.handleMatcher(handler, &ja3Matcher{fingerprints: set}, m.clientHelloLength(), "ja3:"+strings.Join(fingerprints, ","))
+}
+
+type ja3Matcher struct {
+	fingerprints map[string]struct{}
+}
+
+func (j *ja3Matcher) Match(b []byte) (matched bool, needMore bool) {
+	hello, needMore, err := parseClientHello(b)
+	if err != nil || needMore {
+		return false, needMore
+	}
+	_, ok := j.fingerprints[JA3Hash(hello.ja3())]
+	return ok, false
+}
+
+// JA3 returns the JA3 string of the TLS ClientHello held by b, ok is false while it is incomplete or malformed.
+func JA3(b []byte) (ja3 string, ok bool) {
+	hello, needMore, err := parseClientHello(b)
+	if err != nil || needMore {
+		return "", false
+	}
+	return hello.ja3(), true
+}
+
+// JA3Hash returns the fingerprint of the JA3 string, the MD5 hash in hex.
+func JA3Hash(ja3 string) string {
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3 returns the version, the cipher suites, the extensions, the supported groups and the point formats
+// in the form "771,4865-4866,0-10-11,29-23,0", the GREASE values left out.
+func (h *clientHello) ja3() string {
+	var buf strings.Builder
+	buf.WriteString(strconv.Itoa(int(h.legacyVersion)))
+	for _, list := range [][]uint16{h.ciphers, h.extensions, h.curves} {
+		buf.WriteByte(',')
+		writeJA3List(&buf, list)
+	}
+	buf.WriteByte(',')
+	for i, p := range h.points {
+		if i != 0 {
+			buf.WriteByte('-')
+		}
+		buf.WriteString(strconv.Itoa(int(p)))
+	}
+	return buf.String()
+}
+
+func writeJA3List(buf *strings.Builder, list []uint16) {
+	first := true
+	for _, v := range list {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			buf.WriteByte('-')
+		}
+		first = false
+		buf.WriteString(strconv.Itoa(int(v)))
+	}
+}
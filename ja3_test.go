@@ -0,0 +1,182 @@
+package cmux
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// helloProfile is the fields of the ClientHello of a client that the JA3 fingerprint covers.
+type helloProfile struct {
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []byte
+	versions   []uint16
+}
+
+// record returns the ClientHello of the profile for the server name in a single TLS record.
+func (p helloProfile) record(serverName string) []byte {
+	u16 := func(b []byte, v int) []byte {
+		return append(b, byte(v>>8), byte(v))
+	}
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 32)
+	body = append(body, make([]byte, 32)...)
+	body = u16(body, 2*len(p.ciphers))
+	for _, c := range p.ciphers {
+		body = u16(body, int(c))
+	}
+	body = append(body, 1, 0)
+
+	var exts []byte
+	for _, typ := range p.extensions {
+		var data []byte
+		switch typ {
+		case extensionServerName:
+			data = u16(data, 3+len(serverName))
+			data = append(data, serverNameTypeHostName)
+			data = u16(data, len(serverName))
+			data = append(data, serverName...)
+		case extensionSupportedGroups:
+			data = u16(data, 2*len(p.curves))
+			for _, c := range p.curves {
+				data = u16(data, int(c))
+			}
+		case extensionECPointFormats:
+			data = append(data, byte(len(p.points)))
+			data = append(data, p.points...)
+		case extensionSupportedVersion:
+			data = append(data, byte(2*len(p.versions)))
+			for _, v := range p.versions {
+				data = u16(data, int(v))
+			}
+		}
+		exts = u16(exts, int(typ))
+		exts = u16(exts, len(data))
+		exts = append(exts, data...)
+	}
+	body = u16(body, len(exts))
+	body = append(body, exts...)
+
+	msg := []byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return tlsRecords(append(msg, body...))
+}
+
+var (
+	// chromeHello is the ClientHello of Chrome 70, with its GREASE values
+	chromeHello = helloProfile{
+		ciphers:    []uint16{0x8a8a, 4865, 4866, 4867, 49195, 49199, 49196, 49200, 52393, 52392, 49171, 49172, 156, 157, 47, 53},
+		extensions: []uint16{0xdada, 0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27, 21, 0x4a4a},
+		curves:     []uint16{0x2a2a, 29, 23, 24},
+		points:     []byte{0},
+		versions:   []uint16{0x6a6a, 0x0304, 0x0303, 0x0302, 0x0301},
+	}
+	chromeJA3     = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-21,29-23-24,0"
+	chromeJA3Hash = "b32309a26951912be7dba376398abc3b"
+
+	// curlHello is the ClientHello of curl with OpenSSL 1.1.1
+	curlHello = helloProfile{
+		ciphers: []uint16{4866, 4867, 4865, 49196, 49200, 159, 52393, 52392, 52394, 49195, 49199, 158, 49188, 49192, 107,
+			49187, 49191, 103, 49162, 49172, 57, 49161, 49171, 51, 157, 156, 61, 60, 53, 47, 255},
+		extensions: []uint16{0, 11, 10, 13172, 16, 22, 23, 49, 13, 43, 45, 51},
+		curves:     []uint16{29, 23, 30, 25, 24},
+		points:     []byte{0, 1, 2},
+		versions:   []uint16{0x0304, 0x0303, 0x0302, 0x0301},
+	}
+	curlJA3     = "771,4866-4867-4865-49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,0-11-10-13172-16-22-23-49-13-43-45-51,29-23-30-25-24,0-1-2"
+	curlJA3Hash = "ba730f97dcd1122e74e65411e68f1b40"
+)
+
+func TestJA3(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		hello helloProfile
+		ja3   string
+		hash  string
+	}{
+		{"chrome", chromeHello, chromeJA3, chromeJA3Hash},
+		{"curl", curlHello, curlJA3, curlJA3Hash},
+	} {
+		ja3, ok := JA3(tc.hello.record("example.com"))
+		if !ok {
+			t.Errorf("%s: JA3 did not parse the ClientHello", tc.name)
+			continue
+		}
+		if ja3 != tc.ja3 {
+			t.Errorf("%s: JA3 = %q, want %q", tc.name, ja3, tc.ja3)
+		}
+		if hash := JA3Hash(ja3); hash != tc.hash {
+			t.Errorf("%s: JA3Hash = %s, want %s", tc.name, hash, tc.hash)
+		}
+	}
+
+	b := chromeHello.record("example.com")
+	for _, n := range []int{0, 3, recordHeaderLength, len(b) - 1} {
+		if _, ok := JA3(b[:n]); ok {
+			t.Errorf("JA3 parsed %d bytes of the ClientHello", n)
+		}
+	}
+}
+
+func TestHandleTLSFingerprint(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleTLSFingerprint(handlerID("tarpit"), strings.ToUpper(chromeJA3Hash)+" ", "00000000000000000000000000000000")
+	mux.HandleTLSDefault(handlerID("tls"))
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"chrome", chromeHello.record("a.example.com"), "tarpit"},
+		{"chrome for another name", chromeHello.record("b.example.com"), "tarpit"},
+		{"chrome in two records", tlsRecords(chromeHello.record("a.example.com")[recordHeaderLength:], 40), "tarpit"},
+		{"curl", curlHello.record("a.example.com"), "tls"},
+		{"HTTP", []byte("GET / HTTP/1.1\r\n\r\n"), "http"},
+	} {
+		if got := matchOf(t, mux, string(tc.b)); got != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHandleTLSFingerprintReplaysClientHello(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleTLSFingerprint(h, curlJA3Hash)
+	client := servePipe(mux)
+	defer client.Close()
+	b := string(curlHello.record("a.example.com"))
+	go writeChunks(client, b[:2], b[2:7], b[7:100], b[100:])
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(b)); got != b {
+		t.Fatal("the handler did not read the ClientHello untouched")
+	}
+}
+
+func TestHandleTLSFingerprintHandshake(t *testing.T) {
+	cert := testCert(t, "a.example.com")
+	msg := clientHelloMessage(t, "a.example.com")
+	ja3, ok := JA3(tlsRecords(msg))
+	if !ok {
+		t.Fatal("JA3 did not parse the ClientHello of crypto/tls")
+	}
+	if n := binary.BigEndian.Uint16(msg[4:6]); !strings.HasPrefix(ja3, "771,") || n != 0x0303 {
+		t.Fatalf("the JA3 of crypto/tls is %q", ja3)
+	}
+	mux := NewCMux()
+	mux.HandleTLSFingerprint(tlsBackend("go", cert), JA3Hash(ja3))
+	mux.HandleTLSFingerprint(tlsBackend("chrome", cert), chromeJA3Hash)
+	mux.HandleTLSDefault(tlsBackend("default", cert))
+	got, err := tlsDial(t, mux, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "go" {
+		t.Fatalf("the handshake of crypto/tls was served by %q, want its fingerprint", got)
+	}
+}
@@ -0,0 +1,328 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTooManyConns = fmt.Errorf("too many connections")
+
+// Stats is a snapshot of the counters of the mux.
+type Stats struct {
+	// InFlight is the number of the connections being sniffed or served.
+	InFlight int64
+	// Rejected is the number of the connections closed by the limit of SetMaxConns.
+	Rejected uint64
+	// NotFound is the number of the connections that matched nothing.
+	NotFound uint64
+	// Errors is the number of the connections that could not be dispatched for another reason.
+	Errors uint64
+	// Redispatched is the number of the connections handed back by the handlers with Redispatch.
+	Redispatched uint64
+	// IdleClosed is the number of the connections closed by IdleTimeoutHandler or SetIdleTimeout.
+	IdleClosed uint64
+	// SourceRejected is the number of the connections closed by SetPerSourceLimit.
+	SourceRejected uint64
+	// TopSources is the sources with the most active connections since SetPerSourceLimit, up to 10 of them.
+	TopSources []SourceStats
+	// Speculated is the number of the connections dispatched by the cache of EnableMatchCache,
+	// MisSpeculated is the number of them that matched another pattern.
+	Speculated    uint64
+	MisSpeculated uint64
+	// AmbiguousFallbacks is the number of the connections of HandleAmbiguous that went to the primary handler undecided.
+	AmbiguousFallbacks uint64
+	// Patterns is the counters of every pattern ever registered, keyed by the pattern,
+	// the folded prefixes and the masked patterns are keyed with a "fold:" and a "mask:" in front.
+	Patterns map[string]PatternStats
+	// FirstByte and Decided aggregate the SniffTiming of the connections, they are only counted after SetSniffStats.
+	FirstByte DurationStats
+	Decided   DurationStats
+}
+
+// PatternStats is the counters of a pattern.
+type PatternStats struct {
+	// Matched is the number of the connections dispatched by the pattern.
+	Matched uint64
+	// Active is the number of the connections being served by the pattern.
+	Active int64
+	// BytesIn and BytesOut are the totals of the connections closed since SetAccounting.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// routeCounter counts the connections of a pattern, it outlives the registration of the pattern.
+type routeCounter struct {
+	matched  uint64
+	active   int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+// counterOf returns the counter of the pattern, the caller must hold the lock.
+func (m *CMux) counterOf(pattern string) *routeCounter {
+	c, ok := m.counters[pattern]
+	if !ok {
+		if m.counters == nil {
+			m.counters = map[string]*routeCounter{}
+		}
+		c = &routeCounter{}
+		m.counters[pattern] = c
+	}
+	return c
+}
+
+// Stats returns the counters of the mux.
+func (m *CMux) Stats() Stats {
+	m.mut.Lock()
+	patterns := make(map[string]PatternStats, len(m.counters))
+	for pattern, c := range m.counters {
+		patterns[pattern] = PatternStats{
+			Matched:  atomic.LoadUint64(&c.matched),
+			Active:   atomic.LoadInt64(&c.active),
+			BytesIn:  atomic.LoadInt64(&c.bytesIn),
+			BytesOut: atomic.LoadInt64(&c.bytesOut),
+		}
+	}
+	s := m.load().sniffStats
+	m.mut.Unlock()
+	stats := Stats{
+		InFlight:           atomic.LoadInt64(&m.inFlight),
+		Rejected:           atomic.LoadUint64(&m.rejected),
+		NotFound:           atomic.LoadUint64(&m.notFounds),
+		Errors:             atomic.LoadUint64(&m.errors),
+		Redispatched:       atomic.LoadUint64(&m.redispatched),
+		IdleClosed:         atomic.LoadUint64(&m.idleClosed),
+		SourceRejected:     atomic.LoadUint64(&m.sourceRejected),
+		Speculated:         atomic.LoadUint64(&m.speculated),
+		MisSpeculated:      atomic.LoadUint64(&m.misSpeculated),
+		AmbiguousFallbacks: atomic.LoadUint64(&m.fallbacks),
+		Patterns:           patterns,
+	}
+	if l := m.loadSources(); l != nil {
+		stats.TopSources = l.top()
+	}
+	if s != nil {
+		stats.FirstByte = s.firstByte.stats()
+		stats.Decided = s.decided.stats()
+	}
+	return stats
+}
+
+// SetMaxConns bounds the connections being sniffed or served at the same time, zero means no bound.
+// The connections over the bound are closed with ErrTooManyConns after the wait set by SetMaxConnsWait.
+func (m *CMux) SetMaxConns(n int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if n <= 0 {
+		m.slots = nil
+	} else {
+		m.slots = make(chan struct{}, n)
+	}
+	m.rebuild()
+}
+
+// SetMaxConnsWait sets how long a connection over the bound of SetMaxConns waits for a slot, zero means no waiting.
+func (m *CMux) SetMaxConnsWait(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.slotWait = d
+	m.rebuild()
+}
+
+// acquire takes a slot of the table, it reports false when no slot is free in time.
+func (t *table) acquire() bool {
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if t.slotWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(t.slotWait)
+	defer timer.Stop()
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// LimitHandler is a Handler that bounds the connections served by the handler at the same time,
+// the connections over the bound are closed.
+type LimitHandler struct {
+	active   int64
+	rejected uint64
+	Handler
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// NewLimitHandler create a new LimitHandler serving at most n connections at the same time,
+// a connection over the bound waits up to wait for a slot, a negative wait queues it until a slot is free.
+func NewLimitHandler(handler Handler, n int, wait time.Duration) *LimitHandler {
+	if n < 0 {
+		n = 0
+	}
+	return &LimitHandler{
+		Handler: handler,
+		slots:   make(chan struct{}, n),
+		wait:    wait,
+	}
+}
+
+// Active returns the number of the connections being served.
+func (h *LimitHandler) Active() int64 {
+	return atomic.LoadInt64(&h.active)
+}
+
+// Rejected returns the number of the connections closed by the bound.
+func (h *LimitHandler) Rejected() uint64 {
+	return atomic.LoadUint64(&h.rejected)
+}
+
+func (h *LimitHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *LimitHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	if !h.acquire(ctx) {
+		atomic.AddUint64(&h.rejected, 1)
+		conn.Close()
+		return
+	}
+	atomic.AddInt64(&h.active, 1)
+	defer func() {
+		atomic.AddInt64(&h.active, -1)
+		<-h.slots
+	}()
+	serveHandler(ctx, h.Handler, conn)
+}
+
+func (h *LimitHandler) acquire(ctx context.Context) bool {
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if h.wait == 0 {
+		return false
+	}
+	var timeout <-chan time.Time
+	if h.wait > 0 {
+		timer := time.NewTimer(h.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// HandlePrefixLimited handle the handler that matches the prefix, serving at most limit connections at the same time.
+func (m *CMux) HandlePrefixLimited(handler Handler, limit int, prefixes ...string) error {
+	if err := noBudget("HandlePrefixLimited", handler); err != nil {
+		return err
+	}
+	return m.HandlePrefix(NewLimitHandler(handler, limit, 0), prefixes...)
+}
+
+// RateLimitHandler is a Handler that bounds the rate of the connections served by the handler with a token bucket,
+// the connections over the rate are closed.
+type RateLimitHandler struct {
+	dropped uint64
+	Handler
+	mut      sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	maxDelay time.Duration
+}
+
+// NewRateLimitHandler create a new RateLimitHandler letting perSecond connections through with bursts of burst,
+// a connection over the rate is delayed when its token is due within maxDelay.
+func NewRateLimitHandler(handler Handler, perSecond float64, burst int, maxDelay time.Duration) *RateLimitHandler {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimitHandler{
+		Handler:  handler,
+		rate:     perSecond,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+		maxDelay: maxDelay,
+	}
+}
+
+// Dropped returns the number of the connections closed by the rate.
+func (h *RateLimitHandler) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+func (h *RateLimitHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *RateLimitHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	delay, ok := h.reserve()
+	if ok && delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			ok = false
+		}
+	}
+	if !ok {
+		atomic.AddUint64(&h.dropped, 1)
+		conn.Close()
+		return
+	}
+	serveHandler(ctx, h.Handler, conn)
+}
+
+// reserve takes a token, delay is how long to wait for it to be due.
+func (h *RateLimitHandler) reserve() (delay time.Duration, ok bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	now := time.Now()
+	h.tokens += now.Sub(h.last).Seconds() * h.rate
+	if h.tokens > h.burst {
+		h.tokens = h.burst
+	}
+	h.last = now
+	if h.tokens >= 1 {
+		h.tokens--
+		return 0, true
+	}
+	if h.rate <= 0 {
+		return 0, false
+	}
+	delay = time.Duration((1 - h.tokens) / h.rate * float64(time.Second))
+	if delay > h.maxDelay {
+		return 0, false
+	}
+	h.tokens--
+	return delay, true
+}
+
+// HandlePrefixRate handle the handler that matches the prefix, serving at most perSecond connections with bursts of burst.
+func (m *CMux) HandlePrefixRate(handler Handler, perSecond float64, burst int, prefixes ...string) error {
+	if err := noBudget("HandlePrefixRate", handler); err != nil {
+		return err
+	}
+	return m.HandlePrefix(NewRateLimitHandler(handler, perSecond, burst, 0), prefixes...)
+}
@@ -0,0 +1,408 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConnsRejectsOverLimit(t *testing.T) {
+	const n = 8
+	mux := NewCMux()
+	mux.SetMaxConns(n)
+	var active, peak int64
+	release := make(chan struct{})
+	started := make(chan net.Conn, n)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		a := atomic.AddInt64(&active, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if a <= p || atomic.CompareAndSwapInt64(&peak, p, a) {
+				break
+			}
+		}
+		started <- conn
+		<-release
+		atomic.AddInt64(&active, -1)
+	}), "x")
+	rejected := make(chan error, 4*n)
+	mux.OnError(func(conn net.Conn, err error) {
+		rejected <- err
+	})
+
+	var clients []net.Conn
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i != n; i++ {
+		client := servePipe(mux)
+		clients = append(clients, client)
+		go client.Write([]byte("x"))
+		recvConn(t, started)
+	}
+	if got := mux.Stats().InFlight; got != n {
+		t.Fatalf("InFlight is %d, want %d", got, n)
+	}
+
+	// the (n+1)th and every later connection is rejected while the slots are held
+	var wg sync.WaitGroup
+	for i := 0; i != 3*n; i++ {
+		client := servePipe(mux)
+		clients = append(clients, client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Write([]byte("x"))
+		}()
+	}
+	for i := 0; i != 3*n; i++ {
+		select {
+		case err := <-rejected:
+			if !errors.Is(err, ErrTooManyConns) {
+				t.Fatalf("OnError got %v, want ErrTooManyConns", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d connections over the limit were rejected", i)
+		}
+	}
+	wg.Wait()
+	close(release)
+	if p := atomic.LoadInt64(&peak); p > n {
+		t.Fatalf("%d connections were served at the same time, the limit is %d", p, n)
+	}
+	if got := mux.Stats().Rejected; got != 3*n {
+		t.Fatalf("Rejected is %d, want %d", got, 3*n)
+	}
+}
+
+func TestMaxConnsNeverExceeded(t *testing.T) {
+	const n = 4
+	mux := NewCMux()
+	mux.SetMaxConns(n)
+	mux.SetMaxConnsWait(time.Second)
+	var active, peak int64
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		a := atomic.AddInt64(&active, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if a <= p || atomic.CompareAndSwapInt64(&peak, p, a) {
+				break
+			}
+		}
+		if in := mux.Stats().InFlight; in > n {
+			t.Errorf("InFlight is %d over the limit %d", in, n)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt64(&active, -1)
+	}), "x")
+	var served int64
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		atomic.AddInt64(&served, 1)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i != 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write([]byte("x"))
+			mux.ServeConn(server)
+		}()
+	}
+	wg.Wait()
+	if p := atomic.LoadInt64(&peak); p > n {
+		t.Fatalf("%d connections were served at the same time, the limit is %d", p, n)
+	}
+	// the waiting connections got a slot in time
+	if got := atomic.LoadInt64(&served); got != 64 {
+		t.Fatalf("served %d connections, want all of them to wait for a slot", got)
+	}
+	if got := mux.Stats().InFlight; got != 0 {
+		t.Fatalf("InFlight is %d once every connection is done", got)
+	}
+}
+
+func TestSetMaxConnsWhileServing(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("x"), "x")
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mux.SetMaxConns(i % 3)
+			mux.SetMaxConnsWait(time.Duration(i%2) * time.Millisecond)
+		}
+	}()
+	for i := 0; i != 200; i++ {
+		client, server := net.Pipe()
+		go client.Write([]byte("x"))
+		mux.ServeConn(server)
+		client.Close()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestLimitHandlerSaturated(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan net.Conn, 2)
+	ssh := NewLimitHandler(slowHandler(started, release), 2, 0)
+	httpH, httpCh := connChan()
+	mux := NewCMux()
+	mux.HandlePrefix(ssh, "SSH-")
+	mux.HandlePrefix(httpH, "GET ")
+
+	var clients []net.Conn
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i != 2; i++ {
+		client := servePipe(mux)
+		clients = append(clients, client)
+		go client.Write([]byte("SSH-2.0-x\r\n"))
+		recvConn(t, started)
+	}
+	// the third session is closed by the handler limit
+	client := servePipe(mux)
+	clients = append(clients, client)
+	go client.Write([]byte("SSH-2.0-x\r\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the session over the limit was not closed")
+	}
+	if ssh.Active() != 2 || ssh.Rejected() != 1 {
+		t.Fatalf("Active is %d and Rejected is %d, want 2 and 1", ssh.Active(), ssh.Rejected())
+	}
+
+	// the other handler is not limited
+	for i := 0; i != 8; i++ {
+		client := servePipe(mux)
+		clients = append(clients, client)
+		go client.Write([]byte("GET / HTTP/1.1\r\n"))
+		conn := recvConn(t, httpCh)
+		conn.Close()
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for ssh.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Active is %d once the handlers returned", ssh.Active())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimitHandlerQueues(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan net.Conn, 2)
+	h := NewLimitHandler(slowHandler(started, release), 1, -1)
+
+	for i := 0; i != 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go h.ServeConn(server)
+	}
+	recvConn(t, started)
+	select {
+	case <-started:
+		t.Fatal("the queued connection was served over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	recvConn(t, started)
+	if h.Rejected() != 0 {
+		t.Fatalf("Rejected is %d, want the connection queued", h.Rejected())
+	}
+}
+
+func TestLimitHandlerPanic(t *testing.T) {
+	h := NewLimitHandler(HandlerFunc(func(conn net.Conn) {
+		panic("boom")
+	}), 1, 0)
+	for i := 0; i != 2; i++ {
+		client, server := net.Pipe()
+		client.Close()
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("the panic of the handler was swallowed")
+				}
+			}()
+			h.ServeConn(server)
+		}()
+		// the slot is released by the panic, so the next call is not rejected
+		if h.Active() != 0 || h.Rejected() != 0 {
+			t.Fatalf("after a panic Active is %d and Rejected is %d", h.Active(), h.Rejected())
+		}
+	}
+}
+
+func TestRateLimitHandlerBurst(t *testing.T) {
+	const total, burst = 100, 5
+	var accepted int64
+	mux := NewCMux()
+	h := NewRateLimitHandler(HandlerFunc(func(conn net.Conn) {
+		atomic.AddInt64(&accepted, 1)
+		conn.Close()
+	}), 10, burst, 0)
+	mux.HandlePrefix(h, "SSH-")
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i != total; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write([]byte("SSH-2.0-x\r\n"))
+			mux.ServeConn(server)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if elapsed > time.Second {
+		t.Fatalf("the dropped connections took %v to be closed", elapsed)
+	}
+	// the bucket refills by 10 per second while the connections arrive
+	max := int64(burst + 1 + elapsed.Seconds()*10)
+	got := atomic.LoadInt64(&accepted)
+	if got < burst || got > max {
+		t.Fatalf("accepted %d of %d connections, want between %d and %d", got, total, burst, max)
+	}
+	if dropped := h.Dropped(); dropped != uint64(total-got) {
+		t.Fatalf("Dropped is %d, want %d", dropped, total-got)
+	}
+}
+
+func TestRateLimitHandlerDelay(t *testing.T) {
+	var accepted int64
+	h := NewRateLimitHandler(HandlerFunc(func(conn net.Conn) {
+		atomic.AddInt64(&accepted, 1)
+		conn.Close()
+	}), 20, 1, 200*time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i != 3; i++ {
+		client, server := net.Pipe()
+		client.Close()
+		h.ServeConn(server)
+	}
+	// the second and the third wait for their token instead of being dropped
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("3 connections at 20/s with a burst of 1 took %v", elapsed)
+	}
+	if got := atomic.LoadInt64(&accepted); got != 3 || h.Dropped() != 0 {
+		t.Fatalf("accepted %d and dropped %d, want every connection delayed", got, h.Dropped())
+	}
+
+	// a token due after the max delay is not waited for
+	slow := NewRateLimitHandler(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), 1, 1, 10*time.Millisecond)
+	for i := 0; i != 2; i++ {
+		client, server := net.Pipe()
+		client.Close()
+		slow.ServeConn(server)
+	}
+	if slow.Dropped() != 1 {
+		t.Fatalf("Dropped is %d, want the connection over the max delay dropped", slow.Dropped())
+	}
+}
+
+func TestStatsUnderLoad(t *testing.T) {
+	const workers, rounds = 8, 200
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ")
+	errIO := errors.New("connection reset")
+
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		var last Stats
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := mux.Stats()
+			if s.NotFound < last.NotFound || s.Errors < last.Errors || s.Patterns["SSH-"].Matched < last.Patterns["SSH-"].Matched {
+				t.Errorf("the counters went back from %+v to %+v", last, s)
+				return
+			}
+			if s.InFlight < 0 || s.InFlight > workers {
+				t.Errorf("InFlight is %d with %d workers", s.InFlight, workers)
+				return
+			}
+			last = s
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w != workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i != rounds; i++ {
+				mux.DispatchConn(newMemConn([]byte("SSH-2.0-x")))
+				mux.DispatchConn(newMemConn([]byte("GET / HTTP/1.1")))
+				mux.DispatchConn(newMemConn([]byte("POST / HTTP/1.1")))
+				mux.DispatchConn(newMemConn([]byte("nothing")))
+				mux.DispatchConn(&failingConn{Conn: newMemConn(nil), err: errIO})
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-polled
+
+	const n = workers * rounds
+	s := mux.Stats()
+	for pattern, want := range map[string]uint64{"SSH-": n, "GET ": n, "POST ": n} {
+		if got := s.Patterns[pattern]; got.Matched != want || got.Active != 0 {
+			t.Errorf("%q counted %+v, want %d matched and none active", pattern, got, want)
+		}
+	}
+	if s.NotFound != n || s.Errors != n || s.InFlight != 0 {
+		t.Errorf("NotFound is %d, Errors is %d and InFlight is %d, want %d, %d and 0", s.NotFound, s.Errors, s.InFlight, n, n)
+	}
+}
+
+func TestStatsSurviveRemoval(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	for i := 0; i != 3; i++ {
+		mux.DispatchConn(newMemConn([]byte("SSH-2.0-x")))
+	}
+	mux.RemovePrefix("SSH-")
+	if got := mux.Stats().Patterns["SSH-"].Matched; got != 3 {
+		t.Fatalf("the removed pattern counted %d, want the totals kept", got)
+	}
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.DispatchConn(newMemConn([]byte("SSH-2.0-x")))
+	if got := mux.Stats().Patterns["SSH-"].Matched; got != 4 {
+		t.Fatalf("the registered again pattern counted %d, want 4", got)
+	}
+}
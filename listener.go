@@ -3,6 +3,7 @@ package cmux
 import (
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 )
 
@@ -100,3 +101,187 @@ func (l *muxListener) Close() error {
 func (l *muxListener) Addr() net.Addr {
 	return l.addr
 }
+
+type matchListener struct {
+	mux  *CMux
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+	// err is returned by Accept once done is closed, net.ErrClosed if it is nil.
+	err error
+}
+
+func newMatchListener(mux *CMux) *matchListener {
+	return &matchListener{
+		mux:  mux,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *matchListener) ServeConn(conn net.Conn) {
+	select {
+	case <-l.done:
+		l.mux.serveNotFound(conn)
+		return
+	default:
+	}
+	select {
+	case l.ch <- conn:
+	case <-l.done:
+		l.mux.serveNotFound(conn)
+	}
+}
+
+func (l *matchListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *matchListener) Close() error {
+	l.closeWithError(nil)
+	return nil
+}
+
+// closeWithError closes the listener, Accept returns err.
+func (l *matchListener) closeWithError(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *matchListener) Addr() net.Addr {
+	if addr, ok := l.mux.addr.Load().(*net.Addr); ok {
+		return *addr
+	}
+	return muxAddr{}
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string {
+	return "cmux"
+}
+
+func (muxAddr) String() string {
+	return "cmux"
+}
+
+// ListenerHandler is a Handler that queues the dispatched connections for Accept,
+// it glues the mux to servers that only take a net.Listener.
+type ListenerHandler struct {
+	ch            chan net.Conn
+	done          chan struct{}
+	once          sync.Once
+	overflowClose bool
+}
+
+// ListenerOption configures a ListenerHandler.
+type ListenerOption func(l *ListenerHandler)
+
+// WithListenerBacklog sets the number of connections queued before Accept, the default is 128.
+func WithListenerBacklog(n int) ListenerOption {
+	return func(l *ListenerHandler) {
+		if n < 0 {
+			n = 0
+		}
+		l.ch = make(chan net.Conn, n)
+	}
+}
+
+// WithListenerOverflowClose makes a full queue close the dispatched connection instead of blocking.
+func WithListenerOverflowClose() ListenerOption {
+	return func(l *ListenerHandler) {
+		l.overflowClose = true
+	}
+}
+
+// NewListenerHandler create a new ListenerHandler.
+func NewListenerHandler(opts ...ListenerOption) *ListenerHandler {
+	l := &ListenerHandler{
+		ch:   make(chan net.Conn, 128),
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// ServeConn queues the conn, the conn is closed once the listener is closed.
+func (l *ListenerHandler) ServeConn(conn net.Conn) {
+	select {
+	case <-l.done:
+		conn.Close()
+		return
+	default:
+	}
+	if l.overflowClose {
+		select {
+		case l.ch <- conn:
+		default:
+			conn.Close()
+		}
+	} else {
+		select {
+		case l.ch <- conn:
+		case <-l.done:
+			conn.Close()
+		}
+	}
+
+	// Close may have raced with the queueing, so no conn is left behind in the queue.
+	select {
+	case <-l.done:
+		l.drain()
+	default:
+	}
+}
+
+// Accept waits for and returns the next dispatched connection.
+func (l *ListenerHandler) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener and the connections still queued.
+func (l *ListenerHandler) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.drain()
+	})
+	return nil
+}
+
+func (l *ListenerHandler) drain() {
+	for {
+		select {
+		case c := <-l.ch:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Addr returns the address of the listener.
+func (l *ListenerHandler) Addr() net.Addr {
+	return muxAddr{}
+}
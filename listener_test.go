@@ -0,0 +1,228 @@
+package cmux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMatchListenerAccept(t *testing.T) {
+	mux := NewCMux()
+	l := mux.Match("GET ", "POST ")
+	defer l.Close()
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("POST /x HTTP/1.0\r\n"))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := readN(t, conn, 8); got != "POST /x " {
+		t.Fatalf("accepted conn read %q, want the prefix replayed", got)
+	}
+}
+
+func TestMatchListenerHTTPServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewCMux()
+	httpLn := mux.Match("GET ")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	})}
+	go srv.Serve(httpLn)
+	defer srv.Close()
+	go mux.Serve(ln)
+	defer ln.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	if body != "hello /path" {
+		t.Fatalf("got %q", body)
+	}
+	if httpLn.Addr().String() != ln.Addr().String() {
+		t.Fatalf("Addr is %v, want the served listener %v", httpLn.Addr(), ln.Addr())
+	}
+}
+
+func TestMatchListenerRegistrationError(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	for _, prefixes := range [][]string{{"GET "}, {""}, {"POST ", "POST "}} {
+		l := mux.Match(prefixes...)
+		done := make(chan error, 1)
+		go func() {
+			_, err := l.Accept()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || errors.Is(err, net.ErrClosed) {
+				t.Fatalf("Accept of %q returned %v, want the error of the registration", prefixes, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Accept of %q blocked on a listener that was not registered", prefixes)
+		}
+		l.Close()
+	}
+	if got := mux.Prefixes(); len(got) != 1 {
+		t.Fatalf("registered %q", got)
+	}
+}
+
+func TestMatchListenerCloseUnblocksAccept(t *testing.T) {
+	mux := NewCMux()
+	l := mux.Match("GET ")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Accept returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept was not unblocked by Close")
+	}
+	if l.Addr().Network() != "cmux" {
+		t.Fatalf("Addr before serving is %v", l.Addr())
+	}
+}
+
+func TestMatchListenerClosedFallsBackToNotFound(t *testing.T) {
+	mux := NewCMux()
+	l := mux.Match("GET ")
+	l.Close()
+	h, ch := connChan()
+	mux.NotFound(h)
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("GET / HTTP/1.0\r\n"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 4); got != "GET " {
+		t.Fatalf("NotFound read %q, want the prefix replayed", got)
+	}
+}
+
+func TestListenerHandlerHTTPServer(t *testing.T) {
+	lh := NewListenerHandler()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("adapter " + r.URL.Path))
+	})}
+	go srv.Serve(lh)
+	defer srv.Close()
+
+	mux := NewCMux()
+	mux.HandleHTTP1(lh)
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go mux.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	if body != "adapter /p" {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestListenerHandlerClose(t *testing.T) {
+	lh := NewListenerHandler()
+	queued, server := net.Pipe()
+	defer queued.Close()
+	lh.ServeConn(server)
+
+	lh.Close()
+	if _, err := lh.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+	// the queued and the later conns are closed rather than leaked
+	late, server := net.Pipe()
+	defer late.Close()
+	lh.ServeConn(server)
+	for _, conn := range []net.Conn{queued, late} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("read from a conn dispatched to the closed listener: %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestListenerHandlerOverflowClose(t *testing.T) {
+	lh := NewListenerHandler(WithListenerBacklog(1), WithListenerOverflowClose())
+	defer lh.Close()
+	first, server := net.Pipe()
+	defer first.Close()
+	lh.ServeConn(server)
+	second, server := net.Pipe()
+	defer second.Close()
+	lh.ServeConn(server)
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the overflowing conn: %v, want io.EOF", err)
+	}
+	conn, err := lh.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenerHandlerOverflowBlocks(t *testing.T) {
+	lh := NewListenerHandler(WithListenerBacklog(1))
+	defer lh.Close()
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		queued := make(chan struct{})
+		go func() {
+			lh.ServeConn(server)
+			close(queued)
+		}()
+		if i == 0 {
+			<-queued
+			continue
+		}
+		select {
+		case <-queued:
+			t.Fatal("the conn over the backlog was not blocked")
+		case <-time.After(50 * time.Millisecond):
+		}
+		conn, err := lh.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		select {
+		case <-queued:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the blocked conn was not queued once Accept made room")
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// HandlePrefixLocal handle the handler that matches the prefix of the connections that arrived on one of
+// the local addresses, such as "127.0.0.1:8080", ":8080" for a port or "127.0.0.1:" for an address.
+// A unix socket is matched by its path. The connections that arrived elsewhere are matched as if
+// the registration did not exist, so a mux serving several listeners can route them apart.
+// It wins over a plain registration of the same prefix.
+func (m *CMux) HandlePrefixLocal(handler Handler, localAddrs []string, prefixes ...string) error {
+	if err := noBudget("HandlePrefixLocal", handler); err != nil {
+		return err
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	locals := make([]localAddr, 0, len(localAddrs))
+	for _, s := range localAddrs {
+		l, err := parseLocalAddr(s)
+		if err != nil {
+			return err
+		}
+		locals = append(locals, l)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	name := m.nameOf(handler)
+	restricted := make(map[string][]*route, len(m.restricted)+len(prefixes))
+	for prefix, rs := range m.restricted {
+		restricted[prefix] = rs
+	}
+	for _, prefix := range prefixes {
+		pattern := "local:" + strings.Join(localAddrs, ",") + ":" + prefix
+		r := &route{
+			pattern: prefix,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf(pattern),
+			locals:  locals,
+		}
+		rs := make([]*route, 0, len(restricted[prefix])+1)
+		rs = append(rs, restricted[prefix]...)
+		restricted[prefix] = append(rs, r)
+	}
+	m.restricted = restricted
+	m.rebuild()
+	return nil
+}
+
+// localAddr is a pattern of HandlePrefixLocal, a nil ip or a zero port matches any.
+type localAddr struct {
+	path string
+	ip   net.IP
+	port int
+}
+
+// parseLocalAddr parses "ip:port", ":port", "ip:" or the path of a unix socket.
+func parseLocalAddr(s string) (localAddr, error) {
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, "@") {
+		return localAddr{path: s}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return localAddr{}, fmt.Errorf("invalid local address %q: %w", s, err)
+	}
+	var l localAddr
+	if host != "" {
+		l.ip = net.ParseIP(host)
+		if l.ip == nil {
+			return localAddr{}, fmt.Errorf("invalid local address %q", s)
+		}
+		if ip4 := l.ip.To4(); ip4 != nil {
+			l.ip = ip4
+		}
+	}
+	if port != "" {
+		l.port, err = strconv.Atoi(port)
+		if err != nil || l.port <= 0 || l.port > 0xffff {
+			return localAddr{}, fmt.Errorf("invalid local address %q", s)
+		}
+	}
+	if l.ip == nil && l.port == 0 {
+		return localAddr{}, fmt.Errorf("invalid local address %q", s)
+	}
+	return l, nil
+}
+
+// allowLocal reports whether addr matches one of the locals.
+func allowLocal(locals []localAddr, addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	if a, ok := addr.(*net.UnixAddr); ok {
+		for _, l := range locals {
+			if l.path != "" && l.path == a.Name {
+				return true
+			}
+		}
+		return false
+	}
+	ip, port := addrIP(addr), addrPort(addr)
+	for _, l := range locals {
+		if l.path != "" {
+			continue
+		}
+		if (l.ip == nil || l.ip.Equal(ip)) && (l.port == 0 || l.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrPort returns the port of addr, zero if it has none.
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
@@ -0,0 +1,151 @@
+package cmux
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// localConn is a connection that arrived on the local address.
+type localConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c localConn) LocalAddr() net.Addr { return c.local }
+
+// memListener is a listener on the address whose connections are the pipes handed out by dial.
+type memListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemListener(addr net.Addr) *memListener {
+	return &memListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return l.addr }
+
+func (l *memListener) dial(t testing.TB) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	select {
+	case l.conns <- localConn{Conn: server, local: l.addr}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener is not accepting")
+	}
+	return client
+}
+
+// idHandler writes its id to the connection and closes it.
+type idHandler string
+
+func (h idHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte(h))
+}
+
+func TestHandlePrefixLocalListeners(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixLocal(idHandler("admin"), []string{"127.0.0.1:"}, "ADMIN ")
+	mux.HandlePrefix(idHandler("public"), "ADMIN ")
+	mux.HandlePrefix(idHandler("http"), "GET ")
+	loopback := newMemListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	public := newMemListener(&net.TCPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 443})
+	defer loopback.Close()
+	defer public.Close()
+	go mux.ServeAll(loopback, public)
+
+	for _, tc := range []struct {
+		l    *memListener
+		b    string
+		want string
+	}{
+		{loopback, "ADMIN stats", "admin"},
+		{public, "ADMIN stats", "public"},
+		{loopback, "GET / ", "http"},
+		{public, "GET / ", "http"},
+		{loopback, "ADMIN again", "admin"},
+	} {
+		client := tc.l.dial(t)
+		go client.Write([]byte(tc.b))
+		if got := readN(t, client, len(tc.want)); got != tc.want {
+			t.Errorf("%q on %v was served by %q, want %q", tc.b, tc.l.addr, got, tc.want)
+		}
+		client.Close()
+	}
+}
+
+// dispatchLocal returns the id of the handler that matched b arriving on the local address.
+func dispatchLocal(t testing.TB, mux *CMux, local net.Addr, b string) string {
+	t.Helper()
+	var id string
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		id = string(handler.(handlerID))
+	})
+	if err := mux.DispatchConn(localConn{Conn: newMemConn([]byte(b)), local: local}); err != nil {
+		return ""
+	}
+	return id
+}
+
+func TestHandlePrefixLocal(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixLocal(handlerID("port"), []string{":8080"}, "A")
+	mux.HandlePrefixLocal(handlerID("exact"), []string{"10.0.0.1:22", "[::1]:22"}, "B")
+	mux.HandlePrefixLocal(handlerID("unix"), []string{"/run/admin.sock", "@abstract"}, "C")
+	mux.HandlePrefix(handlerID("ab"), "AB")
+
+	for _, tc := range []struct {
+		local net.Addr
+		b     string
+		want  string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}, "A", "port"},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 8080}, "A", "port"},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8081}, "A", ""},
+		// the restricted prefix is ignored, matching goes on to the others
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8081}, "AB", "ab"},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}, "B", "exact"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 22}, "B", "exact"},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 22}, "B", "exact"},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 22}, "B", ""},
+		{&net.UnixAddr{Name: "/run/admin.sock", Net: "unix"}, "C", "unix"},
+		{&net.UnixAddr{Name: "@abstract", Net: "unix"}, "C", "unix"},
+		{&net.UnixAddr{Name: "/run/other.sock", Net: "unix"}, "C", ""},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, "C", ""},
+	} {
+		if got := dispatchLocal(t, mux, tc.local, tc.b); got != tc.want {
+			t.Errorf("%q on %v matched %q, want %q", tc.b, tc.local, got, tc.want)
+		}
+	}
+}
+
+func TestHandlePrefixLocalInvalid(t *testing.T) {
+	for _, s := range []string{"", "8080", "localhost:80", "1.2.3.4:0", ":", "1.2.3.4:99999", "[::1]:x"} {
+		mux := NewCMux()
+		if err := mux.HandlePrefixLocal(handlerID("x"), []string{s}, "A"); err == nil {
+			t.Errorf("HandlePrefixLocal accepted %q", s)
+		}
+		if len(mux.Prefixes()) != 0 {
+			t.Errorf("HandlePrefixLocal registered a prefix with %q", s)
+		}
+	}
+}
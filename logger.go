@@ -0,0 +1,84 @@
+package cmux
+
+import (
+	"net"
+	"time"
+)
+
+// EventKind is the kind of an Event.
+type EventKind uint8
+
+const (
+	// EventAccepted is logged when the mux starts sniffing a connection.
+	EventAccepted EventKind = iota
+	// EventMatched is logged when a handler is picked, Duration is the time spent sniffing.
+	EventMatched
+	// EventNotFound is logged when nothing matches, Duration is the time spent sniffing.
+	EventNotFound
+	// EventError is logged when the connection could not be dispatched, Err is the reason.
+	EventError
+	// EventDone is logged when the handler returns, Duration is the time spent in the handler.
+	EventDone
+)
+
+var eventKindNames = [...]string{
+	EventAccepted: "accepted",
+	EventMatched:  "matched",
+	EventNotFound: "not found",
+	EventError:    "error",
+	EventDone:     "done",
+}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventKindNames) {
+		return eventKindNames[k]
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a connection dispatched by the mux.
+type Event struct {
+	Kind       EventKind
+	RemoteAddr net.Addr
+	// Pattern is the registration that won, empty for the NotFound handler.
+	Pattern string
+	// Sniffed is the number of the bytes read while matching.
+	Sniffed  int
+	Duration time.Duration
+	Err      error
+}
+
+// Logger receives the events of the mux.
+type Logger interface {
+	Log(e Event)
+}
+
+// LoggerFunc is a function that is a Logger.
+type LoggerFunc func(e Event)
+
+func (f LoggerFunc) Log(e Event) {
+	f(e)
+}
+
+// SetLogger sets the logger receiving the events of every connection, nil disables the logging.
+func (m *CMux) SetLogger(logger Logger) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.logger = logger
+	m.rebuild()
+}
+
+// log sends the event to the logger, the events are only built when there is a logger.
+func (t *table) log(kind EventKind, conn net.Conn, pattern string, sniffed int, d time.Duration, err error) {
+	if t.logger == nil {
+		return
+	}
+	t.logger.Log(Event{
+		Kind:       kind,
+		RemoteAddr: conn.RemoteAddr(),
+		Pattern:    pattern,
+		Sniffed:    sniffed,
+		Duration:   d,
+		Err:        err,
+	})
+}
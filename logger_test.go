@@ -0,0 +1,156 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the events it receives.
+type recordingLogger struct {
+	mut    sync.Mutex
+	events []Event
+}
+
+func (l *recordingLogger) Log(e Event) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *recordingLogger) kinds() []EventKind {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	kinds := make([]EventKind, 0, len(l.events))
+	for _, e := range l.events {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+func (l *recordingLogger) last() Event {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.events[len(l.events)-1]
+}
+
+func TestLoggerMatched(t *testing.T) {
+	mux := NewCMux()
+	logger := &recordingLogger{}
+	mux.SetLogger(logger)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+	}), "SSH-")
+
+	conn := newMemConn([]byte("SSH-2.0-x"))
+	if err := mux.DispatchConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	want := []EventKind{EventAccepted, EventMatched, EventDone}
+	if got := logger.kinds(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("logged %v, want %v", got, want)
+	}
+	done := logger.last()
+	if done.Pattern != "SSH-" || done.Sniffed != 4 || done.RemoteAddr != memAddr {
+		t.Fatalf("the done event is %+v", done)
+	}
+	if done.Duration < 10*time.Millisecond {
+		t.Fatalf("the done event lasted %v, want the time in the handler", done.Duration)
+	}
+}
+
+func TestLoggerNotFound(t *testing.T) {
+	mux := NewCMux()
+	logger := &recordingLogger{}
+	mux.SetLogger(logger)
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	if err := mux.DispatchConn(newMemConn([]byte("GET "))); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DispatchConn returned %v", err)
+	}
+	want := []EventKind{EventAccepted, EventNotFound}
+	if got := logger.kinds(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("logged %v, want %v", got, want)
+	}
+	if e := logger.last(); e.Pattern != "" || e.Sniffed != 4 {
+		t.Fatalf("the not found event is %+v", e)
+	}
+
+	// with a NotFound handler the handler is logged as done
+	mux.NotFound(handlerID("nf"))
+	logger.events = nil
+	mux.DispatchConn(newMemConn([]byte("GET ")))
+	want = []EventKind{EventAccepted, EventNotFound, EventDone}
+	if got := logger.kinds(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("logged %v, want %v", got, want)
+	}
+}
+
+func TestLoggerError(t *testing.T) {
+	mux := NewCMux()
+	logger := &recordingLogger{}
+	mux.SetLogger(logger)
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	errIO := errors.New("connection reset")
+	client, server := net.Pipe()
+	defer client.Close()
+	mux.DispatchConn(&failingConn{Conn: server, err: errIO})
+	want := []EventKind{EventAccepted, EventError}
+	if got := logger.kinds(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("logged %v, want %v", got, want)
+	}
+	if e := logger.last(); !errors.Is(e.Err, errIO) {
+		t.Fatalf("the error event carries %v", e.Err)
+	}
+}
+
+func TestNilLoggerDoesNotAllocate(t *testing.T) {
+	mux := NewCMux()
+	tbl := mux.load()
+	conn := newMemConn(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		for kind := EventAccepted; kind <= EventDone; kind++ {
+			tbl.log(kind, conn, "SSH-", 4, time.Second, nil)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("logging without a logger made %v allocations", allocs)
+	}
+}
+
+func BenchmarkLogNilLogger(b *testing.B) {
+	tbl := NewCMux().load()
+	conn := newMemConn(nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tbl.log(EventMatched, conn, "SSH-", 4, time.Second, nil)
+	}
+}
+
+func benchmarkDispatchLogger(b *testing.B, logger Logger) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.SetLogger(logger)
+	data := []byte("SSH-2.0-x")
+	conn := newMemConn(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.r.Reset(data)
+		if err := mux.DispatchConn(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDispatchNilLogger(b *testing.B) {
+	benchmarkDispatchLogger(b, nil)
+}
+
+func BenchmarkDispatchLogger(b *testing.B) {
+	benchmarkDispatchLogger(b, LoggerFunc(func(e Event) {}))
+}
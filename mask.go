@@ -0,0 +1,78 @@
+package cmux
+
+import (
+	"fmt"
+)
+
+type maskRoute struct {
+	route
+	value []byte
+	mask  []byte
+}
+
+// HandlePattern handle the handler that matches the pattern under the mask,
+// only the bits set in the mask are compared so a mask byte of 0x00 matches any value at its position.
+// A plain prefix of the same length wins over the pattern.
+func (m *CMux) HandlePattern(handler Handler, pattern []byte, mask []byte) error {
+	if err := noBudget("HandlePattern", handler); err != nil {
+		return err
+	}
+	if len(pattern) == 0 {
+		return nil
+	}
+	if len(mask) != len(pattern) {
+		return fmt.Errorf("mask length %d does not match pattern length %d", len(mask), len(pattern))
+	}
+	mr := &maskRoute{
+		value: make([]byte, len(pattern)),
+		mask:  append([]byte(nil), mask...),
+	}
+	display := make([]byte, len(pattern))
+	for i := range pattern {
+		mr.value[i] = pattern[i] & mask[i]
+		display[i] = pattern[i]
+		if mask[i] == 0 {
+			display[i] = '?'
+		}
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	mr.route = route{
+		pattern: string(display),
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf("mask:" + string(display)),
+	}
+	m.masks = append(m.masks, mr)
+	m.rebuild()
+	return nil
+}
+
+// match reports whether b matches the pattern, pending is reported while b is too short to decide.
+func (mr *maskRoute) match(b []byte) (matched bool, pending bool) {
+	n := len(mr.value)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if b[i]&mr.mask[i] != mr.value[i] {
+			return false, false
+		}
+	}
+	return n == len(mr.value), n < len(mr.value)
+}
+
+// matchMask returns the longest pattern that matches b,
+// pending is reported while a longer pattern may still match.
+func (t *table) matchMask(b []byte) (matched *route, pending bool) {
+	for _, mr := range t.masks {
+		ok, more := mr.match(b)
+		if more {
+			pending = true
+		}
+		if ok && (matched == nil || len(mr.pattern) > len(matched.pattern)) {
+			matched = &mr.route
+		}
+	}
+	return matched, pending
+}
@@ -0,0 +1,63 @@
+package cmux
+
+import (
+	"testing"
+)
+
+func TestHandlePatternWildcard(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePattern(handlerID("tls"), []byte{0x16, 0x03, 0x00}, []byte{0xff, 0xff, 0x00})
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	for i := 0; i != 256; i++ {
+		b := string([]byte{0x16, 0x03, byte(i), 0x00})
+		if got := matchOf(t, mux, b); got != "tls" {
+			t.Fatalf("%q matched %q, want the wildcard to match every value", b, got)
+		}
+	}
+	for _, b := range []string{"\x16\x02\x01", "\x17\x03\x01", "\x16\x03"} {
+		if got := matchOf(t, mux, b); got != "" {
+			t.Errorf("%q matched %q", b, got)
+		}
+	}
+	if got := matchOf(t, mux, "SSH-2.0-x"); got != "ssh" {
+		t.Errorf("SSH matched %q", got)
+	}
+}
+
+func TestHandlePatternDoesNotShadowLiteral(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePattern(handlerID("framing"), []byte("MX?v"), []byte{0xff, 0xff, 0x00, 0xff})
+	mux.HandlePrefix(handlerID("exact"), "MX2v")
+	mux.HandlePrefix(handlerID("longer"), "MX3v1")
+	mux.HandlePrefix(handlerID("shorter"), "MX")
+
+	for b, want := range map[string]string{
+		"MX1v":  "framing",
+		"MX9v":  "framing",
+		"MX2v":  "exact",
+		"MX3v1": "longer",
+		"MX3v2": "framing",
+		"MX1w":  "shorter",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandlePatternBitMask(t *testing.T) {
+	mux := NewCMux()
+	// the high nibble of the second byte is the version, the low nibble is ignored
+	mux.HandlePattern(handlerID("v1"), []byte{0xa5, 0x10}, []byte{0xff, 0xf0})
+	for _, b := range []byte{0x10, 0x1f, 0x17} {
+		if got := matchOf(t, mux, string([]byte{0xa5, b})); got != "v1" {
+			t.Errorf("%#x matched %q, want v1", b, got)
+		}
+	}
+	if got := matchOf(t, mux, "\xa5\x20"); got != "" {
+		t.Errorf("another version matched %q", got)
+	}
+	if err := mux.HandlePattern(handlerID("bad"), []byte{1, 2}, []byte{1}); err == nil {
+		t.Error("a mask of another length was accepted")
+	}
+}
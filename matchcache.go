@@ -0,0 +1,191 @@
+package cmux
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMisSpeculated = fmt.Errorf("the connection did not match the cached pattern of its source")
+
+// EnableMatchCache remembers the pattern that won for each source IP address for ttl, up to size sources
+// evicting the least recently used, zero disables it, the default. A new connection from a remembered source
+// is dispatched at once to the handler of the pattern without waiting for its first bytes, which are matched
+// as the handler reads them. If they match something else, the source is forgotten and the connection
+// is closed with ErrMisSpeculated, the bytes it read may already have reached the wrong handler.
+// The handler is not told the SniffedBytes of such a connection. The cache is cleared by any registration,
+// and it is not used with the PROXY protocol, SetBanner, HandleServerFirst, HandleALPN, HandleOriginalDst
+// or SetSkipLeading, whose connections are not decided by their first bytes alone, nor with HandlePrefixStrip,
+// whose prefix is only discarded once it was sniffed.
+func (m *CMux) EnableMatchCache(ttl time.Duration, size int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if ttl <= 0 || size <= 0 {
+		m.matchCache.Store((*matchCache)(nil))
+		return
+	}
+	m.matchCache.Store(newMatchCache(ttl, size))
+}
+
+// loadMatchCache returns the cache of EnableMatchCache, nil if it is disabled.
+func (m *CMux) loadMatchCache() *matchCache {
+	c, _ := m.matchCache.Load().(*matchCache)
+	return c
+}
+
+// canSpeculate reports whether the connections of t are decided by their first bytes alone.
+func (t *table) canSpeculate() bool {
+	return !t.proxyProtocol && len(t.origDst) == 0 && len(t.banner) == 0 &&
+		t.serverFirst == nil && len(t.alpn) == 0 && t.skipMax == 0 && !t.strip
+}
+
+// matchCache is the patterns that won for the sources, the most recently used first.
+type matchCache struct {
+	mut     sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newMatchCache(ttl time.Duration, size int) *matchCache {
+	return &matchCache{
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// matchEntry is the route of a source, it is only valid for the table it was matched with.
+type matchEntry struct {
+	key     string
+	t       *table
+	route   *route
+	expires time.Time
+}
+
+// cacheKey returns the key of the source of addr, empty if it is not an IP address.
+func cacheKey(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// get returns the route of the source for t, nil if there is none.
+func (c *matchCache) get(key string, t *table) *route {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*matchEntry)
+	if e.t != t || time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e.route
+}
+
+// put remembers the route of the source.
+func (c *matchCache) put(key string, t *table, r *route) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*matchEntry)
+		e.t, e.route, e.expires = t, r, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&matchEntry{key: key, t: t, route: r, expires: expires})
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*matchEntry).key)
+	}
+}
+
+// drop forgets the source if it is still remembered with r.
+func (c *matchCache) drop(key string, r *route) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	el, ok := c.entries[key]
+	if ok && el.Value.(*matchEntry).route == r {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// speculate returns conn wrapped to verify the cached route of its source, nil if the source is not cached.
+func (m *CMux) speculate(c *matchCache, t *table, conn net.Conn) (net.Conn, *route) {
+	key := cacheKey(conn.RemoteAddr())
+	if key == "" {
+		return conn, nil
+	}
+	r := c.get(key, t)
+	if r == nil {
+		return conn, nil
+	}
+	s := &speculation{
+		mux:   m,
+		cache: c,
+		key:   key,
+		route: r,
+	}
+	s.sniffer.m = m
+	s.sniffer.reset(t, conn.RemoteAddr(), conn.LocalAddr())
+	if us, ok := asUnreadConn(conn); ok {
+		s.reader = us.Reader
+		us.Reader = s
+	} else {
+		s.reader = conn
+		conn = newUnreadConn(conn, s)
+	}
+	s.conn = conn
+	return conn, r
+}
+
+// speculation matches the bytes read by the handler of a speculative dispatch.
+type speculation struct {
+	reader  io.Reader
+	conn    net.Conn
+	mux     *CMux
+	cache   *matchCache
+	key     string
+	route   *route
+	sniffer Sniffer
+	done    bool
+	failed  bool
+}
+
+func (s *speculation) Read(p []byte) (int, error) {
+	if s.failed {
+		return 0, ErrMisSpeculated
+	}
+	n, err := s.reader.Read(p)
+	if s.done {
+		return n, err
+	}
+	if !s.sniffer.Feed(p[:n]) && err == nil {
+		return n, nil
+	}
+	s.done = true
+	if r, fed := s.sniffer.route(); !fed || r == s.route {
+		return n, err
+	}
+	s.failed = true
+	s.cache.drop(s.key, s.route)
+	atomic.AddUint64(&s.mux.misSpeculated, 1)
+	s.mux.load().closeWithError(s.conn, ErrMisSpeculated)
+	return 0, ErrMisSpeculated
+}
@@ -0,0 +1,355 @@
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readAnswer is a handler reading the n bytes of the prefix and answering with the id.
+func readAnswer(id string, n int, errs chan<- error) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		_, err := io.ReadFull(conn, make([]byte, n))
+		if err != nil {
+			if errs != nil {
+				errs <- err
+			}
+			return
+		}
+		conn.Write([]byte(id))
+	})
+}
+
+// dialFrom sends the prefix through mux from the ip and returns what was answered.
+func dialFrom(t testing.TB, mux *CMux, ip, prefix string) string {
+	t.Helper()
+	conn := serveFrom(mux, ip, prefix)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+// cacheMux routes SSH and HTTP with the match cache enabled.
+func cacheMux(errs chan<- error) *CMux {
+	mux := NewCMux()
+	mux.HandlePrefix(readAnswer("ssh", 4, errs), "SSH-")
+	mux.HandlePrefix(readAnswer("http", 4, errs), "GET ")
+	mux.EnableMatchCache(time.Minute, 16)
+	return mux
+}
+
+func TestMatchCacheDispatchesBeforeBytes(t *testing.T) {
+	entered := make(chan net.Conn, 1)
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		entered <- conn
+	}), "SSH-")
+	mux.HandlePrefix(readAnswer("http", 4, nil), "GET ")
+	mux.EnableMatchCache(time.Minute, 16)
+	client := serveFrom(mux, "192.0.2.1", "SSH-")
+	recvConn(t, entered).Close()
+	client.Close()
+	if s := mux.Stats(); s.Speculated != 0 {
+		t.Fatalf("%d connections speculated before the source was remembered", s.Speculated)
+	}
+
+	// the handler of the remembered source is served before the client sends anything
+	client, server := net.Pipe()
+	defer client.Close()
+	go mux.ServeConn(&sourceConn{Conn: server, remote: tcpAddr("192.0.2.1")})
+	conn := recvConn(t, entered)
+	defer conn.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Fatalf("the speculated handler read %q", got)
+	}
+	if s := mux.Stats(); s.Speculated != 1 || s.MisSpeculated != 0 {
+		t.Fatalf("%d speculated, %d mis-speculated, want 1 and 0", s.Speculated, s.MisSpeculated)
+	}
+	// another source is sniffed
+	if got := dialFrom(t, mux, "192.0.2.2", "GET "); got != "http" {
+		t.Fatalf("answered %q", got)
+	}
+	if s := mux.Stats(); s.Speculated != 1 {
+		t.Fatalf("%d connections speculated, want the remembered source only", s.Speculated)
+	}
+}
+
+func TestMatchCacheMisSpeculation(t *testing.T) {
+	handled := make(chan error, 4)
+	mux := cacheMux(handled)
+	errs := make(chan error, 4)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	if got := dialFrom(t, mux, "192.0.2.1", "SSH-"); got != "ssh" {
+		t.Fatalf("answered %q", got)
+	}
+
+	// the source changes its protocol, the SSH handler is given the conn and fails to read it
+	if got := dialFrom(t, mux, "192.0.2.1", "GET "); got != "" {
+		t.Fatalf("the mis-speculated connection was answered with %q", got)
+	}
+	if err := <-handled; !errors.Is(err, ErrMisSpeculated) {
+		t.Fatalf("the handler read %v, want ErrMisSpeculated", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrMisSpeculated) {
+			t.Fatalf("reported %v, want ErrMisSpeculated", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mis-speculation was not reported")
+	}
+	if s := mux.Stats(); s.Speculated != 1 || s.MisSpeculated != 1 {
+		t.Fatalf("%d speculated, %d mis-speculated, want 1 and 1", s.Speculated, s.MisSpeculated)
+	}
+
+	// the source was forgotten, its next connection is sniffed and remembered again
+	if got := dialFrom(t, mux, "192.0.2.1", "GET "); got != "http" {
+		t.Fatalf("answered %q after the mis-speculation", got)
+	}
+	if got := dialFrom(t, mux, "192.0.2.1", "GET "); got != "http" {
+		t.Fatalf("answered %q", got)
+	}
+	if s := mux.Stats(); s.Speculated != 2 || s.MisSpeculated != 1 {
+		t.Fatalf("%d speculated, %d mis-speculated, want 2 and 1", s.Speculated, s.MisSpeculated)
+	}
+}
+
+func TestMatchCacheMisSpeculationSplitPrefix(t *testing.T) {
+	handled := make(chan error, 4)
+	mux := cacheMux(handled)
+	dialFrom(t, mux, "192.0.2.1", "SSH-")
+	// the bytes shared by the patterns do not decide, the handler reads them before the mismatch
+	client, server := net.Pipe()
+	defer client.Close()
+	go mux.ServeConn(&sourceConn{Conn: server, remote: tcpAddr("192.0.2.1")})
+	writeChunks(client, "S", "X")
+	if err := <-handled; !errors.Is(err, ErrMisSpeculated) {
+		t.Fatalf("the handler read %v, want ErrMisSpeculated", err)
+	}
+	if s := mux.Stats(); s.MisSpeculated != 1 {
+		t.Fatalf("%d mis-speculated, want 1", s.MisSpeculated)
+	}
+}
+
+func TestMatchCacheClearedByRegistration(t *testing.T) {
+	mux := cacheMux(nil)
+	dialFrom(t, mux, "192.0.2.1", "SSH-")
+	mux.HandlePrefix(readAnswer("other", 4, nil), "OTHE")
+	if got := dialFrom(t, mux, "192.0.2.1", "SSH-"); got != "ssh" {
+		t.Fatalf("answered %q", got)
+	}
+	if s := mux.Stats(); s.Speculated != 0 {
+		t.Fatalf("%d connections speculated with the routes before the registration", s.Speculated)
+	}
+}
+
+func TestMatchCacheNotSpeculated(t *testing.T) {
+	for name, set := range map[string]func(mux *CMux){
+		"PROXY protocol": func(mux *CMux) { mux.EnableProxyProtocol() },
+		"banner":         func(mux *CMux) { mux.SetBanner([]byte("hello\r\n"), 0) },
+		"skip leading":   func(mux *CMux) { mux.SetSkipLeading("\r\n", 4) },
+		"strip":          func(mux *CMux) { mux.HandlePrefixStrip(handlerID("strip"), "MAGIC") },
+	} {
+		set := set
+		t.Run(name, func(t *testing.T) {
+			mux := cacheMux(nil)
+			set(mux)
+			if mux.load().canSpeculate() {
+				t.Fatal("the connections can be speculated")
+			}
+		})
+	}
+}
+
+func TestMatchCacheStrip(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixStrip(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		b := make([]byte, 5)
+		io.ReadFull(conn, b)
+		conn.Write(b)
+	}), "MAGICv1\n")
+	mux.EnableMatchCache(time.Minute, 16)
+	// the repeated connections of the source are still stripped of the magic
+	for i := 0; i != 3; i++ {
+		if got := dialFrom(t, mux, "192.0.2.1", "MAGICv1\nhello"); got != "hello" {
+			t.Fatalf("connection %d: the handler read %q", i, got)
+		}
+	}
+	if s := mux.Stats(); s.Speculated != 0 {
+		t.Fatalf("%d connections speculated", s.Speculated)
+	}
+}
+
+func TestMatchCacheLRU(t *testing.T) {
+	c := newMatchCache(time.Minute, 2)
+	tbl := NewCMux().load()
+	a, b, d := &route{pattern: "a"}, &route{pattern: "b"}, &route{pattern: "d"}
+	c.put("1", tbl, a)
+	c.put("2", tbl, b)
+	// 1 is used, so 2 is the least recently used
+	if c.get("1", tbl) != a {
+		t.Fatal("1 is not remembered")
+	}
+	c.put("3", tbl, d)
+	if c.get("2", tbl) != nil {
+		t.Fatal("the least recently used source was not evicted")
+	}
+	if c.get("1", tbl) != a || c.get("3", tbl) != d {
+		t.Fatal("the recently used sources were evicted")
+	}
+	if len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Fatalf("%d entries, %d in the list, want 2", len(c.entries), c.lru.Len())
+	}
+	// a drop of another route keeps the entry
+	c.drop("1", d)
+	if c.get("1", tbl) != a {
+		t.Fatal("the entry was dropped for another route")
+	}
+	c.drop("1", a)
+	if c.get("1", tbl) != nil {
+		t.Fatal("the entry was not dropped")
+	}
+	// another table does not see the entries
+	if c.get("3", NewCMux().load()) != nil {
+		t.Fatal("the entry of another table was returned")
+	}
+}
+
+func TestMatchCacheTTL(t *testing.T) {
+	c := newMatchCache(10*time.Millisecond, 2)
+	tbl := NewCMux().load()
+	r := &route{pattern: "a"}
+	c.put("1", tbl, r)
+	if c.get("1", tbl) != r {
+		t.Fatal("the entry is not remembered")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if c.get("1", tbl) != nil {
+		t.Fatal("the expired entry was returned")
+	}
+	if len(c.entries) != 0 {
+		t.Fatal("the expired entry was not removed")
+	}
+}
+
+func TestMatchCacheConcurrent(t *testing.T) {
+	mux := cacheMux(nil)
+	mux.EnableMatchCache(time.Minute, 2)
+	var wg sync.WaitGroup
+	for i := 0; i != 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j != 30; j++ {
+				ip := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}[(i+j)%3]
+				prefix := []string{"SSH-", "GET "}[(i*j)%2]
+				want := map[string]string{"SSH-": "ssh", "GET ": "http"}[prefix]
+				// a mis-speculation closes the connection without an answer
+				if got := dialFrom(t, mux, ip, prefix); got != want && got != "" {
+					t.Errorf("%s from %s was answered with %q", prefix, ip, got)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j != 20; j++ {
+			mux.Stats()
+			mux.EnableMatchCache(time.Minute, 1+j%3)
+		}
+	}()
+	wg.Wait()
+}
+
+// delayedConn is a memConn whose first read waits for the second segment of the client.
+type delayedConn struct {
+	*memConn
+	delay time.Duration
+	read  bool
+}
+
+func (c *delayedConn) Read(p []byte) (int, error) {
+	if !c.read {
+		c.read = true
+		time.Sleep(c.delay)
+	}
+	return c.memConn.Read(p)
+}
+
+// benchmarkMatchCache dispatches the connections of a source, the handler reads their prefix.
+func benchmarkMatchCache(b *testing.B, cached bool) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Read(make([]byte, 16))
+	}), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ", "PUT ")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03\x01", "\x16\x03\x03")
+	if cached {
+		mux.EnableMatchCache(time.Minute, 16)
+	}
+	data := []byte("SSH-2.0-OpenSSH_8.9\r\n")
+	mux.ServeConn(newMemConn(data))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mux.ServeConn(newMemConn(data))
+	}
+	b.StopTimer()
+	if cached && mux.Stats().Speculated != uint64(b.N) {
+		b.Fatalf("%d of %d connections speculated", mux.Stats().Speculated, b.N)
+	}
+}
+
+func BenchmarkMatchCacheDispatch(b *testing.B) {
+	benchmarkMatchCache(b, true)
+}
+
+func BenchmarkSniffDispatch(b *testing.B) {
+	benchmarkMatchCache(b, false)
+}
+
+// benchmarkTimeToHandler measures how long the handler waits for a client whose first bytes come late.
+func benchmarkTimeToHandler(b *testing.B, cached bool) {
+	const delay = 200 * time.Microsecond
+	var entered time.Time
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		entered = time.Now()
+		conn.Read(make([]byte, 16))
+	}), "SSH-")
+	if cached {
+		mux.EnableMatchCache(time.Minute, 16)
+	}
+	data := []byte("SSH-2.0-OpenSSH_8.9\r\n")
+	mux.ServeConn(newMemConn(data))
+	var total time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		mux.ServeConn(&delayedConn{memConn: newMemConn(data), delay: delay})
+		total += entered.Sub(start)
+	}
+	b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns-to-handler/op")
+}
+
+func BenchmarkMatchCacheTimeToHandler(b *testing.B) {
+	benchmarkTimeToHandler(b, true)
+}
+
+func BenchmarkSniffTimeToHandler(b *testing.B) {
+	benchmarkTimeToHandler(b, false)
+}
@@ -0,0 +1,147 @@
+package cmux
+
+import (
+	"fmt"
+	"time"
+)
+
+// Matcher decides whether the sniffed bytes belong to a protocol.
+// It returns needMore when the bytes seen so far are not enough to decide.
+// The b is only valid during the call.
+type Matcher interface {
+	Match(b []byte) (matched bool, needMore bool)
+}
+
+type MatcherFunc func(b []byte) (matched bool, needMore bool)
+
+func (m MatcherFunc) Match(b []byte) (matched bool, needMore bool) {
+	return m(b)
+}
+
+// MoreMatcher is a matcher that tells how many more bytes it needs to decide,
+// the sniffing buffer is grown for it instead of being sized for its bound up front.
+// It returns a positive more while the bytes seen so far are not enough to decide.
+// The b is only valid during the call.
+type MoreMatcher interface {
+	MatchMore(b []byte) (matched bool, more int)
+}
+
+type MoreMatcherFunc func(b []byte) (matched bool, more int)
+
+func (m MoreMatcherFunc) MatchMore(b []byte) (matched bool, more int) {
+	return m(b)
+}
+
+type matcherRoute struct {
+	route
+	matcher  Matcher
+	more     MoreMatcher
+	maxBytes int
+	priority int
+}
+
+// initialGrowLength is the size of the sniffing buffer when only a MoreMatcher needs it.
+const initialGrowLength = 512
+
+type matchState uint8
+
+const (
+	matchPending matchState = iota
+	matchMatched
+	matchFailed
+)
+
+// HandleMatcher handle the handler that the matcher accepts, the matcher is fed with at most maxBytes bytes.
+// Matchers are consulted in registration order when no prefix matches, with the priority 0.
+// A matcher of a handler of WithBudget that is still undecided after WithMaxWait fails.
+func (m *CMux) HandleMatcher(handler Handler, matcher Matcher, maxBytes int) error {
+	return m.handleMatcher(handler, matcher, maxBytes, "matcher")
+}
+
+// HandleMatcherPriority handle the handler that the matcher accepts like HandleMatcher, the matchers are consulted
+// once no prefix matches from the highest priority to the lowest, in registration order for the same priority.
+func (m *CMux) HandleMatcherPriority(handler Handler, matcher Matcher, priority int, maxBytes int) error {
+	return m.addMatcher(handler, &matcherRoute{matcher: matcher, maxBytes: maxBytes, priority: priority}, "matcher")
+}
+
+// HandleMoreMatcher handle the handler that the matcher accepts like HandleMatcher,
+// the bytes are buffered as the matcher asks for more of them, up to maxBytes.
+// Reaching maxBytes without a decision fails the matcher.
+func (m *CMux) HandleMoreMatcher(handler Handler, matcher MoreMatcher, maxBytes int) error {
+	return m.addMatcher(handler, &matcherRoute{more: matcher, maxBytes: maxBytes}, "matcher")
+}
+
+// handleMatcher registers the matcher, pattern names the registration in the hooks.
+func (m *CMux) handleMatcher(handler Handler, matcher Matcher, maxBytes int, pattern string) error {
+	return m.addMatcher(handler, &matcherRoute{matcher: matcher, maxBytes: maxBytes}, pattern)
+}
+
+func (m *CMux) addMatcher(handler Handler, mr *matcherRoute, pattern string) error {
+	handler, b, err := budgetOf(handler)
+	if err != nil {
+		return err
+	}
+	if b.maxBytes > 0 && b.maxBytes < mr.maxBytes {
+		mr.maxBytes = b.maxBytes
+	}
+	if mr.maxBytes <= 0 {
+		return fmt.Errorf("invalid max bytes %d", mr.maxBytes)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	mr.route = route{
+		pattern: pattern,
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf(pattern),
+		maxWait: b.maxWait,
+	}
+	m.matchers = append(m.matchers, mr)
+	m.rebuild()
+	return nil
+}
+
+// match runs the pending matchers against buf, it returns the route of the first matcher
+// in the order of the priorities that accepts buf, decided is false while an earlier matcher still needs more bytes.
+// With final set no more bytes will arrive, so the pending matchers are failed.
+// want is raised to the length of the buffer asked for by the pending MoreMatchers,
+// the matchers out of time elapsed since the sniffing started are failed.
+func (t *table) match(buf []byte, states []matchState, final bool, want *int, elapsed time.Duration) (matched *route, decided bool) {
+	for i, mr := range t.matchers {
+		if states[i] == matchPending && !mr.live(elapsed) {
+			states[i] = matchFailed
+		}
+		if states[i] == matchPending {
+			b := buf
+			if len(b) > mr.maxBytes {
+				b = b[:mr.maxBytes]
+			}
+			var matched, needMore bool
+			if mr.more != nil {
+				var more int
+				matched, more = mr.more.MatchMore(b)
+				if !matched && more > 0 {
+					needMore = true
+					if n := len(b) + more; n > *want {
+						*want = n
+					}
+				}
+			} else {
+				matched, needMore = mr.matcher.Match(b)
+			}
+			switch {
+			case matched:
+				states[i] = matchMatched
+			case !needMore || final || len(b) == mr.maxBytes:
+				states[i] = matchFailed
+			}
+		}
+		switch states[i] {
+		case matchPending:
+			return nil, false
+		case matchMatched:
+			return &mr.route, true
+		}
+	}
+	return nil, true
+}
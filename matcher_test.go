@@ -0,0 +1,306 @@
+package cmux
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsRecord matches a TLS handshake record of version 3.1.
+var tlsRecord = MatcherFunc(func(b []byte) (bool, bool) {
+	if len(b) < 3 {
+		return false, len(b) == 0 || b[0] == 0x16
+	}
+	return b[0] == 0x16 && b[2] == 0x01, false
+})
+
+func TestHandleMatcher(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleMatcher(handlerID("tls"), tlsRecord, 3)
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	for b, want := range map[string]string{
+		"\x16\x03\x01\x02": "tls",
+		"\x16\x03\x03\x02": "",
+		"SSH-2.0-":         "ssh",
+		"GET /":            "",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleMatcherNeedMore(t *testing.T) {
+	mux := NewCMux()
+	var longest int
+	mux.HandleMatcher(handlerID("four"), MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) > longest {
+			longest = len(b)
+		}
+		if len(b) < 4 {
+			return false, true
+		}
+		return string(b[:4]) == "abcd", false
+	}), 6)
+	// the bytes arrive one at a time
+	if got := matchOf(t, mux, "abcdef"); got != "four" {
+		t.Fatalf("matched %q, want four", got)
+	}
+	if longest < 4 || longest > 6 {
+		t.Fatalf("the matcher saw %d bytes, want between 4 and its bound", longest)
+	}
+
+	longest = 0
+	mux = NewCMux()
+	mux.HandleMatcher(handlerID("never"), MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) > longest {
+			longest = len(b)
+		}
+		return false, true
+	}), 5)
+	if got := matchOf(t, mux, "0123456789"); got != "" {
+		t.Fatalf("matched %q, want nothing once the bound is reached", got)
+	}
+	if longest != 5 {
+		t.Fatalf("the matcher saw %d bytes, want 5", longest)
+	}
+}
+
+func TestHandleMatcherPrefixWins(t *testing.T) {
+	mux := NewCMux()
+	any := MatcherFunc(func(b []byte) (bool, bool) {
+		return len(b) != 0, len(b) == 0
+	})
+	mux.HandleMatcher(handlerID("any"), any, 8)
+	mux.HandlePrefix(handlerID("get"), "GET ")
+	if got := matchOf(t, mux, "GET / HTTP/1.1\r\n"); got != "get" {
+		t.Fatalf("matched %q, want the prefix to win", got)
+	}
+	if got := matchOf(t, mux, "PUT / HTTP/1.1\r\n"); got != "any" {
+		t.Fatalf("matched %q, want the matcher", got)
+	}
+}
+
+func TestHandleMatcherRegistrationOrder(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleMatcher(handlerID("first"), MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) < 2 {
+			return false, true
+		}
+		return b[1] == 'b', false
+	}), 2)
+	mux.HandleMatcher(handlerID("second"), MatcherFunc(func(b []byte) (bool, bool) {
+		return len(b) != 0 && b[0] == 'a', len(b) == 0
+	}), 1)
+	// the first registration is waited for although the second already accepted
+	if got := matchOf(t, mux, "ab"); got != "first" {
+		t.Fatalf("matched %q, want first", got)
+	}
+	if got := matchOf(t, mux, "ac"); got != "second" {
+		t.Fatalf("matched %q, want second", got)
+	}
+}
+
+func TestHandleMatcherInvalidMaxBytes(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandleMatcher(handlerID("x"), tlsRecord, 0); err == nil {
+		t.Fatal("HandleMatcher accepted a zero bound")
+	}
+}
+
+// hundredMatcher needs exactly 100 bytes and accepts them if they end with "!".
+func hundredMatcher(seen *[]int) MoreMatcher {
+	return MoreMatcherFunc(func(b []byte) (bool, int) {
+		*seen = append(*seen, len(b))
+		if len(b) < 100 {
+			return false, 100 - len(b)
+		}
+		return b[99] == '!', 0
+	})
+}
+
+func TestHandleMoreMatcherRandomChunks(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	input := []byte(strings.Repeat("x", 99) + "!tail")
+	for i := 0; i != 50; i++ {
+		var seen []int
+		mux := NewCMux()
+		mux.HandlePrefix(handlerID("deep"), "SSH-2.0-")
+		mux.HandleMoreMatcher(handlerID("hundred"), hundredMatcher(&seen), 200)
+		var sizes []int
+		for n := 0; n < len(input); {
+			size := 1 + rnd.Intn(30)
+			sizes = append(sizes, size)
+			n += size
+		}
+		got, prefix := resolveID(t, mux, &chunkReader{b: input, sizes: sizes})
+		if got != "hundred" {
+			t.Fatalf("reads of %v matched %q, want the matcher", sizes, got)
+		}
+		if len(prefix) < 100 {
+			t.Fatalf("reads of %v sniffed %d bytes, want at least 100", sizes, len(prefix))
+		}
+		for j := 1; j < len(seen); j++ {
+			if seen[j] < seen[j-1] {
+				t.Fatalf("the matcher saw %v bytes, want them to grow", seen)
+			}
+		}
+		// the prefixes are still matched by the trie
+		if got := matchOf(t, mux, "SSH-2.0-OpenSSH"); got != "deep" {
+			t.Fatalf("matched %q, want the prefix", got)
+		}
+	}
+}
+
+func TestHandleMoreMatcherBound(t *testing.T) {
+	var seen []int
+	mux := NewCMux()
+	mux.HandleMoreMatcher(handlerID("hundred"), hundredMatcher(&seen), 64)
+	mux.NotFound(handlerID("nf"))
+	got, _ := resolveID(t, mux, &chunkReader{b: []byte(strings.Repeat("x", 99) + "!"), sizes: []int{7}})
+	if got != "nf" {
+		t.Fatalf("matched %q, want NotFound once the bound is reached", got)
+	}
+	if max := seen[len(seen)-1]; max > 64 {
+		t.Fatalf("the matcher saw %d bytes, over its bound of 64", max)
+	}
+}
+
+// lengthMatch accepts the first n bytes that ok accepts, it asks for more until there are n.
+func lengthMatch(n int, ok func(b []byte) bool) Matcher {
+	return MatcherFunc(func(b []byte) (bool, bool) {
+		if len(b) < n {
+			return false, true
+		}
+		return ok(b), false
+	})
+}
+
+// precedenceMux registers every kind of registration that decides by the sniffed bytes.
+func precedenceMux(withDefault bool) *CMux {
+	isTLS := func(b []byte) bool { return b[0] == 0x16 && b[1] == 0x03 }
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("ssh2"), "SSH-2.0-")
+	mux.HandlePrefix(handlerID("pinned"), "\x16\x03\x03\xff\x05")
+	mux.HandlePrefixFold(handlerID("get"), "get ")
+	mux.HandlePattern(handlerID("mask"), []byte("MQ\x00\x04"), []byte("\xff\xff\x00\xff"))
+	mux.HandlePrefix(handlerID("mq"), "MQ\x01\x04")
+	// the matchers are registered out of their order of priority
+	mux.HandleMatcher(handlerID("tls-a"), lengthMatch(3, func(b []byte) bool { return isTLS(b) && b[2] <= 0x01 }), 3)
+	mux.HandleMatcherPriority(handlerID("low"), lengthMatch(1, func(b []byte) bool { return b[0] == 'Z' }), -1, 1)
+	mux.HandleMatcherPriority(handlerID("sni"), lengthMatch(3, func(b []byte) bool { return isTLS(b) && b[2] == 0x03 }), 5, 3)
+	mux.HandleMatcher(handlerID("tls-b"), lengthMatch(3, func(b []byte) bool { return isTLS(b) && b[2] <= 0x02 }), 3)
+	mux.HandleMatcherPriority(handlerID("blocklist"), lengthMatch(4, func(b []byte) bool { return isTLS(b) && b[3] == 0xff }), 10, 4)
+	mux.HandleMatcher(handlerID("zz"), lengthMatch(2, func(b []byte) bool { return b[0] == 'Z' && b[1] == 'Z' }), 2)
+	mux.HandleTLSDefault(handlerID("tls-default"))
+	if withDefault {
+		mux.HandleDefault(handlerID("default"))
+	}
+	mux.NotFound(handlerID("not-found"))
+	return mux
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	mux := precedenceMux(true)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"the longest literal prefix", "SSH-2.0-OpenSSH", "ssh2"},
+		{"a shorter literal prefix", "SSH-1.99-x", "ssh"},
+		{"a literal prefix over every matcher", "\x16\x03\x03\xff\x05\x00", "pinned"},
+		{"a folded prefix", "GET / HTTP/1.1", "get"},
+		{"a masked prefix", "MQ\x07\x04", "mask"},
+		{"a literal prefix over a masked one of the same length", "MQ\x01\x04", "mq"},
+		{"the highest priority", "\x16\x03\x03\xff\x00", "blocklist"},
+		{"a higher priority", "\x16\x03\x03\x00\x00", "sni"},
+		{"the first registration of a priority", "\x16\x03\x01\x00\x00", "tls-a"},
+		{"a later registration of the same priority", "\x16\x03\x02\x00\x00", "tls-b"},
+		{"the priority 0 over a negative one", "ZZ", "zz"},
+		{"a negative priority", "Za", "low"},
+		{"the TLS records no matcher accepts", "\x16\x03\x04\x00\x00", "tls-default"},
+		{"the default", "hello", "default"},
+	}
+	for _, tt := range tests {
+		if got := matchOf(t, mux, tt.in); got != tt.want {
+			t.Errorf("%s: %q matched %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+
+	// NotFound takes what nothing else does
+	if got := matchOf(t, precedenceMux(false), "hello"); got != "not-found" {
+		t.Errorf("hello matched %q without a default, want not-found", got)
+	}
+}
+
+func TestMatchPrecedenceString(t *testing.T) {
+	mux := precedenceMux(true)
+	want := []string{"blocklist", "sni", "tls-a", "tls-b", "zz", "low"}
+	var order []string
+	for _, mr := range mux.load().matchers {
+		order = append(order, string(mr.handler.(handlerID)))
+	}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Fatalf("the matchers are consulted in the order %q, want %q", order, want)
+	}
+	// the dump lists them in the order they are consulted
+	var lines []string
+	for _, line := range strings.Split(mux.String(), "\n") {
+		if strings.HasPrefix(line, "#") {
+			lines = append(lines, line[:strings.Index(line, " ->")])
+		}
+	}
+	wantLines := []string{
+		"#0 matcher(4) priority 10",
+		"#1 matcher(3) priority 5",
+		"#2 matcher(3)",
+		"#3 matcher(3)",
+		"#4 matcher(2)",
+		"#5 matcher(1) priority -1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(wantLines, "\n") {
+		t.Fatalf("the matchers are listed as %q, want %q", lines, wantLines)
+	}
+
+	// the routes consulted before the prefixes are listed first
+	mux.HandleServerFirst(handlerID("banner"), time.Second)
+	mux.HandleALPN(handlerID("h2"), "h2")
+	wantKinds := []string{"server-first", "alpn", "prefix", "fold", "mask", "matcher", "tls", "default", "*"}
+	if err := mux.HandleOriginalDst(handlerID("dst"), 22); err == nil {
+		wantKinds = append([]string{"origdst"}, wantKinds...)
+	}
+	if got := dumpOrder(mux.String()); strings.Join(got, " ") != strings.Join(wantKinds, " ") {
+		t.Fatalf("the routes are listed in the order %q, want %q", got, wantKinds)
+	}
+	if len(mux.load().origDst) != 0 {
+		// with the sniffing the original destination only takes what matches nothing
+		mux.SetOriginalDstSniffing(true)
+		wantKinds = append(wantKinds[1:len(wantKinds)-1], "origdst", "*")
+		if got := dumpOrder(mux.String()); strings.Join(got, " ") != strings.Join(wantKinds, " ") {
+			t.Fatalf("with the sniffing the routes are listed in the order %q, want %q", got, wantKinds)
+		}
+	}
+}
+
+// dumpOrder returns the kinds of the lines of the dump of String, the repeated kinds once.
+func dumpOrder(s string) []string {
+	var kinds []string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		kind := line[:strings.Index(line, " ->")]
+		switch {
+		case strings.HasPrefix(kind, `"`):
+			kind = "prefix"
+		case strings.HasPrefix(kind, "#"):
+			kind = "matcher"
+		default:
+			kind = strings.FieldsFunc(kind, func(r rune) bool { return r == ':' || r == '(' })[0]
+		}
+		if len(kinds) == 0 || kinds[len(kinds)-1] != kind {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,41 @@
+package cmux
+
+import (
+	"context"
+	"net"
+)
+
+// MetaConn is implemented by the connections served with ServeConnWithValue,
+// the handlers, the NotFound handler and the hooks receive it.
+type MetaConn interface {
+	net.Conn
+	// Meta returns the value the connection was served with.
+	Meta() interface{}
+}
+
+type metaKey struct{}
+
+// ServeConnWithValue is like ServeConn, the conn handed to the handlers and the hooks implements MetaConn
+// returning meta, such as the name of the listener the conn was accepted from.
+func (m *CMux) ServeConnWithValue(conn net.Conn, meta interface{}) {
+	m.ServeConnContext(context.WithValue(context.Background(), metaKey{}, meta), conn)
+}
+
+// withMeta attaches the meta value of the ctx to conn, conn is wrapped if it does not replay anything.
+func withMeta(ctx context.Context, conn net.Conn) net.Conn {
+	meta := ctx.Value(metaKey{})
+	if meta == nil {
+		return conn
+	}
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	us.meta = meta
+	return conn
+}
+
+func (c *unreadConn) Meta() interface{} {
+	return c.meta
+}
@@ -0,0 +1,100 @@
+package cmux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// metaOf returns the meta value of conn, nil if it is not a MetaConn.
+func metaOf(conn net.Conn) interface{} {
+	mc, ok := conn.(MetaConn)
+	if !ok {
+		return nil
+	}
+	return mc.Meta()
+}
+
+func TestServeConnWithValueHandler(t *testing.T) {
+	mux := NewCMux()
+	metas := make(chan interface{}, 2)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		metas <- metaOf(conn)
+		// the meta value survives wrapping the conn again
+		metas <- metaOf(UnreadConn(conn, []byte("x")))
+	}), "SSH-")
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0"))
+	go mux.ServeConnWithValue(server, "listener-a")
+	for i := 0; i != 2; i++ {
+		select {
+		case meta := <-metas:
+			if meta != "listener-a" {
+				t.Fatalf("the handler saw the meta value %v", meta)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the conn was not served")
+		}
+	}
+}
+
+func TestServeConnWithValueNotFound(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	metas := make(chan interface{}, 1)
+	mux.NotFound(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+		metas <- metaOf(conn)
+	}))
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET "))
+	go mux.ServeConnWithValue(server, 8443)
+	select {
+	case meta := <-metas:
+		if meta != 8443 {
+			t.Fatalf("the NotFound handler saw the meta value %v", meta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the conn was not served")
+	}
+}
+
+func TestServeConnWithValueOnError(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	metas := make(chan interface{}, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		metas <- metaOf(conn)
+	})
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("X"))
+		client.Close()
+	}()
+	go mux.ServeConnWithValue(server, "tenant-1")
+	select {
+	case meta := <-metas:
+		if meta != "tenant-1" {
+			t.Fatalf("OnError saw the meta value %v", meta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failing conn was not reported")
+	}
+}
+
+func TestServeConnWithoutValue(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if meta := metaOf(conn); meta != nil {
+		t.Fatalf("the conn served without a value has the meta value %v", meta)
+	}
+}
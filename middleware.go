@@ -0,0 +1,113 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler, a middleware should serve the ctx of a ContextHandler through serveHandler
+// like the stock ones so that the ctx reaches the wrapped handler.
+type Middleware func(handler Handler) Handler
+
+// Use appends the middlewares wrapping every handler the mux dispatches to, including the NotFound handler.
+// The first middleware is the outermost, and they apply to the handlers registered before as well.
+func (m *CMux) Use(mws ...Middleware) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.middlewares = append(m.middlewares[:len(m.middlewares):len(m.middlewares)], mws...)
+	m.rebuild()
+}
+
+// chain wraps the handler with the middlewares of the table.
+func (t *table) chain(handler Handler) Handler {
+	for i := len(t.middlewares) - 1; i >= 0; i-- {
+		handler = t.middlewares[i](handler)
+	}
+	return handler
+}
+
+// notFoundServer serves the NotFound handler of the table as a Handler, so that the middlewares can wrap it.
+type notFoundServer struct {
+	t      *table
+	prefix []byte
+}
+
+func (n *notFoundServer) ServeConn(conn net.Conn) {
+	n.t.serveNotFound(conn, n.prefix)
+}
+
+func (n *notFoundServer) ServeConnContext(ctx context.Context, conn net.Conn) {
+	n.t.serveNotFoundContext(ctx, conn, n.prefix)
+}
+
+// DeadlineMiddleware sets the deadline of the connection to d from the dispatching before it is served.
+func DeadlineMiddleware(d time.Duration) Middleware {
+	return func(handler Handler) Handler {
+		return &middlewareHandler{
+			handler: handler,
+			serve: func(ctx context.Context, conn net.Conn, next Handler) {
+				conn.SetDeadline(time.Now().Add(d))
+				serveHandler(ctx, next, conn)
+			},
+		}
+	}
+}
+
+// RecoverMiddleware recovers the panics of the handler and closes the connection,
+// onPanic is called with the recovered value if it is not nil.
+func RecoverMiddleware(onPanic func(conn net.Conn, v interface{})) Middleware {
+	return func(handler Handler) Handler {
+		return &middlewareHandler{
+			handler: handler,
+			serve: func(ctx context.Context, conn net.Conn, next Handler) {
+				defer func() {
+					if v := recover(); v != nil {
+						conn.Close()
+						if onPanic != nil {
+							onPanic(conn, v)
+						}
+					}
+				}()
+				serveHandler(ctx, next, conn)
+			},
+		}
+	}
+}
+
+type middlewareHandler struct {
+	handler Handler
+	serve   func(ctx context.Context, conn net.Conn, next Handler)
+}
+
+func (h *middlewareHandler) ServeConn(conn net.Conn) {
+	h.serve(context.Background(), conn, h.handler)
+}
+
+func (h *middlewareHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	h.serve(ctx, conn, h.handler)
+}
+
+// RecoverPanics recovers the panics of the handlers the mux dispatches to, including the NotFound handler
+// and the middlewares, the connection is closed and fn is called with the recovered value and the stack.
+// Without it a panic crashes the program.
+func (m *CMux) RecoverPanics(fn func(conn net.Conn, recovered interface{}, stack []byte)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onPanic = fn
+	m.rebuild()
+}
+
+// serve serves conn with the handler, recovering its panics if RecoverPanics is set.
+func (t *table) serve(ctx context.Context, handler Handler, conn net.Conn) {
+	if fn := t.onPanic; fn != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				conn.Close()
+				fn(conn, v, debug.Stack())
+			}
+		}()
+	}
+	serveHandler(ctx, handler, conn)
+}
@@ -0,0 +1,208 @@
+package cmux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceMiddleware records its name before and after the handler in the trace.
+func traceMiddleware(name string, mut *sync.Mutex, trace *[]string) Middleware {
+	return func(handler Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			mut.Lock()
+			*trace = append(*trace, name+">")
+			mut.Unlock()
+			handler.ServeConn(conn)
+			mut.Lock()
+			*trace = append(*trace, "<"+name)
+			mut.Unlock()
+		})
+	}
+}
+
+func TestUseOrder(t *testing.T) {
+	var mut sync.Mutex
+	var trace []string
+	mux := NewCMux()
+	// registered before the middlewares, they wrap it all the same
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		mut.Lock()
+		trace = append(trace, "handler")
+		mut.Unlock()
+		conn.Close()
+	}), "SSH-")
+	mux.Use(traceMiddleware("a", &mut, &trace))
+	mux.Use(traceMiddleware("b", &mut, &trace), traceMiddleware("c", &mut, &trace))
+
+	if err := mux.DispatchConn(newMemConn([]byte("SSH-2.0-x"))); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a>", "b>", "c>", "handler", "<c", "<b", "<a"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace %q, want %q", trace, want)
+	}
+}
+
+func TestUseWrapsNotFound(t *testing.T) {
+	var mut sync.Mutex
+	var trace []string
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.NotFound(HandlerFunc(func(conn net.Conn) {
+		_, buf := UnwrapUnreadConn(conn)
+		mut.Lock()
+		trace = append(trace, "notfound:"+string(buf))
+		mut.Unlock()
+		conn.Close()
+	}))
+	mux.Use(traceMiddleware("a", &mut, &trace))
+
+	if err := mux.DispatchConn(newMemConn([]byte("GET "))); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a>", "notfound:GET ", "<a"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace %q, want %q", trace, want)
+	}
+}
+
+func TestUseKeepsContext(t *testing.T) {
+	mux := NewCMux()
+	ch := make(ctxHandler, 1)
+	mux.HandlePrefix(ch, "SSH-")
+	mux.Use(DeadlineMiddleware(time.Minute), RecoverMiddleware(nil))
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	if err := mux.DispatchConnContext(ctx, newMemConn([]byte("SSH-"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-ch).Value(ctxKey{}); got != "value" {
+		t.Fatalf("the handler behind the stock middlewares got %v from the ctx", got)
+	}
+}
+
+// deadlineConn records the deadlines set on it.
+type deadlineConn struct {
+	*memConn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func TestDeadlineMiddleware(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.Use(DeadlineMiddleware(time.Minute))
+	conn := &deadlineConn{memConn: newMemConn([]byte("SSH-"))}
+	start := time.Now()
+	mux.DispatchConn(conn)
+	if d := conn.deadline.Sub(start); d < time.Minute || d > time.Minute+time.Second {
+		t.Fatalf("the deadline is %v after the dispatching, want a minute", d)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		panic("boom")
+	}), "SSH-")
+	recovered := make(chan interface{}, 1)
+	mux.Use(RecoverMiddleware(func(conn net.Conn, v interface{}) {
+		recovered <- v
+	}))
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-"))
+	select {
+	case v := <-recovered:
+		if v != "boom" {
+			t.Fatalf("recovered %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panic was not recovered")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from the panicked conn: %v, want it closed", err)
+	}
+}
+
+func TestRecoverPanicsCoversMiddlewares(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	recovered := make(chan interface{}, 1)
+	mux.RecoverPanics(func(conn net.Conn, v interface{}, stack []byte) {
+		recovered <- v
+	})
+	mux.Use(func(handler Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			panic(errors.New("middleware"))
+		})
+	})
+	if err := mux.DispatchConn(newMemConn([]byte("SSH-"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-recovered:
+		if err, ok := v.(error); !ok || err.Error() != "middleware" {
+			t.Fatalf("recovered %v", v)
+		}
+	default:
+		t.Fatal("the panic of the middleware was not recovered")
+	}
+}
+
+func TestRecoverPanicsKeepsServing(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		panic("handler")
+	}), "BOOM")
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	mux.NotFound(HandlerFunc(func(conn net.Conn) {
+		panic("notfound")
+	}))
+	type recovery struct {
+		v     interface{}
+		stack string
+	}
+	recovered := make(chan recovery, 2)
+	mux.RecoverPanics(func(conn net.Conn, v interface{}, stack []byte) {
+		recovered <- recovery{v, string(stack)}
+	})
+
+	for _, b := range []string{"BOOM", "GET "} {
+		client := servePipe(mux)
+		go client.Write([]byte(b))
+		if err := readErr(t, client); err != io.EOF {
+			t.Fatalf("the panicked conn read %v, want it closed", err)
+		}
+		client.Close()
+		r := <-recovered
+		if want := map[string]string{"BOOM": "handler", "GET ": "notfound"}[b]; r.v != want {
+			t.Fatalf("recovered %v for %q, want %q", r.v, b, want)
+		}
+		if !strings.Contains(r.stack, "middleware_test.go") {
+			t.Fatalf("the stack does not show the panicking handler:\n%s", r.stack)
+		}
+	}
+
+	// the other connections are still served
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 4); got != "SSH-" {
+		t.Fatalf("read %q after the panics", got)
+	}
+}
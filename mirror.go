@@ -0,0 +1,170 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrMirrorOverflow is returned to the tap of a MirrorHandler that fell behind the client by more than the bound.
+var ErrMirrorOverflow = fmt.Errorf("mirror buffer overflow")
+
+// defaultMirrorLimit is the bound of the bytes buffered for a tap when none is given.
+const defaultMirrorLimit = 1 << 20
+
+// MirrorHandler returns a handler that serves the connections with primary while the bytes read from the client
+// are copied to tap, such as a shadow backend. The tap is served in its own goroutine with a connection
+// whose writes are discarded, it never slows down the primary: once it falls behind by more than bufLimit bytes,
+// 1 MiB for zero, the copy stops and its reads fail with ErrMirrorOverflow. The tap sees the end of the stream
+// when the primary is done.
+func MirrorHandler(primary Handler, tap Handler, bufLimit int) Handler {
+	if bufLimit <= 0 {
+		bufLimit = defaultMirrorLimit
+	}
+	return &mirrorHandler{
+		primary: primary,
+		tap:     tap,
+		limit:   bufLimit,
+	}
+}
+
+type mirrorHandler struct {
+	primary Handler
+	tap     Handler
+	limit   int
+}
+
+func (h *mirrorHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *mirrorHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	p := &mirrorPipe{limit: h.limit}
+	p.cond.L = &p.mut
+	go func() {
+		// a panic of the tap must not take the primary down
+		defer func() {
+			recover()
+		}()
+		serveHandler(ctx, h.tap, &tapConn{pipe: p, local: conn.LocalAddr(), remote: conn.RemoteAddr()})
+	}()
+	defer p.closeWithError(io.EOF)
+	serveHandler(ctx, h.primary, &mirrorConn{Conn: conn, pipe: p})
+}
+
+// mirrorConn copies the bytes read from the connection to the pipe.
+type mirrorConn struct {
+	net.Conn
+	pipe *mirrorPipe
+}
+
+func (c *mirrorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.pipe.write(p[:n])
+	if err == io.EOF {
+		c.pipe.closeWithError(io.EOF)
+	}
+	return n, err
+}
+
+func (c *mirrorConn) Close() error {
+	c.pipe.closeWithError(io.EOF)
+	return c.Conn.Close()
+}
+
+// mirrorPipe buffers the copied bytes up to limit for the tap.
+type mirrorPipe struct {
+	mut   sync.Mutex
+	cond  sync.Cond
+	buf   []byte
+	limit int
+	err   error
+}
+
+func (p *mirrorPipe) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.err != nil {
+		return
+	}
+	if len(p.buf)+len(b) > p.limit {
+		p.buf = nil
+		p.err = ErrMirrorOverflow
+	} else {
+		p.buf = append(p.buf, b...)
+	}
+	p.cond.Broadcast()
+}
+
+func (p *mirrorPipe) closeWithError(err error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+func (p *mirrorPipe) read(b []byte) (int, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for len(p.buf) == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if len(p.buf) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+	return n, nil
+}
+
+// tapConn is the connection of the tap, it reads the copied bytes and discards the writes.
+// The deadlines are ignored.
+type tapConn struct {
+	pipe   *mirrorPipe
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	return c.pipe.read(b)
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *tapConn) Close() error {
+	c.pipe.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (c *tapConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tapConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tapConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *tapConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *tapConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
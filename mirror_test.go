@@ -0,0 +1,130 @@
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoAll is a primary reading the client to the end and sending back what it read.
+func echoAll(got chan<- []byte) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		conn.Write(b)
+		got <- b
+	})
+}
+
+// mirrorRun sends the bytes in random writes through a mux serving h, and returns what the client read back.
+func mirrorRun(t *testing.T, h Handler, b []byte, seed int64) []byte {
+	t.Helper()
+	mux := NewCMux()
+	mux.HandlePrefix(h, "MIRROR ")
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		rnd := rand.New(rand.NewSource(seed))
+		for rest := b; len(rest) != 0; {
+			n := 1 + rnd.Intn(4096)
+			if n > len(rest) {
+				n = len(rest)
+			}
+			conn.Write(rest[:n])
+			rest = rest[n:]
+		}
+		conn.CloseWrite()
+	}()
+	back, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back
+}
+
+func TestMirrorHandlerSameBytes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i != 10; i++ {
+		b := make([]byte, 7+rnd.Intn(64<<10))
+		rnd.Read(b)
+		copy(b, "MIRROR ")
+
+		plain := make(chan []byte, 1)
+		want := mirrorRun(t, echoAll(plain), b, int64(i))
+
+		primary := make(chan []byte, 1)
+		tapped := make(chan []byte, 1)
+		tap := HandlerFunc(func(conn net.Conn) {
+			b, _ := io.ReadAll(conn)
+			// the writes of the tap go nowhere
+			conn.Write([]byte("shadow answer"))
+			tapped <- b
+		})
+		got := mirrorRun(t, MirrorHandler(echoAll(primary), tap, 0), b, int64(i))
+
+		if !bytes.Equal(<-plain, b) || !bytes.Equal(want, b) {
+			t.Fatal("the primary without a tap did not read the bytes of the client")
+		}
+		if !bytes.Equal(<-primary, b) {
+			t.Fatal("the primary with a tap read other bytes")
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("the client read other bytes with a tap")
+		}
+		select {
+		case mirrored := <-tapped:
+			if !bytes.Equal(mirrored, b) {
+				t.Fatalf("the tap read %d bytes, want the %d of the client", len(mirrored), len(b))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the tap did not see the end of the stream")
+		}
+	}
+}
+
+func TestMirrorHandlerStalledTap(t *testing.T) {
+	release := make(chan struct{})
+	tapErr := make(chan error, 1)
+	tap := HandlerFunc(func(conn net.Conn) {
+		<-release
+		_, err := io.ReadAll(conn)
+		tapErr <- err
+	})
+	primary := make(chan []byte, 1)
+	b := append([]byte("MIRROR "), bytes.Repeat([]byte("x"), 1<<20)...)
+	// a primary blocked by the tap would fail the deadline of the client
+	if got := mirrorRun(t, MirrorHandler(echoAll(primary), tap, 4096), b, 1); !bytes.Equal(got, b) {
+		t.Fatal("the client read other bytes with a stalled tap")
+	}
+	<-primary
+	close(release)
+	if err := <-tapErr; err != ErrMirrorOverflow {
+		t.Fatalf("the tap read %v, want ErrMirrorOverflow", err)
+	}
+}
+
+func TestMirrorHandlerTapPanics(t *testing.T) {
+	tap := HandlerFunc(func(conn net.Conn) {
+		panic("tap")
+	})
+	primary := make(chan []byte, 1)
+	b := []byte("MIRROR hello")
+	if got := mirrorRun(t, MirrorHandler(echoAll(primary), tap, 0), b, 1); !bytes.Equal(got, b) {
+		t.Fatalf("the client read %q with a panicking tap", got)
+	}
+}
+
+func TestMirrorHandlerTapCloses(t *testing.T) {
+	tap := HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	})
+	primary := make(chan []byte, 1)
+	b := append([]byte("MIRROR "), bytes.Repeat([]byte("y"), 64<<10)...)
+	if got := mirrorRun(t, MirrorHandler(echoAll(primary), tap, 0), b, 2); !bytes.Equal(got, b) {
+		t.Fatal("the client read other bytes after the tap closed")
+	}
+}
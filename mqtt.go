@@ -0,0 +1,76 @@
+package cmux
+
+const (
+	mqttPacketConnect = 0x10
+	// maxMQTTHeaderLength is the length of the fixed header with the longest remaining length,
+	// the longest protocol name with its length, the protocol level and the connect flags.
+	maxMQTTHeaderLength = 1 + 4 + 2 + 6 + 1 + 1
+)
+
+// HandleMQTT handle the handler that matches the CONNECT packet of MQTT 3.1, 3.1.1 and 5, see MatchMQTT.
+// The sniffed bytes are replayed so the broker reads the whole packet.
+func (m *CMux) HandleMQTT(handler Handler) error {
+	return m.addMatcher(handler, &matcherRoute{more: MoreMatcherFunc(MatchMQTT), maxBytes: maxMQTTHeaderLength}, "mqtt")
+}
+
+// MatchMQTT matches the start of a MQTT CONNECT packet, the fixed header with no flags,
+// a remaining length that fits the variable header, the protocol name "MQTT" with the level 4 or 5
+// or the name "MQIsdp" with the level 3, and the connect flags with the reserved bit clear.
+func MatchMQTT(b []byte) (matched bool, more int) {
+	if len(b) < 1 {
+		return false, 1
+	}
+	if b[0] != mqttPacketConnect {
+		return false, 0
+	}
+
+	// the remaining length is a varint of up to 4 bytes
+	remaining := 0
+	off := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return false, 0
+		}
+		if len(b) <= off {
+			return false, off + 1 - len(b)
+		}
+		c := b[off]
+		off++
+		remaining |= int(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+
+	if len(b) < off+2 {
+		return false, off + 2 - len(b)
+	}
+	name := int(b[off])<<8 | int(b[off+1])
+	if name != 4 && name != 6 {
+		return false, 0
+	}
+	// the name, the level, the connect flags and the keep alive
+	if remaining < 2+name+1+1+2 {
+		return false, 0
+	}
+	off += 2
+	if len(b) < off+name+2 {
+		return false, off + name + 2 - len(b)
+	}
+	switch string(b[off : off+name]) {
+	case "MQTT":
+		if v := b[off+name]; v != 4 && v != 5 {
+			return false, 0
+		}
+	case "MQIsdp":
+		if b[off+name] != 3 {
+			return false, 0
+		}
+	default:
+		return false, 0
+	}
+	if b[off+name+1]&0x01 != 0 {
+		return false, 0
+	}
+	return true, 0
+}
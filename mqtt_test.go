@@ -0,0 +1,94 @@
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+// mqttConnect returns a CONNECT packet with the protocol name, the level and the client id.
+func mqttConnect(name string, level byte, flags byte, clientID string) []byte {
+	var vh []byte
+	vh = append(vh, byte(len(name)>>8), byte(len(name)))
+	vh = append(vh, name...)
+	vh = append(vh, level, flags, 0, 60)
+	if level == 5 {
+		vh = append(vh, 0) // no properties
+	}
+	vh = append(vh, byte(len(clientID)>>8), byte(len(clientID)))
+	vh = append(vh, clientID...)
+	b := []byte{mqttPacketConnect}
+	for n := len(vh); ; {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, vh...)
+}
+
+func TestMatchMQTT(t *testing.T) {
+	long := strings.Repeat("c", 300)
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"3.1", mqttConnect("MQIsdp", 3, 0x02, "client"), true},
+		{"3.1.1", mqttConnect("MQTT", 4, 0x02, "client"), true},
+		{"5", mqttConnect("MQTT", 5, 0x02, "client"), true},
+		{"3.1.1 two byte length", mqttConnect("MQTT", 4, 0x02, long), true},
+		{"reserved flag", mqttConnect("MQTT", 4, 0x03, "client"), false},
+		{"3.1 with the level of 3.1.1", mqttConnect("MQIsdp", 4, 0x02, "client"), false},
+		{"unknown level", mqttConnect("MQTT", 6, 0x02, "client"), false},
+		{"other name", mqttConnect("MQTX", 4, 0x02, "client"), false},
+		{"flags in the fixed header", append([]byte{0x12}, mqttConnect("MQTT", 4, 0x02, "c")[1:]...), false},
+		{"binary frame", []byte{0x10, 0x02, 0xff, 0xff, 0x00}, false},
+		{"remaining length too short", []byte{0x10, 0x03, 0x00, 0x04, 'M', 'Q', 'T', 'T', 4, 2}, false},
+		{"varint over 4 bytes", []byte{0x10, 0xff, 0xff, 0xff, 0xff, 0x01}, false},
+	} {
+		mux := NewCMux()
+		mux.HandleMQTT(handlerID("mqtt"))
+		want := ""
+		if tc.want {
+			want = "mqtt"
+		}
+		if got := matchOf(t, mux, string(tc.b)); got != want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func TestMatchMQTTMore(t *testing.T) {
+	b := mqttConnect("MQTT", 4, 0x02, strings.Repeat("c", 300))
+	// every cut asks for more bytes, never for more than the header
+	for n := 0; n < 11; n++ {
+		matched, more := MatchMQTT(b[:n])
+		if matched || more <= 0 || n+more > maxMQTTHeaderLength {
+			t.Fatalf("MatchMQTT of %d bytes = %v, %d", n, matched, more)
+		}
+	}
+	if matched, more := MatchMQTT(b[:11]); !matched || more != 0 {
+		t.Fatalf("MatchMQTT of the header = %v, %d", matched, more)
+	}
+}
+
+func TestHandleMQTTReplaysPacket(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleMQTT(h)
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	packet := mqttConnect("MQTT", 5, 0x02, "sensor-1")
+	client := servePipe(mux)
+	defer client.Close()
+	go writeChunks(client, string(packet[:3]), string(packet[3:9]), string(packet[9:]))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(packet)); got != string(packet) {
+		t.Fatalf("the broker read %x, want the whole packet %x", got, packet)
+	}
+}
@@ -0,0 +1,60 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// NamedHandler is a Handler with a human-readable name used by the hooks, stats and String output.
+type NamedHandler struct {
+	Handler
+	name string
+}
+
+// NewNamedHandler create a new NamedHandler.
+func NewNamedHandler(name string, handler Handler) *NamedHandler {
+	return &NamedHandler{
+		Handler: handler,
+		name:    name,
+	}
+}
+
+// Name returns the name of the handler.
+func (h *NamedHandler) Name() string {
+	return h.name
+}
+
+func (h *NamedHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	serveHandler(ctx, h.Handler, conn)
+}
+
+func (h *NamedHandler) String() string {
+	return h.name
+}
+
+// HandlePrefixNamed handle the handler that matches the prefix under the name.
+func (m *CMux) HandlePrefixNamed(name string, handler Handler, prefixes ...string) error {
+	if err := noBudget("HandlePrefixNamed", handler); err != nil {
+		return err
+	}
+	return m.HandlePrefix(NewNamedHandler(name, handler), prefixes...)
+}
+
+// nameOf returns the name of the handler, unnamed handlers are named after their function or their type
+// so the name does not depend on the order of the registrations.
+func (m *CMux) nameOf(handler Handler) string {
+	if n, ok := handler.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	if v := reflect.ValueOf(handler); v.Kind() == reflect.Func && !v.IsNil() {
+		if f := runtime.FuncForPC(v.Pointer()); f != nil {
+			name := f.Name()
+			return name[strings.LastIndex(name, "/")+1:]
+		}
+	}
+	return fmt.Sprintf("%T", handler)
+}
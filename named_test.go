@@ -0,0 +1,83 @@
+package cmux
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNamedHandlerInString(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixNamed("tls-passthrough", handlerID("tls"), "\x16\x03\x01")
+	mux.HandlePrefix(NewNamedHandler("ssh", handlerID("ssh")), "SSH-")
+	s := mux.String()
+	for _, want := range []string{
+		`"\x16\x03\x01" -> tls-passthrough (cmux.handlerID)`,
+		`"SSH-" -> ssh (cmux.handlerID)`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() = %q, want it to contain %q", s, want)
+		}
+	}
+}
+
+func TestNamedHandlerInOnMatch(t *testing.T) {
+	mux := NewCMux()
+	events := onMatchChan(mux)
+	h, ch := connChan()
+	mux.HandlePrefixNamed("tls-passthrough", h, "\x16\x03\x01")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("\x16\x03\x01\x00"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	ev := <-events
+	n, ok := ev.handler.(interface{ Name() string })
+	if !ok {
+		t.Fatalf("OnMatch got %T, want a named handler", ev.handler)
+	}
+	if n.Name() != "tls-passthrough" {
+		t.Fatalf("OnMatch got the handler named %q, want %q", n.Name(), "tls-passthrough")
+	}
+}
+
+func sshHandler(conn net.Conn) {
+	conn.Close()
+}
+
+func TestAutoNameIsStable(t *testing.T) {
+	const want = `"SSH-" -> cmux.sshHandler (cmux.HandlerFunc)`
+	mux := NewCMux()
+	if err := mux.HandlePrefix(HandlerFunc(sshHandler), "SSH-"); err != nil {
+		t.Fatal(err)
+	}
+	if s := mux.String(); !strings.Contains(s, want) {
+		t.Fatalf("String() = %q, want it to contain %q", s, want)
+	}
+
+	// failed, removed and other registrations do not shift the name
+	if err := mux.HandlePrefix(handlerID("dup"), "SSH-"); err == nil {
+		t.Fatal("duplicate prefix was accepted")
+	}
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	mux.RemovePrefix("SSH-")
+	if err := mux.HandlePrefix(HandlerFunc(sshHandler), "SSH-"); err != nil {
+		t.Fatal(err)
+	}
+	s := mux.String()
+	if !strings.Contains(s, want) {
+		t.Fatalf("String() after re-registration = %q, want it to contain %q", s, want)
+	}
+	if !strings.Contains(s, `"GET " -> cmux.handlerID`+"\n") {
+		t.Fatalf("String() = %q, want the unnamed handler named after its type", s)
+	}
+
+	// another mux registering in another order gets the same names
+	other := NewCMux()
+	other.HandlePrefix(handlerID("http"), "GET ")
+	other.HandlePrefix(HandlerFunc(sshHandler), "SSH-")
+	if other.String() != s {
+		t.Fatalf("String() depends on the registration order:\n%s\nvs\n%s", other.String(), s)
+	}
+}
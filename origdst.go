@@ -0,0 +1,95 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// OriginalDstConn is implemented by the connections the mux dispatches to the handlers
+// once HandleOriginalDst is registered.
+type OriginalDstConn interface {
+	net.Conn
+	// OriginalDst returns the destination the client connected to before it was redirected,
+	// nil if it could not be retrieved.
+	OriginalDst() *net.TCPAddr
+}
+
+// HandleOriginalDst handle the handler that serves the connections whose original destination port,
+// before an iptables REDIRECT or TPROXY, is one of the ports. It is dispatched without reading anything,
+// so it suits the protocols where the server speaks first, unless SetOriginalDstSniffing is set.
+// It is only supported on Linux and fails elsewhere. The original destination is not looked up
+// with the PROXY protocol.
+func (m *CMux) HandleOriginalDst(handler Handler, ports ...int) error {
+	if err := noBudget("HandleOriginalDst", handler); err != nil {
+		return err
+	}
+	if err := originalDstSupported(); err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	for _, port := range ports {
+		if port <= 0 || port > 0xffff {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	name := m.nameOf(handler)
+	origDst := make(map[int]*route, len(m.origDst)+len(ports))
+	for port, r := range m.origDst {
+		origDst[port] = r
+	}
+	for _, port := range ports {
+		pattern := fmt.Sprintf("origdst:%d", port)
+		origDst[port] = &route{
+			pattern: pattern,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf(pattern),
+		}
+	}
+	m.origDst = origDst
+	m.rebuild()
+	return nil
+}
+
+// SetOriginalDstSniffing sets whether the connections of HandleOriginalDst are sniffed first,
+// the original destination then only decides the handler of the connections that match nothing,
+// the clients that send nothing are left to HandleServerFirst. The default is false, they are dispatched at once.
+func (m *CMux) SetOriginalDstSniffing(sniff bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.origDstSniff = sniff
+	m.rebuild()
+}
+
+// lookupOriginalDst retrieves the original destination of conn, it is a variable so that it can be faked.
+var lookupOriginalDst = originalDst
+
+// originalDst records the original destination of conn on the returned conn
+// and returns the route of its port, nil if it has none or the lookup failed.
+func (m *CMux) originalDst(t *table, conn net.Conn) (net.Conn, *route) {
+	dst, err := lookupOriginalDst(conn)
+	if err != nil || dst == nil {
+		return conn, nil
+	}
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	us.origDst = dst
+	return conn, t.origDst[dst.Port]
+}
+
+func (t *table) sortedOrigDstPorts() []int {
+	ports := make([]int, 0, len(t.origDst))
+	for port := range t.origDst {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
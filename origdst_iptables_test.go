@@ -0,0 +1,68 @@
+//go:build linux && iptables
+// +build linux,iptables
+
+package cmux
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestHandleOriginalDstIptables redirects a port of 127.0.0.2 to the listener of the mux with iptables,
+// it needs root and is run with the iptables build tag.
+func TestHandleOriginalDstIptables(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("iptables needs root")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const port = 47025
+	rule := []string{"-t", "nat", "OUTPUT", "-p", "tcp", "-d", "127.0.0.2", "--dport", strconv.Itoa(port),
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)}
+	iptables := func(op string) error {
+		args := append([]string{rule[0], rule[1], op}, rule[2:]...)
+		out, err := exec.Command("iptables", args...).CombinedOutput()
+		if err != nil {
+			t.Logf("iptables %v: %s", args, out)
+		}
+		return err
+	}
+	if err := iptables("-A"); err != nil {
+		t.Fatal(err)
+	}
+	defer iptables("-D")
+
+	mux := NewCMux()
+	h, ch := connChan()
+	if err := mux.HandleOriginalDst(h, port); err != nil {
+		t.Fatal(err)
+	}
+	go mux.Serve(l)
+
+	client, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	dst := conn.(OriginalDstConn).OriginalDst()
+	if dst == nil || dst.Port != port || !dst.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("the original destination is %v, want 127.0.0.2:%d", dst, port)
+	}
+	// the server speaks first
+	go conn.Write([]byte("220 ready\r\n"))
+	if got := readN(t, client, 11); got != "220 ready\r\n" {
+		t.Fatalf("the client read %q", got)
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package cmux
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of the SOL_IP level and IP6T_SO_ORIGINAL_DST of the SOL_IPV6 level.
+const soOriginalDst = 80
+
+func originalDstSupported() error {
+	return nil
+}
+
+// originalDst retrieves the original destination of conn from the conntrack of its socket.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := baseConn(conn).(syscall.Conn)
+	if !ok {
+		return nil, errUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			dst, serr = originalDst6(int(fd))
+		} else {
+			dst, serr = originalDst4(int(fd))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, serr
+}
+
+func originalDst4(fd int) (*net.TCPAddr, error) {
+	// the sockaddr_in fits in the buffer of an ipv6_mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	b := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(b[2])<<8 | int(b[3]),
+	}, nil
+}
+
+func originalDst6(fd int) (*net.TCPAddr, error) {
+	// the sockaddr_in6 fits in the buffer of an ip6_mtuinfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port[0])<<8 | int(port[1]),
+	}, nil
+}
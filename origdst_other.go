@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func originalDstSupported() error {
+	return fmt.Errorf("original destination is not supported on %s", runtime.GOOS)
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, originalDstSupported()
+}
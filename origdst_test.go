@@ -0,0 +1,149 @@
+package cmux
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeOriginalDstOnce sync.Once
+
+// fakeOriginalDst makes the original destination of the connections arriving on 198.51.100.0/24 their local address,
+// the lookup of the other connections is left to the socket. It is never undone so that it does not race
+// with the connections still served.
+func fakeOriginalDst(t *testing.T) {
+	if err := originalDstSupported(); err != nil {
+		t.Skip(err)
+	}
+	fakeOriginalDstOnce.Do(func() {
+		_, fakeNet, _ := net.ParseCIDR("198.51.100.0/24")
+		lookup := lookupOriginalDst
+		lookupOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+			if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && fakeNet.Contains(addr.IP) {
+				return addr, nil
+			}
+			return lookup(conn)
+		}
+	})
+}
+
+func TestHandleOriginalDstServerFirst(t *testing.T) {
+	fakeOriginalDst(t)
+	mux := NewCMux()
+	h, ch := connChan()
+	if err := mux.HandleOriginalDst(h, 25, 587); err != nil {
+		t.Fatal(err)
+	}
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	client, server := net.Pipe()
+	defer client.Close()
+	go mux.ServeConn(localConn{Conn: server, local: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 587}})
+	// the client sends nothing, the server speaks first
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	oc, ok := conn.(OriginalDstConn)
+	if !ok {
+		t.Fatalf("the dispatched %T has no OriginalDst", conn)
+	}
+	if dst := oc.OriginalDst(); dst == nil || dst.Port != 587 || !dst.IP.Equal(net.IPv4(198, 51, 100, 7)) {
+		t.Fatalf("the original destination is %v", dst)
+	}
+	if mc := conn.(MatchedConn); mc.MatchedPattern() != "origdst:587" || len(mc.SniffedBytes()) != 0 {
+		t.Fatalf("the connection matched %q after sniffing %q", mc.MatchedPattern(), mc.SniffedBytes())
+	}
+	go conn.Write([]byte("220 ready\r\n"))
+	if got := readN(t, client, 11); got != "220 ready\r\n" {
+		t.Fatalf("the client read %q", got)
+	}
+}
+
+func TestHandleOriginalDstOtherPorts(t *testing.T) {
+	fakeOriginalDst(t)
+	mux := NewCMux()
+	mux.HandleOriginalDst(handlerID("smtp"), 25)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "GET ")
+	for _, local := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 80},
+		// the lookup fails
+		&net.UnixAddr{Name: "/run/mux.sock", Net: "unix"},
+	} {
+		client, server := net.Pipe()
+		go mux.ServeConn(localConn{Conn: server, local: local})
+		go client.Write([]byte("GET / HTTP/1.1\r\n"))
+		conn := recvConn(t, ch)
+		if got := readN(t, conn, 4); got != "GET " {
+			t.Fatalf("%v: read %q", local, got)
+		}
+		oc := conn.(OriginalDstConn)
+		if dst := oc.OriginalDst(); local.Network() == "tcp" && (dst == nil || dst.Port != 80) || local.Network() != "tcp" && dst != nil {
+			t.Fatalf("%v: the original destination is %v", local, dst)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestHandleOriginalDstSniffing(t *testing.T) {
+	fakeOriginalDst(t)
+	mux := NewCMux()
+	mux.SetOriginalDstSniffing(true)
+	mux.SetReadTimeout(50 * time.Millisecond)
+	smtp, smtpCh := connChan()
+	mux.HandleOriginalDst(smtp, 25)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "EHLO ")
+
+	dial := func(port int, b string) net.Conn {
+		client, server := net.Pipe()
+		go mux.ServeConn(localConn{Conn: server, local: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: port}})
+		if b != "" {
+			go client.Write([]byte(b))
+		}
+		return client
+	}
+
+	// the payload wins when it matches
+	client := dial(25, "EHLO mx\r\n")
+	conn := recvConn(t, ch)
+	if got := readN(t, conn, 5); got != "EHLO " {
+		t.Fatalf("read %q", got)
+	}
+	conn.Close()
+	client.Close()
+
+	// the original destination decides the payloads that match nothing, replayed
+	client = dial(25, "QUIT")
+	conn = recvConn(t, smtpCh)
+	if got := readN(t, conn, 4); got != "QUIT" {
+		t.Fatalf("the original destination handler read %q, want the payload replayed", got)
+	}
+	conn.Close()
+	client.Close()
+
+	// the clients that send nothing are left to HandleServerFirst
+	first, firstCh := connChan()
+	mux.HandleServerFirst(first, 20*time.Millisecond)
+	client = dial(25, "")
+	conn = recvConn(t, firstCh)
+	conn.Close()
+	client.Close()
+	noConn(t, ch)
+	noConn(t, smtpCh)
+}
+
+func TestHandleOriginalDstInvalid(t *testing.T) {
+	mux := NewCMux()
+	if err := originalDstSupported(); err != nil {
+		if mux.HandleOriginalDst(handlerID("x"), 25) == nil {
+			t.Fatal("HandleOriginalDst did not fail where it is not supported")
+		}
+		return
+	}
+	for _, port := range []int{0, -1, 65536} {
+		if err := mux.HandleOriginalDst(handlerID("x"), port); err == nil {
+			t.Errorf("HandleOriginalDst accepted the port %d", port)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketHandler serves a datagram read from pc, the payload is owned by the handler.
+type PacketHandler interface {
+	ServePacket(pc net.PacketConn, addr net.Addr, payload []byte)
+}
+
+type PacketHandlerFunc func(pc net.PacketConn, addr net.Addr, payload []byte)
+
+func (h PacketHandlerFunc) ServePacket(pc net.PacketConn, addr net.Addr, payload []byte) {
+	h(pc, addr, payload)
+}
+
+const (
+	// maxDatagramSize is the largest payload of a UDP datagram.
+	maxDatagramSize = 64 << 10
+	// sessionQueueLength is the number of datagrams queued for a session before they are dropped.
+	sessionQueueLength = 64
+)
+
+// PacketCMux is a multiplexer for datagrams,
+// it matches the leading bytes of each datagram against the registered prefixes.
+type PacketCMux struct {
+	mut            sync.Mutex
+	prefixes       map[string]*packetRoute
+	notFound       PacketHandler
+	table          atomic.Value
+	sessionTimeout time.Duration
+}
+
+type packetRoute struct {
+	handler PacketHandler
+	session bool
+}
+
+// packetTable is an immutable snapshot of the routes of a PacketCMux.
+type packetTable struct {
+	prefixes     map[string]*packetRoute
+	prefixLength int
+	notFound     PacketHandler
+}
+
+// NewPacketCMux create a new PacketCMux.
+func NewPacketCMux() *PacketCMux {
+	m := &PacketCMux{
+		prefixes:       map[string]*packetRoute{},
+		sessionTimeout: time.Minute,
+	}
+	m.rebuild()
+	return m
+}
+
+// HandlePrefix handle the handler that matches the prefix, every matching datagram is served on its own.
+// A prefix that is empty or already registered is rejected and nothing is registered.
+func (m *PacketCMux) HandlePrefix(handler PacketHandler, prefixes ...string) error {
+	return m.handlePrefix(&packetRoute{handler: handler}, prefixes)
+}
+
+// HandlePrefixSession handle the handler that matches the prefix with a session per source address,
+// the handler is served once with a virtual net.PacketConn that reads the following datagrams of the source.
+// The session ends when the handler closes the virtual conn or nothing is received for the session timeout.
+func (m *PacketCMux) HandlePrefixSession(handler PacketHandler, prefixes ...string) error {
+	return m.handlePrefix(&packetRoute{handler: handler, session: true}, prefixes)
+}
+
+func (m *PacketCMux) handlePrefix(r *packetRoute, prefixes []string) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	err := checkNewPrefixes(prefixes, nil, func(prefix string) (string, bool) {
+		r, ok := m.prefixes[prefix]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%T", r.handler), true
+	})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		m.prefixes[prefix] = r
+	}
+	m.rebuild()
+	return nil
+}
+
+// NotFound handle the handler that unmatched.
+func (m *PacketCMux) NotFound(handler PacketHandler) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.notFound = handler
+	m.rebuild()
+	return nil
+}
+
+// SetSessionTimeout sets how long a session idles before it is closed, the default is 1 minute.
+func (m *PacketCMux) SetSessionTimeout(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.sessionTimeout = d
+}
+
+// rebuild publishes a new table, the caller must hold the lock.
+func (m *PacketCMux) rebuild() {
+	t := &packetTable{
+		prefixes: make(map[string]*packetRoute, len(m.prefixes)),
+		notFound: m.notFound,
+	}
+	for prefix, r := range m.prefixes {
+		t.prefixes[prefix] = r
+		if t.prefixLength < len(prefix) {
+			t.prefixLength = len(prefix)
+		}
+	}
+	m.table.Store(t)
+}
+
+// match returns the route of the longest prefix of payload.
+func (t *packetTable) match(payload []byte) *packetRoute {
+	n := t.prefixLength
+	if n > len(payload) {
+		n = len(payload)
+	}
+	for ; n > 0; n-- {
+		if r, ok := t.prefixes[string(payload[:n])]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// ServePacket reads the datagrams of pc and dispatches each one,
+// it returns the read error of pc after closing the sessions.
+func (m *PacketCMux) ServePacket(pc net.PacketConn) error {
+	s := &packetSessions{
+		pc:       pc,
+		sessions: map[string]*packetSession{},
+	}
+	defer s.closeAll()
+	m.mut.Lock()
+	timeout := m.sessionTimeout
+	m.mut.Unlock()
+	if timeout > 0 {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		go func() {
+			for range ticker.C {
+				if !s.expire(timeout) {
+					return
+				}
+			}
+		}()
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+
+		key := addr.String()
+		if session := s.get(key); session != nil {
+			session.deliver(payload)
+			continue
+		}
+
+		t := m.table.Load().(*packetTable)
+		r := t.match(payload)
+		switch {
+		case r == nil:
+			if t.notFound != nil {
+				go t.notFound.ServePacket(pc, addr, payload)
+			}
+		case r.session:
+			session := s.add(key, addr)
+			go r.handler.ServePacket(session, addr, payload)
+		default:
+			go r.handler.ServePacket(pc, addr, payload)
+		}
+	}
+}
+
+type packetSessions struct {
+	pc       net.PacketConn
+	mut      sync.Mutex
+	sessions map[string]*packetSession
+	closed   bool
+}
+
+func (s *packetSessions) get(key string) *packetSession {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.sessions[key]
+}
+
+func (s *packetSessions) add(key string, addr net.Addr) *packetSession {
+	session := &packetSession{
+		sessions: s,
+		key:      key,
+		addr:     addr,
+		ch:       make(chan []byte, sessionQueueLength),
+		done:     make(chan struct{}),
+	}
+	session.touch()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.sessions[key] = session
+	return session
+}
+
+func (s *packetSessions) remove(session *packetSession) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.sessions[session.key] == session {
+		delete(s.sessions, session.key)
+	}
+}
+
+// expire closes the sessions idle for the timeout, it reports false once the sessions are closed.
+func (s *packetSessions) expire(timeout time.Duration) bool {
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return false
+	}
+	var idle []*packetSession
+	for _, session := range s.sessions {
+		if time.Since(session.lastActive()) >= timeout {
+			idle = append(idle, session)
+		}
+	}
+	s.mut.Unlock()
+	for _, session := range idle {
+		session.Close()
+	}
+	return true
+}
+
+func (s *packetSessions) closeAll() {
+	s.mut.Lock()
+	s.closed = true
+	sessions := make([]*packetSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mut.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// packetSession is a virtual net.PacketConn that reads the datagrams of a single source.
+type packetSession struct {
+	last     int64
+	sessions *packetSessions
+	key      string
+	addr     net.Addr
+	ch       chan []byte
+	done     chan struct{}
+	once     sync.Once
+	deadline atomic.Value
+}
+
+func (s *packetSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *packetSession) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.last))
+}
+
+// deliver queues the payload, it is dropped when the queue is full like an overflowing socket buffer.
+func (s *packetSession) deliver(payload []byte) {
+	s.touch()
+	select {
+	case s.ch <- payload:
+	default:
+	}
+}
+
+func (s *packetSession) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var timeout <-chan time.Time
+	if d, ok := s.deadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case payload := <-s.ch:
+		return copy(p, payload), s.addr, nil
+	case <-s.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *packetSession) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-s.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.touch()
+	return s.sessions.pc.WriteTo(p, addr)
+}
+
+// Close ends the session, the following datagrams of the source are matched again.
+func (s *packetSession) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.sessions.remove(s)
+	})
+	return nil
+}
+
+func (s *packetSession) LocalAddr() net.Addr {
+	return s.sessions.pc.LocalAddr()
+}
+
+func (s *packetSession) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *packetSession) SetReadDeadline(t time.Time) error {
+	s.deadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline is not supported, the writes share the underlying conn with the other sessions.
+func (s *packetSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
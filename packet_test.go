@@ -0,0 +1,162 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type datagram struct {
+	handler string
+	from    string
+	payload string
+}
+
+// packetRecorder returns a handler sending the datagrams it is served to ch,
+// a session handler keeps reading the following datagrams of its source.
+func packetRecorder(id string, ch chan datagram) PacketHandler {
+	return PacketHandlerFunc(func(pc net.PacketConn, addr net.Addr, payload []byte) {
+		ch <- datagram{id, addr.String(), string(payload)}
+		if _, ok := pc.(*packetSession); !ok {
+			return
+		}
+		buf := make([]byte, 64)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ch <- datagram{id, from.String(), string(buf[:n])}
+		}
+	})
+}
+
+func listenUDP(t testing.TB) *net.UDPConn {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func recvDatagram(t testing.TB, ch chan datagram) datagram {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram was dispatched")
+		return datagram{}
+	}
+}
+
+func TestPacketCMuxPerSourceRouting(t *testing.T) {
+	ch := make(chan datagram, 16)
+	mux := NewPacketCMux()
+	mux.HandlePrefix(packetRecorder("dns", ch), "DNS")
+	mux.HandlePrefixSession(packetRecorder("quic", ch), "QUIC")
+	mux.NotFound(packetRecorder("notfound", ch))
+
+	server := listenUDP(t)
+	go mux.ServePacket(server)
+	a, b, c := listenUDP(t), listenUDP(t), listenUDP(t)
+
+	for _, step := range []struct {
+		from *net.UDPConn
+		send string
+		want string
+	}{
+		{a, "QUIC hello", "quic"},
+		{b, "DNS query", "dns"},
+		// the session of a takes every following datagram of a
+		{a, "DNS inside the session", "quic"},
+		{c, "junk", "notfound"},
+		{b, "QUIC other", "quic"},
+		{b, "not quic", "quic"},
+		{c, "DNS again", "dns"},
+	} {
+		if _, err := step.from.WriteTo([]byte(step.send), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		d := recvDatagram(t, ch)
+		if d.handler != step.want || d.payload != step.send || d.from != step.from.LocalAddr().String() {
+			t.Fatalf("%q from %v was dispatched as %+v, want to %s", step.send, step.from.LocalAddr(), d, step.want)
+		}
+	}
+}
+
+func TestPacketCMuxPrefixRejected(t *testing.T) {
+	ch := make(chan datagram, 16)
+	mux := NewPacketCMux()
+	if err := mux.HandlePrefix(packetRecorder("dns", ch), "DNS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.HandlePrefixSession(packetRecorder("quic", ch), "QUIC", "DNS"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("the registered prefix returned %v, want ErrPrefixExists", err)
+	}
+	if err := mux.HandlePrefix(packetRecorder("a", ch), "A", "A"); !errors.Is(err, ErrPrefixExists) {
+		t.Fatalf("the repeated prefix returned %v, want ErrPrefixExists", err)
+	}
+	if err := mux.HandlePrefix(packetRecorder("empty", ch), ""); err == nil {
+		t.Fatal("the empty prefix was accepted")
+	}
+
+	server := listenUDP(t)
+	go mux.ServePacket(server)
+	a := listenUDP(t)
+	for _, send := range []string{"QUIC hello", "A", "DNS query"} {
+		a.WriteTo([]byte(send), server.LocalAddr())
+	}
+	// nothing of the rejected registrations is served, the first datagrams are dropped
+	if d := recvDatagram(t, ch); d.handler != "dns" || d.payload != "DNS query" {
+		t.Fatalf("dispatched as %+v, want the first registration of DNS", d)
+	}
+}
+
+func TestPacketCMuxSessionExpires(t *testing.T) {
+	ch := make(chan datagram, 16)
+	mux := NewPacketCMux()
+	mux.SetSessionTimeout(50 * time.Millisecond)
+	mux.HandlePrefix(packetRecorder("dns", ch), "DNS")
+	mux.HandlePrefixSession(packetRecorder("quic", ch), "QUIC")
+
+	server := listenUDP(t)
+	go mux.ServePacket(server)
+	a := listenUDP(t)
+
+	a.WriteTo([]byte("QUIC hello"), server.LocalAddr())
+	if d := recvDatagram(t, ch); d.handler != "quic" {
+		t.Fatalf("dispatched as %+v", d)
+	}
+	// once idle for the timeout the source is matched again
+	time.Sleep(200 * time.Millisecond)
+	a.WriteTo([]byte("DNS query"), server.LocalAddr())
+	if d := recvDatagram(t, ch); d.handler != "dns" {
+		t.Fatalf("after the session expired dispatched as %+v, want dns", d)
+	}
+}
+
+func TestPacketCMuxSessionReplies(t *testing.T) {
+	mux := NewPacketCMux()
+	mux.HandlePrefixSession(PacketHandlerFunc(func(pc net.PacketConn, addr net.Addr, payload []byte) {
+		defer pc.Close()
+		pc.WriteTo(append([]byte("echo "), payload...), addr)
+	}), "QUIC")
+
+	server := listenUDP(t)
+	go mux.ServePacket(server)
+	a := listenUDP(t)
+	a.WriteTo([]byte("QUIC x"), server.LocalAddr())
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := a.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "echo QUIC x" || from.String() != server.LocalAddr().String() {
+		t.Fatalf("got %q from %v", buf[:n], from)
+	}
+}
@@ -0,0 +1,43 @@
+package cmux
+
+import (
+	"encoding/binary"
+)
+
+const (
+	postgresHeaderLength = 8
+	// maxPostgresStartupLength is the bound of the server on the length of a startup packet.
+	maxPostgresStartupLength = 10000
+	postgresSSLRequest       = 80877103
+	postgresGSSENCRequest    = 80877104
+	postgresProtocolMajor3   = 3
+)
+
+// HandlePostgres handle the handler that matches the first message of a PostgreSQL client, see MatchPostgres.
+// The sniffed bytes are replayed so that the server answers the SSLRequest itself.
+func (m *CMux) HandlePostgres(handler Handler) error {
+	return m.handleMatcher(handler, MatcherFunc(MatchPostgres), postgresHeaderLength, "postgres")
+}
+
+// MatchPostgres matches the length and the code of an SSLRequest, a GSSENCRequest
+// or a StartupMessage of the protocol 3. The requests have the length 8, the StartupMessage has
+// the length of its parameters bounded like the server does.
+func MatchPostgres(b []byte) (matched bool, needMore bool) {
+	if len(b) >= 1 && b[0] != 0 {
+		// the length is far below 1 << 24
+		return false, false
+	}
+	if len(b) < postgresHeaderLength {
+		return false, true
+	}
+	length := binary.BigEndian.Uint32(b[0:4])
+	code := binary.BigEndian.Uint32(b[4:8])
+	switch {
+	case code == postgresSSLRequest, code == postgresGSSENCRequest:
+		return length == postgresHeaderLength, false
+	case code>>16 == postgresProtocolMajor3:
+		// the parameters end with a terminator
+		return length > postgresHeaderLength && length <= maxPostgresStartupLength, false
+	}
+	return false, false
+}
@@ -0,0 +1,212 @@
+package cmux
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// startupMessage returns the StartupMessage of the protocol 3.0 with the parameters, as libpq and pgx send it.
+func startupMessage(params ...string) string {
+	body := []byte{0x00, 0x03, 0x00, 0x00}
+	for _, p := range params {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(b, uint32(4+len(body)))
+	return string(append(b, body...))
+}
+
+const (
+	// sslRequest is what psql and pgx send first with sslmode=prefer or require
+	sslRequest = "\x00\x00\x00\x08\x04\xd2\x16\x2f"
+	// gssencRequest is what psql sends first with gssencmode=prefer
+	gssencRequest = "\x00\x00\x00\x08\x04\xd2\x16\x30"
+)
+
+func TestHandlePostgres(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePostgres(handlerID("postgres"))
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	psql := startupMessage("user", "postgres", "database", "postgres", "application_name", "psql", "client_encoding", "UTF8")
+	pgx := startupMessage("database", "app", "user", "app")
+	for _, tc := range []struct {
+		name string
+		b    string
+		want string
+	}{
+		{"psql with sslmode=prefer", sslRequest, "postgres"},
+		{"psql with gssencmode=prefer", gssencRequest, "postgres"},
+		{"psql with sslmode=disable", psql, "postgres"},
+		{"pgx with sslmode=disable", pgx, "postgres"},
+		{"HTTP", "GET / HTTP/1.1\r\n\r\n", "http"},
+		{"TLS", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", "tls"},
+		{"SSLRequest of another length", "\x00\x00\x00\x10\x04\xd2\x16\x2f", ""},
+		{"protocol 2", "\x00\x00\x01\x28\x00\x02\x00\x00", ""},
+		{"StartupMessage over the bound", "\x00\x01\x00\x00\x00\x03\x00\x00", ""},
+		{"StartupMessage without parameters", "\x00\x00\x00\x08\x00\x03\x00\x00", ""},
+		{"CancelRequest", "\x00\x00\x00\x10\x04\xd2\x16\x2e", ""},
+	} {
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMatchPostgresTruncated(t *testing.T) {
+	for _, b := range []string{sslRequest, startupMessage("user", "postgres")} {
+		for n := 0; n < postgresHeaderLength; n++ {
+			if matched, needMore := MatchPostgres([]byte(b[:n])); matched || !needMore {
+				t.Fatalf("MatchPostgres(%q) = %v, %v, want more bytes", b[:n], matched, needMore)
+			}
+		}
+	}
+}
+
+func TestHandlePostgresReplaysStartup(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePostgres(h)
+	client := servePipe(mux)
+	defer client.Close()
+	// the client sends the SSLRequest in pieces, the server answers 'N' and the client goes on without TLS
+	go writeChunks(client, sslRequest[:3], sslRequest[3:])
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(sslRequest)); got != sslRequest {
+		t.Fatalf("the server read %q, want the SSLRequest replayed", got)
+	}
+	go conn.Write([]byte("N"))
+	if got := readN(t, client, 1); got != "N" {
+		t.Fatalf("the client read %q, want the answer of the server", got)
+	}
+	startup := startupMessage("user", "postgres")
+	go client.Write([]byte(startup))
+	if got := readN(t, conn, len(startup)); got != startup {
+		t.Fatalf("the server read %q, want the StartupMessage", got)
+	}
+}
+
+// postgresBackend answers the clients the way a PostgreSQL server trusting every user does,
+// it accepts the SSLRequest with cert and sends the user of each session and whether it is over TLS to sessions.
+func postgresBackend(cert tls.Certificate, sessions chan<- string) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer func() { conn.Close() }()
+		over := false
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		for {
+			msg, err := backend.ReceiveStartupMessage()
+			if err != nil {
+				return
+			}
+			switch msg := msg.(type) {
+			case *pgproto3.SSLRequest:
+				if _, err := conn.Write([]byte("S")); err != nil {
+					return
+				}
+				conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				over = true
+				backend = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+			case *pgproto3.GSSEncRequest:
+				if _, err := conn.Write([]byte("N")); err != nil {
+					return
+				}
+			case *pgproto3.StartupMessage:
+				sessions <- fmt.Sprintf("%s tls=%v", msg.Parameters["user"], over)
+				serveSession(backend)
+				return
+			}
+		}
+	})
+}
+
+// serveSession answers the simple queries of a session with an empty result until the client terminates.
+func serveSession(backend *pgproto3.Backend) {
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.ParameterStatus{Name: "server_version", Value: "13.0"},
+		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
+		&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		if err := backend.Send(msg); err != nil {
+			return
+		}
+	}
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto3.Query); !ok {
+			return
+		}
+		backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+}
+
+func TestHandlePostgresClients(t *testing.T) {
+	sessions := make(chan string, 4)
+	mux := NewCMux()
+	mux.HandlePostgres(postgresBackend(testCert(t, "localhost"), sessions))
+	mux.HandleTLSDefault(handlerID("tls"))
+	mux.HandleHTTP1(handlerID("http"))
+	host, port, _ := net.SplitHostPort(listenMux(t, mux))
+
+	for _, mode := range []string{"disable", "prefer"} {
+		user := "pgx-" + mode
+		t.Run("pgx sslmode="+mode, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := pgx.Connect(ctx, fmt.Sprintf("host=%s port=%s user=%s sslmode=%s", host, port, user, mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(ctx)
+			if _, err := conn.Exec(ctx, "select 1"); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := recvSession(t, sessions), fmt.Sprintf("%s tls=%v", user, mode == "prefer"); got != want {
+				t.Fatalf("the server had the session %q, want %q", got, want)
+			}
+		})
+		t.Run("psql sslmode="+mode, func(t *testing.T) {
+			psql, err := exec.LookPath("psql")
+			if err != nil {
+				t.Skip("psql is not installed")
+			}
+			user := "psql-" + mode
+			cmd := exec.Command(psql, "-X", "-w", "-c", "select 1", fmt.Sprintf("host=%s port=%s user=%s sslmode=%s", host, port, user, mode))
+			cmd.Env = []string{"PGCONNECT_TIMEOUT=5", "PGGSSENCMODE=disable"}
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("psql failed: %v\n%s", err, out)
+			}
+			if got, want := recvSession(t, sessions), fmt.Sprintf("%s tls=%v", user, mode == "prefer"); got != want {
+				t.Fatalf("the server had the session %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func recvSession(t testing.TB, sessions chan string) string {
+	t.Helper()
+	select {
+	case s := <-sessions:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session was started")
+		return ""
+	}
+}
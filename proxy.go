@@ -0,0 +1,374 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyOption configures the handler returned by NewProxyHandler.
+type ProxyOption func(p *proxyHandler)
+
+// WithProxyDialer sets the function used to dial the upstream, the default is a net.Dialer.
+func WithProxyDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) ProxyOption {
+	return func(p *proxyHandler) {
+		p.dial = dial
+	}
+}
+
+// WithProxyDialTimeout bounds the dialing of the upstream.
+func WithProxyDialTimeout(timeout time.Duration) ProxyOption {
+	return func(p *proxyHandler) {
+		p.dialTimeout = timeout
+	}
+}
+
+// WithProxyIdleTimeout closes both sides once no bytes flowed in either direction for the timeout.
+func WithProxyIdleTimeout(timeout time.Duration) ProxyOption {
+	return func(p *proxyHandler) {
+		p.idleTimeout = timeout
+	}
+}
+
+// WithProxyErrorHandler sets the function called with the dial and copy errors of a connection.
+func WithProxyErrorHandler(fn func(conn net.Conn, err error)) ProxyOption {
+	return func(p *proxyHandler) {
+		p.onError = fn
+	}
+}
+
+// NewProxyHandler returns a handler that dials the upstream address and copies bytes both ways,
+// the bytes sniffed while matching reach the upstream first and half-closes are propagated.
+func NewProxyHandler(network, address string, opts ...ProxyOption) Handler {
+	p := &proxyHandler{
+		network: network,
+		address: address,
+		dial:    (&net.Dialer{}).DialContext,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+type proxyHandler struct {
+	network     string
+	address     string
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+	cooldown    time.Duration
+	onError     func(conn net.Conn, err error)
+}
+
+func (p *proxyHandler) ServeConn(conn net.Conn) {
+	p.ServeConnContext(context.Background(), conn)
+}
+
+func (p *proxyHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	dialCtx := ctx
+	if p.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, p.dialTimeout)
+		defer cancel()
+	}
+	upstream, err := p.dial(dialCtx, p.network, p.address)
+	if err != nil {
+		p.reportError(conn, err)
+		conn.Close()
+		return
+	}
+	proxyConns(ctx, conn, upstream, p.idleTimeout, func(err error) {
+		p.reportError(conn, err)
+	})
+}
+
+func (p *proxyHandler) reportError(conn net.Conn, err error) {
+	if p.onError != nil {
+		p.onError(conn, err)
+	}
+}
+
+// proxyConns copies bytes between a and b in both directions and closes them when done,
+// the end of one direction is propagated by CloseWrite if the other side supports it.
+// The first error closes both sides and is passed to onError, the idle timeout and the ctx count as errors.
+func proxyConns(ctx context.Context, a, b net.Conn, idleTimeout time.Duration, onError func(err error)) {
+	p := &pipe{
+		a:    a,
+		b:    b,
+		done: make(chan struct{}),
+	}
+
+	if idleTimeout > 0 {
+		p.touch()
+		var timer *time.Timer
+		timer = time.AfterFunc(idleTimeout, func() {
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&p.last)))
+			if idle < idleTimeout {
+				timer.Reset(idleTimeout - idle)
+				return
+			}
+			p.fail(errIdleTimeout)
+		})
+		defer timer.Stop()
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.fail(ctx.Err())
+			case <-p.done:
+			}
+		}()
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- p.copy(b, a, idleTimeout > 0)
+	}()
+	go func() {
+		errc <- p.copy(a, b, idleTimeout > 0)
+	}()
+	for i := 0; i != 2; i++ {
+		err := <-errc
+		if err != nil {
+			p.fail(err)
+		}
+	}
+	p.close()
+	p.mut.Lock()
+	err := p.err
+	p.mut.Unlock()
+	if err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+var errIdleTimeout = &timeoutError{"idle timeout"}
+
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type pipe struct {
+	a, b   net.Conn
+	last   int64
+	mut    sync.Mutex
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+func (p *pipe) touch() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+}
+
+// copy copies src to dst and half-closes dst once src is drained.
+func (p *pipe) copy(dst, src net.Conn, track bool) error {
+	var w io.Writer = dst
+	if track {
+		w = touchWriter{dst, p}
+	}
+	_, err := io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	p.close()
+	return nil
+}
+
+// fail records the first error and closes both sides, errors caused by the closing are ignored.
+func (p *pipe) fail(err error) {
+	p.mut.Lock()
+	if !p.closed && p.err == nil {
+		p.err = err
+	}
+	p.mut.Unlock()
+	p.close()
+}
+
+func (p *pipe) close() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.a.Close()
+	p.b.Close()
+}
+
+type touchWriter struct {
+	io.Writer
+	p *pipe
+}
+
+func (w touchWriter) Write(b []byte) (int, error) {
+	w.p.touch()
+	n, err := w.Writer.Write(b)
+	w.p.touch()
+	return n, err
+}
+
+// Policy picks the backend of a BalancedProxyHandler.
+type Policy uint8
+
+const (
+	// RoundRobin picks the backends in turn.
+	RoundRobin Policy = iota
+	// LeastConns picks the backend with the fewest active connections.
+	LeastConns
+)
+
+// BackendStats is the counters of a backend of a BalancedProxyHandler.
+type BackendStats struct {
+	Address  string
+	Active   int64
+	Total    uint64
+	Failures uint64
+	Down     bool
+}
+
+// BalancedProxyHandler is a proxy handler that spreads the connections over several backends.
+// A backend whose dial fails is marked down for a cooldown and the next backend is tried.
+type BalancedProxyHandler struct {
+	proxyHandler
+	policy   Policy
+	backends []*backend
+	next     uint64
+}
+
+type backend struct {
+	address   string
+	active    int64
+	total     uint64
+	failures  uint64
+	downUntil int64
+}
+
+// WithProxyCooldown sets how long a backend whose dial failed is skipped, the default is 10 seconds.
+func WithProxyCooldown(cooldown time.Duration) ProxyOption {
+	return func(p *proxyHandler) {
+		p.cooldown = cooldown
+	}
+}
+
+// NewBalancedProxyHandler returns a handler that proxies to the tcp addresses picked by the policy.
+func NewBalancedProxyHandler(addrs []string, policy Policy, opts ...ProxyOption) *BalancedProxyHandler {
+	p := &BalancedProxyHandler{
+		proxyHandler: proxyHandler{
+			network:  "tcp",
+			dial:     (&net.Dialer{}).DialContext,
+			cooldown: 10 * time.Second,
+		},
+		policy: policy,
+	}
+	for _, opt := range opts {
+		opt(&p.proxyHandler)
+	}
+	for _, addr := range addrs {
+		p.backends = append(p.backends, &backend{address: addr})
+	}
+	return p
+}
+
+// Stats returns the counters of the backends in the order of the addresses.
+func (p *BalancedProxyHandler) Stats() []BackendStats {
+	now := time.Now().UnixNano()
+	stats := make([]BackendStats, 0, len(p.backends))
+	for _, b := range p.backends {
+		stats = append(stats, BackendStats{
+			Address:  b.address,
+			Active:   atomic.LoadInt64(&b.active),
+			Total:    atomic.LoadUint64(&b.total),
+			Failures: atomic.LoadUint64(&b.failures),
+			Down:     atomic.LoadInt64(&b.downUntil) > now,
+		})
+	}
+	return stats
+}
+
+func (p *BalancedProxyHandler) ServeConn(conn net.Conn) {
+	p.ServeConnContext(context.Background(), conn)
+}
+
+func (p *BalancedProxyHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	var err error = errNoBackend
+	for _, b := range p.candidates() {
+		var upstream net.Conn
+		upstream, err = p.dialBackend(ctx, b)
+		if err != nil {
+			atomic.AddUint64(&b.failures, 1)
+			atomic.StoreInt64(&b.downUntil, time.Now().Add(p.cooldown).UnixNano())
+			continue
+		}
+		atomic.AddUint64(&b.total, 1)
+		atomic.AddInt64(&b.active, 1)
+		defer atomic.AddInt64(&b.active, -1)
+		proxyConns(ctx, conn, upstream, p.idleTimeout, func(err error) {
+			p.reportError(conn, err)
+		})
+		return
+	}
+	p.reportError(conn, err)
+	conn.Close()
+}
+
+var errNoBackend = fmt.Errorf("no backend")
+
+func (p *BalancedProxyHandler) dialBackend(ctx context.Context, b *backend) (net.Conn, error) {
+	if p.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.dialTimeout)
+		defer cancel()
+	}
+	return p.dial(ctx, p.network, b.address)
+}
+
+// candidates returns the backends in the order to be tried, the ones marked down are tried last.
+func (p *BalancedProxyHandler) candidates() []*backend {
+	n := len(p.backends)
+	if n == 0 {
+		return nil
+	}
+	type candidate struct {
+		backend *backend
+		active  int64
+		down    bool
+	}
+	now := time.Now().UnixNano()
+	start := int((atomic.AddUint64(&p.next, 1) - 1) % uint64(n))
+	list := make([]candidate, 0, n)
+	for i := 0; i != n; i++ {
+		b := p.backends[(start+i)%n]
+		list = append(list, candidate{
+			backend: b,
+			active:  atomic.LoadInt64(&b.active),
+			down:    atomic.LoadInt64(&b.downUntil) > now,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].down != list[j].down {
+			return !list[i].down
+		}
+		return p.policy == LeastConns && list[i].active < list[j].active
+	})
+	backends := make([]*backend, 0, n)
+	for _, c := range list {
+		backends = append(backends, c.backend)
+	}
+	return backends
+}
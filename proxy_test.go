@@ -0,0 +1,333 @@
+package cmux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpServer serves the connections of a local listener with fn and returns the listener.
+func tcpServer(t testing.TB, fn func(conn *net.TCPConn)) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fn(conn.(*net.TCPConn))
+		}
+	}()
+	return ln
+}
+
+// echo copies the conn back to itself and half-closes it after the EOF of the client.
+func echo(conn *net.TCPConn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+	conn.CloseWrite()
+}
+
+// countAfterEOF reads the conn to its end and only then answers with the number of bytes read.
+func countAfterEOF(conn *net.TCPConn) {
+	defer conn.Close()
+	n, _ := io.Copy(io.Discard, conn)
+	fmt.Fprintf(conn, "n=%d", n)
+}
+
+func TestProxyHandlerReplaysPrefix(t *testing.T) {
+	upstream := tcpServer(t, echo)
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", upstream.Addr().String()), "ECHO")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("ECHO hello"))
+	if got := readN(t, conn, 10); got != "ECHO hello" {
+		t.Fatalf("echoed %q, want the prefix first", got)
+	}
+}
+
+func TestProxyHandlerHalfClose(t *testing.T) {
+	upstream := tcpServer(t, countAfterEOF)
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", upstream.Addr().String()), "COUNT")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("COUNT 12345"))
+	// the answer only comes once the close of the client reached the upstream
+	conn.CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "n=11" {
+		t.Fatalf("got %q, want the upstream to see the half-close after every byte", got)
+	}
+}
+
+func TestProxyHandlerUpstreamHalfClose(t *testing.T) {
+	upstream := tcpServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		conn.Write([]byte("bye"))
+		conn.CloseWrite()
+		// the client can still talk after the upstream is done talking
+		b, _ := io.ReadAll(conn)
+		conn.Write(b)
+	})
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", upstream.Addr().String()), "HI")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("HI"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Fatalf("got %q before the EOF of the upstream", got)
+	}
+	if _, err := conn.Write([]byte(" more")); err != nil {
+		t.Fatalf("write after the upstream half-closed: %v", err)
+	}
+	conn.CloseWrite()
+}
+
+func TestProxyHandlerDialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	errc := make(chan error, 1)
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", addr,
+		WithProxyDialTimeout(time.Second),
+		WithProxyErrorHandler(func(conn net.Conn, err error) {
+			errc <- err
+		}),
+	), "X")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("X"))
+	select {
+	case err := <-errc:
+		var op *net.OpError
+		if !errors.As(err, &op) || op.Op != "dial" {
+			t.Fatalf("error handler got %v, want the dial error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dial failure was not reported")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the dial failure: %v, want io.EOF", err)
+	}
+}
+
+func TestProxyHandlerIdleTimeout(t *testing.T) {
+	upstream := tcpServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	errc := make(chan error, 1)
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", upstream.Addr().String(),
+		WithProxyIdleTimeout(50*time.Millisecond),
+		WithProxyErrorHandler(func(conn net.Conn, err error) {
+			errc <- err
+		}),
+	), "X")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("X"))
+	select {
+	case err := <-errc:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("error handler got %v, want the idle timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection was not closed")
+	}
+}
+
+func TestProxyHandlerDialer(t *testing.T) {
+	upstream := tcpServer(t, echo)
+	var mut sync.Mutex
+	var dialed []string
+	mux := NewCMux()
+	mux.HandlePrefix(NewProxyHandler("tcp", "backend:1", WithProxyDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mut.Lock()
+		dialed = append(dialed, address)
+		mut.Unlock()
+		return net.Dial(network, upstream.Addr().String())
+	})), "X")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte("Xy"))
+	if got := readN(t, conn, 2); got != "Xy" {
+		t.Fatalf("echoed %q", got)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if len(dialed) != 1 || dialed[0] != "backend:1" {
+		t.Fatalf("dialed %q, want the configured address", dialed)
+	}
+}
+
+// idServer answers every connection with id.
+func idServer(t testing.TB, id string) net.Listener {
+	return tcpServer(t, func(conn *net.TCPConn) {
+		conn.Write([]byte(id))
+		conn.Close()
+	})
+}
+
+// dialMux sends b through mux and returns what came back until the EOF.
+func dialMux(t testing.TB, mux *CMux, b string) string {
+	t.Helper()
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.Write([]byte(b))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestBalancedProxyRoundRobin(t *testing.T) {
+	a, b := idServer(t, "a"), idServer(t, "b")
+	p := NewBalancedProxyHandler([]string{a.Addr().String(), b.Addr().String()}, RoundRobin)
+	mux := NewCMux()
+	mux.HandlePrefix(p, "X")
+
+	counts := map[string]int{}
+	for i := 0; i != 10; i++ {
+		counts[dialMux(t, mux, "X")]++
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Fatalf("round robin spread %v, want 5 each", counts)
+	}
+	for _, s := range p.Stats() {
+		if s.Total != 5 || s.Failures != 0 || s.Down {
+			t.Errorf("stats of %s are %+v", s.Address, s)
+		}
+	}
+}
+
+func TestBalancedProxyLeastConns(t *testing.T) {
+	release := make(chan struct{})
+	busy := tcpServer(t, func(conn *net.TCPConn) {
+		<-release
+		conn.Close()
+	})
+	idle := idServer(t, "idle")
+	p := NewBalancedProxyHandler([]string{busy.Addr().String(), idle.Addr().String()}, LeastConns)
+	mux := NewCMux()
+	mux.HandlePrefix(p, "X")
+
+	defer close(release)
+
+	// active waits for the backends to have the number of active connections
+	active := func(busyActive, idleActive int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stats := p.Stats()
+			if stats[0].Active == busyActive && stats[1].Active == idleActive {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("active connections are %d and %d, want %d and %d", stats[0].Active, stats[1].Active, busyActive, idleActive)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the first pick of the tie is the first backend
+	held := serveTCP(t, mux)
+	defer held.Close()
+	held.Write([]byte("X"))
+	active(1, 0)
+	for i := 0; i != 4; i++ {
+		if got := dialMux(t, mux, "X"); got != "idle" {
+			t.Fatalf("connection %d went to %q, want the backend with fewer connections", i, got)
+		}
+		active(1, 0)
+	}
+}
+
+func TestBalancedProxyBackendDown(t *testing.T) {
+	a, b := idServer(t, "a"), idServer(t, "b")
+	p := NewBalancedProxyHandler([]string{a.Addr().String(), b.Addr().String()}, RoundRobin, WithProxyCooldown(time.Minute))
+	mux := NewCMux()
+	mux.HandlePrefix(p, "X")
+
+	for i := 0; i != 4; i++ {
+		if got := dialMux(t, mux, "X"); got == "" {
+			t.Fatalf("connection %d failed before the kill", i)
+		}
+	}
+	a.Close()
+	for i := 0; i != 10; i++ {
+		if got := dialMux(t, mux, "X"); got != "b" {
+			t.Fatalf("connection %d after the kill got %q, want the remaining backend", i, got)
+		}
+	}
+	stats := p.Stats()
+	if stats[0].Failures != 1 || !stats[0].Down {
+		t.Fatalf("stats of the killed backend are %+v, want one failure and marked down", stats[0])
+	}
+	if stats[1].Total != 12 {
+		t.Fatalf("the remaining backend served %d, want 12", stats[1].Total)
+	}
+}
+
+func TestBalancedProxyAllDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	errc := make(chan error, 1)
+	p := NewBalancedProxyHandler([]string{addr}, RoundRobin, WithProxyErrorHandler(func(conn net.Conn, err error) {
+		errc <- err
+	}))
+	mux := NewCMux()
+	mux.HandlePrefix(p, "X")
+
+	if got := dialMux(t, mux, "X"); got != "" {
+		t.Fatalf("got %q with no backend up", got)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failure was not reported")
+	}
+}
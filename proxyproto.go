@@ -0,0 +1,242 @@
+package cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidProxyHeader = fmt.Errorf("invalid proxy protocol header")
+)
+
+const (
+	proxyV1Signature = "PROXY "
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+	maxProxyV1Length    = 107
+	proxyV2HeaderLength = 16
+	maxProxyV2Length    = 2048
+)
+
+// ProxyConn is a connection that started with a PROXY protocol header,
+// it reports the addresses carried by the header.
+type ProxyConn struct {
+	net.Conn
+	header     []byte
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// RemoteAddr returns the source address of the header, or of the connection when the header has none.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, or of the connection when the header has none.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyHeader returns the raw PROXY protocol header.
+func (c *ProxyConn) ProxyHeader() []byte {
+	return c.header
+}
+
+// EnableProxyProtocol makes the mux consume a PROXY protocol v1 or v2 header before matching,
+// connections without the header keep working.
+func (m *CMux) EnableProxyProtocol() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.proxyProtocol = true
+	m.rebuild()
+}
+
+// readProxyProtocol consumes the PROXY protocol header of conn if there is one.
+func readProxyProtocol(conn net.Conn) (net.Conn, error) {
+	r := &proxyReader{conn: conn}
+	for {
+		if !bytes.HasPrefix([]byte(proxyV1Signature), r.data(len(proxyV1Signature))) &&
+			!bytes.HasPrefix([]byte(proxyV2Signature), r.data(len(proxyV2Signature))) {
+			return UnreadConn(conn, r.buf), nil
+		}
+		if bytes.HasPrefix(r.buf, []byte(proxyV1Signature)) {
+			return r.readV1()
+		}
+		if bytes.HasPrefix(r.buf, []byte(proxyV2Signature)) {
+			return r.readV2()
+		}
+		err := r.fill(len(r.buf) + 1)
+		if err != nil {
+			if len(r.buf) == 0 {
+				return nil, err
+			}
+			return UnreadConn(conn, r.buf), nil
+		}
+	}
+}
+
+type proxyReader struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (r *proxyReader) data(n int) []byte {
+	if len(r.buf) < n {
+		return r.buf
+	}
+	return r.buf[:n]
+}
+
+// fill reads until at least n bytes are buffered.
+func (r *proxyReader) fill(n int) error {
+	for len(r.buf) < n {
+		var tmp [256]byte
+		i, err := r.conn.Read(tmp[:])
+		r.buf = append(r.buf, tmp[:i]...)
+		if err != nil {
+			if len(r.buf) >= n {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *proxyReader) conned(length int, remote, local net.Addr) *ProxyConn {
+	header := r.buf[:length:length]
+	return &ProxyConn{
+		Conn:       UnreadConn(r.conn, r.buf[length:]),
+		header:     header,
+		remoteAddr: remote,
+		localAddr:  local,
+	}
+}
+
+func (r *proxyReader) readV1() (net.Conn, error) {
+	var end int
+	for {
+		end = bytes.Index(r.buf, []byte("\r\n"))
+		if end >= 0 {
+			break
+		}
+		if len(r.buf) >= maxProxyV1Length {
+			return nil, fmt.Errorf("%w: v1 header exceeds %d bytes", ErrInvalidProxyHeader, maxProxyV1Length)
+		}
+		err := r.fill(len(r.buf) + 1)
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated v1 header: %v", ErrInvalidProxyHeader, err)
+		}
+	}
+	length := end + 2
+	if length > maxProxyV1Length {
+		return nil, fmt.Errorf("%w: v1 header exceeds %d bytes", ErrInvalidProxyHeader, maxProxyV1Length)
+	}
+
+	fields := strings.Split(string(r.buf[len(proxyV1Signature):end]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return r.conned(length, nil, nil), nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown v1 protocol %q", ErrInvalidProxyHeader, fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidProxyHeader, r.buf[:end])
+	}
+	src, err := parseProxyV1Addr(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	return r.conned(length, src, dst), nil
+}
+
+func parseProxyV1Addr(proto, host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: invalid v1 address %q", ErrInvalidProxyHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid v1 port %q", ErrInvalidProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func (r *proxyReader) readV2() (net.Conn, error) {
+	err := r.fill(proxyV2HeaderLength)
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated v2 header: %v", ErrInvalidProxyHeader, err)
+	}
+	verCmd := r.buf[12]
+	family := r.buf[13]
+	length := proxyV2HeaderLength + int(binary.BigEndian.Uint16(r.buf[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported v2 version %d", ErrInvalidProxyHeader, verCmd>>4)
+	}
+	if length > maxProxyV2Length {
+		return nil, fmt.Errorf("%w: v2 header exceeds %d bytes", ErrInvalidProxyHeader, maxProxyV2Length)
+	}
+	err = r.fill(length)
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated v2 header: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		return r.conned(length, nil, nil), nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported v2 command %d", ErrInvalidProxyHeader, verCmd&0x0f)
+	}
+
+	addrs := r.buf[proxyV2HeaderLength:length]
+	var src, dst net.Addr
+	switch family {
+	case 0x00: // UNSPEC
+	case 0x11, 0x12: // TCP4, UDP4
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("%w: short v2 IPv4 addresses", ErrInvalidProxyHeader)
+		}
+		src = proxyV2Addr(family, net.IP(addrs[0:4]), addrs[8:10])
+		dst = proxyV2Addr(family, net.IP(addrs[4:8]), addrs[10:12])
+	case 0x21, 0x22: // TCP6, UDP6
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("%w: short v2 IPv6 addresses", ErrInvalidProxyHeader)
+		}
+		src = proxyV2Addr(family, net.IP(addrs[0:16]), addrs[32:34])
+		dst = proxyV2Addr(family, net.IP(addrs[16:32]), addrs[34:36])
+	case 0x31, 0x32: // UNIX stream, UNIX datagram
+		if len(addrs) < 216 {
+			return nil, fmt.Errorf("%w: short v2 unix addresses", ErrInvalidProxyHeader)
+		}
+		src = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[0:108], "\x00")), Net: "unix"}
+		dst = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[108:216], "\x00")), Net: "unix"}
+	default:
+		return nil, fmt.Errorf("%w: unsupported v2 family 0x%02x", ErrInvalidProxyHeader, family)
+	}
+	return r.conned(length, src, dst), nil
+}
+
+func proxyV2Addr(family byte, ip net.IP, port []byte) net.Addr {
+	ip = append(net.IP(nil), ip...)
+	p := int(binary.BigEndian.Uint16(port))
+	if family&0x0f == 0x2 {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
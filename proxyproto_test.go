@@ -0,0 +1,152 @@
+package cmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// proxyV2Header returns a v2 PROXY header of the command, the family and the address block.
+func proxyV2Header(cmd, family byte, addrs []byte) string {
+	b := []byte(proxyV2Signature)
+	b = append(b, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return string(append(b, addrs...))
+}
+
+func ipv4Block(src, dst string, sport, dport uint16) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	return append(b, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+}
+
+func ipv6Block(src, dst string, sport, dport uint16) []byte {
+	b := append(net.ParseIP(src).To16(), net.ParseIP(dst).To16()...)
+	return append(b, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+}
+
+// readProxy runs readProxyProtocol over a pipe fed with data and the client end closed.
+func readProxy(t *testing.T, data string) (net.Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+	return readProxyProtocol(server)
+}
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		remote string
+		local  string
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "pipe", "pipe"},
+		{"v2 TCP4", proxyV2Header(1, 0x11, ipv4Block("192.0.2.1", "198.51.100.1", 56324, 443)), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 TCP6", proxyV2Header(1, 0x21, ipv6Block("2001:db8::1", "2001:db8::2", 56324, 443)), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v2 UNSPEC", proxyV2Header(1, 0x00, nil), "pipe", "pipe"},
+		{"v2 LOCAL", proxyV2Header(0, 0x11, ipv4Block("192.0.2.1", "198.51.100.1", 1, 2)), "pipe", "pipe"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := readProxy(t, tc.header+"SSH-2.0-x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc, ok := conn.(*ProxyConn)
+			if !ok {
+				t.Fatalf("got %T, want *ProxyConn", conn)
+			}
+			if string(pc.ProxyHeader()) != tc.header {
+				t.Errorf("ProxyHeader() = %q", pc.ProxyHeader())
+			}
+			if got := pc.RemoteAddr().String(); got != tc.remote {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tc.remote)
+			}
+			if got := pc.LocalAddr().String(); got != tc.local {
+				t.Errorf("LocalAddr() = %s, want %s", got, tc.local)
+			}
+			if got := readN(t, pc, 9); got != "SSH-2.0-x" {
+				t.Errorf("read %q after the header", got)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolInvalid(t *testing.T) {
+	long := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"
+	for len(long) <= maxProxyV1Length {
+		long += " "
+	}
+	for _, tc := range []struct {
+		name   string
+		header string
+	}{
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51"},
+		{"v1 oversized", long + "\r\n"},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n"},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n"},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 1 70000\r\n"},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 198.51.100.1 1\r\n"},
+		{"v2 truncated header", proxyV2Signature + "\x21"},
+		{"v2 truncated addresses", proxyV2Header(1, 0x11, ipv4Block("192.0.2.1", "198.51.100.1", 1, 2))[:20]},
+		{"v2 short addresses", proxyV2Header(1, 0x11, []byte{1, 2, 3})},
+		{"v2 oversized", proxyV2Signature + "\x21\x11\xff\xff"},
+		{"v2 version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00"},
+		{"v2 family", proxyV2Header(1, 0x55, nil)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readProxy(t, tc.header)
+			if !errors.Is(err, ErrInvalidProxyHeader) {
+				t.Fatalf("got %v, want ErrInvalidProxyHeader", err)
+			}
+		})
+	}
+}
+
+func TestEnableProxyProtocol(t *testing.T) {
+	mux := NewCMux()
+	mux.EnableProxyProtocol()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	errc := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errc <- err
+	})
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-2.0-x"))
+	conn := recvConn(t, ch)
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr() = %s, want the address of the header", got)
+	}
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Errorf("handler read %q, want the bytes after the header", got)
+	}
+	conn.Close()
+
+	// without a header
+	client = servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-x"))
+	conn = recvConn(t, ch)
+	if got := readN(t, conn, 9); got != "SSH-2.0-x" {
+		t.Errorf("handler read %q", got)
+	}
+	conn.Close()
+
+	// a malformed header is reported
+	client = servePipe(mux)
+	go func() {
+		client.Write([]byte("PROXY TCP4 nowhere\r\n"))
+		client.Close()
+	}()
+	if err := <-errc; !errors.Is(err, ErrInvalidProxyHeader) {
+		t.Fatalf("OnError got %v, want ErrInvalidProxyHeader", err)
+	}
+	noConn(t, ch)
+}
@@ -0,0 +1,106 @@
+package cmux
+
+// maxRESPHeaderLength is the length of the longest array header followed by the longest bulk string header.
+const maxRESPHeaderLength = 2 * (1 + maxRESPDigits + 2)
+
+// maxRESPDigits is the number of the digits of the longest length of RESP.
+const maxRESPDigits = 10
+
+// HandleRedis handle the handler that matches the commands of Redis sent as a RESP array, see MatchRESP,
+// and the inline commands starting with one of inlineCommands, such as "PING", matched ignoring the case.
+// The sniffed bytes are replayed so that the server reads the whole command.
+func (m *CMux) HandleRedis(handler Handler, inlineCommands ...string) error {
+	rm := &redisMatcher{}
+	maxBytes := maxRESPHeaderLength
+	for _, cmd := range inlineCommands {
+		if cmd == "" {
+			continue
+		}
+		rm.inline = append(rm.inline, foldString(cmd))
+		if maxBytes < len(cmd)+1 {
+			maxBytes = len(cmd) + 1
+		}
+	}
+	return m.addMatcher(handler, &matcherRoute{more: rm, maxBytes: maxBytes}, "redis")
+}
+
+type redisMatcher struct {
+	inline []string
+}
+
+func (r *redisMatcher) MatchMore(b []byte) (matched bool, more int) {
+	if len(b) == 0 {
+		return false, 1
+	}
+	if b[0] == '*' {
+		return MatchRESP(b)
+	}
+	return r.matchInline(b)
+}
+
+// matchInline matches the inline command words followed by a space or the end of the line.
+func (r *redisMatcher) matchInline(b []byte) (matched bool, more int) {
+	for _, cmd := range r.inline {
+		n := len(b)
+		if n > len(cmd) {
+			n = len(cmd)
+		}
+		if foldString(string(b[:n])) != cmd[:n] {
+			continue
+		}
+		if len(b) <= len(cmd) {
+			more = len(cmd) + 1 - len(b)
+			continue
+		}
+		switch b[len(cmd)] {
+		case ' ', '\r', '\n':
+			return true, 0
+		}
+	}
+	return false, more
+}
+
+// MatchRESP matches the start of a command sent as a RESP array, the header of an array of at least one element
+// followed by the header of the bulk string of the command name, such as "*1\r\n$4\r\n".
+func MatchRESP(b []byte) (matched bool, more int) {
+	off := 0
+	for _, typ := range []byte{'*', '$'} {
+		if len(b) <= off {
+			return false, off + 1 - len(b)
+		}
+		if b[off] != typ {
+			return false, 0
+		}
+		n, next, more := parseRESPLength(b, off+1)
+		if more != 0 || n <= 0 {
+			return false, more
+		}
+		off = next
+	}
+	return true, 0
+}
+
+// parseRESPLength parses the decimal length at off of b ended by CRLF, it returns -1 for a malformed one
+// and a positive more while b is too short.
+func parseRESPLength(b []byte, off int) (n int, next int, more int) {
+	for i := off; ; i++ {
+		if len(b) <= i {
+			return 0, 0, i + 1 - len(b)
+		}
+		c := b[i]
+		if c >= '0' && c <= '9' && i-off < maxRESPDigits {
+			n = n*10 + int(c-'0')
+			continue
+		}
+		if c != '\r' || i == off {
+			return -1, 0, 0
+		}
+		if len(b) <= i+1 {
+			return 0, 0, 1
+		}
+		if b[i+1] != '\n' {
+			return -1, 0, 0
+		}
+		return n, i + 2, 0
+	}
+}
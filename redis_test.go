@@ -0,0 +1,124 @@
+package cmux
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// respCommand returns the command encoded as a RESP array of bulk strings, as the clients send it.
+func respCommand(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return s
+}
+
+func TestHandleRedis(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleRedis(handlerID("redis"), "PING", "info")
+	mux.HandlePrefix(handlerID("smtp"), "HELO ")
+	for _, tc := range []struct {
+		name string
+		b    string
+		want string
+	}{
+		{"PING array", respCommand("PING"), "redis"},
+		{"SET array", respCommand("SET", "key", strings.Repeat("v", 2000)), "redis"},
+		{"long array header", "*1234567890\r\n$3\r\nGET\r\n", "redis"},
+		{"inline PING", "PING\r\n", "redis"},
+		{"inline ping in lower case", "ping\r\n", "redis"},
+		{"inline INFO with an argument", "INFO server\r\n", "redis"},
+		{"inline command not allowed", "GET key\r\n", ""},
+		{"inline word prefix", "PINGX\r\n", ""},
+		{"other text", "HELO mx\r\n", "smtp"},
+		{"star without digits", "*hello\r\n", ""},
+		{"array without bulk string", "*1\r\n+OK\r\n", ""},
+		{"empty array", "*0\r\n", ""},
+		{"no CRLF", "*1\n$4\nPING\n", ""},
+		{"too many digits", "*12345678901\r\n$4\r\n", ""},
+	} {
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMatchRESPWaitsForBulkHeader(t *testing.T) {
+	b := respCommand("PING")
+	for n := 0; n < len("*1\r\n$4\r\n"); n++ {
+		if matched, more := MatchRESP([]byte(b[:n])); matched || more <= 0 {
+			t.Fatalf("MatchRESP(%q) = %v, %d, want more bytes", b[:n], matched, more)
+		}
+	}
+}
+
+func TestHandleRedisClient(t *testing.T) {
+	// a server answering the commands of a client the way Redis does
+	upstream := tcpServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var n int
+			if _, err := fmt.Sscanf(line, "*%d\r\n", &n); err != nil {
+				fmt.Fprintf(conn, "+inline %s", line)
+				continue
+			}
+			var args []string
+			for i := 0; i != n; i++ {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args = append(args, strings.TrimSuffix(arg, "\r\n"))
+			}
+			fmt.Fprintf(conn, "+%s\r\n", strings.Join(args, " "))
+		}
+	})
+	mux := NewCMux()
+	mux.HandleRedis(NewProxyHandler("tcp", upstream.Addr().String()), "PING")
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	notFound, ch := connChan()
+	mux.NotFound(notFound)
+	addr := listenMux(t, mux)
+
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, cmd := range [][]string{{"PING"}, {"SET", "k", "v"}, {"GET", "k"}} {
+		args := make([]interface{}, len(cmd))
+		for i, arg := range cmd {
+			args[i] = arg
+		}
+		got, err := client.Do(ctx, args...).Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Join(cmd, " "); got != want {
+			t.Fatalf("the command %q was answered %q, want %q", cmd, got, want)
+		}
+	}
+
+	// a payload starting with '*' that is not RESP does not reach the server
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("*hello\r\n"))
+	c := recvConn(t, ch)
+	defer c.Close()
+	if got := readN(t, c, len("*hello\r\n")); got != "*hello\r\n" {
+		t.Fatalf("the unmatched payload was read as %q", got)
+	}
+}
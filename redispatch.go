@@ -0,0 +1,84 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// ErrRedispatchDepth is reported when a connection is redispatched more than maxRedispatchDepth times.
+var ErrRedispatchDepth = fmt.Errorf("too many redispatches")
+
+// maxRedispatchDepth bounds the redispatches of a connection, so that handlers handing it back cannot loop.
+const maxRedispatchDepth = 4
+
+type redispatchKey struct{}
+
+// Redispatch matches conn again from its current position, as a handler does after it has consumed
+// a part of the stream, such as a STARTTLS handler with the *tls.Conn of the upgraded stream.
+// conn goes through the hooks, the read timeout and the counters like an accepted connection,
+// but it does not take another slot of SetMaxConns. After 4 redispatches conn is closed
+// with ErrRedispatchDepth reported to the OnError callback.
+func (m *CMux) Redispatch(conn net.Conn) {
+	m.RedispatchContext(context.Background(), conn)
+}
+
+// RedispatchContext is like Redispatch, the ctx is the one of the handler or a descendant of it.
+func (m *CMux) RedispatchContext(ctx context.Context, conn net.Conn) {
+	depth := redispatchDepth(ctx, conn) + 1
+	if depth > maxRedispatchDepth {
+		m.load().closeWithError(conn, ErrRedispatchDepth)
+		return
+	}
+	atomic.AddUint64(&m.redispatched, 1)
+	m.ServeConnContext(context.WithValue(ctx, redispatchKey{}, depth), conn)
+}
+
+// isRedispatch reports whether ctx is the one of a redispatched connection.
+func isRedispatch(ctx context.Context) bool {
+	return ctx.Value(redispatchKey{}) != nil
+}
+
+// withDepth records the redispatch depth of the ctx on conn, conn is wrapped if it does not replay anything.
+func withDepth(ctx context.Context, conn net.Conn) net.Conn {
+	depth, _ := ctx.Value(redispatchKey{}).(int)
+	if depth == 0 {
+		return conn
+	}
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	us.depth = depth
+	return conn
+}
+
+// maxUnwrap bounds the connections looked through for the depth.
+const maxUnwrap = 16
+
+// redispatchDepth returns the number of times conn was redispatched, as recorded in ctx
+// or on the connections it wraps.
+func redispatchDepth(ctx context.Context, conn net.Conn) int {
+	depth, _ := ctx.Value(redispatchKey{}).(int)
+	for i := 0; i < maxUnwrap && conn != nil; i++ {
+		if us, ok := asUnreadConn(conn); ok {
+			if us.depth > depth {
+				depth = us.depth
+			}
+			conn = us.Conn
+			continue
+		}
+		switch c := conn.(type) {
+		case *ProxyConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			// such as a *tls.Conn
+			conn = c.NetConn()
+		default:
+			conn = nil
+		}
+	}
+	return depth
+}
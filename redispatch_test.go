@@ -0,0 +1,223 @@
+package cmux
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redispatchFunc is a ContextHandler calling the func with the ctx of the dispatching.
+type redispatchFunc func(ctx context.Context, conn net.Conn)
+
+func (h redispatchFunc) ServeConn(conn net.Conn) {
+	h(context.Background(), conn)
+}
+
+func (h redispatchFunc) ServeConnContext(ctx context.Context, conn net.Conn) {
+	h(ctx, conn)
+}
+
+// starttls is a handler answering the STARTTLS command and handing the upgraded stream back to mux.
+func starttls(mux *CMux, cert tls.Certificate) Handler {
+	return redispatchFunc(func(ctx context.Context, conn net.Conn) {
+		buf := make([]byte, len("STARTTLS\r\n"))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		_, err = conn.Write([]byte("220 go ahead\r\n"))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		mux.RedispatchContext(ctx, tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	})
+}
+
+func TestRedispatchSTARTTLS(t *testing.T) {
+	cert := testCert(t, "example.com")
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	mux.HandlePrefix(starttls(mux, cert), "STARTTLS\r\n")
+	mux.HandlePrefix(httpAnswer("http"), "GET ")
+	var mut sync.Mutex
+	var patterns []string
+	accepted := 0
+	mux.OnAccept(func(conn net.Conn) (net.Conn, error) {
+		mut.Lock()
+		accepted++
+		mut.Unlock()
+		return conn, nil
+	})
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		mut.Lock()
+		patterns = append(patterns, pattern)
+		mut.Unlock()
+	})
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("STARTTLS\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, conn, len("220 go ahead\r\n")); got != "220 go ahead\r\n" {
+		t.Fatalf("answered %q", got)
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	_, err = tc.Write([]byte("GET /inner HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "http /inner" {
+		t.Fatalf("the inner request was answered with %q", body)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if len(patterns) != 2 || patterns[0] != "STARTTLS\r\n" || patterns[1] != "GET " {
+		t.Fatalf("matched %q, want the STARTTLS and then the GET", patterns)
+	}
+	if accepted != 2 {
+		t.Fatalf("the OnAccept hook ran %d times, want once per dispatch", accepted)
+	}
+	stats := mux.Stats()
+	if stats.Redispatched != 1 {
+		t.Fatalf("%d connections redispatched, want 1", stats.Redispatched)
+	}
+	if got := stats.Patterns["GET "].Matched; got != 1 {
+		t.Fatalf("the inner pattern matched %d times", got)
+	}
+}
+
+func TestRedispatchDoesNotTakeSlot(t *testing.T) {
+	cert := testCert(t, "example.com")
+	mux := NewCMux()
+	mux.SetMaxConns(1)
+	mux.HandlePrefix(starttls(mux, cert), "STARTTLS\r\n")
+	mux.HandlePrefix(httpAnswer("http"), "GET ")
+
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("STARTTLS\r\n"))
+	readN(t, conn, len("220 go ahead\r\n"))
+	tc := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	tc.Write([]byte("GET /slot HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatalf("the redispatched connection was not served within the bound: %v", err)
+	}
+	resp.Body.Close()
+	if stats := mux.Stats(); stats.Rejected != 0 {
+		t.Fatalf("%d connections rejected", stats.Rejected)
+	}
+}
+
+func TestRedispatchDepth(t *testing.T) {
+	for _, withCtx := range []bool{true, false} {
+		withCtx := withCtx
+		t.Run(map[bool]string{true: "context", false: "conn"}[withCtx], func(t *testing.T) {
+			mux := NewCMux()
+			// the handler hands back the connection as it got it, the same prefix matches again
+			mux.HandlePrefix(redispatchFunc(func(ctx context.Context, conn net.Conn) {
+				if withCtx {
+					mux.RedispatchContext(ctx, conn)
+				} else {
+					mux.Redispatch(conn)
+				}
+			}), "LOOP")
+			errs := make(chan error, 1)
+			mux.OnError(func(conn net.Conn, err error) {
+				errs <- err
+			})
+			conn := servePipe(mux)
+			defer conn.Close()
+			go conn.Write([]byte("LOOP"))
+			select {
+			case err := <-errs:
+				if !errors.Is(err, ErrRedispatchDepth) {
+					t.Fatalf("reported %v, want ErrRedispatchDepth", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the loop was not stopped")
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := conn.Read(make([]byte, 1))
+			if err != io.EOF {
+				t.Fatalf("read %v, want the connection closed", err)
+			}
+			if got := mux.Stats().Redispatched; got != maxRedispatchDepth {
+				t.Fatalf("%d redispatches, want %d", got, maxRedispatchDepth)
+			}
+		})
+	}
+}
+
+func TestRedispatchRestartsReadTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(timeout)
+	mux.HandlePrefix(redispatchFunc(func(ctx context.Context, conn net.Conn) {
+		_, err := io.ReadFull(conn, make([]byte, len("HELLO\r\n")))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		mux.RedispatchContext(ctx, conn)
+	}), "HELLO\r\n")
+	handler, ch := connChan()
+	mux.HandlePrefix(handler, "PING")
+	errs := make(chan error, 4)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+
+	// each command comes within the timeout, both of them together do not
+	conn := servePipe(mux)
+	defer conn.Close()
+	go func() {
+		time.Sleep(timeout * 2 / 3)
+		conn.Write([]byte("HELLO\r\n"))
+		time.Sleep(timeout * 2 / 3)
+		conn.Write([]byte("PING"))
+	}()
+	served := recvConn(t, ch)
+	defer served.Close()
+	if got := readN(t, served, 4); got != "PING" {
+		t.Fatalf("replayed %q", got)
+	}
+
+	// a silent client is timed out again after the redispatch
+	conn = servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("HELLO\r\n"))
+	select {
+	case err := <-errs:
+		var se *SniffError
+		if !errors.As(err, &se) {
+			t.Fatalf("reported %v, want a *SniffError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the redispatched connection was not timed out")
+	}
+	noConn(t, ch)
+}
@@ -0,0 +1,49 @@
+package cmux
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// HandleRegexp handle the handler that matches any of the regular expressions,
+// the expressions are implicitly anchored to the start and see at most maxBytes bytes.
+// They are only consulted when no prefix matches.
+func (m *CMux) HandleRegexp(handler Handler, maxBytes int, exprs ...string) error {
+	if len(exprs) == 0 {
+		return nil
+	}
+	rm := &regexpMatcher{}
+	for _, expr := range exprs {
+		re, err := regexp.Compile(`^(?:` + expr + `)`)
+		if err != nil {
+			return fmt.Errorf("regexp %q: %w", expr, err)
+		}
+		rm.regexps = append(rm.regexps, re)
+	}
+	return m.handleMatcher(handler, rm, maxBytes, "regexp:"+strings.Join(exprs, "|"))
+}
+
+type regexpMatcher struct {
+	regexps []*regexp.Regexp
+}
+
+// Match asks for more bytes as long as an expression may still match,
+// the literal prefix of the expression is used to give up early.
+func (r *regexpMatcher) Match(b []byte) (matched bool, needMore bool) {
+	for _, re := range r.regexps {
+		if re.Match(b) {
+			return true, false
+		}
+		lit, _ := re.LiteralPrefix()
+		if n := len(b); n < len(lit) {
+			if bytes.Equal(b, []byte(lit[:n])) {
+				needMore = true
+			}
+		} else if bytes.HasPrefix(b, []byte(lit)) {
+			needMore = true
+		}
+	}
+	return false, needMore
+}
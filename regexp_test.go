@@ -0,0 +1,88 @@
+package cmux
+
+import (
+	"bytes"
+	"testing"
+)
+
+const sipExpr = `[A-Z]+ sip:[^ ]+ SIP/2\.0\r\n`
+
+func TestHandleRegexp(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandleRegexp(handlerID("sip"), 256, sipExpr); err != nil {
+		t.Fatal(err)
+	}
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	for b, want := range map[string]string{
+		"INVITE sip:bob@example.com SIP/2.0\r\nVia: x\r\n": "sip",
+		"REGISTER sip:example.com SIP/2.0\r\n":             "sip",
+		"SSH-2.0-x\r\n":                                    "ssh",
+		"INVITE sip:bob@example.com HTTP/1.1\r\n":          "",
+		// anchored, the expression does not match further in
+		"xx INVITE sip:bob@example.com SIP/2.0\r\n": "",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleRegexpPartialData(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleRegexp(handlerID("sip"), 256, sipExpr)
+
+	// the request line arrives in pieces, the expression waits for the rest of it
+	req := "OPTIONS sip:example.com SIP/2.0\r\n"
+	handler, prefix, err := mux.Handler(&bytewiseReader{b: []byte(req + "Via: x\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler != handlerID("sip") {
+		t.Fatalf("matched %v, want sip", handler)
+	}
+	if !bytes.HasPrefix(prefix, []byte(req)) {
+		t.Fatalf("sniffed %q, want the whole request line", prefix)
+	}
+
+	// the bound is reached before the expression can match
+	mux = NewCMux()
+	mux.HandleRegexp(handlerID("sip"), 16, sipExpr)
+	if got := matchOf(t, mux, req); got != "" {
+		t.Fatalf("matched %q with a bound shorter than the request line", got)
+	}
+}
+
+func TestHandleRegexpInvalid(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandleRegexp(handlerID("x"), 16, "("); err == nil {
+		t.Fatal("HandleRegexp accepted an invalid expression")
+	}
+	if len(mux.load().matchers) != 0 {
+		t.Fatal("the invalid expression was registered")
+	}
+}
+
+func benchmarkPrefixMatch(b *testing.B, mux *CMux) {
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ")
+	data := []byte("SSH-2.0-OpenSSH\r\n")
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		mux.Handler(r)
+	}
+}
+
+func BenchmarkPrefixOnly(b *testing.B) {
+	benchmarkPrefixMatch(b, NewCMux())
+}
+
+// BenchmarkPrefixWithRegexp is BenchmarkPrefixOnly with an expression registered,
+// the prefix decides before the expression is consulted.
+func BenchmarkPrefixWithRegexp(b *testing.B) {
+	mux := NewCMux()
+	mux.HandleRegexp(handlerID("sip"), 256, sipExpr)
+	benchmarkPrefixMatch(b, mux)
+}
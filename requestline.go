@@ -0,0 +1,54 @@
+package cmux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HandleRequestLine handle the handler that matches the request line of a text protocol in the style of HTTP,
+// such as SIP or RTSP, whose method is one of methods and whose version is versionSuffix, such as "SIP/2.0".
+// The line is buffered up to maxLine bytes and replayed to the handler.
+// "OPTIONS sip:a@example.com SIP/2.0" and "OPTIONS / HTTP/1.1" are told apart by the version.
+func (m *CMux) HandleRequestLine(handler Handler, methods []string, versionSuffix string, maxLine int) error {
+	version := strings.TrimSpace(versionSuffix)
+	if len(methods) == 0 || version == "" {
+		return fmt.Errorf("request line needs methods and a version")
+	}
+	return m.handleMatcher(handler, &requestLineMatcher{
+		methods: methods,
+		version: version,
+	}, maxLine, "line:"+strings.Join(methods, ",")+":"+version)
+}
+
+// requestLineMatcher matches the request line whose method is one of methods and whose version is version.
+type requestLineMatcher struct {
+	methods []string
+	version string
+}
+
+func (r *requestLineMatcher) Match(b []byte) (matched bool, needMore bool) {
+	// fail on the method without waiting for the end of the line
+	if !r.matchMethod(b) {
+		return false, false
+	}
+	method, _, version, ok, needMore := parseRequestLine(b)
+	if !ok {
+		return false, needMore
+	}
+	return r.matchMethod(method) && string(version) == r.version, false
+}
+
+// matchMethod reports whether b may start with one of the methods followed by a space.
+func (r *requestLineMatcher) matchMethod(b []byte) bool {
+	for _, method := range r.methods {
+		token := method + " "
+		n := len(b)
+		if n > len(token) {
+			n = len(token)
+		}
+		if string(b[:n]) == token[:n] {
+			return true
+		}
+	}
+	return false
+}
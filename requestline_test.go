@@ -0,0 +1,74 @@
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandleRequestLine(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleRequestLine(handlerID("sip"), []string{"INVITE", "REGISTER", "OPTIONS", "BYE"}, " SIP/2.0", 256)
+	mux.HandleRequestLine(handlerID("rtsp"), []string{"OPTIONS", "DESCRIBE", "SETUP", "PLAY"}, "RTSP/1.0", 256)
+	mux.HandleRequestLine(handlerID("http"), []string{"GET", "OPTIONS"}, "HTTP/1.1", 256)
+	for _, tc := range []struct {
+		b    string
+		want string
+	}{
+		{"OPTIONS sip:bob@example.com SIP/2.0\r\nVia: SIP/2.0/UDP a\r\n\r\n", "sip"},
+		{"INVITE sip:bob@example.com SIP/2.0\r\n", "sip"},
+		{"OPTIONS rtsp://example.com/media.mp4 RTSP/1.0\r\nCSeq: 1\r\n\r\n", "rtsp"},
+		{"DESCRIBE rtsp://example.com/media.mp4 RTSP/1.0\r\n", "rtsp"},
+		{"OPTIONS /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", "http"},
+		{"OPTIONS * HTTP/1.1\r\n", "http"},
+		{"GET / HTTP/1.1\r\n", "http"},
+		// the method does not go with the version
+		{"PLAY sip:bob@example.com SIP/2.0\r\n", ""},
+		{"INVITE / HTTP/1.1\r\n", ""},
+		{"OPTIONS sip:bob@example.com SIP/3.0\r\n", ""},
+		// the method must be followed by a space
+		{"OPTIONSX sip:bob@example.com SIP/2.0\r\n", ""},
+		{"OPTIONS sip:bob@example.com SIP/2.0 extra\r\n", ""},
+		{"SSH-2.0-OpenSSH\r\n", ""},
+	} {
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("%q matched %q, want %q", tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestHandleRequestLineMaxLine(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleRequestLine(handlerID("sip"), []string{"INVITE"}, "SIP/2.0", 64)
+	mux.NotFound(handlerID("nf"))
+	long := "INVITE sip:" + strings.Repeat("a", 64) + "@example.com SIP/2.0\r\n"
+	if got, _ := resolveID(t, mux, &chunkReader{b: []byte(long), sizes: []int{5}}); got != "nf" {
+		t.Fatalf("a line over the bound matched %q, want NotFound", got)
+	}
+}
+
+func TestHandleRequestLineInvalid(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandleRequestLine(handlerID("x"), nil, "SIP/2.0", 64); err == nil {
+		t.Error("HandleRequestLine accepted no methods")
+	}
+	if err := mux.HandleRequestLine(handlerID("x"), []string{"INVITE"}, " ", 64); err == nil {
+		t.Error("HandleRequestLine accepted no version")
+	}
+}
+
+func TestHandleRequestLineReplays(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleRequestLine(h, []string{"OPTIONS"}, "RTSP/1.0", 256)
+	mux.HandleRequestLine(handlerID("http"), []string{"OPTIONS"}, "HTTP/1.1", 256)
+	client := servePipe(mux)
+	defer client.Close()
+	req := "OPTIONS rtsp://example.com/media.mp4 RTSP/1.0\r\nCSeq: 1\r\n\r\n"
+	// the line arrives in pieces past the common method
+	go writeChunks(client, req[:3], req[3:12], req[12:40], req[40:])
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(req)); got != req {
+		t.Fatalf("the RTSP handler read %q, want the request replayed", got)
+	}
+}
@@ -0,0 +1,106 @@
+package cmux
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// responderTimeout bounds the writing of the response of a ResponderFunc.
+const responderTimeout = 5 * time.Second
+
+// ResponderFunc computes the response to the prefix of a connection, close tells whether the connection
+// is closed once the response is written.
+type ResponderFunc func(prefix []byte, remote net.Addr) (response []byte, close bool)
+
+// HandleResponder handle the responder for the prefix, for the probes such as the health checks or the redirects
+// that are answered at once. The mux calls fn with the sniffed bytes and writes the response itself,
+// with a deadline of 5 seconds, without a handler nor a wrapper of the connection and without the middlewares.
+// If fn does not close, the connection goes on to the handler set by SetResponderNext
+// with the sniffed bytes replayed, it is closed if there is none.
+func (m *CMux) HandleResponder(fn ResponderFunc, prefixes ...string) error {
+	return m.HandlePrefix(&responderHandler{mux: m, fn: fn}, prefixes...)
+}
+
+// SetResponderNext sets the handler of the connections that a ResponderFunc does not close.
+func (m *CMux) SetResponderNext(handler Handler) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.responderNext = handler
+	m.rebuild()
+}
+
+type responderHandler struct {
+	mux *CMux
+	fn  ResponderFunc
+}
+
+// ServeConn answers a connection that was not dispatched by the mux, such as by a ChainHandler.
+func (h *responderHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *responderHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	var prefix []byte
+	if mc, ok := conn.(MatchedConn); ok {
+		prefix = mc.SniffedBytes()
+	}
+	next := h.mux.load().responderNext
+	response, closing := h.fn(prefix, conn.RemoteAddr())
+	if writeResponse(conn, response) != nil || closing || next == nil {
+		conn.Close()
+		return
+	}
+	serveHandler(ctx, next, conn)
+}
+
+func (h *responderHandler) bind(m *CMux) Handler {
+	c := *h
+	c.mux = m
+	return &c
+}
+
+// writeResponse writes the response with the deadline of the responders.
+func writeResponse(conn net.Conn, response []byte) error {
+	if len(response) == 0 {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(responderTimeout))
+	_, err := conn.Write(response)
+	conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// respond answers conn with the responder of matched, or serves it with the next handler if the responder
+// does not close it.
+func (m *CMux) respond(ctx context.Context, t *table, conn net.Conn, matched *route, rh *responderHandler, buf []byte, start time.Time, sniffed time.Duration) (_ net.Conn, err error) {
+	if fn := t.onPanic; fn != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				conn.Close()
+				fn(conn, v, debug.Stack())
+			}
+		}()
+	}
+	t.log(EventMatched, conn, matched.pattern, len(buf), time.Since(start), nil)
+	if c := matched.counter; c != nil {
+		atomic.AddUint64(&c.matched, 1)
+	}
+	// the hook is told of the match before the response is written, like before a handler runs
+	t.matched(conn, buf, matched.pattern, rh)
+	response, closing := rh.fn(buf, conn.RemoteAddr())
+	err = writeResponse(conn, response)
+	if err != nil {
+		return conn, err
+	}
+	if next := t.responderNext; !closing && next != nil {
+		r := *matched
+		r.handler = next
+		return m.serveRoute(ctx, t, withTiming(NewUnreadConn(conn, buf), start, sniffed), &r, buf, false)
+	}
+	conn.Close()
+	t.log(EventDone, conn, matched.pattern, len(buf), time.Since(start), nil)
+	return conn, nil
+}
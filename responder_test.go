@@ -0,0 +1,223 @@
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog records the order of the events of a connection.
+type eventLog struct {
+	mut    sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) get() []string {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// pong answers PING and closes unless keep.
+func pong(l *eventLog, keep bool) ResponderFunc {
+	return func(prefix []byte, remote net.Addr) ([]byte, bool) {
+		l.add("respond " + string(prefix))
+		return []byte("+PONG\r\n"), !keep
+	}
+}
+
+func TestHandleResponderCloses(t *testing.T) {
+	var l eventLog
+	mux := NewCMux()
+	mux.HandleResponder(pong(&l, false), "PING")
+	wrapped := make(chan bool, 1)
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		l.add("match " + pattern)
+		_, ok := asUnreadConn(conn)
+		wrapped <- ok
+	})
+	conn := servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("PING\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "+PONG\r\n" {
+		t.Fatalf("read %q, %v, want the response and the close", b, err)
+	}
+	if got := l.get(); len(got) != 2 || got[0] != "match PING" || got[1] != "respond PING" {
+		t.Fatalf("the events are %q, want the match before the response", got)
+	}
+	if <-wrapped {
+		t.Fatal("the responded conn was wrapped")
+	}
+	if got := mux.Stats().Patterns["PING"].Matched; got != 1 {
+		t.Fatalf("the responder matched %d times", got)
+	}
+}
+
+func TestHandleResponderContinue(t *testing.T) {
+	var l eventLog
+	mux := NewCMux()
+	mux.HandleResponder(pong(&l, true), "PING")
+	active := make(chan int64, 1)
+	next, ch := connChan()
+	mux.SetResponderNext(HandlerFunc(func(conn net.Conn) {
+		l.add("next")
+		active <- mux.Stats().Patterns["PING"].Active
+		next.ServeConn(conn)
+	}))
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		l.add("match " + pattern)
+	})
+	conn := servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("PING\r\n"))
+	if got := readN(t, conn, 7); got != "+PONG\r\n" {
+		t.Fatalf("responded %q", got)
+	}
+	served := recvConn(t, ch)
+	defer served.Close()
+	// the sniffed bytes are replayed before the ones sent after the response
+	go conn.Write([]byte("ECHO x\r\n"))
+	if got := readN(t, served, 14); got != "PING\r\nECHO x\r\n" {
+		t.Fatalf("the next handler read %q", got)
+	}
+	if mc, ok := served.(MatchedConn); !ok || mc.MatchedPattern() != "PING" || string(mc.SniffedBytes()) != "PING" {
+		t.Fatalf("the next handler was given %T without the match", served)
+	}
+	if got := l.get(); len(got) != 3 || got[0] != "match PING" || got[1] != "respond PING" || got[2] != "next" {
+		t.Fatalf("the events are %q, want the match once, the response and the next handler", got)
+	}
+	if n := <-active; n != 1 {
+		t.Fatalf("%d connections active while the next handler runs, want 1", n)
+	}
+	if got := mux.Stats().Patterns["PING"].Matched; got != 1 {
+		t.Fatalf("the responder matched %d times", got)
+	}
+}
+
+func TestHandleResponderContinueWithoutNext(t *testing.T) {
+	var l eventLog
+	mux := NewCMux()
+	mux.HandleResponder(pong(&l, true), "PING")
+	conn := servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("PING\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "+PONG\r\n" {
+		t.Fatalf("read %q, %v, want the response and the close", b, err)
+	}
+}
+
+func TestHandleResponderWriteError(t *testing.T) {
+	var l eventLog
+	mux := NewCMux()
+	mux.HandleResponder(pong(&l, true), "PING")
+	next, ch := connChan()
+	mux.SetResponderNext(next)
+	errs := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	client, server := net.Pipe()
+	go client.Write([]byte("PING"))
+	done := make(chan struct{})
+	go func() {
+		mux.ServeConn(&failingWriteConn{Conn: server})
+		close(done)
+	}()
+	select {
+	case err := <-errs:
+		if err != errWrite {
+			t.Fatalf("reported %v, want the error of the write", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the error of the write was not reported")
+	}
+	<-done
+	client.Close()
+	noConn(t, ch)
+}
+
+func TestHandleResponderClone(t *testing.T) {
+	var l eventLog
+	mux := NewCMux()
+	mux.HandleResponder(pong(&l, true), "PING")
+	mux.SetResponderNext(handlerID("original"))
+	c := mux.Clone()
+	next, ch := connChan()
+	c.SetResponderNext(next)
+	// the responder served outside of the dispatching goes on to the next handler of the clone
+	h, ok := c.HandlerForPrefix("PING")
+	if !ok {
+		t.Fatal("the clone has no responder")
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go h.ServeConn(server)
+	if got := readN(t, client, 7); got != "+PONG\r\n" {
+		t.Fatalf("responded %q", got)
+	}
+	recvConn(t, ch).Close()
+}
+
+var errWrite = errors.New("write failed")
+
+// failingWriteConn is a conn whose writes fail.
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (c *failingWriteConn) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+// probeMux answers the probes with a responder or with a handler doing the same.
+func probeMux(responder bool) *CMux {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ", "POST ")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	if responder {
+		mux.HandleResponder(func(prefix []byte, remote net.Addr) ([]byte, bool) {
+			return response, true
+		}, "HEAD /health")
+	} else {
+		mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+			conn.Read(make([]byte, 64))
+			writeResponse(conn, response)
+			conn.Close()
+		}), "HEAD /health")
+	}
+	return mux
+}
+
+func benchmarkProbe(b *testing.B, responder bool) {
+	mux := probeMux(responder)
+	data := []byte("HEAD /health HTTP/1.1\r\nHost: lb\r\n\r\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mux.ServeConn(newMemConn(data))
+		}
+	})
+}
+
+func BenchmarkResponderProbe(b *testing.B) {
+	benchmarkProbe(b, true)
+}
+
+func BenchmarkHandlerProbe(b *testing.B) {
+	benchmarkProbe(b, false)
+}
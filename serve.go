@@ -0,0 +1,78 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Serve accepts incoming connections on the listener and dispatches each one in a new goroutine.
+// Temporary accept errors are retried with backoff, it returns net.ErrClosed once the listener is closed
+// and ErrMuxClosed once the mux is shut down.
+func (m *CMux) Serve(l net.Listener) error {
+	if !m.conns.addListener(l) {
+		return ErrMuxClosed
+	}
+	defer m.conns.removeListener(l)
+	addr := l.Addr()
+	m.addr.Store(&addr)
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if m.conns.isClosed() {
+				return ErrMuxClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go m.ServeConn(conn)
+	}
+}
+
+// ServeAll serves every listener like Serve and returns once all of them are done.
+// A listener that is closed only ends its own loop, the first other error closes the listeners
+// and is returned. Shutdown and Close stop all of them at once.
+func (m *CMux) ServeAll(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return nil
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- m.Serve(l)
+		}(l)
+	}
+	var first error
+	for range listeners {
+		err := <-errc
+		if errors.Is(err, net.ErrClosed) {
+			continue
+		}
+		if first == nil {
+			first = err
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}
+	if first == nil {
+		return net.ErrClosed
+	}
+	return first
+}
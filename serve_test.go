@@ -0,0 +1,296 @@
+package cmux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails the first accepts with a temporary error, then hands out its conns until it is closed.
+type flakyListener struct {
+	mut      sync.Mutex
+	failures int
+	accepts  []time.Time
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newFlakyListener(failures int) *flakyListener {
+	return &flakyListener{
+		failures: failures,
+		conns:    make(chan net.Conn, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mut.Lock()
+	l.accepts = append(l.accepts, time.Now())
+	if l.failures > 0 {
+		l.failures--
+		l.mut.Unlock()
+		return nil, temporaryError{}
+	}
+	l.mut.Unlock()
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *flakyListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *flakyListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestServeRetriesTemporaryAcceptError(t *testing.T) {
+	mux := NewCMux()
+	served := make(chan []byte, 1)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 4)
+		n, _ := conn.Read(buf)
+		served <- buf[:n]
+	}), "ping")
+
+	l := newFlakyListener(3)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- mux.Serve(l)
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	l.conns <- server
+	go client.Write([]byte("ping"))
+	select {
+	case got := <-served:
+		if string(got) != "ping" {
+			t.Fatalf("served %q, want %q", got, "ping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection accepted after the temporary errors was not served")
+	}
+
+	l.mut.Lock()
+	accepts := l.accepts
+	l.mut.Unlock()
+	if len(accepts) < 4 {
+		t.Fatalf("accepted %d times, want the 3 failures retried", len(accepts))
+	}
+	// the backoff doubles from 5ms
+	for i, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		if d := accepts[i+1].Sub(accepts[i]); d < want {
+			t.Errorf("retry %d after %v, want at least %v", i+1, d, want)
+		}
+	}
+
+	l.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return once the listener was closed")
+	}
+}
+
+func TestServeReturnsErrClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewCMux()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- mux.Serve(l)
+	}()
+	// the mux serves the connections accepted before the close
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	l.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return once the listener was closed")
+	}
+}
+
+func TestServeReturnsErrMuxClosedOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mux := NewCMux()
+	errc := make(chan error, 1)
+	started := make(chan struct{})
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		close(started)
+		conn.Close()
+	}), "x")
+	go func() {
+		errc <- mux.Serve(l)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mux.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrMuxClosed {
+			t.Fatalf("Serve returned %v, want ErrMuxClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return once the mux was shut down")
+	}
+	if err := mux.Serve(l); err != ErrMuxClosed {
+		t.Fatalf("Serve after Shutdown returned %v, want ErrMuxClosed", err)
+	}
+}
+
+func TestServeReturnsPermanentAcceptError(t *testing.T) {
+	want := errors.New("permanent")
+	mux := NewCMux()
+	err := mux.Serve(&errListener{err: want})
+	if err != want {
+		t.Fatalf("Serve returned %v, want %v", err, want)
+	}
+}
+
+type errListener struct {
+	err error
+}
+
+func (l *errListener) Accept() (net.Conn, error) { return nil, l.err }
+func (l *errListener) Close() error              { return nil }
+func (l *errListener) Addr() net.Addr            { return &net.TCPAddr{} }
+
+// dialListener hands a pipe to l and returns the id written back by the handler.
+func dialListener(t testing.TB, l *flakyListener) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	select {
+	case l.conns <- server:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener is not accepting")
+	}
+	go client.Write([]byte("id"))
+	return readN(t, client, 2)
+}
+
+func TestServeAllListeners(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, io.LimitReader(conn, 2))
+	}), "id")
+	a, b := newFlakyListener(0), newFlakyListener(0)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- mux.ServeAll(a, b)
+	}()
+	for _, l := range []*flakyListener{a, b, a, b} {
+		if got := dialListener(t, l); got != "id" {
+			t.Fatalf("served %q", got)
+		}
+	}
+
+	// closing one listener leaves the other one served
+	a.Close()
+	for i := 0; i != 3; i++ {
+		if got := dialListener(t, b); got != "id" {
+			t.Fatalf("served %q after closing the other listener", got)
+		}
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("ServeAll returned %v with a listener left", err)
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mux.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrMuxClosed {
+			t.Fatalf("ServeAll returned %v, want ErrMuxClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return once the mux was shut down")
+	}
+}
+
+func TestServeAllAllClosed(t *testing.T) {
+	mux := NewCMux()
+	a, b := newFlakyListener(0), newFlakyListener(0)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- mux.ServeAll(a, b)
+	}()
+	a.Close()
+	b.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("ServeAll returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return once the listeners were closed")
+	}
+}
+
+func TestServeAllPermanentErrorClosesOthers(t *testing.T) {
+	want := errors.New("permanent")
+	mux := NewCMux()
+	other := newFlakyListener(0)
+	err := mux.ServeAll(other, &errListener{err: want})
+	if err != want {
+		t.Fatalf("ServeAll returned %v, want %v", err, want)
+	}
+	select {
+	case <-other.closed:
+	default:
+		t.Fatal("the other listener was not closed")
+	}
+}
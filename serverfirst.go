@@ -0,0 +1,76 @@
+package cmux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// HandleServerFirst handle the handler that serves the connections whose client sends nothing within the wait,
+// such as the clients of MySQL, SMTP or FTP that wait for the server to speak first.
+// The handler is served with the read deadline cleared and nothing to replay.
+// The wait replaces the read timeout until the first byte, the read timeout then starts again for the sniffing.
+// Only one handler can be registered.
+func (m *CMux) HandleServerFirst(handler Handler, wait time.Duration) error {
+	if err := noBudget("HandleServerFirst", handler); err != nil {
+		return err
+	}
+	if wait <= 0 {
+		return fmt.Errorf("invalid wait %v", wait)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.serverFirst != nil {
+		return fmt.Errorf("server first handler already registered")
+	}
+	m.serverFirst = &route{
+		pattern: "server-first",
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf("server-first"),
+	}
+	m.serverFirstWait = wait
+	m.rebuild()
+	return nil
+}
+
+// awaitClient waits for the first byte of conn, it returns the server first route when nothing arrives within the wait.
+// The byte that arrived is unread to the returned conn.
+func (t *table) awaitClient(conn net.Conn) (net.Conn, *route, error) {
+	conn, timedOut, err := t.waitClient(conn, t.serverFirstWait)
+	if timedOut {
+		return conn, t.serverFirst, nil
+	}
+	return conn, nil, err
+}
+
+// waitClient waits up to wait for the first byte of conn, the byte that arrived is unread to the returned conn
+// and the read timeout starts again. timedOut is reported with the read deadline cleared when nothing arrived.
+func (t *table) waitClient(conn net.Conn, wait time.Duration) (c net.Conn, timedOut bool, err error) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	var b [1]byte
+	var n int
+	for empty := 0; n == 0 && err == nil; empty++ {
+		if empty == maxEmptyReads {
+			return conn, false, &SniffError{Err: io.ErrNoProgress}
+		}
+		n, err = conn.Read(b[:])
+	}
+	if n != 0 {
+		if t.readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		return UnreadConn(conn, b[:n]), false, nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		conn.SetReadDeadline(time.Time{})
+		return conn, true, nil
+	}
+	if err == io.EOF {
+		return conn, false, ErrEmptyConn
+	}
+	return conn, false, &SniffError{Err: err}
+}
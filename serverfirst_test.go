@@ -0,0 +1,97 @@
+package cmux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleServerFirstSilentClient(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	mux := NewCMux()
+	mysql, ch := connChan()
+	if err := mux.HandleServerFirst(mysql, wait); err != nil {
+		t.Fatal(err)
+	}
+	mux.HandleHTTP1(handlerID("http"))
+	// the wait takes precedence over a shorter read timeout
+	mux.SetReadTimeout(10 * time.Millisecond)
+
+	start := time.Now()
+	client := servePipe(mux)
+	defer client.Close()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < wait {
+		t.Fatalf("the silent client was dispatched after %v, before the wait of %v", elapsed, wait)
+	}
+	if _, buf := UnwrapUnreadConn(conn); len(buf) != 0 {
+		t.Fatalf("the server first handler got %q to replay", buf)
+	}
+
+	// the server speaks first and the read deadline is cleared
+	go conn.Write([]byte("greeting"))
+	if got := readN(t, client, 8); got != "greeting" {
+		t.Fatalf("the client read %q", got)
+	}
+	go func() {
+		time.Sleep(2 * wait)
+		client.Write([]byte("login"))
+	}()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read after the wait: %v, want the deadline cleared", err)
+	}
+}
+
+func TestHandleServerFirstChattyClient(t *testing.T) {
+	const wait = time.Second
+	mux := NewCMux()
+	mux.HandleServerFirst(handlerID("mysql"), wait)
+	h, ch := connChan()
+	mux.HandleHTTP1(h)
+
+	start := time.Now()
+	client := servePipe(mux)
+	defer client.Close()
+	go writeChunks(client, "G", "ET / HTTP/1.1\r\n")
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed >= wait {
+		t.Fatalf("the chatty client was dispatched after %v", elapsed)
+	}
+	if got := readN(t, conn, 16); got != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("the HTTP handler read %q, want the first byte replayed too", got)
+	}
+}
+
+func TestHandleServerFirstOnce(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandleServerFirst(handlerID("mysql"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.HandleServerFirst(handlerID("smtp"), time.Second); err == nil {
+		t.Fatal("a second server first handler was accepted")
+	}
+	if err := NewCMux().HandleServerFirst(handlerID("ftp"), 0); err == nil {
+		t.Fatal("a zero wait was accepted")
+	}
+}
+
+func TestHandleServerFirstClientCloses(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleServerFirst(h, time.Second)
+	empty := make(chan struct{}, 1)
+	mux.OnEmptyConn(func(conn net.Conn) {
+		empty <- struct{}{}
+	})
+	client := servePipe(mux)
+	client.Close()
+	select {
+	case <-empty:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a client closing without a byte was not reported as empty")
+	}
+	noConn(t, ch)
+}
@@ -0,0 +1,117 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrMuxClosed = fmt.Errorf("mux closed")
+
+// connTracker keeps the connections being served and the listeners being served on.
+type connTracker struct {
+	mut       sync.Mutex
+	conns     map[net.Conn]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+	idle      chan struct{}
+}
+
+// add tracks conn, it reports false once the mux is shut down.
+func (t *connTracker) add(conn net.Conn) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	delete(t.conns, conn)
+	if len(t.conns) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+func (t *connTracker) addListener(l net.Listener) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.listeners == nil {
+		t.listeners = map[net.Listener]struct{}{}
+	}
+	t.listeners[l] = struct{}{}
+	return true
+}
+
+func (t *connTracker) removeListener(l net.Listener) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	delete(t.listeners, l)
+}
+
+func (t *connTracker) isClosed() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.closed
+}
+
+// close stops tracking new connections and closes the listeners,
+// the returned channel is closed once no connection is left.
+func (t *connTracker) close() <-chan struct{} {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.closed = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	t.listeners = nil
+	idle := make(chan struct{})
+	if len(t.conns) == 0 {
+		close(idle)
+	} else if t.idle != nil {
+		idle = t.idle
+	} else {
+		t.idle = idle
+	}
+	return idle
+}
+
+func (t *connTracker) closeConns() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown stops the mux gracefully, it closes the listeners passed to Serve,
+// closes the new connections and waits for the connections being served to be done.
+// It returns the error of the ctx if the ctx is done first, Close can then cut the remaining connections.
+func (m *CMux) Shutdown(ctx context.Context) error {
+	idle := m.conns.close()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the mux immediately, it closes the listeners passed to Serve and every connection being served.
+func (m *CMux) Close() error {
+	m.conns.close()
+	m.conns.closeConns()
+	return nil
+}
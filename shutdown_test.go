@@ -0,0 +1,92 @@
+package cmux
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowHandler is a handler that signals started and holds the connection until release is closed.
+func slowHandler(started chan<- net.Conn, release <-chan struct{}) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		started <- conn
+		<-release
+		conn.Close()
+	})
+}
+
+func TestShutdownWaitsForHandler(t *testing.T) {
+	mux := NewCMux()
+	started := make(chan net.Conn, 1)
+	release := make(chan struct{})
+	mux.HandlePrefix(slowHandler(started, release), "slow")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("slow"))
+	recvConn(t, started)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mux.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the handler", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// new connections are closed while the shutdown waits
+	late := servePipe(mux)
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := late.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from a connection after Shutdown: %v, want io.EOF", err)
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the handler returned")
+	}
+}
+
+func TestShutdownExpiredThenClose(t *testing.T) {
+	mux := NewCMux()
+	started := make(chan net.Conn, 1)
+	release := make(chan struct{})
+	defer close(release)
+	mux.HandlePrefix(slowHandler(started, release), "slow")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("slow"))
+	conn := recvConn(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := mux.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+	if err := mux.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the sniffed prefix is still replayed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the slow connection was not closed by Close")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the client of the slow connection read %v, want io.EOF", err)
+	}
+}
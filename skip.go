@@ -0,0 +1,69 @@
+package cmux
+
+import (
+	"io"
+	"strings"
+)
+
+// SetSkipLeading discards up to max leading bytes of a connection that are in the cutset before the matching,
+// such as the stray "\r\n" sent by some clients before their first command, zero max disables it.
+// The discarded bytes are not replayed to the handler unless SetSkipLeadingReplay is set.
+func (m *CMux) SetSkipLeading(cutset string, max int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.skipCutset = cutset
+	m.skipMax = max
+	m.rebuild()
+}
+
+// SetSkipLeadingReplay sets whether the bytes discarded by SetSkipLeading are replayed to the handler.
+func (m *CMux) SetSkipLeadingReplay(replay bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.skipReplay = replay
+	m.rebuild()
+}
+
+// skipReader drops the leading bytes of r that are in the cutset, up to left bytes.
+type skipReader struct {
+	r       io.Reader
+	cutset  string
+	left    int
+	skipped []byte
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	if s.left == 0 {
+		return s.r.Read(p)
+	}
+	for {
+		n, err := s.r.Read(p)
+		i := s.trim(p[:n])
+		if i < n {
+			return copy(p, p[i:n]), err
+		}
+		// only skipped bytes were read, keep reading so that the sniffing does not see an empty read
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		if s.left == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// trim drops the leading bytes of p that are in the cutset and returns their number,
+// the skipping is over once p has another byte.
+func (s *skipReader) trim(p []byte) int {
+	i := 0
+	for i < len(p) && s.left > 0 && strings.IndexByte(s.cutset, p[i]) >= 0 {
+		i++
+		s.left--
+	}
+	s.skipped = append(s.skipped, p[:i]...)
+	if i < len(p) {
+		// the bytes after the skipped ones start the matching
+		s.left = 0
+	}
+	return i
+}
@@ -0,0 +1,63 @@
+package cmux
+
+import (
+	"testing"
+)
+
+func TestSkipLeading(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	if got := matchOf(t, mux, "\r\nGET /"); got != "" {
+		t.Fatalf("matched %q without skipping, want NotFound", got)
+	}
+	mux.SetSkipLeading(" \r\n", 4)
+	for b, want := range map[string]string{
+		"\r\nGET /":     "http",
+		" \r\n GET /":   "http",
+		"GET /":         "http",
+		"\x16\x03\x01":  "tls",
+		"\r\n\x16\x03":  "tls",
+		"\r\n\r\nGET ":  "http",
+		"\r\n\r\n GET ": "",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+	// the leading bytes spread over the reads
+	got, prefix := resolveID(t, mux, &chunkReader{b: []byte("\r\n GET /"), sizes: []int{1, 2, 1}})
+	if got != "http" {
+		t.Fatalf("the skipping over the reads matched %q", got)
+	}
+	if prefix != "GET " {
+		t.Fatalf("the sniffed bytes are %q, want the skipped bytes dropped", prefix)
+	}
+
+	mux.SetSkipLeading("", 0)
+	if got := matchOf(t, mux, "\r\nGET /"); got != "" {
+		t.Fatalf("matched %q after disabling the skipping", got)
+	}
+}
+
+func TestSkipLeadingReplay(t *testing.T) {
+	for _, replay := range []bool{false, true} {
+		mux := NewCMux()
+		h, ch := connChan()
+		mux.HandlePrefix(h, "GET ")
+		mux.SetSkipLeading("\r\n", 8)
+		mux.SetSkipLeadingReplay(replay)
+		client := servePipe(mux)
+		go client.Write([]byte("\r\n\r\nGET /"))
+		conn := recvConn(t, ch)
+		want := "GET /"
+		if replay {
+			want = "\r\n\r\nGET /"
+		}
+		if got := readN(t, conn, len(want)); got != want {
+			t.Errorf("with the replay %v the handler read %q, want %q", replay, got, want)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,231 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// BudgetOption bounds the sniffing for a registration, see WithBudget.
+type BudgetOption func(b *sniffBudget)
+
+type sniffBudget struct {
+	maxBytes int
+	maxWait  time.Duration
+}
+
+// WithMaxBytes bounds the bytes a matcher is fed below its max bytes, it is rejected by the prefixes,
+// which are always given their own length.
+func WithMaxBytes(n int) BudgetOption {
+	return func(b *sniffBudget) {
+		b.maxBytes = n
+	}
+}
+
+// WithMaxWait bounds the time since the sniffing started within which the registration may match,
+// once it is over the registration is dropped and no longer holds the decision back.
+func WithMaxWait(d time.Duration) BudgetOption {
+	return func(b *sniffBudget) {
+		b.maxWait = d
+	}
+}
+
+// WithBudget returns the handler with its own sniffing budget, for HandlePrefix, HandlePrefixTerminal,
+// HandlePrefixReplace, HandleMatcher and the other registrations of a matcher such as HandleSNI,
+// the other registrations reject it.
+// A registration out of its budget is dropped and the connection is decided by the ones still in play,
+// at once if none is left, even before its first byte. The budgets only apply to the connections,
+// not to MatchBytes nor a Sniffer.
+func WithBudget(handler Handler, opts ...BudgetOption) Handler {
+	h := &budgetHandler{Handler: handler}
+	for _, opt := range opts {
+		opt(&h.budget)
+	}
+	return h
+}
+
+type budgetHandler struct {
+	Handler
+	budget sniffBudget
+}
+
+func (h *budgetHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	serveHandler(ctx, h.Handler, conn)
+}
+
+// budgetOf returns the handler under WithBudget and its budget, the budget is zero for another handler.
+func budgetOf(handler Handler) (Handler, sniffBudget, error) {
+	h, ok := handler.(*budgetHandler)
+	if !ok {
+		return handler, sniffBudget{}, nil
+	}
+	if h.budget.maxWait < 0 {
+		return nil, h.budget, fmt.Errorf("invalid max wait %v", h.budget.maxWait)
+	}
+	if h.budget.maxBytes < 0 {
+		return nil, h.budget, fmt.Errorf("invalid max bytes %d", h.budget.maxBytes)
+	}
+	return h.Handler, h.budget, nil
+}
+
+// prefixBudget returns the handler under WithBudget and its max wait for a registration of prefixes,
+// with ok set if the handler is of WithBudget.
+func prefixBudget(handler Handler) (_ Handler, maxWait time.Duration, ok bool, err error) {
+	_, ok = handler.(*budgetHandler)
+	handler, b, err := budgetOf(handler)
+	if err != nil {
+		return nil, 0, ok, err
+	}
+	if b.maxBytes != 0 {
+		return nil, 0, ok, fmt.Errorf("max bytes %d for prefixes, WithMaxBytes is only for the matchers", b.maxBytes)
+	}
+	return handler, b.maxWait, ok, nil
+}
+
+// noBudget returns the error for the first of the handlers of WithBudget, which the registration cannot apply.
+func noBudget(registration string, handlers ...Handler) error {
+	for _, handler := range handlers {
+		if _, ok := handler.(*budgetHandler); ok {
+			return fmt.Errorf("%s has no sniffing budget, WithBudget is not supported", registration)
+		}
+	}
+	return nil
+}
+
+// live reports whether the route may still match elapsed since the sniffing started.
+func (r *route) live(elapsed time.Duration) bool {
+	return r.maxWait == 0 || elapsed <= r.maxWait
+}
+
+// buildWaits collects the budgets of the routes, the sniffing wakes up as each of them passes.
+func (t *table) buildWaits() {
+	seen := map[time.Duration]bool{}
+	add := func(d time.Duration) {
+		if d > 0 && !seen[d] {
+			seen[d] = true
+			t.waits = append(t.waits, d)
+		}
+	}
+	for _, r := range t.prefixes {
+		add(r.maxWait)
+	}
+	for _, mr := range t.matchers {
+		add(mr.maxWait)
+	}
+	sort.Slice(t.waits, func(i, j int) bool {
+		return t.waits[i] < t.waits[j]
+	})
+}
+
+// dropped reports whether every matcher failed or is out of time.
+func (t *table) dropped(states []matchState, elapsed time.Duration) bool {
+	for i, mr := range t.matchers {
+		if states[i] != matchFailed && mr.live(elapsed) {
+			return false
+		}
+	}
+	return true
+}
+
+// expire drops the registrations that are out of time while no byte arrived,
+// it reports true if the matching is over, such as when every registration was dropped.
+func (s *sniffState) expire() bool {
+	t := s.t
+	elapsed := s.elapsed()
+	if !s.exactDone && !t.canExtendFor(s.buf[:s.off], s.addr, s.local, elapsed) {
+		s.exactDone = true
+		if s.foldDone && s.maskDone {
+			s.prefixDone = true
+			s.matched = longestRoute(s.limited, s.matched, s.folded, s.masked)
+		}
+	}
+	if s.off == 0 {
+		// nothing is decided before the first byte, unless nothing is left to match it
+		return s.prefixDone && t.defaultRoute == nil && t.tlsDefault == nil && t.dropped(s.states, elapsed)
+	}
+	return s.step()
+}
+
+// elapsed returns the time since the sniffing started, zero without budgets.
+func (s *sniffState) elapsed() time.Duration {
+	if s.start.IsZero() {
+		return 0
+	}
+	return time.Since(s.start)
+}
+
+// sniffClock wakes the sniffing of a connection up as the budgets pass, by the read deadline.
+type sniffClock struct {
+	ctx   context.Context
+	conn  net.Conn
+	start time.Time
+	// limit is the deadline of SetReadTimeout, zero if there is none.
+	limit time.Time
+	waits []time.Duration
+	armed time.Time
+}
+
+// sniffClock returns the clock of the sniffing of conn, nil if t has no budgets.
+func (t *table) sniffClock(ctx context.Context, conn net.Conn) *sniffClock {
+	if len(t.waits) == 0 {
+		return nil
+	}
+	c := &sniffClock{
+		ctx:   ctx,
+		conn:  conn,
+		start: time.Now(),
+		waits: t.waits,
+	}
+	if t.readTimeout > 0 {
+		c.limit = c.start.Add(t.readTimeout)
+	}
+	return c
+}
+
+// arm sets the read deadline to the next budget to pass after elapsed, or to the limit.
+func (c *sniffClock) arm(elapsed time.Duration) {
+	if c == nil {
+		return
+	}
+	deadline := c.limit
+	for _, w := range c.waits {
+		if w >= elapsed {
+			if at := c.start.Add(w); deadline.IsZero() || at.Before(deadline) {
+				deadline = at
+			}
+			break
+		}
+	}
+	if !deadline.Equal(c.armed) {
+		c.setDeadline(deadline)
+	}
+}
+
+// woke reports whether err is the wake up of a budget rather than the end of the sniffing.
+func (c *sniffClock) woke(err error) bool {
+	if c == nil || c.ctx.Err() != nil {
+		return false
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+	return c.limit.IsZero() || time.Now().Before(c.limit)
+}
+
+// disarm restores the deadline of SetReadTimeout.
+func (c *sniffClock) disarm() {
+	if c != nil && !c.limit.Equal(c.armed) {
+		c.setDeadline(c.limit)
+	}
+}
+
+func (c *sniffClock) setDeadline(deadline time.Time) {
+	c.armed = deadline
+	c.conn.SetReadDeadline(deadline)
+	// the deadline set by the cancellation of the ctx may have just been replaced
+	if c.ctx.Err() != nil {
+		c.conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
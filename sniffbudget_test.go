@@ -0,0 +1,307 @@
+package cmux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// headersMatcher accepts an HTTP request with a Host header, it waits for the end of the headers.
+var headersMatcher = MatcherFunc(func(b []byte) (bool, bool) {
+	i := bytes.Index(b, []byte("\r\n\r\n"))
+	if i < 0 {
+		return false, true
+	}
+	return bytes.Contains(b[:i], []byte("\r\nHost: ")), false
+})
+
+// budgetMux routes a 3 bytes binary magic and a deep HTTP matcher with their own budgets.
+func budgetMux(t testing.TB, magicWait, hostWait time.Duration) (mux *CMux, magic, host, notFound chan net.Conn) {
+	mux = NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	h, magic := connChan()
+	err := mux.HandlePrefix(WithBudget(h, WithMaxWait(magicWait)), "\xca\xfe\x01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, host = connChan()
+	err = mux.HandleMatcher(WithBudget(h, WithMaxWait(hostWait)), headersMatcher, 8<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, notFound = connChan()
+	mux.NotFound(h)
+	return mux, magic, host, notFound
+}
+
+// sendSlowly writes the chunks to conn with the delay before each one but the first.
+func sendSlowly(conn net.Conn, delay time.Duration, chunks ...string) {
+	for i, chunk := range chunks {
+		if i != 0 {
+			time.Sleep(delay)
+		}
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			return
+		}
+	}
+}
+
+func TestBudgetFastClients(t *testing.T) {
+	mux, magic, host, _ := budgetMux(t, 50*time.Millisecond, 50*time.Millisecond)
+	conn := servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("\xca\xfe\x01\x00"))
+	recvConn(t, magic).Close()
+
+	conn = servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	recvConn(t, host).Close()
+}
+
+func TestBudgetSlowClientDropsMatcher(t *testing.T) {
+	const (
+		hostWait = 50 * time.Millisecond
+		delay    = 150 * time.Millisecond
+	)
+	// the magic has no time budget, it keeps matching after the HTTP matcher dropped out
+	mux, magic, host, notFound := budgetMux(t, 0, hostWait)
+	conn := servePipe(mux)
+	defer conn.Close()
+	start := time.Now()
+	go sendSlowly(conn, delay, "\xca", "\xfe\x01")
+	got := recvConn(t, magic)
+	defer got.Close()
+	if d := time.Since(start); d < delay {
+		t.Fatalf("dispatched after %v, before the magic was complete", d)
+	}
+	if b := readN(t, got, 3); b != "\xca\xfe\x01" {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, host)
+	noConn(t, notFound)
+
+	// the slow HTTP client runs out of the budget of the matcher
+	conn = servePipe(mux)
+	defer conn.Close()
+	start = time.Now()
+	go sendSlowly(conn, delay, "GET / HTTP/1.1\r\n", "Host: example.com\r\n\r\n")
+	got = recvConn(t, notFound)
+	defer got.Close()
+	if d := time.Since(start); d < hostWait || d >= delay {
+		t.Fatalf("not found after %v, want once the matcher dropped out after %v", d, hostWait)
+	}
+	if b := readN(t, got, 16); b != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("replayed %q", b)
+	}
+	noConn(t, host)
+}
+
+func TestBudgetEverythingDrops(t *testing.T) {
+	const (
+		magicWait = 30 * time.Millisecond
+		hostWait  = 60 * time.Millisecond
+	)
+	mux, magic, host, notFound := budgetMux(t, magicWait, hostWait)
+	tests := []struct {
+		name   string
+		chunks []string
+		// earliest is when the last registration still in play drops
+		earliest time.Duration
+	}{
+		{"silent client", nil, hostWait},
+		{"slow magic", []string{"\xca", "\xfe\x01"}, hostWait},
+		{"slow HTTP", []string{"GET / HTTP/1.1\r\n", "Host: example.com\r\n\r\n"}, hostWait},
+	}
+	for _, tt := range tests {
+		conn := servePipe(mux)
+		start := time.Now()
+		go sendSlowly(conn, 500*time.Millisecond, tt.chunks...)
+		// the NotFound handler is not held back by the bytes to come, even before the first one
+		recvConn(t, notFound).Close()
+		d := time.Since(start)
+		if d < tt.earliest || d > tt.earliest+300*time.Millisecond {
+			t.Fatalf("%s: not found after %v, want soon after %v", tt.name, d, tt.earliest)
+		}
+		conn.Close()
+	}
+	noConn(t, magic)
+	noConn(t, host)
+}
+
+func TestBudgetMatcherMaxBytes(t *testing.T) {
+	var mut sync.Mutex
+	longest := 0
+	mux := NewCMux()
+	h, ch := connChan()
+	err := mux.HandleMatcher(WithBudget(h, WithMaxBytes(4)), MatcherFunc(func(b []byte) (bool, bool) {
+		mut.Lock()
+		if len(b) > longest {
+			longest = len(b)
+		}
+		mut.Unlock()
+		return len(b) >= 4, len(b) < 4
+	}), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := servePipe(mux)
+	defer conn.Close()
+	go conn.Write([]byte("abcdefgh"))
+	recvConn(t, ch).Close()
+	mut.Lock()
+	defer mut.Unlock()
+	if longest != 4 {
+		t.Fatalf("the matcher was fed %d bytes, want the 4 of WithMaxBytes", longest)
+	}
+}
+
+func TestBudgetInvalid(t *testing.T) {
+	mux := NewCMux()
+	if err := mux.HandlePrefix(WithBudget(handlerID("a"), WithMaxBytes(8)), "abc"); err == nil {
+		t.Fatal("max bytes were accepted for a prefix")
+	}
+	if err := mux.HandlePrefix(WithBudget(handlerID("a"), WithMaxWait(-time.Second)), "abc"); err == nil {
+		t.Fatal("a negative max wait was accepted")
+	}
+	if err := mux.HandleMatcher(WithBudget(handlerID("a"), WithMaxBytes(-1)), headersMatcher, 8); err == nil {
+		t.Fatal("negative max bytes were accepted")
+	}
+	if len(mux.Prefixes()) != 0 || len(mux.load().matchers) != 0 {
+		t.Fatal("an invalid budget registered something")
+	}
+	// the handler under the budget is registered
+	mux.HandlePrefix(WithBudget(handlerID("a"), WithMaxWait(time.Second)), "abc")
+	if h, ok := mux.HandlerForPrefix("abc"); !ok || h != handlerID("a") {
+		t.Fatalf("registered %v", h)
+	}
+}
+
+func TestBudgetUnsupported(t *testing.T) {
+	h := WithBudget(handlerID("a"), WithMaxWait(time.Second))
+	cert := tls.Certificate{}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	for name, register := range map[string]func(mux *CMux) error{
+		"HandlePrefixNamed":   func(mux *CMux) error { return mux.HandlePrefixNamed("a", h, "abc") },
+		"HandlePrefixStrip":   func(mux *CMux) error { return mux.HandlePrefixStrip(h, "abc") },
+		"HandlePrefixFold":    func(mux *CMux) error { return mux.HandlePrefixFold(h, "abc") },
+		"HandlePrefixFrom":    func(mux *CMux) error { return mux.HandlePrefixFrom(h, []string{"192.0.2.0/24"}, "abc") },
+		"HandlePrefixLocal":   func(mux *CMux) error { return mux.HandlePrefixLocal(h, []string{"192.0.2.1"}, "abc") },
+		"HandlePrefixLimited": func(mux *CMux) error { return mux.HandlePrefixLimited(h, 1, "abc") },
+		"HandlePrefixRate":    func(mux *CMux) error { return mux.HandlePrefixRate(h, 1, 1, "abc") },
+		"HandlePrefixTLS":     func(mux *CMux) error { return mux.HandlePrefixTLS(h, cfg, "abc") },
+		"HandleSNITLS":        func(mux *CMux) error { return mux.HandleSNITLS(h, cfg, "example.com") },
+		"HandlePattern":       func(mux *CMux) error { return mux.HandlePattern(h, []byte("abc"), []byte("\xff\xff\xff")) },
+		"HandleChain":         func(mux *CMux) error { return mux.HandleChain([]string{"abc"}, h) },
+		"HandleAmbiguous":     func(mux *CMux) error { return mux.HandleAmbiguous(handlerID("b"), h, dnsLike, time.Second, "abc") },
+		"HandleDefault":       func(mux *CMux) error { return mux.HandleDefault(h) },
+		"HandleTLSDefault":    func(mux *CMux) error { return mux.HandleTLSDefault(h) },
+		"HandleServerFirst":   func(mux *CMux) error { return mux.HandleServerFirst(h, time.Second) },
+		"HandleALPN":          func(mux *CMux) error { return mux.HandleALPN(h, "h2") },
+		"HandleOriginalDst":   func(mux *CMux) error { return mux.HandleOriginalDst(h, 443) },
+		"NotFound":            func(mux *CMux) error { return mux.NotFound(h) },
+		"SetRoutes":           func(mux *CMux) error { return mux.SetRoutes(map[string]Handler{"abc": h}, nil) },
+	} {
+		mux := NewCMux()
+		if err := register(mux); err == nil {
+			t.Errorf("%s accepted a handler of WithBudget", name)
+		}
+		if s := mux.String(); s != NewCMux().String() {
+			t.Errorf("%s registered a handler of WithBudget:\n%s", name, s)
+		}
+	}
+}
+
+func TestBudgetTerminalAndReplace(t *testing.T) {
+	const maxWait = 30 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	h, ch := connChan()
+	if err := mux.HandlePrefixTerminal(WithBudget(h, WithMaxWait(maxWait)), "\xca\xfe"); err != nil {
+		t.Fatal(err)
+	}
+	if r := mux.load().prefixes["\xca\xfe"]; !r.terminal || r.maxWait != maxWait {
+		t.Fatalf("registered terminal %v with the max wait %v", r.terminal, r.maxWait)
+	}
+	// the replacement keeps the budget of the registration, unless it has its own
+	mux.HandlePrefixReplace(h, "\xca\xfe")
+	if r := mux.load().prefixes["\xca\xfe"]; !r.terminal || r.maxWait != maxWait {
+		t.Fatalf("replaced with terminal %v and the max wait %v", r.terminal, r.maxWait)
+	}
+	mux.HandlePrefixReplace(WithBudget(h), "\xca\xfe")
+	if r := mux.load().prefixes["\xca\xfe"]; !r.terminal || r.maxWait != 0 {
+		t.Fatalf("replaced with terminal %v and the max wait %v, want no budget", r.terminal, r.maxWait)
+	}
+	if _, err := mux.HandlePrefixReplace(WithBudget(h, WithMaxBytes(2)), "\xca\xfe"); err == nil {
+		t.Fatal("max bytes were accepted for the replacement of a prefix")
+	}
+	mux.HandlePrefixReplace(WithBudget(h, WithMaxWait(maxWait)), "\xca\xfe")
+	errs := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	conn := servePipe(mux)
+	defer conn.Close()
+	go sendSlowly(conn, 500*time.Millisecond, "\xca", "\xfe")
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("reported %v, want the terminal prefix dropped", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the terminal prefix was not dropped")
+	}
+	noConn(t, ch)
+}
+
+func TestBudgetMatcherSingleWait(t *testing.T) {
+	const maxWait = 40 * time.Millisecond
+	mux := NewCMux()
+	mux.HandleMatcher(WithBudget(handlerID("a"), WithMaxWait(maxWait)), headersMatcher, 8<<10)
+	tbl := mux.load()
+	// the waits of the sniffing and the drops of the matcher read the one of the route
+	if mr := tbl.matchers[0]; mr.route.maxWait != maxWait {
+		t.Fatalf("the route of the matcher has the max wait %v", mr.route.maxWait)
+	}
+	if len(tbl.waits) != 1 || tbl.waits[0] != maxWait {
+		t.Fatalf("the sniffing wakes up after %v", tbl.waits)
+	}
+	states := []matchState{matchPending}
+	if tbl.dropped(states, maxWait) || !tbl.dropped(states, maxWait+1) {
+		t.Fatal("the matcher is not dropped once its max wait is over")
+	}
+}
+
+func TestBudgetPrefixDrops(t *testing.T) {
+	const maxWait = 30 * time.Millisecond
+	mux := NewCMux()
+	mux.SetReadTimeout(5 * time.Second)
+	h, magic := connChan()
+	mux.HandlePrefix(WithBudget(h, WithMaxWait(maxWait)), "\xca\xfe\x01")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	errs := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	conn := servePipe(mux)
+	defer conn.Close()
+	start := time.Now()
+	go sendSlowly(conn, 500*time.Millisecond, "\xca", "\xfe\x01")
+	select {
+	case err := <-errs:
+		if d := time.Since(start); d < maxWait || d > maxWait+300*time.Millisecond {
+			t.Fatalf("not found after %v, want soon after %v", d, maxWait)
+		}
+		var nf *NotFoundError
+		if !errors.As(err, &nf) || string(nf.Prefix) != "\xca" {
+			t.Fatalf("reported %v, want the not found of the bytes sniffed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not dropped")
+	}
+	noConn(t, magic)
+}
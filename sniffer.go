@@ -0,0 +1,277 @@
+package cmux
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Sniffer matches the bytes fed to it against the routes of a mux like Handler does with a reader,
+// such as the payloads of captured packets. It is bound to the routes of the mux when it is created
+// or reset, and it does not allocate while it is fed. A Sniffer must not be used concurrently.
+type Sniffer struct {
+	m       *CMux
+	s       sniffState
+	skip    skipReader
+	decided bool
+}
+
+// NewSniffer create a new Sniffer of the routes of the mux.
+func (m *CMux) NewSniffer() *Sniffer {
+	sn := &Sniffer{m: m}
+	sn.Reset()
+	return sn
+}
+
+// Reset forgets the bytes fed so far and binds the Sniffer to the current routes of the mux.
+func (sn *Sniffer) Reset() {
+	sn.reset(sn.m.load(), nil, nil)
+}
+
+// reset binds the Sniffer to t and the routes restricted to the addresses.
+func (sn *Sniffer) reset(t *table, addr, local net.Addr) {
+	size := t.sniffLength
+	if t.growLength > size {
+		size = t.growLength
+	}
+	buf := sn.s.buf[:cap(sn.s.buf)]
+	if len(buf) < size {
+		buf = make([]byte, size)
+	}
+	sn.s.init(t, addr, local, buf[:t.sniffLength])
+	skipped := sn.skip.skipped[:0]
+	if cap(skipped) < t.skipMax {
+		skipped = make([]byte, 0, t.skipMax)
+	}
+	sn.skip = skipReader{cutset: t.skipCutset, left: t.skipMax, skipped: skipped}
+	sn.decided = t.sniffLength == 0 && t.growLength == 0
+}
+
+// Feed matches the next bytes of the stream, it can be called with chunks of any size.
+// It reports decided once the handler is known, the bytes fed after that are ignored.
+func (sn *Sniffer) Feed(p []byte) (decided bool) {
+	if sn.decided {
+		return true
+	}
+	if sn.skip.left > 0 {
+		p = p[sn.skip.trim(p):]
+	}
+	s := &sn.s
+	for len(p) != 0 {
+		n := copy(s.buf[s.off:], p)
+		p = p[n:]
+		if s.add(n) || s.step() {
+			sn.decided = true
+			return true
+		}
+	}
+	return false
+}
+
+// Result returns the handler of the bytes fed so far and the registration that won, as Handler does
+// once the stream ends. It is the NotFound handler with an empty pattern when nothing matches,
+// or a *NotFoundError whose Prefix is only valid until the Sniffer is fed or reset.
+// It returns io.EOF if nothing was fed.
+func (sn *Sniffer) Result() (Handler, string, error) {
+	s := &sn.s
+	matched, fed := sn.route()
+	if !fed {
+		return nil, "", io.EOF
+	}
+	if matched == nil {
+		if s.t.notFound != nil {
+			return s.t.notFound, "", nil
+		}
+		prefix := s.buf[:s.off]
+		if s.t.skipReplay && len(sn.skip.skipped) != 0 {
+			prefix = append(sn.skip.skipped[:len(sn.skip.skipped):len(sn.skip.skipped)], prefix...)
+		}
+		return nil, "", &NotFoundError{Prefix: prefix}
+	}
+	return matched.handler, matched.pattern, nil
+}
+
+// route returns the route of the bytes fed so far, nil if nothing matches, and whether anything was fed.
+func (sn *Sniffer) route() (matched *route, fed bool) {
+	s := &sn.s
+	matched = s.result()
+	if matched == nil && !sn.decided && s.off == 0 {
+		return nil, false
+	}
+	if matched != nil && matched.excluded {
+		matched = nil
+	}
+	return matched, true
+}
+
+// sniffState is the progress of the matching of a stream, its bytes are appended to buf
+// and passed to add as they arrive.
+type sniffState struct {
+	t           *table
+	addr        net.Addr
+	local       net.Addr
+	exactDone   bool
+	foldDone    bool
+	maskDone    bool
+	prefixDone  bool
+	matched     *route
+	limited     *route
+	folded      *route
+	masked      *route
+	lower       []byte
+	states      []matchState
+	exactLength int
+	off         int
+	want        int
+	buf         []byte
+	// start is when the sniffing of a connection with budgets started, see WithBudget.
+	start time.Time
+}
+
+// init starts the matching with t, it reuses the buffers of the previous matching that fit.
+func (s *sniffState) init(t *table, addr, local net.Addr, buf []byte) {
+	lower, states := s.lower, s.states
+	*s = sniffState{
+		t:           t,
+		addr:        addr,
+		local:       local,
+		exactDone:   len(t.sorted) == 0,
+		foldDone:    len(t.foldSorted) == 0,
+		maskDone:    len(t.masks) == 0,
+		exactLength: t.exactLength,
+		buf:         buf,
+	}
+	s.prefixDone = s.exactDone && s.foldDone && s.maskDone
+	if !s.foldDone {
+		if cap(lower) < t.foldLength {
+			lower = make([]byte, t.foldLength)
+		}
+		s.lower = lower[:t.foldLength]
+	}
+	if cap(states) < len(t.matchers) {
+		states = make([]matchState, len(t.matchers))
+	}
+	s.states = states[:len(t.matchers)]
+	for i := range s.states {
+		s.states[i] = matchPending
+	}
+}
+
+// add matches the i bytes appended to buf, it reports true if a prefix match ends the matching.
+func (s *sniffState) add(i int) bool {
+	t := s.t
+	s.off += i
+	buf, off := s.buf, s.off
+	elapsed := s.elapsed()
+	if off == i {
+		if r := t.byFirst[buf[0]]; r != nil {
+			s.matched = r
+			s.prefixDone = true
+			return true
+		}
+		s.exactLength = t.firstLength[buf[0]]
+	}
+	if !s.exactDone {
+		// look up every length that was completed by this read, a prefix may be split across reads
+		s.matched = lookupPrefix(t.prefixes, buf[:off], off-i, s.exactLength, s.matched, t.first, elapsed)
+		if s.matched != nil && s.matched.terminal {
+			s.prefixDone = true
+			return true
+		}
+		if (s.addr != nil || s.local != nil) && len(t.restricted) != 0 {
+			s.limited = t.lookupRestricted(buf[:off], off-i, s.addr, s.local, s.limited, t.first)
+		}
+		if !t.canExtendFor(buf[:off], s.addr, s.local, elapsed) {
+			s.exactDone = true
+		}
+	}
+	if !s.foldDone {
+		n := off
+		if n > len(s.lower) {
+			n = len(s.lower)
+		}
+		for j := off - i; j < n; j++ {
+			s.lower[j] = toLower(buf[j])
+		}
+		s.folded = lookupPrefix(t.folds, s.lower[:n], off-i, t.foldLength, s.folded, t.first, 0)
+		if !canExtend(t.foldSorted, s.lower[:n]) {
+			s.foldDone = true
+		}
+	}
+	if !s.maskDone {
+		var pending bool
+		s.masked, pending = t.matchMask(buf[:off])
+		if !pending {
+			s.maskDone = true
+		}
+	}
+	if t.first {
+		if r := shortestRoute(s.limited, s.matched, s.folded, s.masked); r != nil {
+			s.prefixDone = true
+			s.matched = r
+			return true
+		}
+	}
+	if s.exactDone && s.foldDone && s.maskDone {
+		s.prefixDone = true
+		s.matched = longestRoute(s.limited, s.matched, s.folded, s.masked)
+	}
+	return false
+}
+
+// step consults the matchers once no prefix can match longer and grows buf for the MoreMatchers,
+// it reports true if the matching is over.
+func (s *sniffState) step() bool {
+	t := s.t
+	// prefix matches take precedence, the matchers are only consulted once no prefix can match longer,
+	// nothing is decided before the first byte such as when only skipped bytes were read
+	if s.prefixDone && s.off != 0 {
+		if s.matched != nil {
+			return true
+		}
+		mr, decided := t.match(s.buf[:s.off], s.states, false, &s.want, s.elapsed())
+		// the TLS default waits for the header of the record, however the bytes arrive
+		if decided && (mr != nil || t.tlsDefault == nil || !mayBeTLS(s.buf[:s.off])) {
+			s.matched = mr
+			return true
+		}
+	}
+	if s.off == len(s.buf) {
+		if s.want <= s.off || s.off >= t.growLength {
+			return true
+		}
+		// grow the buffer for the MoreMatchers, at least doubling it so that it is grown a few times only
+		n := 2 * len(s.buf)
+		if n < s.want {
+			n = s.want
+		}
+		if n > t.growLength {
+			n = t.growLength
+		}
+		if n <= cap(s.buf) {
+			s.buf = s.buf[:n]
+		} else {
+			s.buf = append(s.buf, make([]byte, n-len(s.buf))...)
+		}
+	}
+	return false
+}
+
+// result returns the route of the bytes matched so far, nil if none.
+func (s *sniffState) result() *route {
+	t := s.t
+	matched := s.matched
+	if !s.prefixDone {
+		matched = longestRoute(s.limited, s.matched, s.folded, s.masked)
+	}
+	if matched == nil {
+		matched, _ = t.match(s.buf[:s.off], s.states, true, &s.want, s.elapsed())
+	}
+	if matched == nil && t.tlsDefault != nil && looksLikeTLS(s.buf[:s.off]) {
+		matched = t.tlsDefault
+	}
+	if matched == nil && s.off != 0 {
+		matched = t.defaultRoute
+	}
+	return matched
+}
@@ -0,0 +1,186 @@
+package cmux
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// digitMatcher matches the bytes that have a digit in their first four.
+var digitMatcher = MatcherFunc(func(b []byte) (bool, bool) {
+	for i := 0; i < len(b) && i < 4; i++ {
+		if b[i] >= '0' && b[i] <= '9' {
+			return true, false
+		}
+	}
+	return false, len(b) < 4
+})
+
+// lengthMatcher matches a digit n followed by n bytes, the last being 'z'.
+var lengthMatcher = MoreMatcherFunc(func(b []byte) (bool, int) {
+	if len(b) == 0 {
+		return false, 1
+	}
+	if b[0] < '0' || b[0] > '9' {
+		return false, 0
+	}
+	n := 1 + int(b[0]-'0')
+	if len(b) < n {
+		return false, n - len(b)
+	}
+	return n > 1 && b[n-1] == 'z', 0
+})
+
+// randomMux registers random prefixes, folded prefixes, masked patterns and matchers.
+func randomMux(rnd *rand.Rand, alphabet string) *CMux {
+	mux := NewCMux()
+	for i := rnd.Intn(5); i != 0; i-- {
+		p := string(randomBytes(rnd, alphabet, 5))
+		if p != "" {
+			mux.HandlePrefix(handlerID(p), p)
+		}
+	}
+	if rnd.Intn(2) == 0 {
+		if p := string(randomBytes(rnd, alphabet, 4)); p != "" {
+			mux.HandlePrefixFold(handlerID("fold:"+p), p)
+		}
+	}
+	if rnd.Intn(3) == 0 {
+		mux.HandlePattern(handlerID("mask"), []byte("a\x00b"), []byte{0xff, 0x00, 0xff})
+	}
+	if rnd.Intn(2) == 0 {
+		mux.HandleMatcher(handlerID("digit"), digitMatcher, 4)
+	}
+	if rnd.Intn(2) == 0 {
+		mux.HandleMoreMatcher(handlerID("length"), lengthMatcher, 12)
+	}
+	if rnd.Intn(2) == 0 {
+		mux.NotFound(handlerID("nf"))
+	}
+	return mux
+}
+
+// feedChunks feeds b to the Sniffer in random chunks until it decides.
+func feedChunks(rnd *rand.Rand, sn *Sniffer, b []byte) {
+	for len(b) != 0 {
+		n := 1 + rnd.Intn(len(b))
+		if sn.Feed(b[:n]) {
+			return
+		}
+		b = b[n:]
+	}
+}
+
+func TestSnifferAgreesWithHandler(t *testing.T) {
+	const alphabet = "abAB0z"
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i != 300; i++ {
+		mux := randomMux(rnd, alphabet)
+		sn := mux.NewSniffer()
+		for j := 0; j != 30; j++ {
+			b := randomBytes(rnd, alphabet, 16)
+			wantHandler, wantPattern, _, wantErr := mux.load().resolve(bytes.NewReader(b))
+			for k := 0; k != 3; k++ {
+				sn.Reset()
+				feedChunks(rnd, sn, b)
+				h, pattern, err := sn.Result()
+				if h != wantHandler || pattern != wantPattern || (err == nil) != (wantErr == nil) {
+					t.Fatalf("%q with %s: the Sniffer decided %v %q %v, Handler %v %q %v",
+						b, mux, h, pattern, err, wantHandler, wantPattern, wantErr)
+				}
+			}
+		}
+	}
+}
+
+func TestSnifferFeedAfterDecided(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	sn := mux.NewSniffer()
+	if _, _, err := sn.Result(); err == nil {
+		t.Fatal("the Sniffer decided before being fed")
+	}
+	if sn.Feed([]byte("SS")) {
+		t.Fatal("the Sniffer decided on a part of the prefix")
+	}
+	if !sn.Feed([]byte("H-2.0")) {
+		t.Fatal("the Sniffer did not decide on the prefix")
+	}
+	// the bytes after the decision are ignored
+	if !sn.Feed([]byte("GET ")) {
+		t.Fatal("the Sniffer forgot its decision")
+	}
+	if h, pattern, err := sn.Result(); err != nil || h != handlerID("ssh") || pattern != "SSH-" {
+		t.Fatalf("Result() = %v, %q, %v", h, pattern, err)
+	}
+	// Reset binds the Sniffer to the routes registered since
+	mux.HandlePrefix(handlerID("http"), "GET ")
+	sn.Reset()
+	sn.Feed([]byte("GET /"))
+	if h, _, _ := sn.Result(); h != handlerID("http") {
+		t.Fatalf("the reset Sniffer matched %v", h)
+	}
+}
+
+func TestSnifferDoesNotAllocate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	mux := randomMux(rnd, "abAB0z")
+	mux.HandlePrefix(handlerID("pri"), HTTP2Preface)
+	mux.HandleMoreMatcher(handlerID("length"), lengthMatcher, 12)
+	sn := mux.NewSniffer()
+	inputs := [][]byte{[]byte(HTTP2Preface), []byte("9abcdefghz"), []byte("zzzz"), []byte("0")}
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, b := range inputs {
+			sn.Reset()
+			for i := range b {
+				if sn.Feed(b[i : i+1]) {
+					break
+				}
+			}
+			sn.Result()
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("the Sniffer allocated %v times per run", allocs)
+	}
+}
+
+// classifyMux is a mux of a log pipeline classifying payloads.
+func classifyMux() (*CMux, [][]byte) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("tls"), "\x16\x03")
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.HandlePrefix(handlerID("h2"), HTTP2Preface)
+	mux.HandleHTTP1(handlerID("http"))
+	mux.NotFound(handlerID("nf"))
+	return mux, [][]byte{
+		[]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03"),
+		[]byte("SSH-2.0-OpenSSH_9.0\r\n"),
+		[]byte(HTTP2Preface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"),
+		[]byte("\x00\x00\x00\x08\x04\xd2\x16\x2f"),
+	}
+}
+
+func BenchmarkSnifferClassify(b *testing.B) {
+	mux, payloads := classifyMux()
+	sn := mux.NewSniffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sn.Reset()
+		sn.Feed(payloads[i%len(payloads)])
+		sn.Result()
+	}
+}
+
+func BenchmarkHandlerClassify(b *testing.B) {
+	mux, payloads := classifyMux()
+	var r bytes.Reader
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(payloads[i%len(payloads)])
+		mux.Handler(&r)
+	}
+}
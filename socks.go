@@ -0,0 +1,71 @@
+package cmux
+
+const (
+	// socks4HeaderLength is the length of the version, the command, the port and the address of a SOCKS4 request.
+	socks4HeaderLength = 8
+	// maxSOCKS5GreetingLength is the length of a SOCKS5 greeting offering every method.
+	maxSOCKS5GreetingLength = 2 + 255
+)
+
+// HandleSOCKS handle the handlers that match the requests of SOCKS4 and SOCKS4a, and the greetings of SOCKS5,
+// see MatchSOCKS4 and MatchSOCKS5. A nil handler leaves its version unmatched.
+// The bytes that do not validate fall through to the other registrations, the sniffed bytes are replayed to the handler.
+func (m *CMux) HandleSOCKS(v4 Handler, v5 Handler) error {
+	if v4 != nil {
+		err := m.handleMatcher(v4, MatcherFunc(MatchSOCKS4), socks4HeaderLength, "socks4")
+		if err != nil {
+			return err
+		}
+	}
+	if v5 != nil {
+		err := m.handleMatcher(v5, MatcherFunc(MatchSOCKS5), maxSOCKS5GreetingLength, "socks5")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchSOCKS4 matches the header of a SOCKS4 request, the version 4 and the command CONNECT or BIND
+// followed by the port and the address.
+func MatchSOCKS4(b []byte) (matched bool, needMore bool) {
+	if len(b) >= 1 && b[0] != 0x04 {
+		return false, false
+	}
+	if len(b) >= 2 && b[1] != 0x01 && b[1] != 0x02 {
+		return false, false
+	}
+	if len(b) < socks4HeaderLength {
+		return false, true
+	}
+	return true, false
+}
+
+// MatchSOCKS5 matches a SOCKS5 greeting, the version 5 and the count of the methods followed by the methods.
+// It needs at least one method and every method must be assigned by IANA or reserved for private use.
+func MatchSOCKS5(b []byte) (matched bool, needMore bool) {
+	if len(b) >= 1 && b[0] != 0x05 {
+		return false, false
+	}
+	if len(b) < 2 {
+		return false, true
+	}
+	n := int(b[1])
+	if n == 0 {
+		return false, false
+	}
+	methods := b[2:]
+	if len(methods) > n {
+		methods = methods[:n]
+	}
+	for _, method := range methods {
+		// NO AUTHENTICATION to JSON Parameter Block, and the private methods
+		if method > 0x09 && (method < 0x80 || method == 0xff) {
+			return false, false
+		}
+	}
+	if len(methods) < n {
+		return false, true
+	}
+	return true, false
+}
@@ -0,0 +1,64 @@
+package cmux
+
+import (
+	"testing"
+)
+
+func TestHandleSOCKS(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleSOCKS(handlerID("v4"), handlerID("v5"))
+	mux.HandleMatcher(handlerID("binary"), MatcherFunc(func(b []byte) (bool, bool) {
+		return len(b) != 0 && (b[0] == 0x04 || b[0] == 0x05), len(b) == 0
+	}), 1)
+	for _, tc := range []struct {
+		name string
+		b    string
+		want string
+	}{
+		{"SOCKS5 no auth", "\x05\x01\x00", "v5"},
+		{"SOCKS5 no auth and password", "\x05\x02\x00\x02", "v5"},
+		{"SOCKS5 private method", "\x05\x01\x80", "v5"},
+		{"SOCKS4 CONNECT", "\x04\x01\x00\x50\x7f\x00\x00\x01user\x00", "v4"},
+		{"SOCKS4a BIND", "\x04\x02\x00\x50\x00\x00\x00\x01\x00example.com\x00", "v4"},
+		{"no methods", "\x05\x00\x00\x00", "binary"},
+		{"unassigned method", "\x05\x02\x00\x41", "binary"},
+		{"text after 0x05", "\x05hello world", "binary"},
+		{"SOCKS4 unknown command", "\x04\x03\x00\x50\x7f\x00\x00\x01\x00", "binary"},
+	} {
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("%s matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHandleSOCKSNilVersion(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleSOCKS(nil, handlerID("v5"))
+	if got := matchOf(t, mux, "\x04\x01\x00\x50\x7f\x00\x00\x01\x00"); got != "" {
+		t.Fatalf("the SOCKS4 request matched %q without a handler", got)
+	}
+}
+
+func TestHandleSOCKSReplaysGreeting(t *testing.T) {
+	mux := NewCMux()
+	v5, ch := connChan()
+	mux.HandleSOCKS(nil, v5)
+	client := servePipe(mux)
+	defer client.Close()
+	// the client waits for the method selection before it sends the request
+	const greeting = "\x05\x02\x00\x02"
+	go client.Write([]byte(greeting))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(greeting)); got != greeting {
+		t.Fatalf("the handler read %q, want the greeting", got)
+	}
+	go conn.Write([]byte("\x05\x00"))
+	if got := readN(t, client, 2); got != "\x05\x00" {
+		t.Fatalf("the client read %q", got)
+	}
+	go client.Write([]byte("\x05\x01\x00\x01"))
+	if got := readN(t, conn, 4); got != "\x05\x01\x00\x01" {
+		t.Fatalf("the handler read %q after the greeting", got)
+	}
+}
@@ -0,0 +1,158 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+var ErrTooManySourceConns = fmt.Errorf("too many connections from the source")
+
+const (
+	// defaultSourcePrefix6 is the length of the prefix that buckets the IPv6 sources.
+	defaultSourcePrefix6 = 64
+	// maxTopSources is the number of the sources reported by the Stats.
+	maxTopSources = 10
+)
+
+// SourceStats is the number of the active connections of a source.
+type SourceStats struct {
+	// Source is the IP address of the source, or its network for IPv6.
+	Source string
+	Active int
+}
+
+// SetPerSourceLimit bounds the active connections of each source IP address, zero means no bound, the default.
+// The IPv4-mapped IPv6 addresses are counted as IPv4 and the IPv6 sources by their /64 network
+// unless changed with SetPerSourcePrefix6. The connections over the bound are closed with
+// ErrTooManySourceConns before being sniffed, the sources that are not IP addresses are not bounded.
+// The source is the address the connection came from, not the client of a PROXY protocol header.
+func (m *CMux) SetPerSourceLimit(n int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	l := m.loadSources()
+	switch {
+	case n <= 0:
+		m.sources.Store((*sourceLimiter)(nil))
+	case l == nil:
+		m.sources.Store(newSourceLimiter(n, m.sourcePrefix6))
+	default:
+		// the connections being served stay counted
+		l.setLimit(n)
+	}
+}
+
+// SetPerSourcePrefix6 sets the length of the network by which SetPerSourceLimit counts the IPv6 sources, 64 by default.
+func (m *CMux) SetPerSourcePrefix6(bits int) error {
+	if bits <= 0 || bits > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", bits)
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.sourcePrefix6 = bits
+	if l := m.loadSources(); l != nil {
+		m.sources.Store(newSourceLimiter(l.getLimit(), bits))
+	}
+	return nil
+}
+
+// loadSources returns the limiter of SetPerSourceLimit, nil if there is no limit.
+func (m *CMux) loadSources() *sourceLimiter {
+	l, _ := m.sources.Load().(*sourceLimiter)
+	return l
+}
+
+// sourceLimiter counts the active connections of each source, the entries of the sources
+// without a connection are removed.
+type sourceLimiter struct {
+	mut     sync.Mutex
+	limit   int
+	prefix6 int
+	active  map[string]int
+}
+
+func newSourceLimiter(limit, prefix6 int) *sourceLimiter {
+	if prefix6 == 0 {
+		prefix6 = defaultSourcePrefix6
+	}
+	return &sourceLimiter{
+		limit:   limit,
+		prefix6: prefix6,
+		active:  map[string]int{},
+	}
+}
+
+func (l *sourceLimiter) setLimit(n int) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.limit = n
+}
+
+func (l *sourceLimiter) getLimit() int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.limit
+}
+
+// key returns the bucket of addr, empty if addr is not an IP address.
+func (l *sourceLimiter) key(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	mask := net.CIDRMask(l.prefix6, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// acquire counts a connection of addr, it reports false if the source is over the limit.
+// The returned key releases it.
+func (l *sourceLimiter) acquire(addr net.Addr) (key string, ok bool) {
+	key = l.key(addr)
+	if key == "" {
+		return "", true
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.active[key] >= l.limit {
+		return "", false
+	}
+	l.active[key]++
+	return key, true
+}
+
+func (l *sourceLimiter) release(key string) {
+	if key == "" {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.active[key] <= 1 {
+		delete(l.active, key)
+	} else {
+		l.active[key]--
+	}
+}
+
+// top returns the sources with the most active connections.
+func (l *sourceLimiter) top() []SourceStats {
+	l.mut.Lock()
+	sources := make([]SourceStats, 0, len(l.active))
+	for source, n := range l.active {
+		sources = append(sources, SourceStats{Source: source, Active: n})
+	}
+	l.mut.Unlock()
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Active != sources[j].Active {
+			return sources[i].Active > sources[j].Active
+		}
+		return sources[i].Source < sources[j].Source
+	})
+	if len(sources) > maxTopSources {
+		sources = sources[:maxTopSources]
+	}
+	return sources
+}
@@ -0,0 +1,204 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sourceConn is a conn coming from the remote address.
+type sourceConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *sourceConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// holdHandler sends the connections it is served to ch and serves them until the client closes them.
+func holdHandler() (Handler, chan net.Conn) {
+	ch := make(chan net.Conn, 64)
+	return HandlerFunc(func(conn net.Conn) {
+		ch <- conn
+		buf := make([]byte, 16)
+		for {
+			_, err := conn.Read(buf)
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}), ch
+}
+
+// serveFrom serves a pipe coming from the ip with mux and returns the client end, the client sends the prefix.
+func serveFrom(mux *CMux, ip string, prefix string) net.Conn {
+	client, server := net.Pipe()
+	go mux.ServeConn(&sourceConn{Conn: server, remote: tcpAddr(ip)})
+	go client.Write([]byte(prefix))
+	return client
+}
+
+func TestPerSourceLimit(t *testing.T) {
+	const limit = 3
+	mux := NewCMux()
+	mux.SetPerSourceLimit(limit)
+	handler, ch := holdHandler()
+	mux.HandlePrefix(handler, "X")
+	errs := make(chan error, 16)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+
+	var clients []net.Conn
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i != limit; i++ {
+		clients = append(clients, serveFrom(mux, "192.0.2.1", "X"))
+		recvConn(t, ch)
+	}
+	// the offender is closed before its connections are sniffed
+	for i := 0; i != 5; i++ {
+		c := serveFrom(mux, "192.0.2.1", "X")
+		clients = append(clients, c)
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrTooManySourceConns) {
+				t.Fatalf("reported %v, want ErrTooManySourceConns", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection over the limit was not closed")
+		}
+	}
+	noConn(t, ch)
+	// another source is not limited by the offender
+	for i := 0; i != 2; i++ {
+		clients = append(clients, serveFrom(mux, "198.51.100.7", "X"))
+		recvConn(t, ch)
+	}
+
+	stats := mux.Stats()
+	if stats.SourceRejected != 5 {
+		t.Fatalf("%d connections rejected, want 5", stats.SourceRejected)
+	}
+	want := []SourceStats{{Source: "192.0.2.1", Active: limit}, {Source: "198.51.100.7", Active: 2}}
+	if len(stats.TopSources) != len(want) || stats.TopSources[0] != want[0] || stats.TopSources[1] != want[1] {
+		t.Fatalf("the top sources are %+v, want %+v", stats.TopSources, want)
+	}
+
+	// the entries are removed once their connections are closed
+	for _, c := range clients {
+		c.Close()
+	}
+	clients = nil
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mux.Stats().TopSources) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the sources %+v are still tracked", mux.Stats().TopSources)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clients = append(clients, serveFrom(mux, "192.0.2.1", "X"))
+	recvConn(t, ch)
+}
+
+func TestPerSourceKey(t *testing.T) {
+	tests := []struct {
+		addr    net.Addr
+		prefix6 int
+		want    string
+	}{
+		{tcpAddr("192.0.2.1"), 0, "192.0.2.1"},
+		{tcpAddr("::ffff:192.0.2.1"), 0, "192.0.2.1"},
+		{tcpAddr("2001:db8:1:2:3:4:5:6"), 0, "2001:db8:1:2::/64"},
+		{tcpAddr("2001:db8:1:2:ffff::1"), 0, "2001:db8:1:2::/64"},
+		{tcpAddr("2001:db8:1:2:3:4:5:6"), 48, "2001:db8:1::/48"},
+		{tcpAddr("2001:db8:1:2:3:4:5:6"), 128, "2001:db8:1:2:3:4:5:6/128"},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 53}, 0, "192.0.2.9"},
+		{memAddr, 0, "192.0.2.1"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, 0, ""},
+	}
+	for _, tt := range tests {
+		l := newSourceLimiter(1, tt.prefix6)
+		if got := l.key(tt.addr); got != tt.want {
+			t.Errorf("the key of %v with /%d is %q, want %q", tt.addr, tt.prefix6, got, tt.want)
+		}
+	}
+}
+
+func TestPerSourceLimitIPv6Network(t *testing.T) {
+	mux := NewCMux()
+	mux.SetPerSourceLimit(1)
+	handler, ch := holdHandler()
+	mux.HandlePrefix(handler, "X")
+	a := serveFrom(mux, "2001:db8::1", "X")
+	defer a.Close()
+	recvConn(t, ch)
+	// the same /64
+	b := serveFrom(mux, "2001:db8::2", "X")
+	defer b.Close()
+	noConn(t, ch)
+
+	if err := mux.SetPerSourcePrefix6(128); err != nil {
+		t.Fatal(err)
+	}
+	c := serveFrom(mux, "2001:db8::3", "X")
+	defer c.Close()
+	recvConn(t, ch)
+	if err := mux.SetPerSourcePrefix6(129); err == nil {
+		t.Fatal("a prefix longer than an IPv6 address was accepted")
+	}
+}
+
+func TestPerSourceLimitNonIP(t *testing.T) {
+	mux := NewCMux()
+	mux.SetPerSourceLimit(1)
+	handler, ch := holdHandler()
+	mux.HandlePrefix(handler, "X")
+	for i := 0; i != 3; i++ {
+		c := servePipe(mux)
+		defer c.Close()
+		go c.Write([]byte("X"))
+		recvConn(t, ch)
+	}
+}
+
+func TestPerSourceLimitConcurrent(t *testing.T) {
+	mux := NewCMux()
+	mux.SetPerSourceLimit(4)
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Close()
+	}), "X")
+	var wg sync.WaitGroup
+	for i := 0; i != 8; i++ {
+		ip := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}[i%3]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j != 50; j++ {
+				client, server := net.Pipe()
+				go client.Write([]byte("X"))
+				mux.ServeConn(&sourceConn{Conn: server, remote: tcpAddr(ip)})
+				client.Close()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j != 50; j++ {
+			mux.Stats()
+			mux.SetPerSourceLimit(2 + j%3)
+		}
+	}()
+	wg.Wait()
+	if top := mux.Stats().TopSources; len(top) != 0 {
+		t.Fatalf("the sources %+v are still tracked without a connection", top)
+	}
+}
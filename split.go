@@ -0,0 +1,167 @@
+package cmux
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SplitMode decides how a SplitHandler picks the handler of a connection.
+type SplitMode uint8
+
+const (
+	// SplitRandom picks a handler at random in proportion to the weights. It is the default.
+	SplitRandom SplitMode = iota
+	// SplitBySource picks by a hash of the source address of the connection weighted by the weights,
+	// the connections of a client keep going to the same handler. A change of the weights only moves
+	// the clients that the change has to move.
+	SplitBySource
+)
+
+// SplitHandler is a Handler that splits the connections between its handlers in proportion to their weights,
+// such as 5% to a new backend and 95% to the old one. The weights can be changed while serving.
+type SplitHandler struct {
+	mut     sync.Mutex
+	keys    map[Handler]uint64
+	entries atomic.Value
+	mode    uint32
+	rnd     *rand.Rand
+}
+
+// splitEntry is a handler with its weight, key identifies the handler for the hashing.
+type splitEntry struct {
+	handler Handler
+	weight  uint32
+	key     uint64
+}
+
+// NewSplitHandler create a new SplitHandler, the handlers must be comparable.
+func NewSplitHandler(weights map[Handler]uint32) (*SplitHandler, error) {
+	h := &SplitHandler{
+		keys: map[Handler]uint64{},
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	err := h.SetWeights(weights)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// SetWeights replaces the weights, a handler of weight zero receives nothing.
+// It fails if no handler has a weight.
+func (h *SplitHandler) SetWeights(weights map[Handler]uint32) error {
+	entries := make([]splitEntry, 0, len(weights))
+	total := uint64(0)
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for handler, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+		key, ok := h.keys[handler]
+		if !ok {
+			key = uint64(len(h.keys)) + 1
+			h.keys[handler] = key
+		}
+		entries = append(entries, splitEntry{handler: handler, weight: weight, key: key})
+		total += uint64(weight)
+	}
+	if total == 0 {
+		return fmt.Errorf("split: every weight is zero")
+	}
+	// the random pick walks the handlers in the order they were first seen
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && entries[j].key < entries[j-1].key; j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+	h.entries.Store(entries)
+	return nil
+}
+
+// SetMode sets how the handlers are picked, the default is SplitRandom.
+func (h *SplitHandler) SetMode(mode SplitMode) {
+	atomic.StoreUint32(&h.mode, uint32(mode))
+}
+
+func (h *SplitHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *SplitHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	serveHandler(ctx, h.pick(conn), conn)
+}
+
+// pick returns the handler of conn.
+func (h *SplitHandler) pick(conn net.Conn) Handler {
+	entries := h.entries.Load().([]splitEntry)
+	if len(entries) == 1 {
+		return entries[0].handler
+	}
+	if SplitMode(atomic.LoadUint32(&h.mode)) == SplitBySource {
+		return pickBySource(entries, sourceKey(conn.RemoteAddr()))
+	}
+	total := uint64(0)
+	for _, e := range entries {
+		total += uint64(e.weight)
+	}
+	h.mut.Lock()
+	n := uint64(h.rnd.Int63n(int64(total)))
+	h.mut.Unlock()
+	for _, e := range entries {
+		if n < uint64(e.weight) {
+			return e.handler
+		}
+		n -= uint64(e.weight)
+	}
+	return entries[len(entries)-1].handler
+}
+
+// pickBySource picks with the weighted rendezvous hashing of the source.
+func pickBySource(entries []splitEntry, source []byte) Handler {
+	var best Handler
+	bestScore := math.Inf(1)
+	for _, e := range entries {
+		f := fnv.New64a()
+		var key [8]byte
+		for i := range key {
+			key[i] = byte(e.key >> (8 * i))
+		}
+		f.Write(key[:])
+		f.Write(source)
+		u := (float64(mix64(f.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -math.Log(u) / float64(e.weight)
+		if score < bestScore {
+			best, bestScore = e.handler, score
+		}
+	}
+	return best
+}
+
+// mix64 spreads the bits of the FNV hash, whose high bits barely change for short inputs.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// sourceKey returns the bytes that identify the client of addr, its IP address without the port if it has one.
+func sourceKey(addr net.Addr) []byte {
+	if ip := addrIP(addr); ip != nil {
+		return ip
+	}
+	if addr == nil {
+		return nil
+	}
+	return []byte(addr.String())
+}
@@ -0,0 +1,181 @@
+package cmux
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingHandler counts the connections it serves.
+type countingHandler struct {
+	n int64
+}
+
+func (h *countingHandler) ServeConn(conn net.Conn) {
+	atomic.AddInt64(&h.n, 1)
+	conn.Close()
+}
+
+func (h *countingHandler) count() int64 {
+	return atomic.LoadInt64(&h.n)
+}
+
+// splitConns serves n connections from the sources with h.
+func splitConns(h Handler, n int, source func(i int) net.Addr) {
+	for i := 0; i != n; i++ {
+		conn := newMemConn(nil)
+		conn.remote = source(i)
+		h.ServeConn(conn)
+	}
+}
+
+func randomSource(i int) net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1024 + i%1000}
+}
+
+func within(got, want, tolerance int64) bool {
+	return got >= want-tolerance && got <= want+tolerance
+}
+
+func TestSplitHandlerRandom(t *testing.T) {
+	old, next, off := &countingHandler{}, &countingHandler{}, &countingHandler{}
+	h, err := NewSplitHandler(map[Handler]uint32{old: 95, next: 5, off: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitConns(h, 5000, randomSource)
+	if !within(next.count(), 250, 80) || old.count()+next.count() != 5000 {
+		t.Fatalf("the split of 5%% served %d and %d", next.count(), old.count())
+	}
+	if off.count() != 0 {
+		t.Fatalf("the handler of weight zero served %d connections", off.count())
+	}
+
+	// the weights change while the handler is in use
+	if err := h.SetWeights(map[Handler]uint32{old: 1, next: 1}); err != nil {
+		t.Fatal(err)
+	}
+	before := next.count()
+	splitConns(h, 4000, randomSource)
+	if got := next.count() - before; !within(got, 2000, 150) {
+		t.Fatalf("the split of 50%% served %d of 4000", got)
+	}
+}
+
+func TestSplitHandlerZeroWeights(t *testing.T) {
+	a, b := &countingHandler{}, &countingHandler{}
+	for _, weights := range []map[Handler]uint32{nil, {}, {a: 0, b: 0}} {
+		if _, err := NewSplitHandler(weights); err == nil {
+			t.Errorf("NewSplitHandler accepted %v", weights)
+		}
+	}
+	h, err := NewSplitHandler(map[Handler]uint32{a: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetWeights(map[Handler]uint32{a: 0, b: 0}); err == nil {
+		t.Fatal("SetWeights accepted every weight zero")
+	}
+	// the weights before the failed change are kept
+	splitConns(h, 10, randomSource)
+	if a.count() != 10 || b.count() != 0 {
+		t.Fatalf("served %d and %d after a failed SetWeights", a.count(), b.count())
+	}
+}
+
+func TestSplitHandlerBySource(t *testing.T) {
+	old, next := &countingHandler{}, &countingHandler{}
+	h, err := NewSplitHandler(map[Handler]uint32{old: 90, next: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetMode(SplitBySource)
+
+	// the clients keep their handler whatever their port
+	onNext := map[string]bool{}
+	for i := 0; i != 4000; i++ {
+		ip := net.IPv4(172, 16, byte(i>>8), byte(i))
+		var picked Handler
+		for port := 1; port != 6; port++ {
+			conn := newMemConn(nil)
+			conn.remote = &net.TCPAddr{IP: ip, Port: 40000 + port}
+			got := h.pick(conn)
+			if picked != nil && got != picked {
+				t.Fatalf("%v went to two handlers", ip)
+			}
+			picked = got
+		}
+		onNext[ip.String()] = picked == next
+	}
+	var n int64
+	for _, b := range onNext {
+		if b {
+			n++
+		}
+	}
+	if !within(n, 400, 80) {
+		t.Fatalf("the split of 10%% by source sent %d clients of 4000", n)
+	}
+
+	// raising the share only moves clients to the new handler
+	if err := h.SetWeights(map[Handler]uint32{old: 80, next: 20}); err != nil {
+		t.Fatal(err)
+	}
+	var moved int64
+	for ip, was := range onNext {
+		conn := newMemConn(nil)
+		conn.remote = &net.TCPAddr{IP: net.ParseIP(ip), Port: 1}
+		now := h.pick(conn) == next
+		if was && !now {
+			t.Fatalf("%s left the new handler when its share grew", ip)
+		}
+		if now && !was {
+			moved++
+		}
+	}
+	if !within(moved, 400, 100) {
+		t.Fatalf("raising the share to 20%% moved %d clients of 4000", moved)
+	}
+
+	// the sources that are not IP addresses are hashed by name
+	conn := newMemConn(nil)
+	conn.remote = &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}
+	if a, b := h.pick(conn), h.pick(conn); a != b {
+		t.Fatal("a unix socket went to two handlers")
+	}
+}
+
+func TestSplitHandlerSetWeightsWhileServing(t *testing.T) {
+	a, b := &countingHandler{}, &countingHandler{}
+	h, err := NewSplitHandler(map[Handler]uint32{a: 1, b: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewCMux()
+	mux.HandlePrefix(h, "GET ")
+	var wg sync.WaitGroup
+	for i := 0; i != 4; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j != 200; j++ {
+				conn := newMemConn([]byte("GET /"))
+				conn.remote = randomSource(i*1000 + j)
+				if err := mux.DispatchConn(conn); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i != 200; i++ {
+		h.SetWeights(map[Handler]uint32{a: uint32(i % 3), b: 1})
+		h.SetMode(SplitMode(i % 2))
+	}
+	wg.Wait()
+	if a.count()+b.count() != 800 {
+		t.Fatalf("served %d connections, want 800", a.count()+b.count())
+	}
+}
@@ -0,0 +1,155 @@
+package cmux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// statusTimeout bounds the reading of the request and the writing of the status.
+	statusTimeout = 5 * time.Second
+	// maxStatusRequest is the number of the bytes of an HTTP request read before answering anyway.
+	maxStatusRequest = 8 << 10
+)
+
+// StatusHandler returns a handler that answers with the status of the mux, the prefixes and the Stats,
+// in the format "json" or otherwise in text, and closes the connection. It suits the probes of a load balancer
+// such as a "HEALTH\r\n" prefix. Registered for an HTTP/1.x request, such as by HandleHTTPPath with
+// "/.shunt/status", it answers with an HTTP response. The counters of the pattern that the probe matched
+// are left out of the status and it is named as self instead.
+func StatusHandler(m *CMux, format string) Handler {
+	return &statusHandler{
+		mux:  m,
+		json: format == "json",
+	}
+}
+
+type statusHandler struct {
+	mux  *CMux
+	json bool
+}
+
+// statusReport is the status in the json format.
+type statusReport struct {
+	Routes   int                      `json:"routes"`
+	Prefixes []string                 `json:"prefixes"`
+	InFlight int64                    `json:"in_flight"`
+	Rejected uint64                   `json:"rejected"`
+	NotFound uint64                   `json:"not_found"`
+	Errors   uint64                   `json:"errors"`
+	Patterns map[string]statusPattern `json:"patterns"`
+	Self     string                   `json:"self,omitempty"`
+}
+
+type statusPattern struct {
+	Matched  uint64 `json:"matched"`
+	Active   int64  `json:"active"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+func (h *statusHandler) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+	self := ""
+	var sniffed []byte
+	if mc, ok := conn.(MatchedConn); ok {
+		self = mc.MatchedPattern()
+		sniffed = mc.SniffedBytes()
+	}
+	method, _, version, ok, _ := parseRequestLine(sniffed)
+	isHTTP := ok && matchHTTP1Version(version)
+	if isHTTP {
+		readRequestHead(conn)
+	}
+
+	body := h.render(self)
+	if !isHTTP {
+		conn.Write(body)
+		return
+	}
+	contentType := "text/plain; charset=utf-8"
+	if h.json {
+		contentType = "application/json"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", contentType, len(body))
+	if string(method) != "HEAD" {
+		buf.Write(body)
+	}
+	conn.Write(buf.Bytes())
+}
+
+// readRequestHead consumes the request line and the headers of an HTTP request, up to maxStatusRequest bytes.
+func readRequestHead(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	n := 0
+	for n < maxStatusRequest {
+		line, err := br.ReadSlice('\n')
+		n += len(line)
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+		if err == nil && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return
+		}
+	}
+}
+
+// render returns the status in the format of the handler, without the counters of self.
+func (h *statusHandler) render(self string) []byte {
+	stats := h.mux.Stats()
+	prefixes := h.mux.Prefixes()
+	patterns := make(map[string]statusPattern, len(stats.Patterns))
+	for pattern, s := range stats.Patterns {
+		if pattern == self && self != "" {
+			continue
+		}
+		patterns[pattern] = statusPattern{
+			Matched:  s.Matched,
+			Active:   s.Active,
+			BytesIn:  s.BytesIn,
+			BytesOut: s.BytesOut,
+		}
+	}
+	if h.json {
+		b, _ := json.Marshal(statusReport{
+			Routes:   len(prefixes),
+			Prefixes: prefixes,
+			InFlight: stats.InFlight,
+			Rejected: stats.Rejected,
+			NotFound: stats.NotFound,
+			Errors:   stats.Errors,
+			Patterns: patterns,
+			Self:     self,
+		})
+		return append(b, '\n')
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "routes %d\n", len(prefixes))
+	fmt.Fprintf(&buf, "in_flight %d\n", stats.InFlight)
+	fmt.Fprintf(&buf, "rejected %d\n", stats.Rejected)
+	fmt.Fprintf(&buf, "not_found %d\n", stats.NotFound)
+	fmt.Fprintf(&buf, "errors %d\n", stats.Errors)
+	names := make([]string, 0, len(patterns))
+	for pattern := range patterns {
+		names = append(names, pattern)
+	}
+	sort.Strings(names)
+	for _, pattern := range names {
+		s := patterns[pattern]
+		fmt.Fprintf(&buf, "pattern %s matched=%d active=%d bytes_in=%d bytes_out=%d\n",
+			strconv.Quote(pattern), s.Matched, s.Active, s.BytesIn, s.BytesOut)
+	}
+	if self != "" {
+		fmt.Fprintf(&buf, "self %s\n", strconv.Quote(self))
+	}
+	return buf.Bytes()
+}
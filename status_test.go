@@ -0,0 +1,159 @@
+package cmux
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probe sends the request to the mux and returns everything answered before the close.
+func probe(t *testing.T, mux *CMux, req string) string {
+	t.Helper()
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(req))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// statusMux returns a mux answering the probes with the status in the format, after two SSH connections.
+func statusMux(t *testing.T, format string) *CMux {
+	t.Helper()
+	mux := NewCMux()
+	mux.HandlePrefix(StatusHandler(mux, format), "HEALTH\r\n")
+	mux.HandleHTTPPath(StatusHandler(mux, format), "/.shunt/status")
+	mux.HandlePrefix(HandlerFunc(func(conn net.Conn) {
+		conn.Write([]byte("bye"))
+		conn.Close()
+	}), "SSH-")
+	for i := 0; i != 2; i++ {
+		if got := probe(t, mux, "SSH-2.0-x\r\n"); got != "bye" {
+			t.Fatalf("the SSH connection read %q", got)
+		}
+	}
+	return mux
+}
+
+func TestStatusHandlerText(t *testing.T) {
+	mux := statusMux(t, "text")
+	var got string
+	for i := 0; i != 3; i++ {
+		got = probe(t, mux, "HEALTH\r\n")
+	}
+	for _, line := range []string{
+		"routes 2\n",
+		"in_flight 1\n",
+		"not_found 0\n",
+		`pattern "SSH-" matched=2 active=0 bytes_in=0 bytes_out=0` + "\n",
+		`self "HEALTH\r\n"` + "\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("the status has no line %q:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, `pattern "HEALTH`) {
+		t.Errorf("the status has the counters of the probe:\n%s", got)
+	}
+}
+
+func TestStatusHandlerJSON(t *testing.T) {
+	mux := statusMux(t, "json")
+	var got string
+	for i := 0; i != 3; i++ {
+		got = probe(t, mux, "HEALTH\r\n")
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &report); err != nil {
+		t.Fatalf("the status is not JSON: %v\n%s", err, got)
+	}
+	for field, kind := range map[string]string{
+		"routes":    "number",
+		"prefixes":  "array",
+		"in_flight": "number",
+		"rejected":  "number",
+		"not_found": "number",
+		"errors":    "number",
+		"patterns":  "object",
+		"self":      "string",
+	} {
+		var ok bool
+		switch v := report[field]; kind {
+		case "number":
+			_, ok = v.(float64)
+		case "array":
+			_, ok = v.([]interface{})
+		case "object":
+			_, ok = v.(map[string]interface{})
+		case "string":
+			_, ok = v.(string)
+		}
+		if !ok {
+			t.Errorf("the status has %s = %v, want a %s", field, report[field], kind)
+		}
+	}
+	if report["self"] != "HEALTH\r\n" {
+		t.Errorf("the status names %q as self", report["self"])
+	}
+	patterns := report["patterns"].(map[string]interface{})
+	if _, ok := patterns["HEALTH\r\n"]; ok {
+		t.Error("the status has the counters of the probe")
+	}
+	ssh, _ := patterns["SSH-"].(map[string]interface{})
+	for field, want := range map[string]float64{"matched": 2, "active": 0, "bytes_in": 0, "bytes_out": 0} {
+		if ssh[field] != want {
+			t.Errorf("the SSH pattern has %s = %v, want %v", field, ssh[field], want)
+		}
+	}
+}
+
+func TestStatusHandlerHTTP(t *testing.T) {
+	mux := statusMux(t, "json")
+	for _, method := range []string{"GET", "HEAD"} {
+		conn := serveTCP(t, mux)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, _ := http.NewRequest(method, "http://example.com/.shunt/status?probe=1", nil)
+		req.Header.Set("User-Agent", "health-checker")
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" || !resp.Close {
+			t.Fatalf("%s answered %v %q close %v", method, resp.Status, resp.Header.Get("Content-Type"), resp.Close)
+		}
+		if method == "HEAD" {
+			if len(body) != 0 {
+				t.Fatalf("HEAD answered a body of %d bytes", len(body))
+			}
+			continue
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Fatalf("the Content-Length is %d for a body of %d bytes", resp.ContentLength, len(body))
+		}
+		var report statusReport
+		if err := json.Unmarshal(body, &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Self != "path:/.shunt/status" || report.Routes != 2 {
+			t.Fatalf("the status names %q as self with %d routes", report.Self, report.Routes)
+		}
+		if _, ok := report.Patterns[report.Self]; ok {
+			t.Fatal("the status has the counters of the probe")
+		}
+	}
+}
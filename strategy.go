@@ -0,0 +1,33 @@
+package cmux
+
+// MatchStrategy decides between the registered prefixes that overlap.
+type MatchStrategy uint8
+
+const (
+	// MatchLongest waits until no registered prefix can match longer and picks the longest match,
+	// "GET /admin" wins over "GET " for a request of /admin. It is the default.
+	MatchLongest MatchStrategy = iota
+	// MatchFirst dispatches as soon as a registered prefix is complete,
+	// the shortest one wins and the longer registrations behind it are never reached.
+	MatchFirst
+)
+
+// SetMatchStrategy sets how the overlapping prefixes are decided, the default is MatchLongest.
+// The matchers are consulted only when no prefix matches with either strategy.
+func (m *CMux) SetMatchStrategy(s MatchStrategy) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.strategy = s
+	m.rebuild()
+}
+
+// shortestRoute returns the route of the shortest prefix, the earlier one on a tie.
+func shortestRoute(routes ...*route) *route {
+	var shortest *route
+	for _, r := range routes {
+		if r != nil && (shortest == nil || len(r.pattern) < len(shortest.pattern)) {
+			shortest = r
+		}
+	}
+	return shortest
+}
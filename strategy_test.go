@@ -0,0 +1,48 @@
+package cmux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMatchStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy MatchStrategy
+		b        string
+		want     string
+		consumed int
+	}{
+		{MatchLongest, "GET /admin/x", "admin", 10},
+		{MatchLongest, "GET /x", "get", 6},
+		{MatchLongest, "GEX", "ge", 3},
+		{MatchLongest, "GX", "", 2},
+		{MatchLongest, "LINE 1\n", "line", 7},
+		{MatchFirst, "GET /admin/x", "ge", 2},
+		{MatchFirst, "GET /x", "ge", 2},
+		{MatchFirst, "GEX", "ge", 2},
+		{MatchFirst, "GX", "", 2},
+		// the matchers still decide what no prefix matches
+		{MatchFirst, "LINE 1\n", "line", 7},
+	} {
+		mux := NewCMux()
+		mux.SetMatchStrategy(tc.strategy)
+		mux.HandlePrefix(handlerID("ge"), "GE")
+		mux.HandlePrefix(handlerID("get"), "GET ")
+		mux.HandlePrefix(handlerID("admin"), "GET /admin")
+		mux.HandleMatcher(handlerID("line"), MatcherFunc(func(b []byte) (bool, bool) {
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				return false, true
+			}
+			return bytes.HasPrefix(b, []byte("LINE")), false
+		}), 32)
+
+		if got := matchOf(t, mux, tc.b); got != tc.want {
+			t.Errorf("strategy %d: %q matched %q, want %q", tc.strategy, tc.b, got, tc.want)
+		}
+		_, _, consumed, _ := mux.MatchBytes([]byte(tc.b))
+		if consumed != tc.consumed {
+			t.Errorf("strategy %d: %q decided after %d bytes, want %d", tc.strategy, tc.b, consumed, tc.consumed)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cmux
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+)
+
+// HandleSubMux handle the child mux that matches the prefix, with strip the matched prefix
+// is consumed before the child sniffs the following bytes.
+// The child keeps its own NotFound handler.
+func (m *CMux) HandleSubMux(child *CMux, strip bool, prefixes ...string) error {
+	if !strip {
+		return m.HandlePrefix(child, prefixes...)
+	}
+	return m.HandlePrefixStrip(child, prefixes...)
+}
+
+// HandlePrefixStrip handle the handler that matches the prefix, the matched prefix is discarded
+// and only the bytes read beyond it are replayed to the handler.
+func (m *CMux) HandlePrefixStrip(handler Handler, prefixes ...string) error {
+	if err := noBudget("HandlePrefixStrip", handler); err != nil {
+		return err
+	}
+	return m.HandlePrefix(&stripHandler{
+		handler:  handler,
+		prefixes: prefixes,
+	}, prefixes...)
+}
+
+// stripHandler discards the longest of its prefixes from the connection before serving it.
+type stripHandler struct {
+	handler  Handler
+	prefixes []string
+}
+
+func (s *stripHandler) ServeConn(conn net.Conn) {
+	s.ServeConnContext(context.Background(), conn)
+}
+
+func (s *stripHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	_, buf := UnwrapUnreadConn(conn)
+	n := 0
+	for _, prefix := range s.prefixes {
+		if len(prefix) > n && strings.HasPrefix(string(buf), prefix) {
+			n = len(prefix)
+		}
+	}
+	if n != 0 {
+		_, err := io.CopyN(io.Discard, conn, int64(n))
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+	serveHandler(ctx, s.handler, conn)
+}
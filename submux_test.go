@@ -0,0 +1,154 @@
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+// writeChunks writes the chunks one by one, each of them is a separate read on a pipe.
+func writeChunks(conn net.Conn, chunks ...string) {
+	for _, chunk := range chunks {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			return
+		}
+	}
+}
+
+func TestSubMuxStripTwoLevels(t *testing.T) {
+	grandchild := NewCMux()
+	put, putCh := connChan()
+	grandchild.HandlePrefix(put, "key=")
+
+	child := NewCMux()
+	get, getCh := connChan()
+	child.HandlePrefix(get, "GET ")
+	child.HandleSubMux(grandchild, true, "PUT ")
+
+	parent := NewCMux()
+	parent.HandleSubMux(child, true, "MYAPP1 ")
+
+	client := servePipe(parent)
+	defer client.Close()
+	go writeChunks(client, "MY", "APP", "1 P", "UT", " ke", "y=v", "alue\n")
+	conn := recvConn(t, putCh)
+	defer conn.Close()
+	if got := readN(t, conn, 10); got != "key=value\n" {
+		t.Fatalf("grandchild handler read %q, want both prefixes stripped", got)
+	}
+	noConn(t, getCh)
+
+	client = servePipe(parent)
+	defer client.Close()
+	go writeChunks(client, "MYAPP1", " G", "ET /x\n")
+	conn = recvConn(t, getCh)
+	defer conn.Close()
+	if got := readN(t, conn, 7); got != "GET /x\n" {
+		t.Fatalf("child handler read %q, want the child prefix replayed", got)
+	}
+}
+
+func TestSubMuxKeepPrefix(t *testing.T) {
+	child := NewCMux()
+	h, ch := connChan()
+	child.HandlePrefix(h, "MYAPP1 GET ")
+
+	parent := NewCMux()
+	parent.HandleSubMux(child, false, "MYAPP1 ")
+
+	client := servePipe(parent)
+	defer client.Close()
+	go writeChunks(client, "MYA", "PP1 ", "GE", "T /\n")
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 13); got != "MYAPP1 GET /\n" {
+		t.Fatalf("child handler read %q, want the parent prefix replayed", got)
+	}
+}
+
+func TestSubMuxIndependentNotFound(t *testing.T) {
+	child := NewCMux()
+	childNotFound, childCh := connChan()
+	child.NotFound(childNotFound)
+	child.HandlePrefix(handlerID("get"), "GET ")
+
+	parent := NewCMux()
+	parentNotFound, parentCh := connChan()
+	parent.NotFound(parentNotFound)
+	parent.HandleSubMux(child, true, "MYAPP1 ")
+
+	client := servePipe(parent)
+	defer client.Close()
+	go writeChunks(client, "MYAPP1 ", "DEL", " x\n")
+	conn := recvConn(t, childCh)
+	defer conn.Close()
+	if got := readN(t, conn, 6); got != "DEL x\n" {
+		t.Fatalf("child NotFound read %q", got)
+	}
+	noConn(t, parentCh)
+
+	client = servePipe(parent)
+	defer client.Close()
+	go writeChunks(client, "OTHER\n")
+	conn = recvConn(t, parentCh)
+	defer conn.Close()
+	if got := readN(t, conn, 6); got != "OTHER\n" {
+		t.Fatalf("parent NotFound read %q", got)
+	}
+	noConn(t, childCh)
+}
+
+func TestHandlePrefixStripOverRead(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefixStrip(h, "MAGICv1\n")
+	// a longer prefix makes the sniff read past the matched one
+	mux.HandlePrefix(handlerID("long"), "MAGICv1\nLONGER-PREFIX")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("MAGICv1\nDATA"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	// exactly the 4 bytes read past the prefix are replayed
+	if _, buf := UnwrapUnreadConn(conn); string(buf) != "DATA" {
+		t.Fatalf("replayed %q, want only the bytes beyond the prefix", buf)
+	}
+	if got := readN(t, conn, 4); got != "DATA" {
+		t.Fatalf("handler read %q", got)
+	}
+	go client.Write([]byte("MORE"))
+	if got := readN(t, conn, 4); got != "MORE" {
+		t.Fatalf("handler read %q after the replay", got)
+	}
+}
+
+func TestHandlePrefixStripExactRead(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefixStrip(h, "MAGICv1\n")
+
+	client := servePipe(mux)
+	defer client.Close()
+	go writeChunks(client, "MAGICv1\n", "DATA")
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 4); got != "DATA" {
+		t.Fatalf("handler read %q, want the stream after the prefix", got)
+	}
+}
+
+func TestHandlePrefixStripNotFoundReplays(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefixStrip(handlerID("magic"), "MAGICv1\n")
+	nf, ch := connChan()
+	mux.NotFound(nf)
+
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("MAGICv2\nDATA"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, 12); got != "MAGICv2\nDATA" {
+		t.Fatalf("NotFound read %q, want every byte replayed", got)
+	}
+}
@@ -0,0 +1,151 @@
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SniffTiming is how long the sniffing of a connection took, measured from the dispatching with a monotonic clock.
+type SniffTiming struct {
+	// FirstByte is the time until the first byte of the prefix was read, zero if none was.
+	FirstByte time.Duration
+	// Decided is the time until the handler was chosen or the sniffing failed.
+	Decided time.Duration
+}
+
+// DurationStats aggregates the durations of the connections.
+type DurationStats struct {
+	Count uint64
+	Sum   time.Duration
+	Max   time.Duration
+}
+
+// durationCounter aggregates durations with atomic operations.
+type durationCounter struct {
+	count uint64
+	sum   int64
+	max   int64
+}
+
+func (c *durationCounter) add(d time.Duration) {
+	atomic.AddUint64(&c.count, 1)
+	atomic.AddInt64(&c.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&c.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&c.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (c *durationCounter) stats() DurationStats {
+	return DurationStats{
+		Count: atomic.LoadUint64(&c.count),
+		Sum:   time.Duration(atomic.LoadInt64(&c.sum)),
+		Max:   time.Duration(atomic.LoadInt64(&c.max)),
+	}
+}
+
+// sniffStats is the aggregate of the SniffTiming of the connections.
+type sniffStats struct {
+	firstByte durationCounter
+	decided   durationCounter
+}
+
+// OnSniffStart sets the callback invoked when a connection starts to be sniffed.
+func (m *CMux) OnSniffStart(fn func(conn net.Conn)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onSniffStart = fn
+	m.rebuild()
+}
+
+// OnSniffDone sets the callback invoked when the sniffing of a connection ends, before the OnMatch
+// and the OnError callbacks. pattern is the registration that won, err is a *NotFoundError when nothing matched
+// and the error of the sniffing when it failed.
+func (m *CMux) OnSniffDone(fn func(conn net.Conn, pattern string, timing SniffTiming, err error)) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.onSniffDone = fn
+	m.rebuild()
+}
+
+// SetSniffStats sets whether the SniffTiming of the connections is aggregated in the Stats,
+// the time to the decision is only counted for the connections that matched or matched nothing.
+func (m *CMux) SetSniffStats(enabled bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if !enabled {
+		m.sniffStats = nil
+	} else if m.sniffStats == nil {
+		m.sniffStats = &sniffStats{}
+	}
+	m.rebuild()
+}
+
+// sniffTimer returns the recorder of the first byte, nil if nothing wants the timing.
+func (t *table) sniffTimer(conn net.Conn) *firstByte {
+	if t.onSniffStart == nil && t.onSniffDone == nil && t.sniffStats == nil {
+		return nil
+	}
+	if t.onSniffStart != nil {
+		t.onSniffStart(conn)
+	}
+	return &firstByte{}
+}
+
+// sniffDone reports the timing of the sniffing that started at start.
+func (t *table) sniffDone(conn net.Conn, start time.Time, fb *firstByte, matched *route, prefix []byte, err error) {
+	timing := SniffTiming{
+		Decided: time.Since(start),
+	}
+	if !fb.at.IsZero() {
+		timing.FirstByte = fb.at.Sub(start)
+	}
+	pattern := ""
+	if err == ErrNotFound {
+		err = &NotFoundError{Prefix: prefix}
+	} else if err == nil {
+		pattern = matched.pattern
+	}
+	if s := t.sniffStats; s != nil {
+		if !fb.at.IsZero() {
+			s.firstByte.add(timing.FirstByte)
+		}
+		if err == nil || errors.Is(err, ErrNotFound) {
+			s.decided.add(timing.Decided)
+		}
+	}
+	if t.onSniffDone != nil {
+		t.onSniffDone(conn, pattern, timing, err)
+	}
+}
+
+// firstByte records when the first byte of the prefix was read.
+type firstByte struct {
+	at time.Time
+}
+
+// reader returns r recording its first byte.
+func (fb *firstByte) reader(r io.Reader) io.Reader {
+	if fb == nil {
+		return r
+	}
+	return &firstByteReader{Reader: r, fb: fb}
+}
+
+type firstByteReader struct {
+	io.Reader
+	fb *firstByte
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n != 0 && r.fb.at.IsZero() {
+		r.fb.at = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,162 @@
+package cmux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowConn hands out its bytes in chunks, sleeping before each one.
+type slowConn struct {
+	*memConn
+	delays []time.Duration
+	chunk  int
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	if len(c.delays) != 0 {
+		time.Sleep(c.delays[0])
+		c.delays = c.delays[1:]
+	}
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.memConn.Read(p)
+}
+
+type sniffDone struct {
+	pattern string
+	timing  SniffTiming
+	err     error
+}
+
+func TestSniffTiming(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	started := 0
+	mux.OnSniffStart(func(conn net.Conn) {
+		started++
+	})
+	var done []sniffDone
+	mux.OnSniffDone(func(conn net.Conn, pattern string, timing SniffTiming, err error) {
+		done = append(done, sniffDone{pattern, timing, err})
+	})
+	mux.SetSniffStats(true)
+
+	// the first byte after 50ms, the decision after two more reads of 30ms
+	conn := &slowConn{memConn: newMemConn([]byte("SSH-2.0")), delays: []time.Duration{50 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond}, chunk: 2}
+	if err := mux.DispatchConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	if started != 1 || len(done) != 1 {
+		t.Fatalf("the hooks were called %d and %d times", started, len(done))
+	}
+	d := done[0]
+	if d.pattern != "SSH-" || d.err != nil {
+		t.Fatalf("OnSniffDone got %q, %v", d.pattern, d.err)
+	}
+	if d.timing.FirstByte < 50*time.Millisecond || d.timing.FirstByte > time.Second {
+		t.Errorf("the first byte took %v, want about 50ms", d.timing.FirstByte)
+	}
+	if d.timing.Decided < 80*time.Millisecond || d.timing.Decided > time.Second {
+		t.Errorf("the decision took %v, want about 80ms", d.timing.Decided)
+	}
+	if d.timing.Decided < d.timing.FirstByte {
+		t.Errorf("the decision at %v came before the first byte at %v", d.timing.Decided, d.timing.FirstByte)
+	}
+
+	stats := mux.Stats()
+	if stats.FirstByte.Count != 1 || stats.FirstByte.Sum != d.timing.FirstByte || stats.FirstByte.Max != d.timing.FirstByte {
+		t.Errorf("the first byte stats are %+v, want the one connection", stats.FirstByte)
+	}
+	if stats.Decided.Count != 1 || stats.Decided.Max != d.timing.Decided {
+		t.Errorf("the decision stats are %+v, want the one connection", stats.Decided)
+	}
+}
+
+func TestSniffTimingNotFoundAndEmpty(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	var done []sniffDone
+	mux.OnSniffDone(func(conn net.Conn, pattern string, timing SniffTiming, err error) {
+		done = append(done, sniffDone{pattern, timing, err})
+	})
+	mux.SetSniffStats(true)
+	mux.DispatchConn(newMemConn([]byte("GET ")))
+	mux.DispatchConn(newMemConn(nil))
+	if len(done) != 2 {
+		t.Fatalf("OnSniffDone was called %d times", len(done))
+	}
+	var nf *NotFoundError
+	if !errors.As(done[0].err, &nf) || string(nf.Prefix) != "GET " || done[0].pattern != "" {
+		t.Errorf("the unmatched connection was reported with %q, %v", done[0].pattern, done[0].err)
+	}
+	if done[1].err == nil || done[1].timing.FirstByte != 0 {
+		t.Errorf("the empty connection was reported with %+v, %v", done[1].timing, done[1].err)
+	}
+	// the empty connection has no first byte and no decision
+	stats := mux.Stats()
+	if stats.FirstByte.Count != 1 || stats.Decided.Count != 1 {
+		t.Errorf("the stats counted %d first bytes and %d decisions, want 1 each", stats.FirstByte.Count, stats.Decided.Count)
+	}
+
+	mux.SetSniffStats(false)
+	if stats := mux.Stats(); stats.FirstByte.Count != 0 {
+		t.Errorf("the stats are still counted after disabling them: %+v", stats.FirstByte)
+	}
+}
+
+func TestSniffHooksWhileDispatching(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mux.OnSniffStart(func(conn net.Conn) {})
+			mux.OnSniffDone(func(conn net.Conn, pattern string, timing SniffTiming, err error) {})
+			mux.SetSniffStats(i%2 == 0)
+			mux.Stats()
+		}
+	}()
+	for i := 0; i != 200; i++ {
+		mux.DispatchConn(newMemConn([]byte("SSH-")))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func benchmarkSniffTiming(b *testing.B, enable func(mux *CMux)) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	enable(mux)
+	data := []byte("SSH-2.0-x")
+	conn := newMemConn(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.r.Reset(data)
+		if err := mux.DispatchConn(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSniffTimingDisabled(b *testing.B) {
+	benchmarkSniffTiming(b, func(mux *CMux) {})
+}
+
+func BenchmarkSniffTimingStats(b *testing.B) {
+	benchmarkSniffTiming(b, func(mux *CMux) {
+		mux.SetSniffStats(true)
+	})
+}
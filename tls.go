@@ -0,0 +1,385 @@
+package cmux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	recordTypeHandshake       = 0x16
+	handshakeTypeClientHello  = 0x01
+	recordHeaderLength        = 5
+	maxRecordLength           = 1 << 14
+	extensionServerName       = 0
+	extensionSupportedGroups  = 10
+	extensionECPointFormats   = 11
+	extensionSupportedVersion = 43
+	serverNameTypeHostName    = 0
+	maxClientHelloSniffLength = recordHeaderLength + maxRecordLength
+	maxHandshakeLength        = 1 << 16
+)
+
+var errMalformedClientHello = fmt.Errorf("malformed client hello")
+
+// clientHello is the part of a TLS ClientHello used for routing.
+type clientHello struct {
+	serverName string
+	// version is the highest version offered, from the supported_versions extension if it is present.
+	version uint16
+	// legacyVersion, ciphers, extensions, curves and points are the fields of the JA3 fingerprint, in wire order.
+	legacyVersion uint16
+	ciphers       []uint16
+	extensions    []uint16
+	curves        []uint16
+	points        []uint8
+}
+
+// parseClientHello parses the ClientHello held by the TLS records of b,
+// the handshake message is reassembled when it is split across records.
+// needMore is reported while the message is incomplete.
+func parseClientHello(b []byte) (hello *clientHello, needMore bool, err error) {
+	msg, needMore, err := readHandshakeMessage(b)
+	if err != nil || needMore {
+		return nil, needMore, err
+	}
+	hello, err = parseClientHelloMessage(msg)
+	if err != nil {
+		return nil, false, err
+	}
+	return hello, false, nil
+}
+
+// readHandshakeMessage returns the first handshake message carried by the handshake records of b.
+func readHandshakeMessage(b []byte) (msg []byte, needMore bool, err error) {
+	for {
+		if len(b) >= 1 && b[0] != recordTypeHandshake ||
+			len(b) >= 2 && b[1] != 0x03 {
+			return nil, false, errMalformedClientHello
+		}
+		if len(b) < recordHeaderLength {
+			return nil, true, nil
+		}
+		length := int(binary.BigEndian.Uint16(b[3:5]))
+		if length == 0 || length > maxRecordLength {
+			return nil, false, errMalformedClientHello
+		}
+		if len(b) < recordHeaderLength+length {
+			return nil, true, nil
+		}
+		msg = append(msg, b[recordHeaderLength:recordHeaderLength+length]...)
+		b = b[recordHeaderLength+length:]
+		if len(msg) >= 1 && msg[0] != handshakeTypeClientHello {
+			return nil, false, errMalformedClientHello
+		}
+		if len(msg) >= 4 {
+			n := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if n > maxHandshakeLength {
+				return nil, false, errMalformedClientHello
+			}
+			if len(msg) >= n {
+				return msg[:n], false, nil
+			}
+		}
+	}
+}
+
+func parseClientHelloMessage(b []byte) (*clientHello, error) {
+	r := byteReader(b)
+	typ, ok := r.uint8()
+	if !ok || typ != handshakeTypeClientHello {
+		return nil, errMalformedClientHello
+	}
+	body, ok := r.bytes24()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	r = byteReader(body)
+
+	version, ok := r.uint16()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	// random, session_id
+	if !r.skip(32) || !r.skip8() {
+		return nil, errMalformedClientHello
+	}
+	ciphers, ok := r.bytes16()
+	if !ok || len(ciphers)%2 != 0 {
+		return nil, errMalformedClientHello
+	}
+	// compression_methods
+	if !r.skip8() {
+		return nil, errMalformedClientHello
+	}
+
+	hello := &clientHello{version: version, legacyVersion: version}
+	for len(ciphers) != 0 {
+		v, _ := ciphers.uint16()
+		hello.ciphers = append(hello.ciphers, v)
+	}
+	if len(r) == 0 {
+		return hello, nil
+	}
+	exts, ok := r.bytes16()
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	for len(exts) != 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		data, ok := exts.bytes16()
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case extensionServerName:
+			name, err := parseServerName(data)
+			if err != nil {
+				return nil, err
+			}
+			hello.serverName = name
+		case extensionSupportedVersion:
+			v, err := parseSupportedVersions(data)
+			if err != nil {
+				return nil, err
+			}
+			hello.version = v
+		case extensionSupportedGroups:
+			list, ok := data.bytes16()
+			if !ok || len(list)%2 != 0 {
+				return nil, errMalformedClientHello
+			}
+			for len(list) != 0 {
+				v, _ := list.uint16()
+				hello.curves = append(hello.curves, v)
+			}
+		case extensionECPointFormats:
+			list, ok := data.bytes8()
+			if !ok {
+				return nil, errMalformedClientHello
+			}
+			hello.points = append(hello.points, list...)
+		}
+	}
+	return hello, nil
+}
+
+func parseServerName(b byteReader) (string, error) {
+	list, ok := b.bytes16()
+	if !ok {
+		return "", errMalformedClientHello
+	}
+	for len(list) != 0 {
+		typ, ok := list.uint8()
+		if !ok {
+			return "", errMalformedClientHello
+		}
+		name, ok := list.bytes16()
+		if !ok {
+			return "", errMalformedClientHello
+		}
+		if typ == serverNameTypeHostName {
+			return strings.ToLower(strings.TrimSuffix(string(name), ".")), nil
+		}
+	}
+	return "", nil
+}
+
+// parseSupportedVersions returns the highest version of the list, the GREASE values are ignored.
+func parseSupportedVersions(b byteReader) (uint16, error) {
+	list, ok := b.bytes8()
+	if !ok || len(list)%2 != 0 {
+		return 0, errMalformedClientHello
+	}
+	var max uint16
+	for len(list) != 0 {
+		v, _ := list.uint16()
+		if isGREASE(v) {
+			continue
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		return 0, errMalformedClientHello
+	}
+	return max, nil
+}
+
+// isGREASE reports whether v is one of the values reserved by RFC 8701 to keep the servers tolerant.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// byteReader reads big-endian TLS wire values, every method reports false on a short buffer.
+type byteReader []byte
+
+func (r *byteReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *byteReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *byteReader) next(n int) (byteReader, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *byteReader) bytes8() (byteReader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.next(int(n))
+}
+
+func (r *byteReader) bytes16() (byteReader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.next(int(n))
+}
+
+func (r *byteReader) bytes24() (byteReader, bool) {
+	if len(*r) < 3 {
+		return nil, false
+	}
+	n := int((*r)[0])<<16 | int((*r)[1])<<8 | int((*r)[2])
+	*r = (*r)[3:]
+	return r.next(n)
+}
+
+func (r *byteReader) skip(n int) bool {
+	_, ok := r.next(n)
+	return ok
+}
+
+func (r *byteReader) skip8() bool {
+	_, ok := r.bytes8()
+	return ok
+}
+
+func (r *byteReader) skip16() bool {
+	_, ok := r.bytes16()
+	return ok
+}
+
+// sniMatcher matches the ClientHello whose server name is one of names,
+// with no names it matches the ClientHello carrying no server name.
+type sniMatcher struct {
+	names []string
+}
+
+func (s *sniMatcher) Match(b []byte) (matched bool, needMore bool) {
+	hello, needMore, err := parseClientHello(b)
+	if err != nil || needMore {
+		return false, needMore
+	}
+	if len(s.names) == 0 {
+		return hello.serverName == "", false
+	}
+	return matchServerName(s.names, hello.serverName), false
+}
+
+// matchServerName reports whether name equals one of names, a name of the form "*.example.com"
+// matches every subdomain of example.com.
+func matchServerName(names []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, n := range names {
+		if strings.HasPrefix(n, "*.") {
+			if strings.HasSuffix(name, n[1:]) {
+				return true
+			}
+		} else if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSNI handle the handler that matches the server name of the TLS ClientHello,
+// the whole ClientHello is replayed to the handler.
+func (m *CMux) HandleSNI(handler Handler, serverNames ...string) error {
+	if len(serverNames) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(serverNames))
+	for _, name := range serverNames {
+		names = append(names, strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	return m.handleMatcher(handler, &sniMatcher{names: names}, m.clientHelloLength(), "sni:"+strings.Join(names, ","))
+}
+
+// HandleSNIDefault handle the handler that matches the TLS ClientHello without a server name.
+func (m *CMux) HandleSNIDefault(handler Handler) error {
+	return m.handleMatcher(handler, &sniMatcher{}, m.clientHelloLength(), "sni:")
+}
+
+// SetMaxClientHelloLength sets the upper bound of the bytes buffered for a ClientHello by the later SNI registrations,
+// a ClientHello split across several records is reassembled up to the bound, the default is 16 KiB.
+func (m *CMux) SetMaxClientHelloLength(n int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.maxClientHello = n
+}
+
+func (m *CMux) clientHelloLength() int {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.maxClientHello > 0 {
+		return m.maxClientHello
+	}
+	return maxClientHelloSniffLength
+}
+
+// HandleTLSDefault handle the handler that takes the TLS connections nothing else matches,
+// such as a ClientHello that timed out before being complete or exceeded the bound of SetMaxClientHelloLength.
+func (m *CMux) HandleTLSDefault(handler Handler) error {
+	if err := noBudget("HandleTLSDefault", handler); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.tlsDefault = &route{
+		pattern: "tls",
+		name:    m.nameOf(handler),
+		handler: handler,
+		counter: m.counterOf("tls"),
+	}
+	m.rebuild()
+	return nil
+}
+
+// looksLikeTLS reports whether b starts with the header of a TLS handshake record.
+func looksLikeTLS(b []byte) bool {
+	return len(b) >= 3 && b[0] == recordTypeHandshake && b[1] == 0x03 && b[2] <= 0x04
+}
+
+// mayBeTLS reports whether b is too short for looksLikeTLS but may still become a TLS handshake record.
+func mayBeTLS(b []byte) bool {
+	return len(b) < 3 && len(b) != 0 && b[0] == recordTypeHandshake && (len(b) < 2 || b[1] == 0x03)
+}
@@ -0,0 +1,246 @@
+package cmux
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for the names.
+func testCert(t testing.TB, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cmux test"},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsBackend is a handler completing the handshake itself and answering with its id.
+func tlsBackend(id string, cert tls.Certificate) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if tc.Handshake() != nil {
+			return
+		}
+		tc.Write([]byte(id))
+	})
+}
+
+// tlsDial completes a handshake with the server name through mux and returns what the server answered.
+func tlsDial(t testing.TB, mux *CMux, cfg *tls.Config) (string, error) {
+	t.Helper()
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := tls.Client(conn, cfg)
+	err := tc.Handshake()
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(tc)
+	return string(b), err
+}
+
+func TestHandleSNI(t *testing.T) {
+	cert := testCert(t, "a.example.com", "b.example.com", "x.wild.example.com")
+	mux := NewCMux()
+	mux.HandleSNI(tlsBackend("a", cert), "a.example.com")
+	mux.HandleSNI(tlsBackend("b", cert), "B.example.com.")
+	mux.HandleSNI(tlsBackend("wild", cert), "*.wild.example.com")
+	mux.HandleSNIDefault(tlsBackend("default", cert))
+	mux.NotFound(tlsBackend("notfound", cert))
+
+	for name, want := range map[string]string{
+		"a.example.com":      "a",
+		"b.example.com":      "b",
+		"x.wild.example.com": "wild",
+		"c.example.com":      "notfound",
+	} {
+		got, err := tlsDial(t, mux, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s was served by %q, want %q", name, got, want)
+		}
+	}
+
+	// without a server name
+	got, err := tlsDial(t, mux, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "default" {
+		t.Fatalf("the ClientHello without SNI was served by %q, want default", got)
+	}
+}
+
+func TestHandleSNIMalformed(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandleSNI(handlerID("sni"), "a.example.com")
+	mux.NotFound(h)
+	client := servePipe(mux)
+	defer client.Close()
+	// a handshake record whose message is not a ClientHello
+	record := "\x16\x03\x01\x00\x08\x02\x00\x00\x04abcd"
+	go client.Write([]byte(record))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if got := readN(t, conn, len(record)); got != record {
+		t.Fatalf("NotFound read %q, want the record replayed", got)
+	}
+}
+
+func TestHandleSNIReplaysClientHello(t *testing.T) {
+	cert := testCert(t, "a.example.com")
+	mux := NewCMux()
+	prefixes := make(chan []byte, 1)
+	mux.OnMatch(func(conn net.Conn, prefix []byte, pattern string, handler Handler) {
+		prefixes <- append([]byte(nil), prefix...)
+	})
+	mux.HandleSNI(tlsBackend("a", cert), "a.example.com")
+	got, err := tlsDial(t, mux, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a" {
+		t.Fatalf("served by %q", got)
+	}
+	hello, needMore, err := parseClientHello(<-prefixes)
+	if err != nil || needMore {
+		t.Fatalf("the sniffed bytes are not a whole ClientHello: %v %v", needMore, err)
+	}
+	if hello.serverName != "a.example.com" {
+		t.Fatalf("the ClientHello names %q", hello.serverName)
+	}
+}
+
+// clientHelloMessage returns the ClientHello handshake message a tls.Client sends for the server name.
+func clientHelloMessage(t testing.TB, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, recordHeaderLength)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// tlsRecords returns the handshake message split into records at the offsets.
+func tlsRecords(msg []byte, offsets ...int) []byte {
+	var b []byte
+	last := 0
+	for _, off := range append(offsets, len(msg)) {
+		b = append(b, recordTypeHandshake, 0x03, 0x01, byte((off-last)>>8), byte(off-last))
+		b = append(b, msg[last:off]...)
+		last = off
+	}
+	return b
+}
+
+func TestHandleSNIFragmentedClientHello(t *testing.T) {
+	const name = "fragmented.example.com"
+	msg := clientHelloMessage(t, name)
+	sni := bytes.Index(msg, []byte(name))
+	if sni < 0 {
+		t.Fatal("the server name is not in the ClientHello")
+	}
+	mux := NewCMux()
+	mux.HandleSNI(handlerID("sni"), name)
+	mux.HandleSNIDefault(handlerID("default"))
+
+	for _, split := range []struct {
+		name    string
+		offsets []int
+	}{
+		{"one record", nil},
+		{"inside the handshake header", []int{2}},
+		{"inside the server name", []int{sni + 5}},
+		{"before the server name", []int{sni - 2}},
+		{"many records", []int{1, 4, 40, sni, sni + 1, sni + 10}},
+	} {
+		records := tlsRecords(msg, split.offsets...)
+		if got := matchOf(t, mux, string(records)); got != "sni" {
+			t.Errorf("%s matched %q, want sni", split.name, got)
+		}
+		// the records also arrive in reads cut inside the record headers
+		for _, sizes := range [][]int{{3}, {2, 4, 7}, {recordHeaderLength + 1, 1}} {
+			got, _ := resolveID(t, mux, &chunkReader{b: records, sizes: sizes})
+			if got != "sni" {
+				t.Errorf("%s in reads of %v matched %q, want sni", split.name, sizes, got)
+			}
+		}
+	}
+}
+
+func TestHandleSNIFragmentTimeoutFallsBackToTLSDefault(t *testing.T) {
+	const name = "slow.example.com"
+	msg := clientHelloMessage(t, name)
+	mux := NewCMux()
+	mux.SetReadTimeout(50 * time.Millisecond)
+	mux.HandleSNI(handlerID("sni"), name)
+	h, ch := connChan()
+	mux.HandleTLSDefault(h)
+	nf, nfCh := connChan()
+	mux.NotFound(nf)
+
+	client := servePipe(mux)
+	defer client.Close()
+	records := tlsRecords(msg, len(msg)/2)
+	// the second record never comes
+	go client.Write(records[:recordHeaderLength+len(msg)/2+recordHeaderLength+3])
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if _, buf := UnwrapUnreadConn(conn); !bytes.HasPrefix(records, buf) || len(buf) == 0 {
+		t.Fatalf("the TLS default got %d bytes that are not the start of the records", len(buf))
+	}
+	noConn(t, nfCh)
+}
+
+func TestHandleSNIClientHelloOverBound(t *testing.T) {
+	const name = "big.example.com"
+	msg := clientHelloMessage(t, name)
+	mux := NewCMux()
+	mux.SetMaxClientHelloLength(len(msg) / 2)
+	mux.HandleSNI(handlerID("sni"), name)
+	mux.HandleTLSDefault(handlerID("tls-default"))
+	h, _, err := mux.Handler(bytes.NewReader(tlsRecords(msg, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != handlerID("tls-default") {
+		t.Fatalf("a ClientHello over the bound went to %v, want the TLS default", h)
+	}
+}
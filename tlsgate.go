@@ -0,0 +1,76 @@
+package cmux
+
+import (
+	"context"
+	"net"
+)
+
+const (
+	recordTypeAlert        = 0x15
+	alertLevelFatal        = 2
+	alertProtocolVersion   = 70
+	alertDescriptionLength = 2
+)
+
+// TLSVersionGate returns a handler that refuses the TLS connections whose ClientHello offers no version
+// of at least min, such as tls.VersionTLS12, with a fatal protocol_version alert.
+// The version offered is the highest one of the supported_versions extension if it is present,
+// otherwise the legacy version of the ClientHello, since TLS 1.3 is only advertised by the extension.
+// The other connections are served by next with the ClientHello replayed,
+// a connection that does not send a well-formed ClientHello is closed.
+func TLSVersionGate(min uint16, next Handler) Handler {
+	return &tlsVersionGate{
+		min:  min,
+		next: next,
+	}
+}
+
+type tlsVersionGate struct {
+	min  uint16
+	next Handler
+}
+
+func (g *tlsVersionGate) ServeConn(conn net.Conn) {
+	g.ServeConnContext(context.Background(), conn)
+}
+
+func (g *tlsVersionGate) ServeConnContext(ctx context.Context, conn net.Conn) {
+	buf := make([]byte, 0, 1024)
+	var hello *clientHello
+	for {
+		var needMore bool
+		var err error
+		hello, needMore, err = parseClientHello(buf)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if !needMore {
+			break
+		}
+		if len(buf) == maxClientHelloSniffLength {
+			conn.Close()
+			return
+		}
+		if len(buf) == cap(buf) {
+			size := 2 * cap(buf)
+			if size > maxClientHelloSniffLength {
+				size = maxClientHelloSniffLength
+			}
+			buf = append(make([]byte, 0, size), buf...)
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil && n == 0 {
+			conn.Close()
+			return
+		}
+	}
+	if hello.version < g.min {
+		// the alert is sent with the record version of the ClientHello so that an old client can read it
+		conn.Write([]byte{recordTypeAlert, buf[1], buf[2], 0, alertDescriptionLength, alertLevelFatal, alertProtocolVersion})
+		conn.Close()
+		return
+	}
+	serveHandler(ctx, g.next, UnreadConn(conn, buf))
+}
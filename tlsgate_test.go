@@ -0,0 +1,126 @@
+package cmux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// helloRecord returns a record of the version carrying a minimal ClientHello with the legacy version,
+// and with the supported_versions extension if versions are given.
+func helloRecord(recordVersion, legacyVersion uint16, versions ...uint16) []byte {
+	body := []byte{byte(legacyVersion >> 8), byte(legacyVersion)}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session_id
+	body = append(body, 0, 2, 0x00, 0x2f)    // cipher_suites
+	body = append(body, 1, 0)                // compression_methods
+	if len(versions) != 0 {
+		list := []byte{byte(2 * len(versions))}
+		for _, v := range versions {
+			list = append(list, byte(v>>8), byte(v))
+		}
+		ext := []byte{byte(extensionSupportedVersion >> 8), byte(extensionSupportedVersion & 0xff), 0, byte(len(list))}
+		ext = append(ext, list...)
+		body = append(body, 0, byte(len(ext)))
+		body = append(body, ext...)
+	}
+	msg := []byte{handshakeTypeClientHello, 0, byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+	record := []byte{recordTypeHandshake, byte(recordVersion >> 8), byte(recordVersion), byte(len(msg) >> 8), byte(len(msg))}
+	return append(record, msg...)
+}
+
+// gate serves b with a TLSVersionGate of min in front of next and returns what the client read until the EOF.
+func gate(t testing.TB, min uint16, next Handler, b []byte) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go TLSVersionGate(min, next).ServeConn(server)
+	go client.Write(b)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// replayNext answers with the bytes it reads, it reads n of them.
+func replayNext(n int) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		b := make([]byte, n)
+		io.ReadFull(conn, b)
+		conn.Write(b)
+	})
+}
+
+func TestTLSVersionGateRejects(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		record []byte
+		alert  []byte
+	}{
+		{"SSLv3", helloRecord(0x0300, 0x0300), []byte{recordTypeAlert, 0x03, 0x00, 0, 2, alertLevelFatal, alertProtocolVersion}},
+		{"TLS 1.0", helloRecord(tls.VersionTLS10, tls.VersionTLS10), []byte{recordTypeAlert, 0x03, 0x01, 0, 2, alertLevelFatal, alertProtocolVersion}},
+		{"TLS 1.1 by the extension", helloRecord(tls.VersionTLS10, tls.VersionTLS12, 0x0a0a, tls.VersionTLS11, tls.VersionTLS10), []byte{recordTypeAlert, 0x03, 0x01, 0, 2, alertLevelFatal, alertProtocolVersion}},
+	} {
+		got := gate(t, tls.VersionTLS12, replayNext(len(c.record)), c.record)
+		if !bytes.Equal(got, c.alert) {
+			t.Errorf("%s got %x, want the protocol_version alert %x", c.name, got, c.alert)
+		}
+	}
+}
+
+func TestTLSVersionGatePasses(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		min    uint16
+		record []byte
+	}{
+		{"TLS 1.2", tls.VersionTLS12, helloRecord(tls.VersionTLS10, tls.VersionTLS12)},
+		{"TLS 1.3 by the extension", tls.VersionTLS13, helloRecord(tls.VersionTLS10, tls.VersionTLS12, 0x1a1a, tls.VersionTLS13, tls.VersionTLS12)},
+		{"TLS 1.0 at the minimum", tls.VersionTLS10, helloRecord(tls.VersionTLS10, tls.VersionTLS10)},
+	} {
+		// the bytes after the ClientHello are replayed too
+		b := append(c.record, "more"...)
+		got := gate(t, c.min, replayNext(len(b)), b)
+		if !bytes.Equal(got, b) {
+			t.Errorf("%s: next read %x, want the ClientHello and the bytes after it", c.name, got)
+		}
+	}
+}
+
+func TestTLSVersionGateRealClient(t *testing.T) {
+	cert := testCert(t, "gate.example.com")
+	mux := NewCMux()
+	mux.HandlePrefix(TLSVersionGate(tls.VersionTLS12, tlsBackend("ok", cert)), "\x16\x03")
+
+	got, err := tlsDial(t, mux, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	if err != nil || got != "ok" {
+		t.Fatalf("the TLS 1.3 client got %q, %v", got, err)
+	}
+	if _, err := tlsDial(t, mux, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Fatal("the TLS 1.1 client completed the handshake")
+	}
+}
+
+func TestTLSVersionGateMalformed(t *testing.T) {
+	served := make(chan struct{}, 1)
+	next := HandlerFunc(func(conn net.Conn) {
+		served <- struct{}{}
+		conn.Close()
+	})
+	record := "\x16\x03\x01\x00\x08\x02\x00\x00\x04abcd"
+	if got := gate(t, tls.VersionTLS12, next, []byte(record)); len(got) != 0 {
+		t.Fatalf("the malformed ClientHello got %x", got)
+	}
+	select {
+	case <-served:
+		t.Fatal("the malformed ClientHello was served")
+	default:
+	}
+}
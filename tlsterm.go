@@ -0,0 +1,161 @@
+package cmux
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NewTLSUnwrapHandler returns a handler that terminates TLS with cfg and dispatches
+// the decrypted stream to inner, which may be the mux the handler is registered on.
+// Handshake failures are reported to the error hook of inner.
+func NewTLSUnwrapHandler(cfg *tls.Config, inner *CMux) Handler {
+	return &tlsUnwrapHandler{
+		config: cfg,
+		inner:  inner,
+	}
+}
+
+type tlsUnwrapHandler struct {
+	config *tls.Config
+	inner  *CMux
+}
+
+func (h *tlsUnwrapHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *tlsUnwrapHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	tlsConn, err := h.inner.handshakeTLS(ctx, conn, h.config)
+	if err != nil {
+		h.inner.load().closeWithError(conn, err)
+		return
+	}
+	h.inner.ServeConnContext(ctx, tlsConn)
+}
+
+// HandlePrefixTLS handle the handler that matches the prefix of the connections that the mux terminates with cfg,
+// such as "\x16\x03" for the TLS connections. The handler is served with the *tls.Conn once the handshake
+// is complete, the handshake failures are reported to the OnError callback.
+func (m *CMux) HandlePrefixTLS(handler Handler, cfg *tls.Config, prefixes ...string) error {
+	if err := noBudget("HandlePrefixTLS", handler); err != nil {
+		return err
+	}
+	if cfg == nil {
+		return fmt.Errorf("nil TLS config")
+	}
+	return m.HandlePrefix(&tlsTerminateHandler{mux: m, config: cfg, handler: handler}, prefixes...)
+}
+
+// HandleSNITLS is like HandleSNI for a handler served as by HandlePrefixTLS, the handshake sees the server name
+// so that cfg.GetCertificate can pick the certificate of the name.
+func (m *CMux) HandleSNITLS(handler Handler, cfg *tls.Config, serverNames ...string) error {
+	if err := noBudget("HandleSNITLS", handler); err != nil {
+		return err
+	}
+	if cfg == nil {
+		return fmt.Errorf("nil TLS config")
+	}
+	return m.HandleSNI(&tlsTerminateHandler{mux: m, config: cfg, handler: handler}, serverNames...)
+}
+
+// tlsTerminateHandler completes the handshake before serving handler.
+type tlsTerminateHandler struct {
+	mux     *CMux
+	config  *tls.Config
+	handler Handler
+}
+
+func (h *tlsTerminateHandler) ServeConn(conn net.Conn) {
+	h.ServeConnContext(context.Background(), conn)
+}
+
+func (h *tlsTerminateHandler) ServeConnContext(ctx context.Context, conn net.Conn) {
+	tlsConn, err := h.mux.handshakeTLS(ctx, conn, h.config)
+	if err != nil {
+		h.mux.load().closeWithError(conn, err)
+		return
+	}
+	serveHandler(ctx, h.handler, tlsConn)
+}
+
+func (h *tlsTerminateHandler) bind(m *CMux) Handler {
+	c := *h
+	c.mux = m
+	return &c
+}
+
+// handshakeTLS completes the server handshake of conn with cfg within the read timeout of the mux.
+func (m *CMux) handshakeTLS(ctx context.Context, conn net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, cfg)
+	timeout := m.load().readTimeout
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	stop := watchContext(ctx, tlsConn)
+	err := tlsConn.Handshake()
+	if stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Time{})
+	}
+	return tlsConn, nil
+}
+
+// HandleALPN handle the handler that matches the negotiated ALPN protocol of a TLS terminated connection,
+// such as the one dispatched by NewTLSUnwrapHandler.
+// Connections without a registered protocol fall back to sniffing the decrypted stream.
+func (m *CMux) HandleALPN(handler Handler, protos ...string) error {
+	if err := noBudget("HandleALPN", handler); err != nil {
+		return err
+	}
+	if len(protos) == 0 {
+		return nil
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	alpn := make(map[string]*route, len(m.alpn)+len(protos))
+	for proto, r := range m.alpn {
+		alpn[proto] = r
+	}
+	name := m.nameOf(handler)
+	for _, proto := range protos {
+		alpn[proto] = &route{
+			pattern: "alpn:" + proto,
+			name:    name,
+			handler: handler,
+			counter: m.counterOf("alpn:" + proto),
+		}
+	}
+	m.alpn = alpn
+	m.rebuild()
+	return nil
+}
+
+type tlsConnectionState interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// matchALPN completes the handshake of a TLS connection and returns the route of its negotiated protocol.
+func (t *table) matchALPN(conn net.Conn) (*route, error) {
+	tc, ok := conn.(tlsConnectionState)
+	if !ok {
+		return nil, nil
+	}
+	err := tc.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	proto := tc.ConnectionState().NegotiatedProtocol
+	if proto == "" {
+		return nil, nil
+	}
+	return t.alpn[proto], nil
+}
@@ -0,0 +1,344 @@
+package cmux
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpAnswer is a handler answering the HTTP request of the connection with id and the path.
+func httpAnswer(id string) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Body:          io.NopCloser(strings.NewReader(id + " " + req.URL.Path)),
+			ContentLength: int64(len(id) + 1 + len(req.URL.Path)),
+			Close:         true,
+		}
+		resp.Write(conn)
+	})
+}
+
+// tlsGet sends a GET of the path over a TLS connection through mux and returns the body of the response.
+func tlsGet(t testing.TB, mux *CMux, cfg *tls.Config, path string) string {
+	t.Helper()
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := tls.Client(conn, cfg)
+	_, err := tc.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestTLSUnwrapRoutesToInner(t *testing.T) {
+	cert := testCert(t, "example.com")
+	inner := NewCMux()
+	inner.HandlePrefix(httpAnswer("http"), "GET ")
+	inner.HandlePrefix(handlerID("ssh"), "SSH-")
+
+	mux := NewCMux()
+	mux.HandlePrefix(NewTLSUnwrapHandler(&tls.Config{Certificates: []tls.Certificate{cert}}, inner), "\x16\x03")
+	mux.HandlePrefix(httpAnswer("plain"), "GET ")
+
+	if got := tlsGet(t, mux, &tls.Config{InsecureSkipVerify: true}, "/x"); got != "http /x" {
+		t.Fatalf("got %q, want the inner HTTP handler", got)
+	}
+}
+
+func TestTLSUnwrapSameMux(t *testing.T) {
+	cert := testCert(t, "example.com")
+	mux := NewCMux()
+	mux.HandlePrefix(NewTLSUnwrapHandler(&tls.Config{Certificates: []tls.Certificate{cert}}, mux), "\x16\x03")
+	mux.HandlePrefix(httpAnswer("http"), "GET ")
+
+	done := make(chan string, 1)
+	go func() {
+		done <- tlsGet(t, mux, &tls.Config{InsecureSkipVerify: true}, "/same")
+	}()
+	select {
+	case got := <-done:
+		if got != "http /same" {
+			t.Fatalf("got %q, want the HTTP handler of the same mux", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the re-entrant dispatch deadlocked")
+	}
+}
+
+func TestTLSUnwrapHandshakeFailure(t *testing.T) {
+	cert := testCert(t, "example.com")
+	inner := NewCMux()
+	innerErrs := make(chan error, 1)
+	inner.OnError(func(conn net.Conn, err error) {
+		innerErrs <- err
+	})
+	mux := NewCMux()
+	outerErrs := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		outerErrs <- err
+	})
+	mux.HandlePrefix(NewTLSUnwrapHandler(&tls.Config{Certificates: []tls.Certificate{cert}}, inner), "\x16\x03")
+
+	client := servePipe(mux)
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		client.Write([]byte("\x16\x03\x01\x00\x05hello"))
+		io.Copy(io.Discard, client)
+		close(closed)
+	}()
+	select {
+	case err := <-innerErrs:
+		if err == nil {
+			t.Fatal("OnError of the inner mux got a nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake failure was not reported to the inner mux")
+	}
+	select {
+	case err := <-outerErrs:
+		t.Fatalf("the handshake failure was reported to the outer mux: %v", err)
+	default:
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed connection was not closed")
+	}
+}
+
+// writeID is a handler writing id and closing the connection.
+func writeID(id string) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		conn.Write([]byte(id))
+		conn.Close()
+	})
+}
+
+func TestHandleALPN(t *testing.T) {
+	cert := testCert(t, "example.com")
+	inner := NewCMux()
+	inner.HandleALPN(writeID("h2"), "h2")
+	inner.HandleALPN(writeID("h1"), "http/1.1")
+	inner.HandlePrefix(writeID("sniffed"), "GET ")
+
+	mux := NewCMux()
+	mux.HandlePrefix(NewTLSUnwrapHandler(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, inner), "\x16\x03")
+
+	for _, tc := range []struct {
+		protos []string
+		want   string
+	}{
+		{[]string{"h2"}, "h2"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"h2", "http/1.1"}, "h2"},
+	} {
+		got, err := tlsDial(t, mux, &tls.Config{InsecureSkipVerify: true, NextProtos: tc.protos})
+		if err != nil {
+			t.Fatalf("NextProtos %q: %v", tc.protos, err)
+		}
+		if got != tc.want {
+			t.Errorf("NextProtos %q routed to %q, want %q", tc.protos, got, tc.want)
+		}
+	}
+}
+
+func TestHandleALPNFallsBackToSniffing(t *testing.T) {
+	cert := testCert(t, "example.com")
+	inner := NewCMux()
+	inner.HandleALPN(writeID("h2"), "h2")
+	inner.HandlePrefix(writeID("sniffed"), "GET ")
+
+	mux := NewCMux()
+	mux.HandlePrefix(NewTLSUnwrapHandler(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, inner), "\x16\x03")
+
+	// a protocol without a route and no protocol at all are both sniffed
+	for _, protos := range [][]string{{"http/1.1"}, nil} {
+		conn := serveTCP(t, mux)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		if _, err := tc.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(tc)
+		conn.Close()
+		if string(got) != "sniffed" {
+			t.Errorf("NextProtos %q routed to %q, want the sniffed prefix", protos, got)
+		}
+	}
+}
+
+func TestHandlePrefixTLS(t *testing.T) {
+	cert := testCert(t, "admin.example.com")
+	mux := NewCMux()
+	if err := mux.HandlePrefix(httpAnswer("plain"), "GET "); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan net.Conn, 1)
+	admin := HandlerFunc(func(conn net.Conn) {
+		served <- conn
+		httpAnswer("admin").ServeConn(conn)
+	})
+	if err := mux.HandlePrefixTLS(admin, &tls.Config{Certificates: []tls.Certificate{cert}}, "\x16\x03"); err != nil {
+		t.Fatal(err)
+	}
+	got := tlsGet(t, mux, &tls.Config{ServerName: "admin.example.com", InsecureSkipVerify: true}, "/stats")
+	if got != "admin /stats" {
+		t.Fatalf("the terminated connection was answered %q", got)
+	}
+	if conn, ok := (<-served).(*tls.Conn); !ok {
+		t.Fatalf("the handler was served with %T, want *tls.Conn", conn)
+	}
+	// the plaintext requests are not terminated
+	conn := serveTCP(t, mux)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /plain HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "plain /plain" {
+		t.Fatalf("the plaintext request was answered %q", body)
+	}
+}
+
+func TestHandleSNITLSGetCertificate(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"a.example.com": testCert(t, "a.example.com"),
+		"b.example.com": testCert(t, "b.example.com"),
+	}
+	cfg := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, ok := certs[hello.ServerName]
+			if !ok {
+				return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+			}
+			return &cert, nil
+		},
+	}
+	passthrough := testCert(t, "c.example.com")
+	mux := NewCMux()
+	mux.HandleSNITLS(httpAnswer("terminated"), cfg, "a.example.com", "b.example.com")
+	mux.HandleSNI(tlsBackend("passthrough", passthrough), "c.example.com")
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		conn := serveTCP(t, mux)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tc := tls.Client(conn, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if names := tc.ConnectionState().PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != name {
+			t.Fatalf("%s was served the certificate of %v", name, names)
+		}
+		tc.Write([]byte("GET /" + name + " HTTP/1.1\r\nHost: " + name + "\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "terminated /"+name {
+			t.Fatalf("%s was answered %q", name, body)
+		}
+		conn.Close()
+	}
+
+	// the passthrough backend completes the handshake with its own certificate
+	got, err := tlsDial(t, mux, &tls.Config{ServerName: "c.example.com", InsecureSkipVerify: true})
+	if err != nil || got != "passthrough" {
+		t.Fatalf("the passthrough name was answered %q, %v", got, err)
+	}
+}
+
+func TestHandlePrefixTLSHandshakeFailure(t *testing.T) {
+	cert := testCert(t, "example.com")
+	mux := NewCMux()
+	errs := make(chan error, 1)
+	mux.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	h, ch := connChan()
+	mux.HandlePrefixTLS(h, &tls.Config{Certificates: []tls.Certificate{cert}}, "\x16\x03")
+	client := servePipe(mux)
+	defer client.Close()
+	go func() {
+		client.Write([]byte("\x16\x03\x01\x00\x05hello"))
+		io.Copy(io.Discard, client)
+	}()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("OnError got a nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake failure was not reported")
+	}
+	noConn(t, ch)
+
+	if err := mux.HandlePrefixTLS(h, nil, "\x16\x03"); err == nil {
+		t.Fatal("HandlePrefixTLS accepted a nil config")
+	}
+	if err := mux.HandleSNITLS(h, nil, "example.com"); err == nil {
+		t.Fatal("HandleSNITLS accepted a nil config")
+	}
+}
+
+func TestHandlePrefixTLSClone(t *testing.T) {
+	cert := testCert(t, "example.com")
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefixTLS(h, &tls.Config{Certificates: []tls.Certificate{cert}}, "\x16\x03")
+	mux.OnError(func(conn net.Conn, err error) {
+		t.Errorf("the original reported %v", err)
+	})
+	c := mux.Clone()
+	errs := make(chan error, 1)
+	c.OnError(func(conn net.Conn, err error) {
+		errs <- err
+	})
+	client := servePipe(c)
+	defer client.Close()
+	go func() {
+		client.Write([]byte("\x16\x03\x01\x00\x05hello"))
+		io.Copy(io.Discard, client)
+	}()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake failure of the clone was not reported to the clone")
+	}
+	noConn(t, ch)
+}
@@ -0,0 +1,101 @@
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxUnmatchedSampleLength is the most bytes of the prefix kept by a sample.
+const maxUnmatchedSampleLength = 64
+
+// UnmatchedSample is a connection that matched nothing, as kept by CaptureUnmatched.
+type UnmatchedSample struct {
+	Time       time.Time
+	RemoteAddr net.Addr
+	// Prefix is at most the first 64 bytes sniffed.
+	Prefix []byte
+}
+
+// String returns the sample with the prefix escaped such as "\x16\x03".
+func (s UnmatchedSample) String() string {
+	return fmt.Sprintf("%s %v %+q", s.Time.Format(time.RFC3339Nano), s.RemoteAddr, s.Prefix)
+}
+
+// CaptureUnmatched keeps the last n connections that matched nothing for UnmatchedSamples,
+// zero stops the capturing and drops the samples.
+func (m *CMux) CaptureUnmatched(n int) {
+	var r *unmatchedRing
+	if n > 0 {
+		r = &unmatchedRing{
+			samples: make([]UnmatchedSample, n),
+		}
+	}
+	m.unmatched.Store(r)
+}
+
+// UnmatchedSamples returns the samples kept by CaptureUnmatched, the oldest first.
+func (m *CMux) UnmatchedSamples() []UnmatchedSample {
+	r, _ := m.unmatched.Load().(*unmatchedRing)
+	if r == nil {
+		return nil
+	}
+	return r.list()
+}
+
+// captureUnmatched records the connection if the capturing is enabled.
+func (m *CMux) captureUnmatched(conn net.Conn, prefix []byte) {
+	r, _ := m.unmatched.Load().(*unmatchedRing)
+	if r == nil {
+		return
+	}
+	if len(prefix) > maxUnmatchedSampleLength {
+		prefix = prefix[:maxUnmatchedSampleLength]
+	}
+	r.add(UnmatchedSample{
+		Time:       time.Now(),
+		RemoteAddr: conn.RemoteAddr(),
+		Prefix:     append([]byte(nil), prefix...),
+	})
+}
+
+type unmatchedRing struct {
+	mut     sync.Mutex
+	samples []UnmatchedSample
+	next    int
+	full    bool
+}
+
+func (r *unmatchedRing) add(s UnmatchedSample) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.samples[r.next] = s
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// clone returns a copy of the ring with the samples kept so far.
+func (r *unmatchedRing) clone() *unmatchedRing {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return &unmatchedRing{
+		samples: append([]UnmatchedSample(nil), r.samples...),
+		next:    r.next,
+		full:    r.full,
+	}
+}
+
+func (r *unmatchedRing) list() []UnmatchedSample {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if !r.full {
+		return append([]UnmatchedSample(nil), r.samples[:r.next]...)
+	}
+	samples := make([]UnmatchedSample, 0, len(r.samples))
+	samples = append(samples, r.samples[r.next:]...)
+	return append(samples, r.samples[:r.next]...)
+}
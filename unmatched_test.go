@@ -0,0 +1,92 @@
+package cmux
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCaptureUnmatchedKeepsNewest(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.CaptureUnmatched(3)
+	for i := 0; i != 7; i++ {
+		mux.DispatchConn(newMemConn([]byte(fmt.Sprintf("X%d", i))))
+	}
+	var got []string
+	for _, s := range mux.UnmatchedSamples() {
+		got = append(got, string(s.Prefix))
+	}
+	if want := []string{"X4", "X5", "X6"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("UnmatchedSamples kept %q, want the newest %q", got, want)
+	}
+	// the matched connections are not samples
+	mux.DispatchConn(newMemConn([]byte("SSH-")))
+	if got := mux.UnmatchedSamples(); len(got) != 3 || string(got[2].Prefix) != "X6" {
+		t.Fatalf("UnmatchedSamples after a match = %v", got)
+	}
+}
+
+func TestCaptureUnmatchedSample(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("long"), strings.Repeat("L", 100))
+	mux.CaptureUnmatched(1)
+	b := "\x16\x03" + strings.Repeat("x", 98)
+	mux.DispatchConn(newMemConn([]byte(b)))
+	samples := mux.UnmatchedSamples()
+	if len(samples) != 1 {
+		t.Fatalf("kept %d samples", len(samples))
+	}
+	s := samples[0]
+	if string(s.Prefix) != b[:maxUnmatchedSampleLength] {
+		t.Fatalf("the sample kept %d bytes, want the first %d", len(s.Prefix), maxUnmatchedSampleLength)
+	}
+	if s.RemoteAddr != memAddr || s.Time.IsZero() {
+		t.Fatalf("the sample is from %v at %v", s.RemoteAddr, s.Time)
+	}
+	if str := s.String(); !strings.Contains(str, `"\x16\x03xx`) || !strings.Contains(str, memAddr.String()) {
+		t.Fatalf("String() = %q, want the prefix escaped", str)
+	}
+}
+
+func TestCaptureUnmatchedDisable(t *testing.T) {
+	mux := NewCMux()
+	if got := mux.UnmatchedSamples(); got != nil {
+		t.Fatalf("UnmatchedSamples without capturing = %v", got)
+	}
+	mux.CaptureUnmatched(2)
+	mux.DispatchConn(newMemConn([]byte("X")))
+	mux.CaptureUnmatched(0)
+	if got := mux.UnmatchedSamples(); got != nil {
+		t.Fatalf("UnmatchedSamples after stopping = %v", got)
+	}
+	conn := newMemConn(nil)
+	prefix := []byte("X")
+	if n := testing.AllocsPerRun(100, func() {
+		mux.captureUnmatched(conn, prefix)
+	}); n != 0 {
+		t.Fatalf("capturing while disabled allocates %v times", n)
+	}
+}
+
+func TestCaptureUnmatchedConcurrent(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(handlerID("ssh"), "SSH-")
+	mux.CaptureUnmatched(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				mux.DispatchConn(newMemConn([]byte(fmt.Sprintf("%d-%d", g, i))))
+				mux.UnmatchedSamples()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if got := mux.UnmatchedSamples(); len(got) != 8 {
+		t.Fatalf("kept %d samples, want 8", len(got))
+	}
+}
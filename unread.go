@@ -1,39 +1,355 @@
 package cmux
 
 import (
+	"bufio"
+	"fmt"
 	"io"
 	"net"
+	"syscall"
+	"time"
 )
 
+var errUnsupported = fmt.Errorf("unsupported by the underlying connection")
+
 func UnwrapUnreadConn(conn net.Conn) (net.Conn, []byte) {
-	if us, ok := conn.(*unreadConn); ok {
+	if us, ok := asUnreadConn(conn); ok {
 		_, prefix := UnwrapUnread(us.Reader)
 		return us.Conn, prefix
 	}
 	return conn, nil
 }
 
+// UnreadConn is like NewUnreadConn with a single buffer, but conn is returned as is if prefix is empty.
 func UnreadConn(conn net.Conn, prefix []byte) net.Conn {
 	if len(prefix) == 0 {
 		return conn
 	}
-	if us, ok := conn.(*unreadConn); ok {
-		us.Reader = Unread(us.Reader, prefix)
-		return us
+	return NewUnreadConn(conn, prefix)
+}
+
+// NewUnreadConn returns conn with the buffers in front of its bytes, they are read in order before conn.
+// The returned connection implements UnreaderConn, PeekConn and MatchedConn, and conn is not wrapped again
+// if it is already such a connection, the buffers then go in front of the bytes it has left to replay.
+// The buffers are not copied, they must not be modified while they are replayed.
+func NewUnreadConn(conn net.Conn, buffers ...[]byte) net.Conn {
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
+	}
+	us.Reader = Unread(us.Reader, joinBytes(buffers...))
+	return conn
+}
+
+// UnreaderConn is implemented by the connections of NewUnreadConn and the connections the mux dispatches,
+// it pushes back the bytes read too far, such as the remainder of a buffer after a framing header.
+type UnreaderConn interface {
+	net.Conn
+	// Unread puts a copy of p in front of the bytes still to be read, it is read before them.
+	Unread(p []byte)
+}
+
+// MatchedConn is implemented by the connections the mux dispatches to the handlers,
+// it tells the handler why it was chosen.
+type MatchedConn interface {
+	net.Conn
+	// MatchedPattern returns the registration that won, empty for the NotFound handler.
+	MatchedPattern() string
+	// SniffedBytes returns a copy of the bytes read while matching, they are still replayed by Read.
+	SniffedBytes() []byte
+}
+
+// PeekConn is implemented by the connections the mux dispatches to the handlers,
+// it looks ahead of the bytes read like a bufio.Reader.
+type PeekConn interface {
+	net.Conn
+	// Peek returns the next n bytes without consuming them, they are still returned by Read.
+	// The bytes are only valid until the next read.
+	Peek(n int) ([]byte, error)
+	// Discard skips the next n bytes and returns the number of the bytes skipped.
+	Discard(n int) (int, error)
+}
+
+// withMatch records the match on conn, conn is wrapped if it does not replay anything.
+func withMatch(conn net.Conn, pattern string, sniffed []byte) net.Conn {
+	us, ok := asUnreadConn(conn)
+	if !ok {
+		conn = newUnreadConn(conn, conn)
+		us, _ = asUnreadConn(conn)
 	}
-	return &unreadConn{
-		Reader: Unread(conn, prefix),
+	us.pattern = pattern
+	us.sniffed = sniffed
+	return conn
+}
+
+func newUnreadConn(conn net.Conn, reader io.Reader) net.Conn {
+	us := &unreadConn{
+		Reader: reader,
 		Conn:   conn,
 	}
+
+	// keep the half-close of the underlying connection visible to type assertions,
+	// also under the wrappers of the package such as the ProxyConn
+	switch baseConn(conn).(type) {
+	case interface {
+		closeWriter
+		closeReader
+	}:
+		return unreadHalfCloseConn{us}
+	case closeWriter:
+		return unreadCloseWriteConn{us}
+	}
+	return us
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+func asUnreadConn(conn net.Conn) (*unreadConn, bool) {
+	switch c := conn.(type) {
+	case *unreadConn:
+		return c, true
+	case unreadCloseWriteConn:
+		return c.unreadConn, true
+	case unreadHalfCloseConn:
+		return c.unreadConn, true
+	}
+	return nil, false
 }
 
 type unreadConn struct {
 	io.Reader
 	net.Conn
+	pattern string
+	sniffed []byte
+	meta    interface{}
+	acct    *connAccount
+	origDst *net.TCPAddr
+	depth   int
+	// idle is the watch of IdleTimeoutHandler, idleClosed counts the connections it closes.
+	idle       *idleWatch
+	idleClosed *uint64
+	// dispatched and sniffDuration are the timing of the dispatching, see TimedConn.
+	dispatched    time.Time
+	sniffDuration time.Duration
+}
+
+func (c *unreadConn) MatchedPattern() string {
+	return c.pattern
+}
+
+func (c *unreadConn) SniffedBytes() []byte {
+	return append([]byte(nil), c.sniffed...)
+}
+
+func (c *unreadConn) DispatchTime() time.Time {
+	return c.dispatched
+}
+
+func (c *unreadConn) SniffDuration() time.Duration {
+	return c.sniffDuration
+}
+
+func (c *unreadConn) OriginalDst() *net.TCPAddr {
+	return c.origDst
+}
+
+// NetConn returns the connection under the wrapper, the bytes that are still to be replayed are not read from it.
+func (c *unreadConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Unwrap returns the connection under the wrapper like NetConn.
+func (c *unreadConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Unwrapped returns the connection under the wrapper once every byte to replay has been read,
+// the reads can then go to it directly and miss nothing. It reports false while bytes are left,
+// or if the wrapper reads from something else than the connection, and while the bytes are counted.
+func (c *unreadConn) Unwrapped() (net.Conn, bool) {
+	if c.acct != nil {
+		return nil, false
+	}
+	r := c.Reader
+	if u, ok := r.(*unread); ok {
+		if len(u.prefix) != 0 {
+			return nil, false
+		}
+		r = u.reader
+	}
+	if conn, ok := r.(net.Conn); !ok || conn != c.Conn {
+		return nil, false
+	}
+	return c.Conn, true
+}
+
+func (c *unreadConn) Unread(p []byte) {
+	if len(p) != 0 {
+		c.Reader = Unread(c.Reader, append([]byte(nil), p...))
+	}
+}
+
+func (c *unreadConn) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	u, ok := c.Reader.(*unread)
+	if !ok {
+		u = &unread{reader: c.Reader}
+		c.Reader = u
+	}
+	if len(u.prefix) < n {
+		// the prefix may share its array with the bytes handed to the handler, grow it into a new one
+		prefix := make([]byte, len(u.prefix), n)
+		copy(prefix, u.prefix)
+		for len(prefix) < n {
+			i, err := u.reader.Read(prefix[len(prefix):n])
+			prefix = prefix[:len(prefix)+i]
+			if err != nil {
+				u.prefix = prefix
+				return prefix, err
+			}
+		}
+		u.prefix = prefix
+	}
+	return u.prefix[:n], nil
+}
+
+func (c *unreadConn) Discard(n int) (discarded int, err error) {
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+	if u, ok := c.Reader.(*unread); ok {
+		discarded = len(u.prefix)
+		if discarded > n {
+			discarded = n
+		}
+		u.prefix = u.prefix[discarded:]
+		c.acct.read(int64(discarded))
+	}
+	if discarded < n {
+		i, err := io.CopyN(io.Discard, c.Reader, int64(n-discarded))
+		c.acct.read(i)
+		discarded += int(i)
+		if err != nil {
+			return discarded, err
+		}
+	}
+	return discarded, nil
 }
 
 func (c *unreadConn) Read(p []byte) (n int, err error) {
-	return c.Reader.Read(p)
+	n, err = c.Reader.Read(p)
+	c.acct.read(int64(n))
+	if n != 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *unreadConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.acct.written(int64(n))
+	if n != 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *unreadConn) Close() error {
+	c.idle.stop()
+	return c.close()
+}
+
+// close closes the connection without stopping the idle watch, which may be the caller.
+func (c *unreadConn) close() error {
+	err := c.Conn.Close()
+	c.acct.close()
+	return err
+}
+
+// WriteTo writes the unread prefix first, then leaves the copying to the underlying connection
+// so that io.Copy can still use splice or sendfile.
+func (c *unreadConn) WriteTo(w io.Writer) (n int64, err error) {
+	defer func() {
+		c.acct.read(n)
+	}()
+	if c.idle != nil {
+		w = idleWriter{w: w, idle: c.idle}
+	}
+	r := c.Reader
+	if u, ok := r.(*unread); ok {
+		for len(u.prefix) != 0 {
+			i, err := w.Write(u.prefix)
+			n += int64(i)
+			u.prefix = u.prefix[i:]
+			if err != nil {
+				return n, err
+			}
+		}
+		r = u.reader
+	}
+	// the reads of a speculative dispatch are matched, the others go to the connection
+	if _, ok := r.(*speculation); !ok {
+		r = c.Conn
+	}
+	i, err := io.Copy(w, r)
+	n += i
+	return n, err
+}
+
+// ReadFrom leaves the copying to the underlying connection.
+func (c *unreadConn) ReadFrom(r io.Reader) (n int64, err error) {
+	defer func() {
+		c.acct.written(n)
+	}()
+	if c.idle != nil {
+		return io.Copy(idleWriter{w: c.Conn, idle: c.idle}, r)
+	}
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{c.Conn}, r)
+}
+
+// SyscallConn returns the raw connection of the underlying socket,
+// the bytes that are still unread are not visible through it.
+func (c *unreadConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := baseConn(c.Conn).(syscall.Conn)
+	if !ok {
+		return nil, errUnsupported
+	}
+	return sc.SyscallConn()
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type unreadCloseWriteConn struct {
+	*unreadConn
+}
+
+func (c unreadCloseWriteConn) CloseWrite() error {
+	return baseConn(c.Conn).(closeWriter).CloseWrite()
+}
+
+type unreadHalfCloseConn struct {
+	*unreadConn
+}
+
+func (c unreadHalfCloseConn) CloseWrite() error {
+	return baseConn(c.Conn).(closeWriter).CloseWrite()
+}
+
+func (c unreadHalfCloseConn) CloseRead() error {
+	return baseConn(c.Conn).(closeReader).CloseRead()
 }
 
 func UnwrapUnread(reader io.Reader) (io.Reader, []byte) {
@@ -48,7 +364,7 @@ func Unread(reader io.Reader, prefix []byte) io.Reader {
 		return reader
 	}
 	if ur, ok := reader.(*unread); ok {
-		ur.prefix = append(prefix, ur.prefix...)
+		ur.prefix = joinBytes(prefix, ur.prefix)
 		return reader
 	}
 	return &unread{
@@ -57,6 +373,27 @@ func Unread(reader io.Reader, prefix []byte) io.Reader {
 	}
 }
 
+// joinBytes returns the buffers one after another, in a new array unless there is a single one that is not empty.
+func joinBytes(buffers ...[]byte) []byte {
+	var only []byte
+	size, count := 0, 0
+	for _, b := range buffers {
+		if len(b) != 0 {
+			only = b
+			size += len(b)
+			count++
+		}
+	}
+	if count <= 1 {
+		return only
+	}
+	joined := make([]byte, 0, size)
+	for _, b := range buffers {
+		joined = append(joined, b...)
+	}
+	return joined
+}
+
 type unread struct {
 	prefix []byte
 	reader io.Reader
@@ -66,15 +403,27 @@ func (u *unread) Read(p []byte) (n int, err error) {
 	if len(u.prefix) == 0 {
 		return u.reader.Read(p)
 	}
+	// the replayed bytes are never read together with the bytes of the reader
 	n = copy(p, u.prefix)
-	if n <= len(u.prefix) {
-		u.prefix = u.prefix[n:]
-		return n, nil
-	}
-	a, err := u.reader.Read(p[n:])
-	if err == io.EOF {
-		err = nil
+	u.prefix = u.prefix[n:]
+	return n, nil
+}
+
+// baseConn returns the connection under the wrappers of the package,
+// so that the options of the socket such as SetLinger can be reached.
+func baseConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *ProxyConn:
+			conn = c.Conn
+		case *http2PrefaceConn:
+			conn = c.Conn
+		default:
+			us, ok := asUnreadConn(conn)
+			if !ok {
+				return conn
+			}
+			conn = us.Conn
+		}
 	}
-	n += a
-	return n, err
 }
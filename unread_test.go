@@ -0,0 +1,669 @@
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTCPConn serves one TCP connection with mux and returns the client end
+// with the conn the handler of the prefix was given.
+func serveTCPConn(t testing.TB, mux *CMux, prefix string) (*net.TCPConn, net.Conn) {
+	t.Helper()
+	h, ch := connChan()
+	mux.HandlePrefix(h, prefix)
+	client := serveTCP(t, mux)
+	go client.Write([]byte(prefix))
+	return client, recvConn(t, ch)
+}
+
+func TestUnreadConnCloseWrite(t *testing.T) {
+	client, conn := serveTCPConn(t, NewCMux(), "SSH-")
+	defer client.Close()
+	defer conn.Close()
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("the dispatched %T hides CloseWrite", conn)
+	}
+	if _, ok := conn.(interface{ CloseRead() error }); !ok {
+		t.Fatalf("the dispatched %T hides CloseRead", conn)
+	}
+	conn.Write([]byte("bye"))
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(client)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("client read %q, %v, want the bytes written before CloseWrite and EOF", b, err)
+	}
+	// the read side is still open
+	client.Write([]byte("more"))
+	if got := readN(t, conn, 8); got != "SSH-more" {
+		t.Fatalf("handler read %q after CloseWrite", got)
+	}
+}
+
+func TestUnreadConnCloseWriteProxyProtocol(t *testing.T) {
+	mux := NewCMux()
+	mux.EnableProxyProtocol()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := serveTCP(t, mux)
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	if _, ok := conn.(interface{ CloseRead() error }); !ok {
+		t.Fatalf("the dispatched %T hides CloseRead behind the PROXY header", conn)
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("the dispatched %T hides CloseWrite behind the PROXY header", conn)
+	}
+	conn.Write([]byte("bye"))
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(client)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("client read %q, %v, want the bytes written before CloseWrite and EOF", b, err)
+	}
+}
+
+func TestUnreadConnWithoutHalfClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := UnreadConn(server, []byte("x"))
+	if _, ok := conn.(interface{ CloseWrite() error }); ok {
+		t.Fatal("the conn of a pipe has CloseWrite")
+	}
+}
+
+func TestUnreadConnSyscallConn(t *testing.T) {
+	client, conn := serveTCPConn(t, NewCMux(), "SSH-")
+	defer client.Close()
+	defer conn.Close()
+	if _, ok := conn.(syscall.Conn); !ok {
+		t.Fatalf("the dispatched %T hides syscall.Conn", conn)
+	}
+
+	// every variant of the wrapper
+	tcp := conn.(interface{ NetConn() net.Conn }).NetConn()
+	for _, c := range []net.Conn{
+		UnreadConn(tcp, []byte("x")),
+		UnreadConn(closeWriteOnly{tcp.(*net.TCPConn)}, []byte("x")),
+		UnreadConn(plainConn{tcp}, []byte("x")),
+	} {
+		sc, ok := c.(syscall.Conn)
+		if !ok {
+			t.Errorf("%T hides syscall.Conn", c)
+			continue
+		}
+		raw, err := sc.SyscallConn()
+		if err != nil {
+			t.Errorf("%T: SyscallConn: %v", c, err)
+			continue
+		}
+		if err := raw.Control(func(fd uintptr) {}); err != nil {
+			t.Errorf("%T: Control: %v", c, err)
+		}
+	}
+
+	// a conn without a socket
+	p, _ := net.Pipe()
+	defer p.Close()
+	if _, err := UnreadConn(p, []byte("x")).(syscall.Conn).SyscallConn(); err == nil {
+		t.Error("SyscallConn of a pipe succeeded")
+	}
+}
+
+func TestUnreadConnSyscallConnProxyProtocol(t *testing.T) {
+	mux := NewCMux()
+	mux.EnableProxyProtocol()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := serveTCP(t, mux)
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		t.Fatalf("the dispatched %T hides syscall.Conn", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn behind the PROXY header: %v", err)
+	}
+	if err := raw.Control(func(fd uintptr) {}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+}
+
+// closeWriteOnly is a conn with CloseWrite but without CloseRead,
+// the CloseRead of the TCPConn is shadowed by a method of another signature.
+type closeWriteOnly struct {
+	*net.TCPConn
+}
+
+func (c closeWriteOnly) CloseRead() {}
+
+// plainConn is a conn with nothing but the methods of net.Conn and syscall.Conn.
+type plainConn struct {
+	net.Conn
+}
+
+func (c plainConn) SyscallConn() (syscall.RawConn, error) {
+	return c.Conn.(syscall.Conn).SyscallConn()
+}
+
+func TestUnreadConnWriteToMidBuffer(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("-stream"))
+		client.Close()
+	}()
+	conn := NewUnreadConn(server, []byte("abc"), []byte("def"))
+	if got := readN(t, conn, 2); got != "ab" {
+		t.Fatalf("read %q", got)
+	}
+	conn.(UnreaderConn).Unread([]byte("B"))
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "Bcdef-stream" || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo wrote %q (%d), want the rest of the buffer before the stream", buf.String(), n)
+	}
+}
+
+func TestUnreadConnWriteToShortWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewUnreadConn(server, []byte("abcdef"))
+	var buf bytes.Buffer
+	n, err := conn.(io.WriterTo).WriteTo(&shortWriter{w: &buf, max: 2})
+	if err != io.ErrShortWrite || n != 2 || buf.String() != "ab" {
+		t.Fatalf("WriteTo wrote %q (%d), %v", buf.String(), n, err)
+	}
+	// the bytes that were not written are still replayed
+	if got := readN(t, conn, 4); got != "cdef" {
+		t.Fatalf("read %q after the short write", got)
+	}
+}
+
+// shortWriter writes at most max bytes and fails once it wrote fewer than asked.
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		n, _ := w.w.Write(p[:w.max])
+		return n, io.ErrShortWrite
+	}
+	return w.w.Write(p)
+}
+
+// benchmarkEcho copies a payload through an echo handler served with the conn returned by dispatch.
+func benchmarkEcho(b *testing.B, dispatch func(l net.Listener, echo func(conn net.Conn))) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go dispatch(l, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	payload := make([]byte, 1<<20)
+	copy(payload, "SSH-")
+	back := make([]byte, len(payload))
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		go conn.Write(payload)
+		if _, err := io.ReadFull(conn, back); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+// BenchmarkEchoThroughMux copies through ServeConn, the copying of the wrapper goes to the socket once the prefix is replayed.
+func BenchmarkEchoThroughMux(b *testing.B) {
+	benchmarkEcho(b, func(l net.Listener, echo func(conn net.Conn)) {
+		mux := NewCMux()
+		mux.HandlePrefix(HandlerFunc(echo), "SSH-")
+		mux.Serve(l)
+	})
+}
+
+func BenchmarkEchoRawConn(b *testing.B) {
+	benchmarkEcho(b, func(l net.Listener, echo func(conn net.Conn)) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	})
+}
+
+func TestMatchedConnOverlappingPatterns(t *testing.T) {
+	type matched struct {
+		pattern string
+		sniffed string
+	}
+	ch := make(chan matched, 1)
+	h := HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		mc, ok := conn.(MatchedConn)
+		if !ok {
+			ch <- matched{}
+			return
+		}
+		// the sniffed bytes stay valid while the handler reads them again
+		sniffed := mc.SniffedBytes()
+		io.ReadFull(conn, make([]byte, len(sniffed)))
+		ch <- matched{mc.MatchedPattern(), string(sniffed)}
+	})
+	mux := NewCMux()
+	mux.HandlePrefix(h, "SSH-")
+	mux.HandlePrefix(h, "SSH-2.0-")
+	mux.NotFound(h)
+	for b, want := range map[string]matched{
+		"SSH-1.99": {"SSH-", "SSH-1.99"},
+		"SSH-2.0-": {"SSH-2.0-", "SSH-2.0-"},
+		"GET /":    {"", "GET /"},
+	} {
+		mux.DispatchConn(newMemConn([]byte(b)))
+		if got := <-ch; got != want {
+			t.Errorf("%q was served with %+v, want %+v", b, got, want)
+		}
+	}
+}
+
+func TestMatchedConnSniffedBytesCopy(t *testing.T) {
+	h, ch := connChan()
+	mux := NewCMux()
+	mux.HandlePrefix(h, "SSH-")
+	mux.DispatchConn(newMemConn([]byte("SSH-2.0")))
+	mc := recvConn(t, ch).(MatchedConn)
+	mc.SniffedBytes()[0] = 'x'
+	if got := string(mc.SniffedBytes()); got != "SSH-" {
+		t.Fatalf("SniffedBytes after modifying a result = %q", got)
+	}
+	if got := readN(t, mc, 7); got != "SSH-2.0" {
+		t.Fatalf("read %q after modifying the sniffed bytes", got)
+	}
+}
+
+func TestMatchedConnIgnored(t *testing.T) {
+	mux := NewCMux()
+	mux.HandlePrefix(HandlerFunc(echoConn), "ECHO")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("ECHO hi"))
+	if got := readN(t, client, 7); got != "ECHO hi" {
+		t.Fatalf("echoed %q", got)
+	}
+}
+
+// echoConn copies the conn back to itself without looking at how it was matched.
+func echoConn(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func TestPeekConnAcrossReplay(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	const sent = "SSH-2.0-OpenSSH_9.0\r\nrest of the stream"
+	go func() {
+		// the mux sniffs the first write, the rest is only on the conn
+		client.Write([]byte(sent[:4]))
+		client.Write([]byte(sent[4:]))
+	}()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	pc, ok := conn.(PeekConn)
+	if !ok {
+		t.Fatalf("the dispatched conn %T is not a PeekConn", conn)
+	}
+	if _, buf := UnwrapUnreadConn(conn); string(buf) != "SSH-" {
+		t.Fatalf("the mux sniffed %q", buf)
+	}
+	b, err := pc.Peek(10)
+	if err != nil || string(b) != sent[:10] {
+		t.Fatalf("Peek(10) = %q, %v", b, err)
+	}
+	// a shorter peek sees the same bytes
+	b, err = pc.Peek(2)
+	if err != nil || string(b) != sent[:2] {
+		t.Fatalf("Peek(2) = %q, %v", b, err)
+	}
+	if got := readN(t, conn, len(sent)); got != sent {
+		t.Fatalf("read %q after peeking, want %q", got, sent)
+	}
+}
+
+func TestPeekConnDiscard(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	const sent = "SSH-2.0-OpenSSH"
+	go func() {
+		client.Write([]byte(sent[:4]))
+		client.Write([]byte(sent[4:]))
+	}()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	pc := conn.(PeekConn)
+	if _, err := pc.Peek(6); err != nil {
+		t.Fatal(err)
+	}
+	// the discard goes past the peeked bytes into the conn
+	if n, err := pc.Discard(8); n != 8 || err != nil {
+		t.Fatalf("Discard(8) = %d, %v", n, err)
+	}
+	if got := readN(t, conn, len(sent)-8); got != sent[8:] {
+		t.Fatalf("read %q after discarding, want %q", got, sent[8:])
+	}
+}
+
+func TestPeekConnShort(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	go func() {
+		client.Write([]byte("SSH-2"))
+		client.Close()
+	}()
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := conn.(PeekConn).Peek(10)
+	if err != io.EOF || string(b) != "SSH-2" {
+		t.Fatalf("Peek past the end = %q, %v, want the bytes left and io.EOF", b, err)
+	}
+	if _, err := conn.(PeekConn).Peek(-1); err == nil {
+		t.Fatal("Peek(-1) returned nil")
+	}
+	if got := readN(t, conn, 5); got != "SSH-2" {
+		t.Fatalf("read %q after the short peek", got)
+	}
+}
+
+// unwrapper is the convention of the wrappers handing out the connection they wrap.
+type unwrapper interface {
+	Unwrapped() (net.Conn, bool)
+	Unwrap() net.Conn
+	NetConn() net.Conn
+}
+
+func TestUnwrappedAfterReplay(t *testing.T) {
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := serveTCP(t, mux)
+	defer client.Close()
+	client.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	u, ok := conn.(unwrapper)
+	if !ok {
+		t.Fatalf("the dispatched %T does not unwrap", conn)
+	}
+	if _, ok := u.NetConn().(*net.TCPConn); !ok {
+		t.Fatalf("NetConn returned %T, want the TCP connection", u.NetConn())
+	}
+	if u.Unwrap() != u.NetConn() {
+		t.Fatal("Unwrap and NetConn returned different connections")
+	}
+
+	sniffed := conn.(MatchedConn).SniffedBytes()
+	if _, ok := u.Unwrapped(); ok {
+		t.Fatal("Unwrapped reported the connection with every byte left to replay")
+	}
+	// the replay ends one byte later
+	if got := readN(t, conn, len(sniffed)-1); got != string(sniffed[:len(sniffed)-1]) {
+		t.Fatalf("read %q", got)
+	}
+	if _, ok := u.Unwrapped(); ok {
+		t.Fatal("Unwrapped reported the connection with a byte left to replay")
+	}
+	// the replay ends exactly at the boundary of this read
+	if got := readN(t, conn, 1); got != string(sniffed[len(sniffed)-1:]) {
+		t.Fatalf("read %q", got)
+	}
+	raw, ok := u.Unwrapped()
+	if !ok {
+		t.Fatal("Unwrapped did not report the connection once the replay was read")
+	}
+	if raw != u.NetConn() {
+		t.Fatalf("Unwrapped returned %T, want the TCP connection", raw)
+	}
+
+	// nothing is missed by reading the connection directly
+	rest := "SSH-2.0-OpenSSH\r\n"[len(sniffed):] + "more"
+	go client.Write([]byte("more"))
+	if got := readN(t, raw, len(rest)); got != rest {
+		t.Fatalf("the connection read %q, want %q", got, rest)
+	}
+
+	// the bytes pushed back are to be replayed again
+	conn.(UnreaderConn).Unread([]byte("x"))
+	if _, ok := u.Unwrapped(); ok {
+		t.Fatal("Unwrapped reported the connection with bytes pushed back")
+	}
+}
+
+func TestUnwrappedPeekedPastReplay(t *testing.T) {
+	conn := NewUnreadConn(newMemConn([]byte("tail")), []byte("ab"))
+	u := conn.(unwrapper)
+	// the peeked bytes of the connection are to be replayed too
+	if b, err := conn.(PeekConn).Peek(4); err != nil || string(b) != "abta" {
+		t.Fatalf("Peek returned %q, %v", b, err)
+	}
+	if got := readN(t, conn, 2); got != "ab" {
+		t.Fatalf("read %q", got)
+	}
+	if _, ok := u.Unwrapped(); ok {
+		t.Fatal("Unwrapped reported the connection with peeked bytes left")
+	}
+	if got := readN(t, conn, 2); got != "ta" {
+		t.Fatalf("read %q", got)
+	}
+	raw, ok := u.Unwrapped()
+	if !ok {
+		t.Fatal("Unwrapped did not report the connection once the peeked bytes were read")
+	}
+	if got := readN(t, raw, 2); got != "il" {
+		t.Fatalf("the connection read %q, want il", got)
+	}
+}
+
+func TestUnwrappedWhileCounted(t *testing.T) {
+	mux := NewCMux()
+	mux.SetAccounting(true)
+	h, ch := connChan()
+	mux.HandlePrefix(h, "SSH-")
+	client := servePipe(mux)
+	defer client.Close()
+	go client.Write([]byte("SSH-"))
+	conn := recvConn(t, ch)
+	defer conn.Close()
+	readN(t, conn, 4)
+	// the reads of the connection would not be counted
+	if _, ok := conn.(unwrapper).Unwrapped(); ok {
+		t.Fatal("Unwrapped reported the connection while the bytes are counted")
+	}
+}
+
+// liveConn is a memConn counting the reads that reached it.
+type liveConn struct {
+	*memConn
+	reads int
+}
+
+func (c *liveConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.memConn.Read(p)
+}
+
+func TestNewUnreadConnSegmentsInOrder(t *testing.T) {
+	live := &liveConn{memConn: newMemConn([]byte("ef"))}
+	conn := NewUnreadConn(live, []byte("ab"), nil, []byte("cd"))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("read %q, %v, want the segments in order", buf[:n], err)
+	}
+	// the segments are never read together with the bytes of the conn
+	if live.reads != 0 {
+		t.Fatal("the conn was read with the segments")
+	}
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ef" {
+		t.Fatalf("read %q, %v, want the bytes of the conn", buf[:n], err)
+	}
+	if _, ok := conn.(UnreaderConn); !ok {
+		t.Fatal("the conn does not implement UnreaderConn")
+	}
+	if c := UnreadConn(live, nil); c != net.Conn(live) {
+		t.Fatal("UnreadConn wrapped the conn without a prefix")
+	}
+}
+
+func TestUnreadAfterPartialRead(t *testing.T) {
+	conn := NewUnreadConn(newMemConn([]byte("ef")), []byte("abcd"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	p := []byte("xy")
+	conn.(UnreaderConn).Unread(p)
+	// the pushed back bytes are copied
+	p[0] = '!'
+	conn.(UnreaderConn).Unread([]byte("w"))
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "wxycdef" {
+		t.Fatalf("read %q, %v, want the pushed back bytes before the rest", b, err)
+	}
+	// a pushback once the segments are read goes before the conn
+	conn.(UnreaderConn).Unread([]byte("z"))
+	b, err = io.ReadAll(conn)
+	if err != nil || string(b) != "z" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+func TestNewUnreadConnFlattens(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	inner := NewUnreadConn(server, []byte("cd"))
+	outer := NewUnreadConn(inner, []byte("ab"))
+	if outer != inner {
+		t.Fatal("the conn was wrapped again")
+	}
+	us, _ := asUnreadConn(outer)
+	if us.Conn != server {
+		t.Fatalf("the wrapper is over %T, want the pipe", us.Conn)
+	}
+	go client.Write([]byte("ef"))
+	if got := readN(t, outer, 6); got != "abcdef" {
+		t.Fatalf("read %q", got)
+	}
+	// the dispatched conns are flattened too
+	mux := NewCMux()
+	h, ch := connChan()
+	mux.HandlePrefix(h, "GET ")
+	c := servePipe(mux)
+	defer c.Close()
+	go c.Write([]byte("GET /"))
+	dispatched := recvConn(t, ch)
+	defer dispatched.Close()
+	wrapped := NewUnreadConn(dispatched, []byte("x"))
+	if wrapped != dispatched {
+		t.Fatal("the dispatched conn was wrapped again")
+	}
+	if got := readN(t, wrapped, 6); got != "xGET /" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestUnreadConnOrderProperty(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round != 500; round++ {
+		// the model is the bytes to replay in front of the bytes left in the conn
+		live := randomBytes(rnd, "abcdef", 16)
+		var segments [][]byte
+		var replay []byte
+		for i := rnd.Intn(4); i != 0; i-- {
+			s := randomBytes(rnd, "ABCDEF", 8)
+			segments = append(segments, s)
+			replay = append(replay, s...)
+		}
+		lc := &liveConn{memConn: newMemConn(live)}
+		conn := NewUnreadConn(lc, segments...)
+		if rnd.Intn(2) == 0 {
+			// the segments of a nested wrapping go in front
+			s := randomBytes(rnd, "GHI", 4)
+			conn = NewUnreadConn(conn, s)
+			replay = append(append([]byte(nil), s...), replay...)
+		}
+		for {
+			buf := make([]byte, 1+rnd.Intn(6))
+			reads := lc.reads
+			n, err := conn.Read(buf)
+			var want []byte
+			if len(replay) != 0 {
+				// a read returns the replayed bytes or the bytes of the conn, not both
+				if lc.reads != reads {
+					t.Fatalf("round %d: the conn was read with %q left to replay", round, replay)
+				}
+				want, replay = replay[:n], replay[n:]
+			} else {
+				want, live = live[:n], live[n:]
+			}
+			if !bytes.Equal(buf[:n], want) {
+				t.Fatalf("round %d: read %q, want %q", round, buf[:n], want)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 && rnd.Intn(4) == 0 {
+				// push back a part of what was just read
+				k := 1 + rnd.Intn(n)
+				conn.(UnreaderConn).Unread(buf[n-k : n])
+				replay = append(append([]byte(nil), buf[n-k:n]...), replay...)
+			}
+		}
+		if len(replay) != 0 || len(live) != 0 {
+			t.Fatalf("round %d: %q and %q were not read", round, replay, live)
+		}
+	}
+}
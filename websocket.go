@@ -0,0 +1,56 @@
+package cmux
+
+import (
+	"strings"
+)
+
+// HandleWebSocket handle the handler that matches a HTTP/1.x GET request asking to upgrade to WebSocket,
+// with path prefixes only the requests whose path starts with one of them are matched.
+// The headers are buffered until the Upgrade header is seen and replayed so the handler completes the handshake.
+// The other requests fall through to the matchers registered after it such as HandleHTTP1,
+// a prefix such as "GET " is decided before the matchers and would take the upgrades as well.
+func (m *CMux) HandleWebSocket(handler Handler, pathPrefixes ...string) error {
+	return m.handleMatcher(handler, &webSocketMatcher{prefixes: pathPrefixes}, maxHeaderLength, "websocket:"+strings.Join(pathPrefixes, ","))
+}
+
+type webSocketMatcher struct {
+	prefixes []string
+}
+
+func (w *webSocketMatcher) Match(b []byte) (matched bool, needMore bool) {
+	method, target, _, ok, needMore := parseRequestLine(b)
+	if !ok {
+		return false, needMore
+	}
+	if string(method) != "GET" {
+		return false, false
+	}
+	if len(w.prefixes) != 0 {
+		path := requestPath(target)
+		found := false
+		for _, prefix := range w.prefixes {
+			if strings.HasPrefix(path, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, false
+		}
+	}
+	value, ok, needMore := parseHTTPHeader(b, "Upgrade")
+	if !ok {
+		return false, needMore
+	}
+	// the Upgrade header lists the protocols, a protocol may carry a version after a slash
+	for _, proto := range strings.Split(value, ",") {
+		proto = strings.TrimSpace(proto)
+		if i := strings.IndexByte(proto, '/'); i >= 0 {
+			proto = proto[:i]
+		}
+		if strings.EqualFold(proto, "websocket") {
+			return true, false
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,76 @@
+package cmux
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandleWebSocket(t *testing.T) {
+	mux := NewCMux()
+	mux.HandleWebSocket(handlerID("ws"), "/ws")
+	mux.HandleHTTP1(handlerID("http"))
+
+	for b, want := range map[string]string{
+		"GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n": "ws",
+		"GET /ws/chat HTTP/1.1\r\nupgrade:   WebSocket  \r\n\r\n":                          "ws",
+		"GET /ws HTTP/1.1\r\nUPGRADE:\tWEBSOCKET\r\n\r\n":                                  "ws",
+		"GET /ws HTTP/1.1\r\nUpgrade: h2c, websocket/13\r\n\r\n":                           "ws",
+		"GET /ws HTTP/1.1\r\nUpgrade:\r\n websocket\r\n\r\n":                               "ws",
+		"GET /ws HTTP/1.1\r\nHost: x\r\n\r\n":                                              "http",
+		"GET /ws HTTP/1.1\r\nUpgrade: h2c\r\n\r\n":                                         "http",
+		"GET /api HTTP/1.1\r\nUpgrade: websocket\r\n\r\n":                                  "http",
+		"POST /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\n":                                  "http",
+		"GET /ws HTTP/1.1\r\nX-Upgrade: websocket\r\n\r\n":                                 "http",
+	} {
+		if got := matchOf(t, mux, b); got != want {
+			t.Errorf("%q matched %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestHandleWebSocketReplaysHandshake(t *testing.T) {
+	mux := NewCMux()
+	got := make(chan *http.Request, 1)
+	mux.HandleWebSocket(HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got <- req
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	}))
+	mux.HandleHTTP1(handlerID("http"))
+
+	client := servePipe(mux)
+	defer client.Close()
+	req := "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	var chunks []string
+	for i := 0; i < len(req); i += 5 {
+		end := i + 5
+		if end > len(req) {
+			end = len(req)
+		}
+		chunks = append(chunks, req[i:end])
+	}
+	go writeChunks(client, chunks...)
+	select {
+	case r := <-got:
+		if r.URL.Path != "/chat" || r.Header.Get("Sec-WebSocket-Key") != "dGhlIHNhbXBsZSBub25jZQ==" {
+			t.Fatalf("the WebSocket handler parsed %s with key %q", r.URL.Path, r.Header.Get("Sec-WebSocket-Key"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upgrade was not dispatched")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+}